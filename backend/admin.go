@@ -0,0 +1,85 @@
+// backend/admin.go
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+/*
+Admin HTTP API, mounted at /api/admin/ when -admin-token is set.
+Every request needs "Authorization: Bearer <admin token>". GET and HEAD
+may use basic auth with the token as password instead (which is how the
+/admin dashboard logs in): browsers send basic auth along with requests
+other sites make, so it must not be able to change anything. Subsystems
+register their own routes with Handle; handlers that change something
+write it to the audit log themselves (audit.go).
+*/
+
+// AdminAPI is the token-protected operator API
+type AdminAPI struct {
+	token string
+	mux   *http.ServeMux
+	audit *AuditLog // nil = not audited
+}
+
+func NewAdminAPI(token string) *AdminAPI {
+	return &AdminAPI{token: token, mux: http.NewServeMux()}
+}
+
+// Handle registers h for pattern (a full path such as /api/admin/quotas/)
+func (a *AdminAPI) Handle(pattern string, h http.HandlerFunc) {
+	a.mux.HandleFunc(pattern, h)
+}
+
+// readOnly reports whether r may be authorized with basic auth
+func readOnly(r *http.Request) bool {
+	return r.Method == http.MethodGet || r.Method == http.MethodHead
+}
+
+// authorized reports whether r carries the admin token, as a bearer token
+// or, for reads by browsers (see dashboard.go), as the basic-auth password
+func (a *AdminAPI) authorized(r *http.Request) bool {
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		if !readOnly(r) {
+			// a cross-site form post carries basic auth but can't set a bearer header
+			return false
+		}
+		_, got, _ = r.BasicAuth()
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(a.token)) == 1
+}
+
+func (a *AdminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		msg := "admin token required"
+		if !readOnly(r) {
+			msg = "admin token required as a bearer token"
+		}
+		writeJSONError(w, http.StatusUnauthorized, msg)
+		return
+	}
+	a.mux.ServeHTTP(w, r)
+}
+
+// writeJSON writes v with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// readJSON decodes a (size-limited) request body into v
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
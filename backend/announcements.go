@@ -0,0 +1,266 @@
+// backend/announcements.go
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Scheduled announcements: one-off or recurring system messages delivered to
+everyone, to one room or to the connections with some tags, on every
+game or one, managed through the admin API and saved to -announcements
+so they survive restarts.
+
+	POST   /api/admin/announcements        {"text":"Maintenance at 22:00","at":"2024-05-01T21:45:00Z","every":"24h","room":""}
+	POST   /api/admin/announcements        {"text":"Neue Version im Store","where":{"platform":"mobile","locale":"de"}}
+	GET    /api/admin/announcements
+	DELETE /api/admin/announcements/{id}
+
+Clients receive {"type":"announcement","payload":<text>,"data":{"id":...}}.
+"game" is a mount path ("/ws/chat"); without it the announcement goes to
+every game, and "room" names that room on each of them. "where" is a tag
+selector (see tags.go), which also knows the connection's tenant from
+its session token:
+
+	{"text":"Wartung heute Nacht","where":{"tenant":"acme","locale":"de"}}
+
+With "room" too, only the room's members that match it get the
+announcement, without a room seq.
+A recurring announcement that was due while the server was down is sent
+once on startup and then continues on its schedule.
+*/
+
+const announcementTick = time.Second
+
+// Announcement is one scheduled message
+type Announcement struct {
+	ID       string     `json:"id"`
+	Text     string     `json:"text"`
+	Game     string     `json:"game,omitempty"`  // mount path, "" = every game
+	Room     string     `json:"room,omitempty"`  // "" = all clients
+	Where    Selector   `json:"where,omitempty"` // only connections with these tags
+	At       time.Time  `json:"at"`              // next delivery
+	Every    Duration   `json:"every,omitempty"` // repeat interval, 0 = one-off
+	Until    *time.Time `json:"until,omitempty"` // stop repeating after this
+	Created  time.Time  `json:"created"`
+	LastSent *time.Time `json:"lastSent,omitempty"`
+}
+
+// Announcer delivers announcements when they come due
+type Announcer struct {
+	path string
+
+	mu    sync.Mutex
+	hubs  []*Hub
+	items map[string]*Announcement
+}
+
+func NewAnnouncer(path string) (*Announcer, error) {
+	a := &Announcer{path: path, items: make(map[string]*Announcement)}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []*Announcement
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, err
+	}
+	for _, an := range list {
+		a.items[an.ID] = an
+	}
+	return a, nil
+}
+
+// AddHub delivers announcements to hub's game too
+func (a *Announcer) AddHub(hub *Hub) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.hubs = append(a.hubs, hub)
+}
+
+// saveLocked writes all announcements to disk. Caller holds a.mu.
+func (a *Announcer) saveLocked() error {
+	b, err := json.MarshalIndent(a.listLocked(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(a.path, b)
+}
+
+func (a *Announcer) listLocked() []*Announcement {
+	list := make([]*Announcement, 0, len(a.items))
+	for _, an := range a.items {
+		cp := *an
+		list = append(list, &cp)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].At.Before(list[j].At) })
+	return list
+}
+
+// List returns all pending announcements, soonest first
+func (a *Announcer) List() []*Announcement {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.listLocked()
+}
+
+// Add validates and schedules an; a zero At means "now"
+func (a *Announcer) Add(an *Announcement) error {
+	if strings.TrimSpace(an.Text) == "" {
+		return errors.New("text is required")
+	}
+	if an.Every < 0 || (an.Every > 0 && time.Duration(an.Every) < time.Minute) {
+		return errors.New("every must be at least 1m")
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	an.ID = hex.EncodeToString(b)
+	an.Created = time.Now()
+	an.LastSent = nil
+	if an.At.IsZero() {
+		an.At = an.Created
+	}
+	cp := *an
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.items[cp.ID] = &cp
+	return a.saveLocked()
+}
+
+// Remove cancels an announcement
+func (a *Announcer) Remove(id string) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.items[id]; !ok {
+		return false, nil
+	}
+	delete(a.items, id)
+	return true, a.saveLocked()
+}
+
+// Run delivers due announcements until the process exits
+func (a *Announcer) Run() {
+	ticker := time.NewTicker(announcementTick)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		a.deliverDue(now)
+	}
+}
+
+func (a *Announcer) deliverDue(now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	changed := false
+	for id, an := range a.items {
+		if now.Before(an.At) {
+			continue
+		}
+		a.deliver(an)
+		sent := now
+		an.LastSent = &sent
+		changed = true
+		if an.Every > 0 {
+			// skip occurrences missed while down; keep the original phase
+			for !an.At.After(now) {
+				an.At = an.At.Add(time.Duration(an.Every))
+			}
+		}
+		if an.Every == 0 || (an.Until != nil && an.At.After(*an.Until)) {
+			delete(a.items, id)
+		}
+	}
+	if changed {
+		if err := a.saveLocked(); err != nil {
+			log.Println("announcements: save:", err)
+		}
+	}
+}
+
+// deliver sends an on its games. Requires a.mu.
+func (a *Announcer) deliver(an *Announcement) {
+	data, _ := json.Marshal(map[string]string{"id": an.ID})
+	m := Message{Type: "announcement", Sender: "server", Payload: an.Text, Data: data}
+	sel := Selector{}
+	for k, v := range an.Where {
+		sel[k] = v
+	}
+	if len(sel) > 0 && an.Room != "" {
+		sel["room"] = an.Room
+	}
+	games, n := 0, 0
+	for _, h := range a.hubs {
+		if an.Game != "" && h.path != an.Game {
+			continue
+		}
+		games++
+		switch {
+		case len(sel) > 0:
+			n += h.BroadcastTagged(sel, m)
+		case an.Room == "":
+			h.BroadcastGlobal(m)
+		default:
+			h.BroadcastRoom(an.Room, m)
+		}
+	}
+	if len(sel) > 0 {
+		log.Printf("announcement %s delivered to %d connection(s) on %d game(s) (room=%q where=%v)", an.ID, n, games, an.Room, an.Where)
+		return
+	}
+	log.Printf("announcement %s delivered on %d game(s) (room=%q)", an.ID, games, an.Room)
+}
+
+// RegisterAdmin mounts /api/admin/announcements
+func (a *Announcer) RegisterAdmin(admin *AdminAPI) {
+	admin.Handle("/api/admin/announcements", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, a.List())
+		case http.MethodPost:
+			var an Announcement
+			if err := readJSON(w, r, &an); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "bad announcement: "+err.Error())
+				return
+			}
+			if err := a.Add(&an); err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			admin.audit.Record(adminActor(r), "announcement.create", an.ID, an.Text)
+			writeJSON(w, http.StatusCreated, an)
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, "use GET or POST")
+		}
+	})
+	admin.Handle("/api/admin/announcements/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			writeJSONError(w, http.StatusMethodNotAllowed, "use DELETE")
+			return
+		}
+		id := strings.TrimPrefix(r.URL.Path, "/api/admin/announcements/")
+		ok, err := a.Remove(id)
+		switch {
+		case err != nil:
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+		case !ok:
+			writeJSONError(w, http.StatusNotFound, "no such announcement")
+		default:
+			admin.audit.Record(adminActor(r), "announcement.delete", id, "")
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+}
@@ -0,0 +1,45 @@
+// backend/announcements_test.go
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestAnnouncementTargets delivers to every mounted game, one game, and
+// one tenant
+func TestAnnouncementTargets(t *testing.T) {
+	a, err := NewAnnouncer(filepath.Join(t.TempDir(), "announcements.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary, chat := newRunningHub(), newRunningHub()
+	primary.path, chat.path = "/ws", "/ws/chat"
+	a.AddHub(primary)
+	a.AddHub(chat)
+	p, acme, other := newTestClient(primary, "p"), newTestClient(chat, "acme"), newTestClient(chat, "other")
+	acme.claims = &SessionClaims{Sub: "acme", Tenant: "acme"}
+
+	for _, step := range []struct {
+		an *Announcement
+		to []*Client
+	}{
+		{&Announcement{Text: "everyone"}, []*Client{p, acme, other}},
+		{&Announcement{Text: "chat", Game: "/ws/chat"}, []*Client{acme, other}},
+		{&Announcement{Text: "tenant", Where: Selector{"tenant": "acme"}}, []*Client{acme}},
+	} {
+		if err := a.Add(step.an); err != nil {
+			t.Fatal(err)
+		}
+		a.deliverDue(time.Now())
+		for _, c := range step.to {
+			if m := next(t, c); m.Type != "announcement" || m.Payload != step.an.Text {
+				t.Fatalf("%s got %+v, want announcement %q", c.id, m, step.an.Text)
+			}
+		}
+		for _, c := range []*Client{p, acme, other} {
+			nothing(t, c)
+		}
+	}
+}
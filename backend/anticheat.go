@@ -0,0 +1,382 @@
+// backend/anticheat.go
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+Anti-cheat hooks. Every game action (messages of the configured types, all
+types by default) is passed to each registered AntiCheat together with the
+client's recent actions. The strongest verdict wins:
+
+	flag        record it for operators, let the action through
+	mute        shadow-mute: the client's actions are silently dropped from now on
+	disconnect  record it and close the connection
+
+Built in, configured by the "antiCheat" config block:
+
+	"antiCheat": {
+	  "types": ["move", "guess"],
+	  "maxRate": {"move": 8},                  // actions/sec over the last second
+	  "rateVerdict": "mute",
+	  "automationSamples": 20,                 // intervals looked at
+	  "automationJitter": "2ms",               // stddev below this looks scripted
+	  "automationVerdict": "flag"
+	}
+
+Flags and mutes are visible at GET /api/admin/anticheat; DELETE
+/api/admin/anticheat/mutes/{id} lifts a mute. Mutes are per identity (user
+id, else client id) and last until lifted or restart.
+*/
+
+const (
+	antiCheatHistory  = 64   // actions kept per client
+	antiCheatMaxFlags = 1000 // newest kept
+)
+
+// Verdict is what an AntiCheat decides about one action
+type Verdict int
+
+const (
+	VerdictAllow Verdict = iota
+	VerdictFlag
+	VerdictMute
+	VerdictDisconnect
+)
+
+func (v Verdict) String() string {
+	switch v {
+	case VerdictFlag:
+		return "flag"
+	case VerdictMute:
+		return "mute"
+	case VerdictDisconnect:
+		return "disconnect"
+	}
+	return "allow"
+}
+
+func parseVerdict(s string, def Verdict) (Verdict, error) {
+	switch s {
+	case "":
+		return def, nil
+	case "allow":
+		return VerdictAllow, nil
+	case "flag":
+		return VerdictFlag, nil
+	case "mute":
+		return VerdictMute, nil
+	case "disconnect":
+		return VerdictDisconnect, nil
+	}
+	return def, fmt.Errorf("unknown anti-cheat verdict %q (want flag|mute|disconnect)", s)
+}
+
+// Action is one game action as seen by anti-cheat
+type Action struct {
+	Type      string
+	Payload   string
+	At        time.Time
+	SinceLast time.Duration // since the client's previous action; 0 for the first
+}
+
+// AntiCheat inspects an action; recent holds the client's earlier actions,
+// oldest first, not including a
+type AntiCheat interface {
+	Name() string
+	Check(c *Client, a Action, recent []Action) (Verdict, string)
+}
+
+// CheatFlag is a recorded non-allow verdict
+type CheatFlag struct {
+	Time     time.Time `json:"time"`
+	Identity string    `json:"identity"`
+	ClientID string    `json:"clientId"`
+	Detector string    `json:"detector"`
+	Verdict  string    `json:"verdict"`
+	Reason   string    `json:"reason"`
+}
+
+// AntiCheatConfig is the "antiCheat" config block
+type AntiCheatConfig struct {
+	Types             []string           `json:"types,omitempty"`
+	MaxRate           map[string]float64 `json:"maxRate,omitempty"`
+	RateVerdict       string             `json:"rateVerdict,omitempty"` // default flag
+	AutomationSamples int                `json:"automationSamples,omitempty"`
+	AutomationJitter  Duration           `json:"automationJitter,omitempty"`
+	AutomationVerdict string             `json:"automationVerdict,omitempty"` // default flag
+}
+
+// rateDetector catches impossible action rates
+type rateDetector struct {
+	max     map[string]float64
+	verdict Verdict
+}
+
+func (d *rateDetector) Name() string { return "rate" }
+
+func (d *rateDetector) Check(_ *Client, a Action, recent []Action) (Verdict, string) {
+	limit, ok := d.max[a.Type]
+	if !ok {
+		return VerdictAllow, ""
+	}
+	n := 1
+	for i := len(recent) - 1; i >= 0 && a.At.Sub(recent[i].At) < time.Second; i-- {
+		if recent[i].Type == a.Type {
+			n++
+		}
+	}
+	if float64(n) > limit {
+		return d.verdict, fmt.Sprintf("%d %q actions in 1s (max %g)", n, a.Type, limit)
+	}
+	return VerdictAllow, ""
+}
+
+// automationDetector catches machine-regular input timing
+type automationDetector struct {
+	samples int
+	jitter  time.Duration
+	verdict Verdict
+}
+
+func (d *automationDetector) Name() string { return "automation" }
+
+func (d *automationDetector) Check(_ *Client, a Action, recent []Action) (Verdict, string) {
+	if len(recent) < d.samples {
+		return VerdictAllow, ""
+	}
+	// intervals of the last samples actions, a included
+	window := append(append([]Action(nil), recent[len(recent)-d.samples+1:]...), a)
+	var sum, sumSq float64
+	for _, x := range window {
+		v := float64(x.SinceLast)
+		sum += v
+		sumSq += v * v
+	}
+	n := float64(len(window))
+	mean := sum / n
+	stddev := math.Sqrt(math.Max(0, sumSq/n-mean*mean))
+	if time.Duration(stddev) < d.jitter && mean > 0 {
+		return d.verdict, fmt.Sprintf("last %d actions %v apart with %v jitter", len(window), time.Duration(mean).Round(time.Millisecond), time.Duration(stddev))
+	}
+	return VerdictAllow, ""
+}
+
+// AntiCheatEngine runs detectors and keeps flags, mutes and per-client history
+type AntiCheatEngine struct {
+	types     map[string]bool // empty = every type
+	detectors []AntiCheat
+
+	mu      sync.Mutex
+	history map[*Client][]Action
+	muted   map[string]string // identity -> reason
+	mutes   MuteStore         // nil = mutes end with the process
+	flags   []CheatFlag
+}
+
+// MuteStore persists shadow mutes across restarts
+type MuteStore interface {
+	Mutes() (map[string]string, error)
+	SaveMute(identity, reason string) error
+	DeleteMute(identity string) error
+}
+
+// UseMuteStore loads the mutes in s and saves later changes to it
+func (e *AntiCheatEngine) UseMuteStore(s MuteStore) error {
+	muted, err := s.Mutes()
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for id, reason := range muted {
+		e.muted[id] = reason
+	}
+	e.mutes = s
+	return nil
+}
+
+// NewAntiCheatEngine builds the engine with the built-in detectors from cfg
+// and attaches it to events
+func NewAntiCheatEngine(cfg AntiCheatConfig, events *EventBus) (*AntiCheatEngine, error) {
+	e := &AntiCheatEngine{
+		types:   make(map[string]bool),
+		history: make(map[*Client][]Action),
+		muted:   make(map[string]string),
+	}
+	for _, t := range cfg.Types {
+		e.types[t] = true
+	}
+	if len(cfg.MaxRate) > 0 {
+		v, err := parseVerdict(cfg.RateVerdict, VerdictFlag)
+		if err != nil {
+			return nil, err
+		}
+		e.Add(&rateDetector{max: cfg.MaxRate, verdict: v})
+	}
+	if cfg.AutomationSamples > 0 {
+		v, err := parseVerdict(cfg.AutomationVerdict, VerdictFlag)
+		if err != nil {
+			return nil, err
+		}
+		jitter := time.Duration(cfg.AutomationJitter)
+		if jitter <= 0 {
+			jitter = 2 * time.Millisecond
+		}
+		samples := cfg.AutomationSamples
+		if samples >= antiCheatHistory {
+			samples = antiCheatHistory - 1
+		}
+		e.Add(&automationDetector{samples: samples, jitter: jitter, verdict: v})
+	}
+	e.Attach(events)
+	return e, nil
+}
+
+// Attach drops per-client history when clients of bus disconnect
+func (e *AntiCheatEngine) Attach(bus *EventBus) {
+	bus.Subscribe(func(ev Event) {
+		e.mu.Lock()
+		delete(e.history, ev.Client)
+		e.mu.Unlock()
+	}, EventClientDisconnected)
+}
+
+// Add registers a detector (a plugin)
+func (e *AntiCheatEngine) Add(ac AntiCheat) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.detectors = append(e.detectors, ac)
+}
+
+// Muted reports whether identity is shadow-muted
+func (e *AntiCheatEngine) Muted(identity string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, ok := e.muted[identity]
+	return ok
+}
+
+// Unmute lifts a shadow mute
+func (e *AntiCheatEngine) Unmute(identity string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, ok := e.muted[identity]
+	delete(e.muted, identity)
+	if ok && e.mutes != nil {
+		if err := e.mutes.DeleteMute(identity); err != nil {
+			log.Printf("anticheat: unmute %s: %v", identity, err)
+		}
+	}
+	return ok
+}
+
+// inspect records the action and returns the strongest verdict
+func (e *AntiCheatEngine) inspect(c *Client, m Message) (Verdict, string) {
+	now := time.Now()
+	e.mu.Lock()
+	recent := e.history[c]
+	a := Action{Type: m.Type, Payload: m.Payload, At: now}
+	if len(recent) > 0 {
+		a.SinceLast = now.Sub(recent[len(recent)-1].At)
+	}
+	detectors := e.detectors
+	e.mu.Unlock()
+
+	verdict, reason, by := VerdictAllow, "", ""
+	for _, d := range detectors {
+		if v, r := d.Check(c, a, recent); v > verdict {
+			verdict, reason, by = v, r, d.Name()
+		}
+	}
+
+	identity := presenceIdentity(c)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(recent) >= antiCheatHistory {
+		recent = append(recent[:0:0], recent[len(recent)-antiCheatHistory+1:]...)
+	}
+	e.history[c] = append(recent, a)
+	if verdict == VerdictAllow {
+		return verdict, ""
+	}
+	e.flags = append(e.flags, CheatFlag{Time: now, Identity: identity, ClientID: c.id, Detector: by, Verdict: verdict.String(), Reason: reason})
+	if len(e.flags) > antiCheatMaxFlags {
+		e.flags = append(e.flags[:0:0], e.flags[len(e.flags)-antiCheatMaxFlags:]...)
+	}
+	if verdict == VerdictMute {
+		e.muted[identity] = reason
+		if e.mutes != nil {
+			if err := e.mutes.SaveMute(identity, reason); err != nil {
+				log.Printf("anticheat: mute %s: %v", identity, err)
+			}
+		}
+	}
+	return verdict, reason
+}
+
+// AntiCheatMiddleware runs the detectors on game actions and enforces verdicts
+func AntiCheatMiddleware(e *AntiCheatEngine) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(c *Client, m Message) {
+			if len(e.types) > 0 && !e.types[m.Type] {
+				next(c, m)
+				return
+			}
+			if e.Muted(presenceIdentity(c)) {
+				return // shadow-muted: no error, nobody else sees it
+			}
+			verdict, reason := e.inspect(c, m)
+			switch verdict {
+			case VerdictMute:
+				log.Printf("anticheat: muting %s: %s", presenceIdentity(c), reason)
+				return
+			case VerdictDisconnect:
+				log.Printf("anticheat: disconnecting %s: %s", presenceIdentity(c), reason)
+				c.kick(websocket.ClosePolicyViolation, "anti-cheat")
+				return
+			}
+			next(c, m)
+		}
+	}
+}
+
+// RegisterAdmin mounts /api/admin/anticheat
+func (e *AntiCheatEngine) RegisterAdmin(a *AdminAPI) {
+	a.Handle("/api/admin/anticheat", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "use GET")
+			return
+		}
+		e.mu.Lock()
+		flags := append([]CheatFlag{}, e.flags...)
+		muted := make(map[string]string, len(e.muted))
+		for id, reason := range e.muted {
+			muted[id] = reason
+		}
+		e.mu.Unlock()
+		writeJSON(w, http.StatusOK, map[string]interface{}{"flags": flags, "muted": muted})
+	})
+	a.Handle("/api/admin/anticheat/mutes/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			writeJSONError(w, http.StatusMethodNotAllowed, "use DELETE")
+			return
+		}
+		id := strings.TrimPrefix(r.URL.Path, "/api/admin/anticheat/mutes/")
+		if !e.Unmute(id) {
+			writeJSONError(w, http.StatusNotFound, "not muted")
+			return
+		}
+		a.audit.Record(adminActor(r), "anticheat.unmute", id, "")
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
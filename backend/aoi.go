@@ -0,0 +1,185 @@
+// backend/aoi.go
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"sync"
+)
+
+/*
+Area-of-interest (AOI) index for spatial games.
+Clients report their position with {"type":"aoi.position","data":{"x":1,"y":2}}.
+Games call Hub.BroadcastNear to deliver world updates only to clients within
+the configured radius instead of fanning out to everyone; "aoi.update"
+messages from a positioned client are relayed the same way without any
+game code.
+Positions live in a uniform grid, so a query only visits the cells that
+overlap the radius.
+*/
+
+// AOIConfig is the "aoi" block of the config file
+type AOIConfig struct {
+	Radius   float64 `json:"radius"`   // default 100
+	CellSize float64 `json:"cellSize"` // default = radius
+}
+
+type cellKey struct{ x, y int64 }
+
+type aoiPos struct {
+	x, y float64
+	cell cellKey
+}
+
+// AOI is a grid-partitioned spatial index of client positions
+type AOI struct {
+	radius   float64
+	cellSize float64
+
+	mu    sync.Mutex
+	pos   map[*Client]aoiPos
+	cells map[cellKey]map[*Client]bool
+}
+
+func NewAOI(cfg AOIConfig) *AOI {
+	if cfg.Radius <= 0 {
+		cfg.Radius = 100
+	}
+	if cfg.CellSize <= 0 {
+		cfg.CellSize = cfg.Radius
+	}
+	return &AOI{
+		radius:   cfg.Radius,
+		cellSize: cfg.CellSize,
+		pos:      make(map[*Client]aoiPos),
+		cells:    make(map[cellKey]map[*Client]bool),
+	}
+}
+
+func (a *AOI) cellOf(x, y float64) cellKey {
+	return cellKey{int64(math.Floor(x / a.cellSize)), int64(math.Floor(y / a.cellSize))}
+}
+
+// Update sets c's position
+func (a *AOI) Update(c *Client, x, y float64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := a.cellOf(x, y)
+	if old, ok := a.pos[c]; ok && old.cell != key {
+		a.removeFromCellLocked(c, old.cell)
+	}
+	cell := a.cells[key]
+	if cell == nil {
+		cell = make(map[*Client]bool)
+		a.cells[key] = cell
+	}
+	cell[c] = true
+	a.pos[c] = aoiPos{x: x, y: y, cell: key}
+}
+
+// Remove forgets c (on disconnect)
+func (a *AOI) Remove(c *Client) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if old, ok := a.pos[c]; ok {
+		a.removeFromCellLocked(c, old.cell)
+		delete(a.pos, c)
+	}
+}
+
+func (a *AOI) removeFromCellLocked(c *Client, key cellKey) {
+	if cell := a.cells[key]; cell != nil {
+		delete(cell, c)
+		if len(cell) == 0 {
+			delete(a.cells, key)
+		}
+	}
+}
+
+// Position returns c's last reported position
+func (a *AOI) Position(c *Client) (x, y float64, ok bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	p, ok := a.pos[c]
+	return p.x, p.y, ok
+}
+
+// Near returns clients within the radius of (x, y)
+func (a *AOI) Near(x, y float64) []*Client {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	span := int64(math.Ceil(a.radius / a.cellSize))
+	center := a.cellOf(x, y)
+	r2 := a.radius * a.radius
+	var out []*Client
+	for cx := center.x - span; cx <= center.x+span; cx++ {
+		for cy := center.y - span; cy <= center.y+span; cy++ {
+			for c := range a.cells[cellKey{cx, cy}] {
+				p := a.pos[c]
+				if dx, dy := p.x-x, p.y-y; dx*dx+dy*dy <= r2 {
+					out = append(out, c)
+				}
+			}
+		}
+	}
+	return out
+}
+
+// Attach drops positions of disconnected clients
+func (a *AOI) Attach(bus *EventBus) {
+	bus.Subscribe(func(e Event) { a.Remove(e.Client) }, EventClientDisconnected)
+}
+
+// BroadcastNear sends msg to clients in room within the AOI radius of (x, y),
+// skipping except (may be nil). World updates are frequent and superseded
+// quickly, so a client whose send buffer is full just misses this one rather
+// than being disconnected.
+func (h *Hub) BroadcastNear(room string, x, y float64, msg []byte, except *Client) int {
+	if h.aoi == nil {
+		return 0
+	}
+	near := h.aoi.Near(x, y)
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	sent := 0
+	for _, c := range near {
+		if c == except || !h.clients[c] || c.room != room {
+			continue
+		}
+		if c.trySend(msg) {
+			sent++
+		}
+	}
+	return sent
+}
+
+// AOIMiddleware handles aoi.position and relays aoi.update to nearby clients
+func AOIMiddleware(hub *Hub) Middleware {
+	a := hub.aoi
+	return func(next MessageHandler) MessageHandler {
+		return func(c *Client, m Message) {
+			switch m.Type {
+			case "aoi.position":
+				var p struct {
+					X *float64 `json:"x"`
+					Y *float64 `json:"y"`
+				}
+				if err := json.Unmarshal(m.Data, &p); err != nil || p.X == nil || p.Y == nil {
+					sendError(c, "aoi.bad_position")
+					return
+				}
+				a.Update(c, *p.X, *p.Y)
+			case "aoi.update":
+				x, y, ok := a.Position(c)
+				if !ok {
+					sendError(c, "aoi.no_position")
+					return
+				}
+				b, _ := json.Marshal(m)
+				hub.BroadcastNear(hub.RoomOf(c), x, y, b, c)
+			default:
+				next(c, m)
+			}
+		}
+	}
+}
@@ -0,0 +1,160 @@
+// backend/audit.go
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+Audit log of privileged actions: console kicks and broadcasts, every
+mutating admin API call, and script reloads (game hot-swaps). Entries are
+appended to -audit-log as JSONL and never rewritten.
+
+	GET /api/admin/audit?actor=console&action=kick&target=u1&since=2024-05-01T00:00:00Z&limit=100
+
+returns matching entries, oldest first (limit keeps the newest, default 100).
+*/
+
+const auditPageSize = 100
+
+// AuditEntry is one privileged action
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`  // "console", "admin@<ip>", "system"
+	Action string    `json:"action"` // "kick", "broadcast", "quota.set", "scripts.reload", ...
+	Target string    `json:"target,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// AuditLog appends entries to a file
+type AuditLog struct {
+	path string
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+func OpenAuditLog(path string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{path: path, f: f}, nil
+}
+
+// Record appends an entry. A nil AuditLog records nothing, so callers
+// don't need to check whether auditing is enabled.
+func (a *AuditLog) Record(actor, action, target, detail string) {
+	if a == nil {
+		return
+	}
+	b, _ := json.Marshal(AuditEntry{Time: time.Now().UTC(), Actor: actor, Action: action, Target: target, Detail: detail})
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.f.Write(append(b, '\n')); err != nil {
+		log.Println("audit:", err)
+	}
+}
+
+// AuditFilter selects entries; zero fields match everything
+type AuditFilter struct {
+	Actor, Action, Target string
+	Since, Until          time.Time
+	Limit                 int
+}
+
+func (f AuditFilter) match(e *AuditEntry) bool {
+	return (f.Actor == "" || e.Actor == f.Actor) &&
+		(f.Action == "" || e.Action == f.Action) &&
+		(f.Target == "" || e.Target == f.Target) &&
+		(f.Since.IsZero() || !e.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || e.Time.Before(f.Until))
+}
+
+// Query scans the log for matching entries, oldest first
+func (a *AuditLog) Query(f AuditFilter) ([]AuditEntry, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	file, err := os.Open(a.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var out []AuditEntry
+	sc := bufio.NewScanner(file)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for sc.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			continue // torn write after a crash
+		}
+		if f.match(&e) {
+			out = append(out, e)
+			if f.Limit > 0 && len(out) > 2*f.Limit {
+				out = append(out[:0], out[len(out)-f.Limit:]...)
+			}
+		}
+	}
+	if f.Limit > 0 && len(out) > f.Limit {
+		out = out[len(out)-f.Limit:]
+	}
+	return out, sc.Err()
+}
+
+// RegisterAdmin mounts GET /api/admin/audit
+func (a *AuditLog) RegisterAdmin(admin *AdminAPI) {
+	admin.Handle("/api/admin/audit", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "use GET")
+			return
+		}
+		q := r.URL.Query()
+		f := AuditFilter{Actor: q.Get("actor"), Action: q.Get("action"), Target: q.Get("target"), Limit: auditPageSize}
+		var err error
+		if s := q.Get("since"); s != "" {
+			if f.Since, err = time.Parse(time.RFC3339, s); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "since: "+err.Error())
+				return
+			}
+		}
+		if s := q.Get("until"); s != "" {
+			if f.Until, err = time.Parse(time.RFC3339, s); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "until: "+err.Error())
+				return
+			}
+		}
+		if s := q.Get("limit"); s != "" {
+			if f.Limit, err = strconv.Atoi(s); err != nil || f.Limit < 1 {
+				writeJSONError(w, http.StatusBadRequest, "limit must be a positive integer")
+				return
+			}
+		}
+		entries, err := a.Query(f)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if entries == nil {
+			entries = []AuditEntry{}
+		}
+		writeJSON(w, http.StatusOK, entries)
+	})
+}
+
+// adminActor names the caller of an admin request for the audit log
+func adminActor(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "admin@" + host
+}
@@ -0,0 +1,255 @@
+// backend/auth.go
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+OAuth2 / OIDC login.
+- GET /auth/login    redirects to the provider's consent page
+- GET /auth/callback exchanges the code, upserts the user, sets the session
+  cookie (sessioncookie.go) and redirects to "/#token=<jwt>" for SPAs that
+  pass the session token on the /ws handshake themselves.
+*/
+
+// OAuthProvider describes the endpoints of an authorization-code provider
+type OAuthProvider struct {
+	Name        string
+	AuthURL     string
+	TokenURL    string
+	UserInfoURL string
+	Scopes      []string
+	// parseUser extracts (subject, name, email) from the userinfo response
+	parseUser func(body []byte) (sub, name, email string, err error)
+}
+
+var oauthProviders = map[string]*OAuthProvider{
+	"google": {
+		Name:        "google",
+		AuthURL:     "https://accounts.google.com/o/oauth2/v2/auth",
+		TokenURL:    "https://oauth2.googleapis.com/token",
+		UserInfoURL: "https://openidconnect.googleapis.com/v1/userinfo",
+		Scopes:      []string{"openid", "email", "profile"},
+		parseUser: func(body []byte) (string, string, string, error) {
+			var u struct {
+				Sub   string `json:"sub"`
+				Name  string `json:"name"`
+				Email string `json:"email"`
+			}
+			if err := json.Unmarshal(body, &u); err != nil {
+				return "", "", "", err
+			}
+			return u.Sub, u.Name, u.Email, nil
+		},
+	},
+	"github": {
+		Name:        "github",
+		AuthURL:     "https://github.com/login/oauth/authorize",
+		TokenURL:    "https://github.com/login/oauth/access_token",
+		UserInfoURL: "https://api.github.com/user",
+		Scopes:      []string{"read:user", "user:email"},
+		parseUser: func(body []byte) (string, string, string, error) {
+			var u struct {
+				ID    int64  `json:"id"`
+				Login string `json:"login"`
+				Name  string `json:"name"`
+				Email string `json:"email"`
+			}
+			if err := json.Unmarshal(body, &u); err != nil {
+				return "", "", "", err
+			}
+			name := u.Name
+			if name == "" {
+				name = u.Login
+			}
+			return strconv.FormatInt(u.ID, 10), name, u.Email, nil
+		},
+	},
+}
+
+const oauthStateCookie = "oauth_state"
+
+// OAuthHandler serves the login and callback endpoints
+type OAuthHandler struct {
+	provider     *OAuthProvider
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	users        UserStore
+	sessions     *SessionManager
+	httpClient   *http.Client
+}
+
+func NewOAuthHandler(provider, clientID, clientSecret, redirectURL string, users UserStore, sessions *SessionManager) (*OAuthHandler, error) {
+	p, ok := oauthProviders[provider]
+	if !ok {
+		return nil, fmt.Errorf("unknown oauth provider %q", provider)
+	}
+	if clientID == "" || clientSecret == "" || redirectURL == "" {
+		return nil, errors.New("oauth provider requires client id, client secret and redirect url")
+	}
+	return &OAuthHandler{
+		provider:     p,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		redirectURL:  redirectURL,
+		users:        users,
+		sessions:     sessions,
+		httpClient:   &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (h *OAuthHandler) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	state := hex.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    state,
+		Path:     "/auth",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	q := url.Values{
+		"client_id":     {h.clientID},
+		"redirect_uri":  {h.redirectURL},
+		"response_type": {"code"},
+		"scope":         {strings.Join(h.provider.Scopes, " ")},
+		"state":         {state},
+	}
+	http.Redirect(w, r, h.provider.AuthURL+"?"+q.Encode(), http.StatusFound)
+}
+
+func (h *OAuthHandler) HandleCallback(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		http.Error(w, "login failed: "+e, http.StatusUnauthorized)
+		return
+	}
+	cookie, err := r.Cookie(oauthStateCookie)
+	if err != nil || cookie.Value == "" || cookie.Value != q.Get("state") {
+		http.Error(w, "invalid oauth state", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oauthStateCookie, Path: "/auth", MaxAge: -1})
+
+	accessToken, err := h.exchange(q.Get("code"))
+	if err != nil {
+		log.Println("oauth exchange error:", err)
+		http.Error(w, "login failed", http.StatusBadGateway)
+		return
+	}
+	user, err := h.fetchUser(accessToken)
+	if err != nil {
+		log.Println("oauth userinfo error:", err)
+		http.Error(w, "login failed", http.StatusBadGateway)
+		return
+	}
+	token, err := h.sessions.Issue(user)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if err := h.sessions.SetCookie(w, r, token); err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("user logged in: %s (%s)", user.ID, user.Name)
+	// fragment is never sent back to the server, so the token stays out of access logs
+	http.Redirect(w, r, "/#token="+url.QueryEscape(token), http.StatusFound)
+}
+
+// exchange trades the authorization code for an access token
+func (h *OAuthHandler) exchange(code string) (string, error) {
+	if code == "" {
+		return "", errors.New("missing code")
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {h.redirectURL},
+		"client_id":     {h.clientID},
+		"client_secret": {h.clientSecret},
+	}
+	req, err := http.NewRequest(http.MethodPost, h.provider.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := h.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", err
+	}
+	if tok.AccessToken == "" {
+		return "", fmt.Errorf("token endpoint: status %d, error %q", resp.StatusCode, tok.Error)
+	}
+	return tok.AccessToken, nil
+}
+
+// fetchUser loads the provider profile and upserts it into the user store
+func (h *OAuthHandler) fetchUser(accessToken string) (*User, error) {
+	req, err := http.NewRequest(http.MethodGet, h.provider.UserInfoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+	resp, err := h.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("userinfo: status %d", resp.StatusCode)
+	}
+	var body json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	sub, name, email, err := h.provider.parseUser(body)
+	if err != nil {
+		return nil, err
+	}
+	if sub == "" {
+		return nil, errors.New("userinfo: missing subject")
+	}
+
+	now := time.Now()
+	id := h.provider.Name + ":" + sub
+	u, ok := h.users.Get(id)
+	if !ok {
+		u = &User{ID: id, Provider: h.provider.Name, Subject: sub, CreatedAt: now}
+	}
+	u.Name = name
+	u.Email = email
+	u.LastLogin = now
+	if err := h.users.Put(u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
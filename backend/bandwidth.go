@@ -0,0 +1,295 @@
+// backend/bandwidth.go
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Bandwidth accounting and caps. Every frame's size is counted per client
+and per room (the room the client is in at the time), in both directions.
+Totals per game are exported as ws_bytes_received_total and
+ws_bytes_sent_total, and
+
+	GET /api/admin/bandwidth?game=/ws&limit=20
+
+lists the heaviest clients and rooms. Caps are off unless configured:
+
+	"bandwidth": {"inRate": 65536, "inBurst": 262144, "outRate": 262144, "action": "throttle"}
+
+Rates are bytes per second per client; bursts default to four seconds'
+worth. With "action": "throttle" (the default) an inbound client over its
+cap isn't read from until it is back under (TCP pushes back on it), and
+outbound frames to a client over its cap are held back, so its send
+buffer fills and the usual slow-client handling applies. With
+"disconnect" the client is closed with code 4004 instead.
+*/
+
+// application close code for clients over a bandwidth cap
+const closeBandwidthExceeded = 4004
+
+var errBandwidthExceeded = errors.New("bandwidth limit exceeded")
+
+// BandwidthConfig is the "bandwidth" config block
+type BandwidthConfig struct {
+	InRate   float64 `json:"inRate,omitempty"`   // bytes/s from each client, 0 = no cap
+	InBurst  float64 `json:"inBurst,omitempty"`  // default 4*inRate
+	OutRate  float64 `json:"outRate,omitempty"`  // bytes/s to each client, 0 = no cap
+	OutBurst float64 `json:"outBurst,omitempty"` // default 4*outRate
+	Action   string  `json:"action,omitempty"`   // throttle | disconnect
+}
+
+// byteBucket is a token bucket counted in bytes; each one is only
+// touched by one pump goroutine
+type byteBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take removes n bytes and returns how long the caller must wait to be
+// back under the cap (0 if it is)
+func (b *byteBucket) take(n int, rate, burst float64, now time.Time) time.Duration {
+	if burst <= 0 {
+		burst = 4 * rate
+	}
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else if b.tokens += now.Sub(b.last).Seconds() * rate; b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
+type roomKey struct{ game, room string }
+
+// traffic is a pair of byte counts
+type traffic struct {
+	In  int64 `json:"in"`
+	Out int64 `json:"out"`
+}
+
+// Bandwidth counts traffic and enforces the caps on every game
+type Bandwidth struct {
+	cfg BandwidthConfig
+
+	throttled   Counter
+	disconnects Counter
+
+	mu     sync.Mutex
+	hubs   []*Hub
+	games  map[string]*traffic  // mount path -> totals
+	rooms  map[roomKey]*traffic // live rooms only
+	closed map[*Client]bool     // already being disconnected
+}
+
+func NewBandwidth(cfg BandwidthConfig) *Bandwidth {
+	return &Bandwidth{cfg: cfg, games: make(map[string]*traffic), rooms: make(map[roomKey]*traffic), closed: make(map[*Client]bool)}
+}
+
+// AddHub counts hub's traffic under its path
+func (b *Bandwidth) AddHub(hub *Hub) {
+	b.mu.Lock()
+	b.hubs = append(b.hubs, hub)
+	b.games[hub.path] = &traffic{}
+	b.mu.Unlock()
+	hub.events.Subscribe(func(e Event) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		switch e.Kind {
+		case EventRoomDeleted:
+			if hub.RoomSize(e.Room) == 0 {
+				delete(b.rooms, roomKey{hub.path, e.Room})
+			}
+		case EventClientDisconnected:
+			delete(b.closed, e.Client)
+		}
+	}, EventRoomDeleted, EventClientDisconnected)
+}
+
+// count adds n bytes in or out to c's game and room
+func (b *Bandwidth) count(c *Client, n int, in bool) {
+	room := c.hub.RoomOf(c)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	add := func(t *traffic) {
+		if in {
+			t.In += int64(n)
+		} else {
+			t.Out += int64(n)
+		}
+	}
+	if t := b.games[c.hub.path]; t != nil {
+		add(t)
+	}
+	if room != "" {
+		k := roomKey{c.hub.path, room}
+		t := b.rooms[k]
+		if t == nil {
+			t = &traffic{}
+			b.rooms[k] = t
+		}
+		add(t)
+	}
+}
+
+// received accounts for a frame of n bytes from c (readPump only). It
+// returns false if c is to be disconnected.
+func (c *Client) received(n int) bool {
+	c.bytesIn.Add(int64(n))
+	b := c.hub.bandwidth
+	if b == nil {
+		return true
+	}
+	b.count(c, n, true)
+	if b.cfg.InRate <= 0 {
+		return true
+	}
+	return b.enforce(c, c.inBucket.take(n, b.cfg.InRate, b.cfg.InBurst, time.Now()))
+}
+
+// sent accounts for n bytes written to c (writePump only). It returns
+// false if c is to be disconnected.
+func (c *Client) sent(n int) bool {
+	c.bytesOut.Add(int64(n))
+	b := c.hub.bandwidth
+	if b == nil {
+		return true
+	}
+	b.count(c, n, false)
+	if b.cfg.OutRate <= 0 {
+		return true
+	}
+	return b.enforce(c, c.outBucket.take(n, b.cfg.OutRate, b.cfg.OutBurst, time.Now()))
+}
+
+// enforce applies the configured action to c being wait over its cap
+func (b *Bandwidth) enforce(c *Client, wait time.Duration) bool {
+	if wait <= 0 {
+		return true
+	}
+	if b.cfg.Action != "disconnect" {
+		b.throttled.Inc()
+		time.Sleep(wait)
+		return true
+	}
+	b.mu.Lock()
+	first := !b.closed[c]
+	b.closed[c] = true
+	b.mu.Unlock()
+	if first {
+		b.disconnects.Inc()
+		log.Printf("bandwidth: disconnecting %s (over cap)", c.id)
+		c.kick(closeBandwidthExceeded, "bandwidth limit exceeded")
+	}
+	return false
+}
+
+// Register exports the totals on m
+func (b *Bandwidth) Register(m *Metrics) {
+	totals := func(in bool) func() []Sample {
+		return func() []Sample {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			out := make([]Sample, 0, len(b.games))
+			for game, t := range b.games {
+				v := t.Out
+				if in {
+					v = t.In
+				}
+				out = append(out, Sample{Labels: `game="` + game + `"`, Value: float64(v)})
+			}
+			sort.Slice(out, func(i, j int) bool { return out[i].Labels < out[j].Labels })
+			return out
+		}
+	}
+	m.Register("ws_bytes_received_total", "websocket payload bytes received from clients", "counter", totals(true))
+	m.Register("ws_bytes_sent_total", "websocket payload bytes sent to clients", "counter", totals(false))
+	m.Register("ws_bandwidth_throttled_total", "frames delayed because a client was over its bandwidth cap", "counter", func() []Sample {
+		return []Sample{{Value: float64(b.throttled.Value())}}
+	})
+	m.Register("ws_bandwidth_disconnects_total", "clients disconnected for exceeding a bandwidth cap", "counter", func() []Sample {
+		return []Sample{{Value: float64(b.disconnects.Value())}}
+	})
+}
+
+// clientTraffic is one client in the admin listing
+type clientTraffic struct {
+	ID        string    `json:"id"`
+	User      string    `json:"user,omitempty"`
+	Room      string    `json:"room,omitempty"`
+	Connected time.Time `json:"connected"`
+	traffic
+}
+
+// roomTraffic is one room in the admin listing
+type roomTraffic struct {
+	Room string `json:"room"`
+	traffic
+}
+
+// RegisterAdmin mounts GET /api/admin/bandwidth
+func (b *Bandwidth) RegisterAdmin(a *AdminAPI) {
+	a.Handle("/api/admin/bandwidth", func(w http.ResponseWriter, r *http.Request) {
+		game := r.URL.Query().Get("game")
+		if game == "" {
+			game = "/ws"
+		}
+		limit := 20
+		if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 {
+			limit = n
+		}
+		b.mu.Lock()
+		var hub *Hub
+		for _, h := range b.hubs {
+			if h.path == game {
+				hub = h
+			}
+		}
+		var total traffic
+		if t := b.games[game]; t != nil {
+			total = *t
+		}
+		rooms := []roomTraffic{}
+		for k, t := range b.rooms {
+			if k.game == game {
+				rooms = append(rooms, roomTraffic{Room: k.room, traffic: *t})
+			}
+		}
+		b.mu.Unlock()
+		if hub == nil {
+			writeJSONError(w, http.StatusNotFound, "no game at "+game)
+			return
+		}
+		clients := []clientTraffic{}
+		hub.mu.Lock()
+		for c := range hub.clients {
+			clients = append(clients, clientTraffic{ID: c.id, User: c.userID, Room: c.room, Connected: c.connected,
+				traffic: traffic{In: c.bytesIn.Load(), Out: c.bytesOut.Load()}})
+		}
+		hub.mu.Unlock()
+		sort.Slice(clients, func(i, j int) bool { return clients[i].In+clients[i].Out > clients[j].In+clients[j].Out })
+		sort.Slice(rooms, func(i, j int) bool {
+			ti, tj := rooms[i].In+rooms[i].Out, rooms[j].In+rooms[j].Out
+			return ti > tj || (ti == tj && strings.Compare(rooms[i].Room, rooms[j].Room) < 0)
+		})
+		if len(clients) > limit {
+			clients = clients[:limit]
+		}
+		if len(rooms) > limit {
+			rooms = rooms[:limit]
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"game": game, "total": total, "clients": clients, "rooms": rooms, "caps": b.cfg})
+	})
+}
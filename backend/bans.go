@@ -0,0 +1,188 @@
+// backend/bans.go
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+User bans. A banned user's connections are closed and new handshakes with
+their token get 403 on every game until the ban is lifted or expires:
+
+	POST   /api/admin/bans          {"user":"mallory","reason":"spam","ttl":"24h"}   no ttl = permanent
+	GET    /api/admin/bans
+	DELETE /api/admin/bans/{user}
+
+Bans are kept in the database (-db) when there is one. Anonymous clients
+have no user to ban; kick them (DELETE /api/admin/clients/{id}) instead.
+*/
+
+// Ban keeps one user out
+type Ban struct {
+	User    string     `json:"user"`
+	Reason  string     `json:"reason,omitempty"`
+	By      string     `json:"by,omitempty"`
+	Created time.Time  `json:"created"`
+	Until   *time.Time `json:"until,omitempty"` // nil = permanent
+}
+
+func (b Ban) active(now time.Time) bool { return b.Until == nil || now.Before(*b.Until) }
+
+// Bans is the set of banned users
+type Bans struct {
+	hubs []*Hub // set up before serving; not locked
+
+	mu   sync.Mutex
+	bans map[string]Ban
+	db   *SQLiteDB // nil = memory only
+}
+
+func NewBans() *Bans { return &Bans{bans: make(map[string]Ban)} }
+
+// UseDB loads the stored bans and saves changes to db
+func (b *Bans) UseDB(db *SQLiteDB) error {
+	bans, err := db.bans()
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.db = db
+	for _, ban := range bans {
+		b.bans[ban.User] = ban
+	}
+	return nil
+}
+
+// AddHub lets bans disconnect h's clients
+func (b *Bans) AddHub(h *Hub) { b.hubs = append(b.hubs, h) }
+
+// Banned returns user's ban if one is in force; nil-safe
+func (b *Bans) Banned(user string) (Ban, bool) {
+	if b == nil || user == "" {
+		return Ban{}, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ban, ok := b.bans[user]
+	if ok && !ban.active(time.Now()) {
+		delete(b.bans, user)
+		if b.db != nil {
+			b.db.deleteBan(user)
+		}
+		return Ban{}, false
+	}
+	return ban, ok
+}
+
+// Add bans ban.User and closes their connections; it returns how many
+func (b *Bans) Add(ban Ban) (int, error) {
+	b.mu.Lock()
+	b.bans[ban.User] = ban
+	var err error
+	if b.db != nil {
+		err = b.db.saveBan(ban)
+	}
+	b.mu.Unlock()
+	n := 0
+	for _, h := range b.hubs {
+		for _, c := range h.UserClients(ban.User) {
+			c.kick(websocket.ClosePolicyViolation, "banned")
+			n++
+		}
+	}
+	return n, err
+}
+
+// Remove lifts user's ban and reports whether there was one
+func (b *Bans) Remove(user string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.bans[user]; !ok {
+		return false, nil
+	}
+	delete(b.bans, user)
+	if b.db != nil {
+		return true, b.db.deleteBan(user)
+	}
+	return true, nil
+}
+
+// list returns the bans in force, by user
+func (b *Bans) list() []Ban {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	out := []Ban{}
+	for _, ban := range b.bans {
+		if ban.active(now) {
+			out = append(out, ban)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].User < out[j].User })
+	return out
+}
+
+// RegisterAdmin mounts /api/admin/bans
+func (b *Bans) RegisterAdmin(a *AdminAPI) {
+	a.Handle("/api/admin/bans", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, b.list())
+		case http.MethodPost:
+			var req struct {
+				User   string   `json:"user"`
+				Reason string   `json:"reason"`
+				TTL    Duration `json:"ttl"`
+			}
+			if err := readJSON(w, r, &req); err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if req.User == "" {
+				writeJSONError(w, http.StatusBadRequest, "user is required")
+				return
+			}
+			ban := Ban{User: req.User, Reason: req.Reason, By: adminActor(r), Created: time.Now()}
+			if req.TTL > 0 {
+				until := ban.Created.Add(time.Duration(req.TTL))
+				ban.Until = &until
+			}
+			n, err := b.Add(ban)
+			if err != nil {
+				writeJSONError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			log.Printf("admin: ban %s (%d connections)", req.User, n)
+			a.audit.Record(adminActor(r), "ban", req.User, fmt.Sprintf("%s; %d connection(s)", req.Reason, n))
+			writeJSON(w, http.StatusOK, map[string]interface{}{"ban": ban, "kicked": n})
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, "use GET or POST")
+		}
+	})
+	a.Handle("/api/admin/bans/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			writeJSONError(w, http.StatusMethodNotAllowed, "use DELETE")
+			return
+		}
+		user := strings.TrimPrefix(r.URL.Path, "/api/admin/bans/")
+		ok, err := b.Remove(user)
+		switch {
+		case err != nil:
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+		case !ok:
+			writeJSONError(w, http.StatusNotFound, "not banned")
+		default:
+			a.audit.Record(adminActor(r), "unban", user, "")
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+}
@@ -0,0 +1,89 @@
+// backend/binary.go
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+	lua "github.com/yuin/gopher-lua"
+)
+
+/*
+Binary frames. A client may send raw BinaryMessage frames (input bitfields,
+packed position floats, ...) alongside its JSON text frames. They go
+straight to Game.OnBinaryMessage, skipping the JSON envelope and the
+middleware chain, and are still bounded by maxMessageSize. Games answer
+with Client.SendBinary or Hub.BroadcastBinary, which queue on a separate
+channel so binary data never lands inside a text batch.
+
+In -mode=script, handlers["binary"] gets msg.payload as a Lua string with
+the raw bytes, and send_binary(client_id, bytes) replies in kind.
+*/
+
+const binarySendBuffer = 64
+
+// SendBinary queues a binary frame for c; it reports false if c is backed up
+func (c *Client) SendBinary(b []byte) bool {
+	select {
+	case c.sendBinary <- b:
+		return true
+	default:
+		return false
+	}
+}
+
+// BroadcastBinary sends a binary frame to every client in room ("" = all
+// clients) except except, skipping clients that are backed up
+func (h *Hub) BroadcastBinary(room string, msg []byte, except *Client) int {
+	targets := h.clients
+	if room == "" {
+		h.mu.RLock()
+		defer h.mu.RUnlock()
+	} else {
+		rs := h.room(room)
+		if rs == nil {
+			return 0
+		}
+		rs.mu.Lock()
+		defer rs.mu.Unlock()
+		targets = rs.members
+	}
+	sent := 0
+	for c := range targets {
+		if c != except && c.SendBinary(msg) {
+			sent++
+		}
+	}
+	return sent
+}
+
+// writeBinary writes one binary frame, subject to chaos like text frames
+func (c *Client) writeBinary(b []byte) error {
+	if !c.sent(len(b)) {
+		return errBandwidthExceeded
+	}
+	if chaos := c.hub.chaos; chaos != nil {
+		switch chaos.outbound() {
+		case chaosDrop:
+			return nil
+		case chaosSever:
+			log.Printf("chaos: severing %s", c.id)
+			return errChaosSevered
+		}
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.conn.WriteMessage(websocket.BinaryMessage, b)
+}
+
+func (e *ScriptEngine) luaSendBinary(L *lua.LState) int {
+	id, data := L.CheckString(1), L.CheckString(2)
+	n := 0
+	for _, c := range e.hub.FindClients(id) {
+		if c.SendBinary([]byte(data)) {
+			n++
+		}
+	}
+	L.Push(lua.LNumber(n))
+	return 1
+}
@@ -0,0 +1,133 @@
+// backend/broadcast.go
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+/*
+The broadcast API games and services use to send a Message to more than
+one client. Each picks its audience explicitly:
+
+	hub.BroadcastGlobal(m)            every client of the game, hub-wide seq
+	hub.BroadcastRoom("r1", m)        the members of r1, r1's seq
+	hub.BroadcastExcept(sender, m)    sender's room (everyone when it is in
+	                                  none) minus sender itself
+
+All of them stamp m (see envelope.go). BroadcastExcept still takes a seq
+from the stream it is sent on; in a room the sender gets
+{"type":"filtered","room":...,"seq":...} in its place (see outfilter.go),
+so its stream has no gap to resync, and a replay gives it the same
+stub. Already encoded frames go out with BroadcastRoomRaw,
+BroadcastBinary and BroadcastNear (aoi.go).
+
+A message is encoded once, before any lock is taken, and the same bytes
+are queued for every recipient, so a frame is never changed once it has
+been handed to a send queue. Only the seq differs per message; it is
+spliced into the encoded bytes under the room's lock (or seqMu), which
+keeps the seq order and the send order the same. Outbound filters
+(outfilter.go) may give some recipients a frame of their own.
+*/
+
+// outbound is a frame queued for every client of a hub but except
+type outbound struct {
+	msg    []byte
+	m      Message // what msg encodes, for outbound filters
+	except *Client // nil = nobody
+}
+
+// BroadcastGlobal stamps m with the hub-wide seq and queues it for every
+// client
+func (h *Hub) BroadcastGlobal(m Message) {
+	h.broadcastGlobal(m, nil)
+}
+
+func (h *Hub) broadcastGlobal(m Message, except *Client) {
+	m.stamp()
+	m.Room, m.Seq = "", 0
+	b, _ := json.Marshal(m)
+	h.seqMu.Lock()
+	defer h.seqMu.Unlock()
+	h.globalSeq++
+	m.Seq = h.globalSeq
+	h.broadcast <- outbound{msg: withSeq(b, h.globalSeq), m: m, except: except}
+}
+
+// withSeq returns a copy of b, a Message encoded without seq, with seq
+// added as json.Marshal would have put it: last
+func withSeq(b []byte, seq uint64) []byte {
+	out := make([]byte, 0, len(b)+28)
+	out = append(out, b[:len(b)-1]...)
+	out = append(out, `,"seq":`...)
+	out = strconv.AppendUint(out, seq, 10)
+	return append(out, '}')
+}
+
+// BroadcastRoom stamps m with room's next seq and sends it to every
+// member, returning how many got it. Nothing is sent (or counted) for a
+// room without members.
+func (h *Hub) BroadcastRoom(room string, m Message) int {
+	return h.broadcastRoom(room, m, nil)
+}
+
+func (h *Hub) broadcastRoom(room string, m Message, except *Client) int {
+	rs := h.room(room)
+	if rs == nil {
+		return 0
+	}
+	m.stamp()
+	m.Room, m.Seq = room, 0
+	b, _ := json.Marshal(m)
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if len(rs.members) == 0 {
+		return 0
+	}
+	if h.snapshots[m.Type] {
+		n := 0
+		for c := range rs.members {
+			if c == except {
+				continue
+			}
+			frame := b
+			if h.filtering() {
+				if frame = h.filterFor(c, m, b); frame == nil {
+					continue
+				}
+			}
+			c.queueSnapshot(m.Type, frame)
+			n++
+		}
+		return n
+	}
+	rs.seq++
+	m.Seq = rs.seq
+	b = withSeq(b, rs.seq)
+	rs.remember(b, except, h.replayFrames)
+	sent := 0
+	for c := range rs.members {
+		if c == except {
+			c.trySend(filteredStub(room, rs.seq))
+			continue
+		}
+		frame := b
+		if h.filtering() {
+			frame = h.filterFor(c, m, b)
+		}
+		if c.trySend(frame) {
+			sent++
+		}
+	}
+	return sent
+}
+
+// BroadcastExcept sends m to the others in sender's room, or to every
+// other client of the game when sender is in no room
+func (h *Hub) BroadcastExcept(sender *Client, m Message) {
+	if room := h.RoomOf(sender); room != "" {
+		h.broadcastRoom(room, m, sender)
+		return
+	}
+	h.broadcastGlobal(m, sender)
+}
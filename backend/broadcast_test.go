@@ -0,0 +1,211 @@
+// backend/broadcast_test.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// next waits for the next message queued for c
+func next(t *testing.T, c *Client) Message {
+	t.Helper()
+	select {
+	case b := <-c.send:
+		var m Message
+		if err := json.Unmarshal(b, &m); err != nil {
+			t.Fatalf("%s got invalid JSON %q: %v", c.id, b, err)
+		}
+		return m
+	case <-time.After(time.Second):
+		t.Fatalf("%s got nothing", c.id)
+		return Message{}
+	}
+}
+
+// nothing fails when c has anything queued
+func nothing(t *testing.T, c *Client) {
+	t.Helper()
+	if got := c.drainSend(); len(got) > 0 {
+		t.Fatalf("%s got %q", c.id, got)
+	}
+}
+
+func TestBroadcastGlobal(t *testing.T) {
+	h := newRunningHub()
+	a, b, c := newTestClient(h, "a"), newTestClient(h, "b"), newTestClient(h, "c")
+	h.JoinRoom(a, "r1")
+	h.JoinRoom(b, "r2")
+	h.BroadcastGlobal(Message{Type: "notice", Payload: "one", Room: "r1", Seq: 40})
+	h.BroadcastGlobal(Message{Type: "notice", Payload: "two"})
+	for _, cl := range []*Client{a, b, c} {
+		first, second := next(t, cl), next(t, cl)
+		if first.Payload != "one" || first.Seq != 1 || first.Room != "" {
+			t.Fatalf("%s: first is %+v, want one with global seq 1", cl.id, first)
+		}
+		if second.Payload != "two" || second.Seq != 2 {
+			t.Fatalf("%s: second is %+v, want two with global seq 2", cl.id, second)
+		}
+		if first.ID == "" || first.Ts == 0 {
+			t.Fatalf("%s: message not stamped", cl.id)
+		}
+		nothing(t, cl)
+	}
+}
+
+func TestBroadcastRoom(t *testing.T) {
+	h := newRunningHub()
+	a, b, c, d := newTestClient(h, "a"), newTestClient(h, "b"), newTestClient(h, "c"), newTestClient(h, "d")
+	h.JoinRoom(a, "r1")
+	h.JoinRoom(b, "r1")
+	h.JoinRoom(c, "r2")
+	if n := h.BroadcastRoom("r1", Message{Type: "move", Payload: "e4"}); n != 2 {
+		t.Fatalf("sent to %d, want 2", n)
+	}
+	h.BroadcastRoom("r1", Message{Type: "move", Payload: "e5"})
+	h.BroadcastRoom("r2", Message{Type: "move", Payload: "d4"})
+	for _, cl := range []*Client{a, b} {
+		for seq, want := range []string{"e4", "e5"} {
+			m := next(t, cl)
+			if m.Payload != want || m.Room != "r1" || m.Seq != uint64(seq+1) {
+				t.Fatalf("%s got %+v, want %s in r1 seq %d", cl.id, m, want, seq+1)
+			}
+		}
+		nothing(t, cl)
+	}
+	// each room counts its own seq
+	if m := next(t, c); m.Payload != "d4" || m.Room != "r2" || m.Seq != 1 {
+		t.Fatalf("c got %+v, want d4 in r2 seq 1", m)
+	}
+	nothing(t, c)
+	nothing(t, d)
+	if n := h.BroadcastRoom("nobody", Message{Type: "move"}); n != 0 {
+		t.Fatalf("sent to %d in a room that doesn't exist", n)
+	}
+}
+
+func TestBroadcastExcept(t *testing.T) {
+	h := newRunningHub()
+	a, b, c, out := newTestClient(h, "a"), newTestClient(h, "b"), newTestClient(h, "c"), newTestClient(h, "out")
+	for _, cl := range []*Client{a, b, c} {
+		h.JoinRoom(cl, "r")
+	}
+	h.BroadcastExcept(a, Message{Type: "chat", Payload: "hi"})
+	for _, cl := range []*Client{b, c} {
+		if m := next(t, cl); m.Payload != "hi" || m.Room != "r" || m.Seq != 1 {
+			t.Fatalf("%s got %+v, want hi in r seq 1", cl.id, m)
+		}
+	}
+	// the sender gets a stub for its seq instead of its own message
+	if m := next(t, a); m.Type != "filtered" || m.Room != "r" || m.Seq != 1 || m.Payload != "" {
+		t.Fatalf("sender got %+v, want a filtered stub for r seq 1", m)
+	}
+	nothing(t, out)
+	h.BroadcastRoom("r", Message{Type: "chat", Payload: "next"})
+	for _, cl := range []*Client{a, b, c} {
+		if m := next(t, cl); m.Payload != "next" || m.Seq != 2 {
+			t.Fatalf("%s got %+v, want next with seq 2", cl.id, m)
+		}
+		nothing(t, cl)
+	}
+}
+
+func TestBroadcastExceptWithoutRoom(t *testing.T) {
+	h := newRunningHub()
+	a, b, c := newTestClient(h, "a"), newTestClient(h, "b"), newTestClient(h, "c")
+	h.BroadcastExcept(a, Message{Type: "chat", Payload: "hi"})
+	h.BroadcastGlobal(Message{Type: "chat", Payload: "all"})
+	for _, cl := range []*Client{b, c} {
+		if m := next(t, cl); m.Payload != "hi" || m.Seq != 1 || m.Room != "" {
+			t.Fatalf("%s got %+v, want hi with global seq 1", cl.id, m)
+		}
+		if m := next(t, cl); m.Payload != "all" || m.Seq != 2 {
+			t.Fatalf("%s got %+v, want all with global seq 2", cl.id, m)
+		}
+	}
+	// the hub handles broadcasts in order, so a has had its chance at hi
+	if m := next(t, a); m.Payload != "all" || m.Seq != 2 {
+		t.Fatalf("sender got %+v, want only all with global seq 2", m)
+	}
+	nothing(t, a)
+}
+
+// roomOf registers n clients of h in room, logged in as their client ids,
+// each with a goroutine reading its queue like a write pump; stop
+// unregisters them
+func roomOf(h *Hub, room string, n int) (stop func()) {
+	clients := make([]*Client, n)
+	for i := range clients {
+		id := fmt.Sprintf("%s-%d", room, i)
+		clients[i] = newTestUser(h, id, id)
+		drain(clients[i])
+		h.JoinRoom(clients[i], room)
+	}
+	return func() {
+		for _, c := range clients {
+			h.unregister <- c
+		}
+	}
+}
+
+// BenchmarkBroadcastRoom1k broadcasts to one room of 1000 members; the
+// message is encoded once per broadcast, so allocs/op doesn't grow with
+// the room
+func BenchmarkBroadcastRoom1k(b *testing.B) {
+	h := newRunningHub()
+	defer roomOf(h, "r", 1000)()
+	m := Message{Type: "move", Payload: "e4", Data: json.RawMessage(`{"x":3,"y":4}`)}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.BroadcastRoom("r", m)
+	}
+}
+
+// BenchmarkBroadcastRooms1k broadcasts from parallel goroutines to eight
+// rooms of 1000 members; each room has its own lock, so they contend only
+// on the hub's read lock
+func BenchmarkBroadcastRooms1k(b *testing.B) {
+	h := newRunningHub()
+	const rooms = 8
+	for r := 0; r < rooms; r++ {
+		defer roomOf(h, fmt.Sprint("r", r), 1000)()
+	}
+	m := Message{Type: "move", Payload: "e4", Data: json.RawMessage(`{"x":3,"y":4}`)}
+	var picked atomic.Int32
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		room := fmt.Sprint("r", picked.Add(1)%rooms)
+		for pb.Next() {
+			h.BroadcastRoom(room, m)
+		}
+	})
+}
+
+// BenchmarkBroadcastRoom1kBlocking is BenchmarkBroadcastRoom1k with the
+// friends filter installed: ten members block the sender
+func BenchmarkBroadcastRoom1kBlocking(b *testing.B) {
+	users, err := NewFileUserStore(filepath.Join(b.TempDir(), "users.json"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	f := NewFriends(users, nil)
+	h := newRunningHub()
+	f.AddHub(h)
+	defer roomOf(h, "r", 1000)()
+	for i := 1; i <= 10; i++ {
+		if err := f.Block(fmt.Sprint("r-", i), "r-0", true); err != nil {
+			b.Fatal(err)
+		}
+	}
+	m := Message{Type: "move", Sender: "r-0", Payload: "e4", Data: json.RawMessage(`{"x":3,"y":4}`)}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.BroadcastRoom("r", m)
+	}
+}
@@ -0,0 +1,344 @@
+// backend/cache.go
+package main
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+)
+
+/*
+Read-through caches in front of the stores. After a restart or a network
+blip every client reconnects at once, rejoins its room and asks for
+history.get; without a cache that is one database query per client for
+the same few rooms. With the "cache" config block
+
+	"cache": {"historyRooms": 1000, "users": 10000}
+
+the newest history page (50 messages) of up to historyRooms rooms and up
+to users user records are kept in memory, least recently used first out.
+Concurrent misses on the same key wait for a single store query. Appends
+update cached rooms in place; deletes, anonymization and profile writes
+invalidate. Both default to the sizes above; -1 turns a cache off.
+Hits, misses and sizes are exported as cache_* metrics, labelled by cache.
+*/
+
+// CacheConfig is the "cache" config block
+type CacheConfig struct {
+	HistoryRooms int `json:"historyRooms,omitempty"` // rooms per game, default 1000, -1 = off
+	Users        int `json:"users,omitempty"`        // default 10000, -1 = off
+}
+
+func (cfg CacheConfig) withDefaults() CacheConfig {
+	if cfg.HistoryRooms == 0 {
+		cfg.HistoryRooms = 1000
+	}
+	if cfg.Users == 0 {
+		cfg.Users = 10000
+	}
+	return cfg
+}
+
+// lruEntry is a cached value, or one being loaded until ready closes
+type lruEntry struct {
+	key   string
+	val   interface{}
+	err   error
+	ready chan struct{}
+	stale bool // changed while loading; don't keep the result
+}
+
+// lruCache maps string keys to values, evicting the least recently used
+type lruCache struct {
+	name string
+	max  int
+
+	mu    sync.Mutex
+	order *list.List // of *lruEntry, most recent first
+	items map[string]*list.Element
+
+	hits, misses Counter
+}
+
+func newLRUCache(name string, max int) *lruCache {
+	return &lruCache{name: name, max: max, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+// get returns the value for key, calling load on a miss. Callers that
+// miss together share one load.
+func (l *lruCache) get(key string, load func() (interface{}, error)) (interface{}, error) {
+	l.mu.Lock()
+	if el, ok := l.items[key]; ok {
+		l.order.MoveToFront(el)
+		l.mu.Unlock()
+		l.hits.Inc()
+		e := el.Value.(*lruEntry)
+		<-e.ready
+		return e.val, e.err
+	}
+	e := &lruEntry{key: key, ready: make(chan struct{})}
+	el := l.order.PushFront(e)
+	l.items[key] = el
+	l.mu.Unlock()
+	l.misses.Inc()
+
+	v, err := load()
+	l.mu.Lock()
+	e.val, e.err = v, err
+	close(e.ready)
+	if err != nil || e.stale {
+		l.removeLocked(el)
+	}
+	for l.order.Len() > l.max {
+		l.removeLocked(l.order.Back())
+	}
+	l.mu.Unlock()
+	return v, err
+}
+
+// update replaces the cached value for key with fn(value); keys that
+// aren't cached are left alone
+func (l *lruCache) update(key string, fn func(v interface{}) interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	el, ok := l.items[key]
+	if !ok {
+		return
+	}
+	e := el.Value.(*lruEntry)
+	select {
+	case <-e.ready:
+		if e.err == nil {
+			e.val = fn(e.val)
+		}
+	default:
+		e.stale = true
+		l.removeLocked(el)
+	}
+}
+
+// invalidate drops key
+func (l *lruCache) invalidate(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if el, ok := l.items[key]; ok {
+		el.Value.(*lruEntry).stale = true
+		l.removeLocked(el)
+	}
+}
+
+// purge drops everything
+func (l *lruCache) purge() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, el := range l.items {
+		el.Value.(*lruEntry).stale = true
+	}
+	l.order.Init()
+	l.items = make(map[string]*list.Element)
+}
+
+// removeLocked drops el if it is still the entry for its key
+func (l *lruCache) removeLocked(el *list.Element) {
+	e := el.Value.(*lruEntry)
+	if l.items[e.key] == el {
+		delete(l.items, e.key)
+		l.order.Remove(el)
+	}
+}
+
+func (l *lruCache) len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.order.Len()
+}
+
+// Caches keeps the caches created from one config, for metrics
+type Caches struct {
+	cfg CacheConfig
+
+	mu  sync.Mutex
+	all []*lruCache
+}
+
+func NewCaches(cfg CacheConfig) *Caches { return &Caches{cfg: cfg.withDefaults()} }
+
+func (cs *Caches) add(name string, max int) *lruCache {
+	l := newLRUCache(name, max)
+	cs.mu.Lock()
+	cs.all = append(cs.all, l)
+	cs.mu.Unlock()
+	return l
+}
+
+// History wraps the history store of game in a cache (if enabled)
+func (cs *Caches) History(game string, store HistoryStore) HistoryStore {
+	if store == nil || cs.cfg.HistoryRooms < 0 {
+		return store
+	}
+	return &CachedHistoryStore{HistoryStore: store, rooms: cs.add("history:"+game, cs.cfg.HistoryRooms)}
+}
+
+// Users wraps a user store in a cache (if enabled)
+func (cs *Caches) Users(store UserStore) UserStore {
+	if cs.cfg.Users < 0 {
+		return store
+	}
+	return &CachedUserStore{UserStore: store, users: cs.add("users", cs.cfg.Users)}
+}
+
+// Register exports hit, miss and size counts on m
+func (cs *Caches) Register(m *Metrics) {
+	samples := func(fn func(l *lruCache) float64) func() []Sample {
+		return func() []Sample {
+			cs.mu.Lock()
+			defer cs.mu.Unlock()
+			out := make([]Sample, 0, len(cs.all))
+			for _, l := range cs.all {
+				out = append(out, Sample{Labels: `cache="` + l.name + `"`, Value: fn(l)})
+			}
+			sort.Slice(out, func(i, j int) bool { return out[i].Labels < out[j].Labels })
+			return out
+		}
+	}
+	m.Register("cache_hits_total", "lookups answered from a cache", "counter", samples(func(l *lruCache) float64 { return float64(l.hits.Value()) }))
+	m.Register("cache_misses_total", "lookups that went to the store", "counter", samples(func(l *lruCache) float64 { return float64(l.misses.Value()) }))
+	m.Register("cache_hit_ratio", "hits / lookups since start", "gauge", samples(func(l *lruCache) float64 {
+		hits, total := l.hits.Value(), l.hits.Value()+l.misses.Value()
+		if total == 0 {
+			return 0
+		}
+		return float64(hits) / float64(total)
+	}))
+	m.Register("cache_entries", "entries held by a cache", "gauge", samples(func(l *lruCache) float64 { return float64(l.len()) }))
+}
+
+// CachedHistoryStore keeps the newest historyPageSize messages of recently
+// read rooms in memory
+type CachedHistoryStore struct {
+	HistoryStore
+	rooms *lruCache // room -> []StoredMessage, oldest first
+}
+
+// cacheable reports whether f is a plain "newest n of a room" query
+func (s *CachedHistoryStore) cacheable(f HistoryFilter) bool {
+	return f.Room != "" && f.UserID == "" && f.Since.IsZero() && f.Until.IsZero() && f.Limit > 0 && f.Limit <= historyPageSize
+}
+
+func (s *CachedHistoryStore) Query(f HistoryFilter) ([]StoredMessage, error) {
+	if !s.cacheable(f) {
+		return s.HistoryStore.Query(f)
+	}
+	v, err := s.rooms.get(f.Room, func() (interface{}, error) {
+		return s.HistoryStore.Query(HistoryFilter{Room: f.Room, Limit: historyPageSize})
+	})
+	if err != nil {
+		return nil, err
+	}
+	msgs := v.([]StoredMessage)
+	if len(msgs) > f.Limit {
+		msgs = msgs[len(msgs)-f.Limit:]
+	}
+	return append([]StoredMessage(nil), msgs...), nil
+}
+
+func (s *CachedHistoryStore) Append(m *StoredMessage) error {
+	if err := s.HistoryStore.Append(m); err != nil {
+		return err
+	}
+	added := *m
+	s.rooms.update(m.Room, func(v interface{}) interface{} {
+		old := v.([]StoredMessage)
+		// a new slice each time: readers may still hold the old one
+		msgs := make([]StoredMessage, 0, len(old)+1)
+		msgs = append(msgs, old...)
+		i := len(msgs)
+		for i > 0 && msgs[i-1].ID > added.ID { // concurrent appends may land out of order
+			i--
+		}
+		msgs = append(msgs, StoredMessage{})
+		copy(msgs[i+1:], msgs[i:])
+		msgs[i] = added
+		if len(msgs) > historyPageSize {
+			msgs = msgs[len(msgs)-historyPageSize:]
+		}
+		return msgs
+	})
+	return nil
+}
+
+func (s *CachedHistoryStore) DeleteOldest(f HistoryFilter, n int) (int, error) {
+	deleted, err := s.HistoryStore.DeleteOldest(f, n)
+	if deleted > 0 || err != nil {
+		if f.Room != "" {
+			s.rooms.invalidate(f.Room)
+		} else {
+			s.rooms.purge()
+		}
+	}
+	return deleted, err
+}
+
+func (s *CachedHistoryStore) Anonymize(userID, alias string) (int, error) {
+	n, err := s.HistoryStore.Anonymize(userID, alias)
+	if n > 0 || err != nil {
+		s.rooms.purge()
+	}
+	return n, err
+}
+
+// Compact compacts the wrapped store when it can; erasure relies on it to
+// drop deleted messages from disk
+func (s *CachedHistoryStore) Compact() error {
+	c, ok := s.HistoryStore.(interface{ Compact() error })
+	if !ok {
+		return nil
+	}
+	err := c.Compact()
+	s.rooms.purge()
+	return err
+}
+
+// CachedUserStore keeps recently read user records in memory
+type CachedUserStore struct {
+	UserStore
+	users *lruCache // id -> *User, nil for unknown ids
+}
+
+func (s *CachedUserStore) Get(id string) (*User, bool) {
+	v, _ := s.users.get(id, func() (interface{}, error) {
+		u, _ := s.UserStore.Get(id)
+		return u, nil
+	})
+	u := v.(*User)
+	if u == nil {
+		return nil, false
+	}
+	cp := *u
+	return &cp, true
+}
+
+func (s *CachedUserStore) Put(u *User) error {
+	err := s.UserStore.Put(u)
+	if err != nil {
+		s.users.invalidate(u.ID)
+		return err
+	}
+	cp := *u
+	s.users.update(u.ID, func(interface{}) interface{} { return &cp })
+	return nil
+}
+
+// BlockLists reads through to the store; nil when it can't list them
+func (s *CachedUserStore) BlockLists() (map[string][]string, error) {
+	if bl, ok := s.UserStore.(blockLister); ok {
+		return bl.BlockLists()
+	}
+	return nil, nil
+}
+
+func (s *CachedUserStore) Delete(id string) (bool, error) {
+	ok, err := s.UserStore.Delete(id)
+	s.users.invalidate(id)
+	return ok, err
+}
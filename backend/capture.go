@@ -0,0 +1,420 @@
+// backend/capture.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+Traffic capture and deterministic replay, for catching protocol
+regressions. With -record capture.jsonl the server appends what clients
+do on /ws, one event per line:
+
+	{"t":0,"kind":"connect","client":"10.0.0.7:51234","user":"alice"}
+	{"t":412,"kind":"message","client":"10.0.0.7:51234","msg":{"type":"room.join","payload":"r1",...}}
+	{"t":530,"kind":"binary","client":"10.0.0.7:51234","data":"AAEC"}
+	{"t":9120,"kind":"disconnect","client":"10.0.0.7:51234"}
+
+(t in milliseconds since the first event). The capture is what the server
+saw after parsing, which is what a replay needs. Events are recorded as
+they are published (EventBus.SubscribeSync), so none are lost under
+load, and written out every captureFlush so the hub never waits for the
+disk. Each run
+starts with a header naming the mode and, for games with a Schema, its
+version, {"kind":"header","game":"draw","schema":3}; replay upgrades
+messages recorded under older versions (see schema.go).
+
+	tictactoe-server -mode draw -replay capture.jsonl [-replay-expect golden.jsonl]
+
+runs the same configuration without listeners: each event is fed in order
+through the game pipeline (middleware included) by a client without a
+connection, and after each one the server is given replaySettle to go
+quiet. Everything the clients received is printed as a transcript, one
+line per message, grouped by step and client, with ids and timestamps
+removed. With -replay-expect the transcript is compared with a previous
+one instead, and the first difference is reported (exit status 1).
+Timing is not reproduced, so timer-driven games replay without their
+timeouts; -simulate runs captures on a virtual clock (see simulate.go).
+*/
+
+// replaySettle is how long the server must stay quiet before the next step
+const replaySettle = 20 * time.Millisecond
+
+// captureFlush is how often recorded events are written to the capture
+const captureFlush = 100 * time.Millisecond
+
+// CaptureEvent is one line of a capture
+type CaptureEvent struct {
+	T      int64    `json:"t"` // ms since the first event
+	Kind   string   `json:"kind"`
+	Client string   `json:"client"`
+	User   string   `json:"user,omitempty"`
+	Name   string   `json:"name,omitempty"`
+	Msg    *Message `json:"msg,omitempty"`
+	Data   []byte   `json:"data,omitempty"`   // binary frames
+	Game   string   `json:"game,omitempty"`   // header: game mode
+	Schema int      `json:"schema,omitempty"` // header: game schema version
+	Seed   int64    `json:"seed,omitempty"`   // header: math/rand seed of a simulation
+}
+
+// StartRecording appends hub's client traffic to path until the process
+// exits, after a header for mode and schema (nil if the game has none)
+func StartRecording(hub *Hub, path, mode string, schema *Schema) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	header := CaptureEvent{Kind: "header", Game: mode}
+	if schema != nil {
+		header.Schema = schema.Version
+	}
+	b, _ := json.Marshal(header)
+	w.Write(append(b, '\n'))
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	var (
+		mu      sync.Mutex
+		start   time.Time
+		pending []byte
+	)
+	go func() {
+		for range time.Tick(captureFlush) {
+			mu.Lock()
+			b := pending
+			pending = nil
+			mu.Unlock()
+			if len(b) == 0 {
+				continue
+			}
+			w.Write(b)
+			if err := w.Flush(); err != nil {
+				log.Println("record:", err)
+			}
+		}
+	}()
+	hub.events.SubscribeSync(func(e Event) {
+		ce := CaptureEvent{Client: e.Client.id}
+		switch e.Kind {
+		case EventClientConnected:
+			ce.Kind, ce.User, ce.Name = "connect", e.Client.userID, e.Client.name
+		case EventClientDisconnected:
+			ce.Kind = "disconnect"
+		case EventMessageReceived:
+			if e.Message.Type == "binary" && e.Payload != nil {
+				ce.Kind, ce.Data = "binary", e.Payload
+			} else {
+				ce.Kind, ce.Msg = "message", e.Message
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		// publishers race, so stamp in file order to keep t from going back
+		now := time.Now()
+		if start.IsZero() {
+			start = now
+		}
+		ce.T = now.Sub(start).Milliseconds()
+		b, _ := json.Marshal(ce)
+		pending = append(append(pending, b...), '\n')
+	}, EventClientConnected, EventClientDisconnected, EventMessageReceived)
+	return nil
+}
+
+// ReadCapture parses a capture file
+func ReadCapture(r io.Reader) ([]CaptureEvent, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 16<<20)
+	var events []CaptureEvent
+	for line := 1; sc.Scan(); line++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var e CaptureEvent
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		events = append(events, e)
+	}
+	return events, sc.Err()
+}
+
+// replayClient is a client without a connection whose output is collected
+type replayClient struct {
+	c    *Client
+	mu   sync.Mutex
+	out  [][]byte
+	done chan struct{}
+}
+
+func newReplayClient(hub *Hub, e CaptureEvent) *replayClient {
+	send, limit := hub.sendBuffers.newSendChan()
+	c := &Client{
+		hub:        hub,
+		send:       send,
+		sendBinary: make(chan []byte, binarySendBuffer),
+		done:       make(chan struct{}),
+		snapReady:  make(chan struct{}, 1),
+		id:         e.Client,
+		userID:     e.User,
+		name:       e.Name,
+		connected:  time.Now(),
+	}
+	if e.User != "" {
+		c.claims = &SessionClaims{Sub: e.User, Name: e.Name}
+	}
+	c.sendLimit.Store(limit)
+	c.locale.Store(defaultLocale)
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	rc := &replayClient{c: c, done: make(chan struct{})}
+	go func() {
+		defer close(rc.done)
+		for {
+			select {
+			case b := <-send:
+				rc.add(b)
+			case <-c.done:
+				for _, b := range c.drainSend() {
+					rc.add(b)
+				}
+				return
+			}
+		}
+	}()
+	return rc
+}
+
+func (rc *replayClient) add(b []byte) {
+	rc.mu.Lock()
+	rc.out = append(rc.out, b)
+	rc.mu.Unlock()
+}
+
+// take returns and clears what rc received, snapshots and binary frames
+// included
+func (rc *replayClient) take() [][]byte {
+	for _, b := range rc.c.takeSnapshots() {
+		rc.add(b)
+	}
+	for {
+		select {
+		case b := <-rc.c.sendBinary:
+			frame, _ := json.Marshal(map[string][]byte{"binary": b})
+			rc.add(frame)
+			continue
+		default:
+		}
+		break
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	out := rc.out
+	rc.out = nil
+	return out
+}
+
+// pending reports whether anything is still queued for rc
+func (rc *replayClient) pending() int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return len(rc.out) + len(rc.c.send) + len(rc.c.sendBinary)
+}
+
+// Replay feeds events through game on hub and writes the transcript to w;
+// messages recorded under an older version of schema (nil = none) are
+// upgraded first
+func Replay(hub *Hub, game Game, schema *Schema, events []CaptureEvent, w io.Writer) error {
+	return replay(hub, game, schema, events, w, nil)
+}
+
+// replay is Replay; with clock, the events' t is virtual time on clock,
+// which must be hub's (see simulate.go)
+func replay(hub *Hub, game Game, schema *Schema, events []CaptureEvent, w io.Writer, clock *SimClock) error {
+	recorded := 1 // captures from before headers
+	clients := make(map[string]*replayClient)
+	all := func() []*replayClient {
+		ids := make([]string, 0, len(clients))
+		for id := range clients {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		out := make([]*replayClient, len(ids))
+		for i, id := range ids {
+			out[i] = clients[id]
+		}
+		return out
+	}
+	settle := func() {
+		last := -1
+		for {
+			n := len(hub.broadcast)
+			for _, rc := range clients {
+				n += rc.pending()
+			}
+			if n == last && len(hub.broadcast) == 0 {
+				return
+			}
+			last = n
+			time.Sleep(replaySettle)
+		}
+	}
+	flush := func(step int) {
+		for _, rc := range all() {
+			for _, b := range rc.take() {
+				if clock != nil {
+					fmt.Fprintf(w, "%d %d %s %s\n", step, clock.elapsed(), rc.c.id, normalizeReplayed(b))
+				} else {
+					fmt.Fprintf(w, "%d %s %s\n", step, rc.c.id, normalizeReplayed(b))
+				}
+			}
+		}
+	}
+	last := 0 // the step before, for timer output
+	for step, e := range events {
+		if clock != nil && e.Kind != "header" {
+			at := SimEpoch.Add(time.Duration(e.T) * time.Millisecond)
+			if at.Before(clock.Now()) {
+				return fmt.Errorf("step %d: t %d is before the previous event", step, e.T)
+			}
+			clock.AdvanceTo(at, func() {
+				settle()
+				flush(last)
+			})
+		}
+		rc := clients[e.Client]
+		switch e.Kind {
+		case "header":
+			recorded = e.Schema
+			if recorded == 0 {
+				recorded = 1
+			}
+			if clock != nil {
+				rand.Seed(e.Seed)
+			}
+			continue
+		case "wait":
+			continue
+		case "connect":
+			if rc != nil {
+				return fmt.Errorf("step %d: %s connected twice", step, e.Client)
+			}
+			rc = newReplayClient(hub, e)
+			clients[e.Client] = rc
+			hub.Register(rc.c)
+			game.OnConnect(rc.c)
+		case "message", "binary", "disconnect":
+			if rc == nil {
+				return fmt.Errorf("step %d: %s %s before connecting", step, e.Client, e.Kind)
+			}
+			switch {
+			case e.Kind == "disconnect":
+				hub.unregister <- rc.c
+				rc.c.cancel()
+				game.OnDisconnect(rc.c)
+			case e.Kind == "binary":
+				game.OnBinaryMessage(rc.c, e.Data)
+			case e.Msg != nil:
+				m := *e.Msg
+				m.Room, m.ID, m.Ts, m.Seq = "", "", 0, 0
+				m.stamp()
+				if schema != nil {
+					var err error
+					if m, err = schema.UpgradeMessage(recorded, m); err != nil {
+						return fmt.Errorf("step %d: %v", step, err)
+					}
+				}
+				game.OnMessage(rc.c, m)
+			}
+		default:
+			return fmt.Errorf("step %d: unknown kind %q", step, e.Kind)
+		}
+		settle()
+		flush(step)
+		last = step
+		if e.Kind == "disconnect" {
+			<-rc.done
+			delete(clients, e.Client)
+		}
+	}
+	return nil
+}
+
+// normalizeReplayed strips what differs between runs from an outbound frame
+func normalizeReplayed(b []byte) []byte {
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return b
+	}
+	delete(m, "id")
+	delete(m, "ts")
+	if data, ok := m["data"].(map[string]interface{}); ok && m["type"] == "inbox" {
+		delete(data, "time") // stamped by the inbox, not the game
+	}
+	out, _ := json.Marshal(m)
+	return out
+}
+
+// runReplay replays capture through game and prints or checks the
+// transcript; it returns the process exit status. With clock the capture
+// is a simulation scenario run on it.
+func runReplay(hub *Hub, game Game, schema *Schema, capture, expect string, clock *SimClock) int {
+	name := "replay"
+	if clock != nil {
+		name = "simulate"
+		hub.timers.clock = clock
+	}
+	f, err := os.Open(capture)
+	if err != nil {
+		log.Printf("%s: %v", name, err)
+		return 2
+	}
+	events, err := ReadCapture(f)
+	f.Close()
+	if err != nil {
+		log.Printf("%s: %s: %v", name, capture, err)
+		return 2
+	}
+	var got bytes.Buffer
+	if err := replay(hub, game, schema, events, &got, clock); err != nil {
+		log.Printf("%s: %v", name, err)
+		return 2
+	}
+	if expect == "" {
+		os.Stdout.Write(got.Bytes())
+		return 0
+	}
+	want, err := os.ReadFile(expect)
+	if err != nil {
+		log.Printf("%s: %v", name, err)
+		return 2
+	}
+	gotLines, wantLines := bytes.Split(got.Bytes(), []byte("\n")), bytes.Split(want, []byte("\n"))
+	for i := 0; i < len(gotLines) || i < len(wantLines); i++ {
+		var g, w []byte
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if !bytes.Equal(g, w) {
+			fmt.Printf("%s: transcript differs at line %d\n  want: %s\n  got:  %s\n", name, i+1, w, g)
+			return 1
+		}
+	}
+	log.Printf("%s: %d events, transcript matches %s", name, len(events), expect)
+	return 0
+}
@@ -0,0 +1,56 @@
+// backend/capture_test.go
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestRecordingKeepsEverything records a burst far bigger than an event
+// bus queue; every event must reach the capture, in order
+func TestRecordingKeepsEverything(t *testing.T) {
+	h := newRunningHub()
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	if err := StartRecording(h, path, "chat", nil); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(h, "a")
+	const burst = 10 * subscriberQueueSize
+	for i := 0; i < burst; i++ {
+		h.events.Publish(Event{Kind: EventMessageReceived, Client: c, Message: &Message{Type: "chat", Payload: fmt.Sprint(i)}})
+	}
+	h.unregister <- c
+	var events []CaptureEvent
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(captureFlush) {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		events, err = ReadCapture(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) == burst+3 {
+			break
+		}
+	}
+	// header, connect, the burst, disconnect
+	if len(events) != burst+3 {
+		t.Fatalf("capture has %d events, want %d", len(events), burst+3)
+	}
+	if events[0].Kind != "header" || events[1].Kind != "connect" || events[burst+2].Kind != "disconnect" {
+		t.Fatalf("capture starts %s, %s and ends %s", events[0].Kind, events[1].Kind, events[burst+2].Kind)
+	}
+	for i, e := range events[2 : burst+2] {
+		if e.Msg == nil || e.Msg.Payload != fmt.Sprint(i) {
+			t.Fatalf("event %d is %+v, want message %d", i+2, e, i)
+		}
+		if e.T < events[i+1].T {
+			t.Fatalf("event %d goes back in time", i+2)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// backend/chaos.go
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Chaos mode injects failures on the outbound path so client reconnection and
+state-recovery logic can be exercised against a misbehaving server:
+
+	-chaos="latency=200ms,jitter=100ms,drop=0.05,sever=0.001"
+
+latency/jitter delay every outbound message, drop discards that fraction of
+messages and sever abruptly closes the connection (no close frame) with
+that probability per message. Never enable this in production.
+*/
+
+// Chaos holds the failure-injection settings
+type Chaos struct {
+	Latency time.Duration
+	Jitter  time.Duration
+	Drop    float64
+	Sever   float64
+}
+
+type chaosAction int
+
+const (
+	chaosDeliver chaosAction = iota
+	chaosDrop
+	chaosSever
+)
+
+// ParseChaos parses a comma-separated key=value spec; "" returns nil (disabled)
+func ParseChaos(spec string) (*Chaos, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	ch := &Chaos{}
+	for _, kv := range strings.Split(spec, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok {
+			return nil, fmt.Errorf("chaos: expected key=value, got %q", kv)
+		}
+		var err error
+		switch k {
+		case "latency":
+			ch.Latency, err = time.ParseDuration(v)
+		case "jitter":
+			ch.Jitter, err = time.ParseDuration(v)
+		case "drop":
+			ch.Drop, err = parseProbability(v)
+		case "sever":
+			ch.Sever, err = parseProbability(v)
+		default:
+			return nil, fmt.Errorf("chaos: unknown key %q", k)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("chaos: %s: %v", k, err)
+		}
+	}
+	return ch, nil
+}
+
+func parseProbability(v string) (float64, error) {
+	p, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, err
+	}
+	if p < 0 || p > 1 {
+		return 0, fmt.Errorf("must be between 0 and 1, got %g", p)
+	}
+	return p, nil
+}
+
+func (ch *Chaos) String() string {
+	return fmt.Sprintf("latency=%s jitter=%s drop=%g sever=%g", ch.Latency, ch.Jitter, ch.Drop, ch.Sever)
+}
+
+// outbound delays the caller (the client's writePump) and decides the fate
+// of one outbound message
+func (ch *Chaos) outbound() chaosAction {
+	d := ch.Latency
+	if ch.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(ch.Jitter)))
+	}
+	if d > 0 {
+		time.Sleep(d)
+	}
+	switch r := rand.Float64(); {
+	case r < ch.Sever:
+		return chaosSever
+	case r < ch.Sever+ch.Drop:
+		return chaosDrop
+	}
+	return chaosDeliver
+}
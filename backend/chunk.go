@@ -0,0 +1,182 @@
+// backend/chunk.go
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+/*
+Chunked transfer of large server messages (history pages, canvas and game
+snapshots). A client that can't take big frames says so in its hello:
+
+	{"type":"hello","data":{"maxMessageSize":4096}}
+
+From then on any message sent with sendLarge that is longer than that
+arrives as a series of frames no longer than the limit:
+
+	{"type":"chunk","sender":"server","payload":"<base64>","data":{"id":3,"seq":0,"total":9,"size":30211}}
+
+The client base64-decodes and concatenates the payloads of one id in seq
+order; the result is the original message's JSON. It acknowledges what it
+has (seq is cumulative, i.e. "everything up to seq"):
+
+	{"type":"chunk.ack","data":{"id":3,"seq":3}}
+
+The server keeps at most chunkWindow unacknowledged chunks in flight per
+transfer, so one big state can't fill the send queue ahead of live
+traffic. Transfers nobody acknowledges for chunkAckTimeout are dropped; the
+client re-requests the data if it still wants it. Clients that never send
+maxMessageSize get whole messages as before.
+*/
+
+const (
+	chunkWindow     = 4
+	chunkAckTimeout = 30 * time.Second
+	chunkMinFrame   = 256 // smallest maxMessageSize a client may ask for
+)
+
+type chunkInfo struct {
+	ID    uint32 `json:"id"`
+	Seq   int    `json:"seq"`
+	Total int    `json:"total"`
+	Size  int    `json:"size"`
+}
+
+type transfer struct {
+	chunks [][]byte // encoded chunk frames
+	next   int      // first chunk not yet queued
+	acked  int      // chunks acknowledged
+	active time.Time
+}
+
+// chunkedTransfers is a client's outgoing transfers
+type chunkedTransfers struct {
+	mu     sync.Mutex
+	nextID uint32
+	active map[uint32]*transfer
+}
+
+// setMaxFrame records the largest frame c accepts (0 = no limit)
+func (c *Client) setMaxFrame(n int) {
+	if n > 0 && n < chunkMinFrame {
+		n = chunkMinFrame
+	}
+	c.maxFrame.Store(int32(n))
+}
+
+// sendLarge queues msg for c, split into chunks if it exceeds the frame
+// size c asked for
+func (c *Client) sendLarge(msg []byte) {
+	limit := int(c.maxFrame.Load())
+	if limit == 0 || len(msg) <= limit {
+		c.Send(msg)
+		return
+	}
+	id := c.chunks.newID()
+	t := &transfer{chunks: splitChunks(msg, limit, id), active: time.Now()}
+	c.chunks.mu.Lock()
+	if c.chunks.active == nil {
+		c.chunks.active = make(map[uint32]*transfer)
+	}
+	for stale, old := range c.chunks.active {
+		if time.Since(old.active) > chunkAckTimeout {
+			delete(c.chunks.active, stale)
+		}
+	}
+	c.chunks.active[id] = t
+	out := t.fillLocked()
+	c.chunks.mu.Unlock()
+	for _, b := range out {
+		c.Send(b)
+	}
+}
+
+func (ct *chunkedTransfers) newID() uint32 {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.nextID++
+	return ct.nextID
+}
+
+// fillLocked returns the chunks that fit in the window; requires the mutex
+func (t *transfer) fillLocked() [][]byte {
+	var out [][]byte
+	for t.next < len(t.chunks) && t.next < t.acked+chunkWindow {
+		out = append(out, t.chunks[t.next])
+		t.next++
+	}
+	return out
+}
+
+// ack records that the client has chunks 0..seq of transfer id and queues
+// the next ones
+func (c *Client) ack(id uint32, seq int) {
+	c.chunks.mu.Lock()
+	t := c.chunks.active[id]
+	if t == nil || seq < t.acked || seq >= t.next {
+		c.chunks.mu.Unlock()
+		return
+	}
+	t.acked = seq + 1
+	t.active = time.Now()
+	out := t.fillLocked()
+	if t.acked == len(t.chunks) {
+		delete(c.chunks.active, id)
+	}
+	c.chunks.mu.Unlock()
+	for _, b := range out {
+		c.Send(b)
+	}
+}
+
+// splitChunks encodes msg as chunk frames of at most limit bytes each
+func splitChunks(msg []byte, limit int, id uint32) [][]byte {
+	// envelope size with the widest numbers this transfer can have
+	empty, _ := json.Marshal(Message{Type: "chunk", Sender: "server", Payload: "x",
+		Data: chunkData(chunkInfo{ID: id, Seq: len(msg), Total: len(msg), Size: len(msg)})})
+	per := (limit - len(empty) + 1) / 4 * 3 // raw bytes whose base64 fits
+	if per < 3 {
+		per = 3
+	}
+	total := (len(msg) + per - 1) / per
+	chunks := make([][]byte, 0, total)
+	for seq := 0; seq < total; seq++ {
+		part := msg[seq*per:]
+		if len(part) > per {
+			part = part[:per]
+		}
+		b, _ := json.Marshal(Message{Type: "chunk", Sender: "server", Payload: base64.StdEncoding.EncodeToString(part),
+			Data: chunkData(chunkInfo{ID: id, Seq: seq, Total: total, Size: len(msg)})})
+		chunks = append(chunks, b)
+	}
+	return chunks
+}
+
+func chunkData(info chunkInfo) json.RawMessage {
+	b, _ := json.Marshal(info)
+	return b
+}
+
+// TransferMiddleware handles chunk.ack
+func TransferMiddleware() Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(c *Client, m Message) {
+			if m.Type != "chunk.ack" {
+				next(c, m)
+				return
+			}
+			var req struct {
+				ID  uint32 `json:"id"`
+				Seq int    `json:"seq"`
+			}
+			if err := json.Unmarshal(m.Data, &req); err != nil {
+				sendError(c, "bad_data", m.Type, err.Error())
+				return
+			}
+			c.ack(req.ID, req.Seq)
+		}
+	}
+}
@@ -0,0 +1,360 @@
+// backend/client/client.go
+
+/*
+Package client is a Go client for the server's WebSocket protocol. It
+keeps the connection up by itself: when it drops, the client dials again
+with backoff, joins its room again and reconciles with sync.request, so
+the application sees every room message once and in seq order, or a
+sync.response saying it has to take a fresh snapshot:
+
+	c, err := client.Dial(ctx, client.Options{URL: "ws://localhost:8080/ws", Token: token})
+	if err != nil { ... }
+	c.Join("r1")
+	c.Send(client.Message{Type: "message", Payload: "hi"})
+	for m := range c.Messages() {
+		if m.Type == "sync.response" { ... status snapshot/reset: reload ... }
+		if e, ok := client.AsError(m); ok && e.RetryAfter > 0 { ... resend after e.RetryAfter ... }
+	}
+
+A gap in a room's seq while connected (a message the server dropped for
+a full send buffer) is repaired the same way. Messages sent while the
+connection is down fail with ErrNotConnected; nothing is queued.
+*/
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrNotConnected is returned by Send while the client is reconnecting
+var ErrNotConnected = errors.New("client: not connected")
+
+// ErrClosed is returned once Close has been called
+var ErrClosed = errors.New("client: closed")
+
+// Message is the server's message envelope
+type Message struct {
+	Type           string          `json:"type"`
+	Sender         string          `json:"sender,omitempty"`
+	Payload        string          `json:"payload,omitempty"`
+	Data           json.RawMessage `json:"data,omitempty"`
+	IdempotencyKey string          `json:"idempotencyKey,omitempty"`
+	Code           string          `json:"code,omitempty"`
+	Room           string          `json:"room,omitempty"`
+	ID             string          `json:"id,omitempty"`
+	Ts             int64           `json:"ts,omitempty"`
+	Seq            uint64          `json:"seq,omitempty"`
+}
+
+// Error is an "error" message from the server
+type Error struct {
+	Code       string          // stable id, e.g. "ratelimit.exceeded"
+	Status     int             // class after HTTP: 400, 401, 403, 404, 409, 413, 422, 429, 500 or 503
+	Text       string          // human-readable, in the connection's locale
+	RetryAfter time.Duration   // set when the same message will be accepted after waiting this long
+	Details    json.RawMessage // the error's arguments, for some codes
+}
+
+func (e *Error) Error() string { return e.Text }
+
+// Temporary reports whether sending the same message again later can succeed
+func (e *Error) Temporary() bool { return e.Status == 429 || e.Status == 503 || e.RetryAfter > 0 }
+
+// AsError returns m as an *Error if it is an "error" message
+func AsError(m Message) (*Error, bool) {
+	if m.Type != "error" {
+		return nil, false
+	}
+	var data struct {
+		Status     int             `json:"status"`
+		RetryAfter int64           `json:"retryAfterMs"`
+		Details    json.RawMessage `json:"details"`
+	}
+	json.Unmarshal(m.Data, &data)
+	if data.Status == 0 {
+		data.Status = 400
+	}
+	return &Error{Code: m.Code, Status: data.Status, Text: m.Payload, RetryAfter: time.Duration(data.RetryAfter) * time.Millisecond, Details: data.Details}, true
+}
+
+// SyncResult is one room of a sync.response
+type SyncResult struct {
+	Status string `json:"status"` // current | replay | snapshot | reset | not_member
+	Seq    uint64 `json:"seq,omitempty"`
+	Missed int    `json:"missed,omitempty"`
+}
+
+// Options configure Dial
+type Options struct {
+	URL        string
+	Token      string      // session token, sent as a bearer token
+	Header     http.Header // more handshake headers
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	Dialer     *websocket.Dialer // default websocket.DefaultDialer
+}
+
+// Client is a self-reconnecting connection
+type Client struct {
+	opts Options
+	in   chan Message
+	done chan struct{}
+
+	mu      sync.Mutex // guards the fields below and writes to conn
+	conn    *websocket.Conn
+	room    string
+	tags    map[string]string // set with SetTags, sent again after reconnects
+	seq     map[string]uint64 // last seq delivered per room; absent = none yet
+	syncing bool              // a sync.request is outstanding
+	closed  bool
+}
+
+// Dial connects to opts.URL and keeps the connection up until Close
+func Dial(ctx context.Context, opts Options) (*Client, error) {
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = 500 * time.Millisecond
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = 30 * time.Second
+	}
+	if opts.Dialer == nil {
+		opts.Dialer = websocket.DefaultDialer
+	}
+	c := &Client{opts: opts, in: make(chan Message, 256), done: make(chan struct{}), seq: make(map[string]uint64)}
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+	go c.run(conn)
+	return c, nil
+}
+
+func (c *Client) dial(ctx context.Context) (*websocket.Conn, error) {
+	h := http.Header{}
+	for k, v := range c.opts.Header {
+		h[k] = v
+	}
+	if c.opts.Token != "" {
+		h.Set("Authorization", "Bearer "+c.opts.Token)
+	}
+	conn, _, err := c.opts.Dialer.DialContext(ctx, c.opts.URL, h)
+	return conn, err
+}
+
+// Messages delivers what the server sends; it is closed after Close
+func (c *Client) Messages() <-chan Message { return c.in }
+
+// Send sends m
+func (c *Client) Send(m Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writeLocked(m)
+}
+
+func (c *Client) writeLocked(m Message) error {
+	switch {
+	case c.closed:
+		return ErrClosed
+	case c.conn == nil:
+		return ErrNotConnected
+	}
+	return c.conn.WriteJSON(m)
+}
+
+// Join joins room, leaving the current one; the client rejoins it after
+// reconnects
+func (c *Client) Join(room string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.room = room
+	delete(c.seq, room)
+	c.syncing = false
+	return c.writeLocked(Message{Type: "room.join", Payload: room})
+}
+
+// Leave leaves the current room
+func (c *Client) Leave() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.room = ""
+	return c.writeLocked(Message{Type: "room.leave"})
+}
+
+// SetTags sets connection tags the server lets clients set, such as
+// platform; an empty value removes one. The server replies with a "tags"
+// message. The client sets them again after reconnects.
+func (c *Client) SetTags(tags map[string]string) error {
+	data, err := json.Marshal(tags)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tags == nil {
+		c.tags = make(map[string]string)
+	}
+	for k, v := range tags {
+		if v == "" {
+			delete(c.tags, k)
+		} else {
+			c.tags[k] = v
+		}
+	}
+	return c.writeLocked(Message{Type: "tags.set", Data: data})
+}
+
+// Close shuts the connection down for good
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	if c.conn != nil {
+		return c.conn.Close()
+	}
+	return nil
+}
+
+// run reads conn, and its successors, until Close
+func (c *Client) run(conn *websocket.Conn) {
+	defer close(c.in)
+	for {
+		c.read(conn)
+		c.mu.Lock()
+		c.conn = nil
+		closed := c.closed
+		c.mu.Unlock()
+		if closed {
+			return
+		}
+		if conn = c.reconnect(); conn == nil {
+			return
+		}
+	}
+}
+
+// read delivers conn's messages until it fails
+func (c *Client) read(conn *websocket.Conn) {
+	for {
+		_, frame, err := conn.ReadMessage()
+		if err != nil {
+			conn.Close()
+			return
+		}
+		// with write batching one frame holds several messages
+		for _, line := range bytes.Split(frame, []byte{'\n'}) {
+			var m Message
+			if len(line) == 0 || json.Unmarshal(line, &m) != nil {
+				continue
+			}
+			if !c.accept(m) {
+				continue
+			}
+			select {
+			case c.in <- m:
+			case <-c.done:
+				return
+			}
+		}
+	}
+}
+
+// accept tracks room seqs and reports whether m goes to the application
+func (c *Client) accept(m Message) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if m.Type == "sync.response" {
+		var data struct {
+			Rooms map[string]SyncResult `json:"rooms"`
+		}
+		json.Unmarshal(m.Data, &data)
+		if res, ok := data.Rooms[c.room]; ok {
+			c.syncing = false
+			if res.Status != "replay" && res.Status != "not_member" {
+				c.seq[c.room] = res.Seq
+			}
+		}
+		return true
+	}
+	if m.Room == "" || m.Room != c.room || m.Seq == 0 {
+		return true
+	}
+	last, known := c.seq[m.Room]
+	switch {
+	case c.syncing:
+		// covered by the replay or snapshot on its way
+		return false
+	case known && m.Seq <= last:
+		return false
+	case known && m.Seq > last+1:
+		c.requestSyncLocked()
+		return false
+	}
+	c.seq[m.Room] = m.Seq
+	// a seq that carried something this client isn't shown, such as its
+	// own message in relay mode
+	return m.Type != "filtered"
+}
+
+// requestSyncLocked asks the server to fill the gap after c.seq[c.room]
+func (c *Client) requestSyncLocked() {
+	data, _ := json.Marshal(map[string]interface{}{"rooms": map[string]uint64{c.room: c.seq[c.room]}})
+	if c.writeLocked(Message{Type: "sync.request", Data: data}) == nil {
+		c.syncing = true
+	}
+}
+
+// reconnect dials with backoff until it succeeds, then sets the tags again,
+// rejoins the room and resyncs; nil means the client was closed
+func (c *Client) reconnect() *websocket.Conn {
+	backoff := c.opts.MinBackoff
+	for {
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		select {
+		case <-time.After(wait):
+		case <-c.done:
+			return nil
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		conn, err := c.dial(ctx)
+		cancel()
+		if err != nil {
+			if backoff *= 2; backoff > c.opts.MaxBackoff {
+				backoff = c.opts.MaxBackoff
+			}
+			continue
+		}
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		c.conn, c.syncing = conn, false
+		if len(c.tags) > 0 {
+			data, _ := json.Marshal(c.tags)
+			c.writeLocked(Message{Type: "tags.set", Data: data})
+		}
+		if c.room != "" {
+			c.writeLocked(Message{Type: "room.join", Payload: c.room})
+			if _, known := c.seq[c.room]; known {
+				c.requestSyncLocked()
+			}
+		}
+		c.mu.Unlock()
+		return conn
+	}
+}
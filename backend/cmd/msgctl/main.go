@@ -0,0 +1,327 @@
+// backend/cmd/msgctl/main.go
+
+/*
+msgctl drives a running server through its admin API, for runbooks and
+automation:
+
+	msgctl [-server http://localhost:8080] [-token $ADMIN_TOKEN] [-game /ws] [-json] <command>
+
+	clients                                   connected clients
+	rooms                                     rooms and member counts
+	rooms create <room> -owner <user>         a private room; prints its join code
+	kick <client or user id>                  disconnect, on every game
+	ban <user> [-reason text] [-ttl 24h]      ban and disconnect; no -ttl = permanent
+	unban <user>
+	bans
+	announce [-room r] [-at RFC3339] [-every 1h] <text>
+	drain                                     stop admitting and disconnect everyone
+	resume                                    admit again after a drain
+	events [-kind room.created,...]           follow server events until interrupted
+	stats
+
+-server and -token default to $MSGCTL_SERVER and $ADMIN_TOKEN. Tables go
+to stdout; with -json the API's JSON is printed as is. The exit status is
+0 on success, 1 when the server refuses, 2 on usage errors.
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// errUsage makes main exit with status 2
+var errUsage = errors.New("usage")
+
+// api is one admin API endpoint
+type api struct {
+	server, token, game string
+	raw                 bool // print JSON instead of tables
+	client              *http.Client
+}
+
+func main() {
+	server := os.Getenv("MSGCTL_SERVER")
+	if server == "" {
+		server = "http://localhost:8080"
+	}
+	a := &api{client: &http.Client{Timeout: 30 * time.Second}}
+	flag.StringVar(&a.server, "server", server, "base URL of the server (default $MSGCTL_SERVER)")
+	flag.StringVar(&a.token, "token", os.Getenv("ADMIN_TOKEN"), "admin token (default $ADMIN_TOKEN)")
+	flag.StringVar(&a.game, "game", "/ws", "game the command applies to, where that matters")
+	flag.BoolVar(&a.raw, "json", false, "print JSON instead of tables")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: msgctl [flags] clients|rooms [create]|kick|ban|unban|bans|announce|drain|resume|events|stats ...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	a.server = strings.TrimRight(a.server, "/")
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	err := a.run(flag.Arg(0), flag.Args()[1:])
+	switch {
+	case errors.Is(err, errUsage):
+		flag.Usage()
+		os.Exit(2)
+	case err != nil:
+		fmt.Fprintln(os.Stderr, "msgctl:", err)
+		os.Exit(1)
+	}
+}
+
+func (a *api) run(cmd string, args []string) error {
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	owner := fs.String("owner", "", "rooms create: owner of the room")
+	reason := fs.String("reason", "", "ban: reason shown to the user")
+	ttl := fs.String("ttl", "", "ban: duration, e.g. 24h")
+	room := fs.String("room", "", "announce: room ('' = everyone)")
+	at := fs.String("at", "", "announce: first delivery, RFC 3339 (default now)")
+	every := fs.String("every", "", "announce: repeat interval")
+	kind := fs.String("kind", "", "events: comma-separated event kinds")
+	// flags may come before, between or after the arguments
+	var pos []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return errUsage
+		}
+		if args = fs.Args(); len(args) == 0 {
+			break
+		}
+		pos, args = append(pos, args[0]), args[1:]
+	}
+	args = pos
+	game := "?game=" + url.QueryEscape(a.game)
+	switch {
+	case cmd == "clients":
+		var clients []struct {
+			ID       string `json:"id"`
+			UserID   string `json:"userId"`
+			Room     string `json:"room"`
+			Buffered int    `json:"buffered"`
+			RTT      int64  `json:"rttMs"`
+		}
+		return a.show("GET", "/api/admin/clients"+game, nil, &clients, func(w io.Writer) {
+			fmt.Fprintln(w, "ID\tUSER\tROOM\tQUEUED\tRTT")
+			for _, c := range clients {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%dms\n", c.ID, c.UserID, c.Room, c.Buffered, c.RTT)
+			}
+		})
+	case cmd == "rooms" && len(args) == 0:
+		var rooms []struct {
+			Name    string `json:"name"`
+			Members int    `json:"members"`
+		}
+		return a.show("GET", "/api/admin/rooms"+game, nil, &rooms, func(w io.Writer) {
+			fmt.Fprintln(w, "ROOM\tMEMBERS")
+			for _, r := range rooms {
+				fmt.Fprintf(w, "%s\t%d\n", r.Name, r.Members)
+			}
+		})
+	case cmd == "rooms" && len(args) == 2 && args[0] == "create":
+		if *owner == "" {
+			return errUsage
+		}
+		var out struct{ Room, Code string }
+		return a.show("POST", "/api/admin/rooms"+game, map[string]string{"name": args[1], "owner": *owner}, &out, func(w io.Writer) {
+			fmt.Fprintf(w, "created %s, join code %s\n", out.Room, out.Code)
+		})
+	case cmd == "kick" && len(args) == 1:
+		var out struct{ Kicked int }
+		return a.show("DELETE", "/api/admin/clients/"+url.PathEscape(args[0]), nil, &out, func(w io.Writer) {
+			fmt.Fprintf(w, "kicked %d connection(s)\n", out.Kicked)
+		})
+	case cmd == "ban" && len(args) == 1:
+		var out struct{ Kicked int }
+		body := map[string]string{"user": args[0], "reason": *reason}
+		if *ttl != "" {
+			body["ttl"] = *ttl
+		}
+		return a.show("POST", "/api/admin/bans", body, &out, func(w io.Writer) {
+			fmt.Fprintf(w, "banned %s, kicked %d connection(s)\n", args[0], out.Kicked)
+		})
+	case cmd == "unban" && len(args) == 1:
+		return a.show("DELETE", "/api/admin/bans/"+url.PathEscape(args[0]), nil, nil, func(w io.Writer) {
+			fmt.Fprintf(w, "unbanned %s\n", args[0])
+		})
+	case cmd == "bans":
+		var bans []struct {
+			User    string     `json:"user"`
+			Reason  string     `json:"reason"`
+			By      string     `json:"by"`
+			Created time.Time  `json:"created"`
+			Until   *time.Time `json:"until"`
+		}
+		return a.show("GET", "/api/admin/bans", nil, &bans, func(w io.Writer) {
+			fmt.Fprintln(w, "USER\tUNTIL\tBY\tREASON")
+			for _, b := range bans {
+				until := "forever"
+				if b.Until != nil {
+					until = b.Until.Local().Format(time.RFC3339)
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", b.User, until, b.By, b.Reason)
+			}
+		})
+	case cmd == "announce" && len(args) > 0:
+		body := map[string]string{"text": strings.Join(args, " "), "room": *room, "at": *at}
+		if body["at"] == "" {
+			body["at"] = time.Now().UTC().Format(time.RFC3339)
+		}
+		if *every != "" {
+			body["every"] = *every
+		}
+		var out struct{ ID string }
+		return a.show("POST", "/api/admin/announcements", body, &out, func(w io.Writer) {
+			fmt.Fprintf(w, "announcement %s scheduled\n", out.ID)
+		})
+	case cmd == "drain":
+		var out struct{ Disconnected int }
+		return a.show("POST", "/api/admin/drain", nil, &out, func(w io.Writer) {
+			fmt.Fprintf(w, "draining; disconnected %d connection(s)\n", out.Disconnected)
+		})
+	case cmd == "resume":
+		return a.show("DELETE", "/api/admin/drain", nil, nil, func(w io.Writer) {
+			fmt.Fprintln(w, "admitting connections again")
+		})
+	case cmd == "events":
+		q := game
+		if *kind != "" {
+			q += "&kind=" + url.QueryEscape(*kind)
+		}
+		return a.tail("/api/admin/events" + q)
+	case cmd == "stats":
+		var stats map[string]interface{}
+		return a.show("GET", "/api/admin/stats", nil, &stats, func(w io.Writer) {
+			keys := make([]string, 0, len(stats))
+			for k := range stats {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				b, _ := json.Marshal(stats[k])
+				fmt.Fprintf(w, "%s\t%s\n", k, b)
+			}
+		})
+	}
+	return errUsage
+}
+
+// do sends a request with body as JSON and returns the response, which
+// is an error unless it is 2xx
+func (a *api) do(method, path string, body interface{}) (*http.Response, error) {
+	var rd io.Reader
+	if body != nil {
+		b, _ := json.Marshal(body)
+		rd = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, a.server+path, rd)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		var e struct{ Error string }
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if json.Unmarshal(b, &e) != nil || e.Error == "" {
+			e.Error = strings.TrimSpace(string(b))
+		}
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, e.Error)
+	}
+	return resp, nil
+}
+
+// show runs a request and prints its JSON reply, or decodes it into out
+// and lets table print it
+func (a *api) show(method, path string, body, out interface{}, table func(io.Writer)) error {
+	resp, err := a.do(method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if a.raw {
+		if len(b) > 0 {
+			os.Stdout.Write(b)
+			if b[len(b)-1] != '\n' {
+				fmt.Println()
+			}
+		}
+		return nil
+	}
+	if out != nil && len(b) > 0 {
+		if err := json.Unmarshal(b, out); err != nil {
+			return fmt.Errorf("%s %s: %v", method, path, err)
+		}
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	table(tw)
+	return tw.Flush()
+}
+
+// tail prints the event stream at path until it ends
+func (a *api) tail(path string) error {
+	a.client.Timeout = 0
+	resp, err := a.do("GET", path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		if a.raw {
+			fmt.Println(sc.Text())
+			continue
+		}
+		var e struct {
+			Time       time.Time `json:"time"`
+			Kind       string    `json:"kind"`
+			Client     string    `json:"client"`
+			User       string    `json:"user"`
+			Room       string    `json:"room"`
+			Type       string    `json:"type"`
+			Recipients int       `json:"recipients"`
+			Match      int64     `json:"match"`
+		}
+		if json.Unmarshal(sc.Bytes(), &e) != nil {
+			continue
+		}
+		line := e.Time.Local().Format("15:04:05.000") + " " + e.Kind
+		for _, f := range [][2]string{{"client", e.Client}, {"user", e.User}, {"room", e.Room}, {"type", e.Type}} {
+			if f[1] != "" {
+				line += " " + f[0] + "=" + f[1]
+			}
+		}
+		if e.Recipients > 0 {
+			line += fmt.Sprintf(" recipients=%d", e.Recipients)
+		}
+		if e.Match > 0 {
+			line += fmt.Sprintf(" match=%d", e.Match)
+		}
+		fmt.Println(line)
+	}
+	return sc.Err()
+}
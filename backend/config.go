@@ -0,0 +1,113 @@
+// backend/config.go
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// Config is the optional JSON config file passed with -config.
+// Flags cover the basics; the file holds the structured settings.
+type Config struct {
+	// RateLimits maps a message type to its limits; "*" applies to types not listed
+	RateLimits map[string]RateLimit `json:"rateLimits,omitempty"`
+	// AOI configures area-of-interest broadcasting for spatial games
+	AOI AOIConfig `json:"aoi"`
+	// Listeners replaces -addr with one or more TCP/TLS/unix listeners
+	Listeners []ListenerConfig `json:"listeners,omitempty"`
+	// Static sets cache lifetimes and SPA routes of the -static files (see static.go)
+	Static StaticConfig `json:"static"`
+	// History selects which message types are persisted (with -history)
+	History HistoryConfig `json:"history"`
+	// Quotas are the default per-room and per-user history limits
+	Quotas QuotaConfig `json:"quotas"`
+	// Ephemeral configures typing/cursor events that are relayed but never stored
+	Ephemeral EphemeralConfig `json:"ephemeral"`
+	// WriteBatch coalesces queued outbound messages into fewer frames
+	WriteBatch WriteBatchConfig `json:"writeBatch"`
+	// Snapshots lists full-state message types that replace, not queue behind, older ones
+	Snapshots SnapshotConfig `json:"snapshots"`
+	// Keepalive bounds the ping interval and pong timeout clients may negotiate
+	Keepalive KeepaliveConfig `json:"keepalive"`
+	// Bandwidth caps per-client traffic (see bandwidth.go)
+	Bandwidth BandwidthConfig `json:"bandwidth"`
+	// Reconnect limits connection attempts per IP and sets drain retry hints
+	Reconnect ReconnectConfig `json:"reconnect"`
+	// SendBuffer sizes per-client send queues, optionally adaptively
+	SendBuffer SendBufferConfig `json:"sendBuffer"`
+	// AntiCheat configures the built-in cheat detectors
+	AntiCheat AntiCheatConfig `json:"antiCheat"`
+	// Trivia configures -mode=trivia
+	Trivia TriviaConfig `json:"trivia"`
+	// Parties configures party size and matchmaking teams
+	Parties PartyConfig `json:"parties"`
+	// RoomRoles sets which room role each permission needs (see roomroles.go)
+	RoomRoles RoomRolesConfig `json:"roomRoles"`
+	// Judging sets timeouts and retries of deferred verdicts (see judging.go)
+	Judging JudgingConfig `json:"judging"`
+	// Cache sizes the in-memory history and user caches (see cache.go)
+	Cache CacheConfig `json:"cache"`
+	// DeadLetters sizes the dead-letter store and picks what goes there (see deadletter.go)
+	DeadLetters DeadLetterConfig `json:"deadLetters"`
+	// Sync sizes the per-room replay buffer of sync.request (see resync.go)
+	Sync SyncConfig `json:"sync"`
+	// LoadMetrics labels traffic counters by game, room and tenant (see loadmetrics.go)
+	LoadMetrics LoadMetricsConfig `json:"loadMetrics"`
+	// Deprecations announce and retire message types and protocol versions (see deprecation.go)
+	Deprecations []DeprecationRule `json:"deprecations,omitempty"`
+	// Tags sets which connection tags clients may set themselves (see tags.go)
+	Tags TagsConfig `json:"tags"`
+	// Reports sets the moderation room and moderators of abuse reports (see reports.go)
+	Reports ReportConfig `json:"reports"`
+	// Routes send messages to rooms, webhooks or the event bus by rule (see routing.go)
+	Routes []RouteRule `json:"routes,omitempty"`
+	// Features sets feature flags per room, tenant, game or globally (see features.go)
+	Features map[string]FeatureFlag `json:"features,omitempty"`
+	// Services maps service account names to the bearer tokens they use
+	// to inject room messages over HTTP
+	Services map[string]string `json:"services,omitempty"`
+	// Federation exchanges direct messages with other servers (see federation.go)
+	Federation FederationConfig `json:"federation"`
+	// Uplinks maps the names of edge nodes that may register here to their
+	// tokens (see uplink.go)
+	Uplinks map[string]string `json:"uplinks,omitempty"`
+	// Games mounts more games, each with its own hub, next to the -mode game on /ws
+	Games []GameMount `json:"games,omitempty"`
+}
+
+// LoadConfig reads path; an empty path yields the zero config
+func LoadConfig(path string) (*Config, error) {
+	cfg := &Config{}
+	if path == "" {
+		return cfg, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Duration is a time.Duration that reads and writes JSON as "90s", "5m", ...
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
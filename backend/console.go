@@ -0,0 +1,179 @@
+// backend/console.go
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+Operator console. Enabled with -console (reads stdin) and/or
+-console-socket=/run/gows.sock (connect with `nc -U` or `socat - UNIX:...`).
+
+	clients             list connected clients
+	rooms               list rooms and member counts
+	kick <id>           disconnect a client (client id or user id)
+	broadcast <text>    send a system message to everyone
+	forget <user> [anonymize]  erase a user's stored data (see erasure.go)
+	stats               server counters
+*/
+
+// Console executes operator commands against the hub
+type Console struct {
+	hub        *Hub
+	audit      *AuditLog
+	eraser     *Eraser // nil disables forget
+	started    time.Time
+	received   atomic.Int64
+	broadcasts atomic.Int64
+}
+
+func NewConsole(hub *Hub) *Console {
+	c := &Console{hub: hub, started: time.Now()}
+	hub.events.Subscribe(func(e Event) {
+		switch e.Kind {
+		case EventMessageReceived:
+			c.received.Add(1)
+		case EventBroadcastSent:
+			c.broadcasts.Add(1)
+		}
+	}, EventMessageReceived, EventBroadcastSent)
+	return c
+}
+
+// Serve runs a read-eval-print loop until r is exhausted
+func (con *Console) Serve(r io.Reader, w io.Writer) {
+	sc := bufio.NewScanner(r)
+	fmt.Fprint(w, "> ")
+	for sc.Scan() {
+		if line := strings.TrimSpace(sc.Text()); line != "" {
+			con.Exec(line, w)
+		}
+		fmt.Fprint(w, "> ")
+	}
+}
+
+// ListenUnix serves the console on a unix socket (owner-only permissions)
+func (con *Console) ListenUnix(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return err
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				log.Println("console accept:", err)
+				return
+			}
+			go func() {
+				defer conn.Close()
+				con.Serve(conn, conn)
+			}()
+		}
+	}()
+	return nil
+}
+
+// Exec runs a single command line
+func (con *Console) Exec(line string, w io.Writer) {
+	cmd, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+	switch cmd {
+	case "help":
+		fmt.Fprintln(w, "commands: clients | rooms | kick <id> | broadcast <text> | forget <user> [anonymize] | stats")
+	case "clients":
+		clients := con.hub.Clients()
+		sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tUSER\tROOM\tBUFFERED")
+		for _, c := range clients {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d/%d\n", c.ID, c.UserID, c.Room, c.Buffered, c.Limit)
+		}
+		tw.Flush()
+	case "rooms":
+		rooms := con.hub.Rooms()
+		names := make([]string, 0, len(rooms))
+		for name := range rooms {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ROOM\tMEMBERS")
+		for _, name := range names {
+			fmt.Fprintf(tw, "%s\t%d\n", name, rooms[name])
+		}
+		tw.Flush()
+	case "kick":
+		if arg == "" {
+			fmt.Fprintln(w, "usage: kick <client id | user id>")
+			return
+		}
+		targets := con.hub.FindClients(arg)
+		for _, c := range targets {
+			c.kick(websocket.ClosePolicyViolation, "kicked by operator")
+		}
+		fmt.Fprintf(w, "kicked %d connection(s)\n", len(targets))
+		log.Printf("console: kick %s (%d connections)", arg, len(targets))
+		con.audit.Record("console", "kick", arg, fmt.Sprintf("%d connection(s)", len(targets)))
+	case "broadcast":
+		if arg == "" {
+			fmt.Fprintln(w, "usage: broadcast <text>")
+			return
+		}
+		con.hub.BroadcastGlobal(Message{Type: "system", Sender: "admin", Payload: arg})
+		con.audit.Record("console", "broadcast", "", arg)
+		fmt.Fprintln(w, "queued")
+	case "forget":
+		user, mode, _ := strings.Cut(arg, " ")
+		if user == "" || (mode != "" && mode != "anonymize") {
+			fmt.Fprintln(w, "usage: forget <user id> [anonymize]")
+			return
+		}
+		if con.eraser == nil {
+			fmt.Fprintln(w, "erasure is not available")
+			return
+		}
+		rep, err := con.eraser.Erase(user, mode == "anonymize", "console")
+		fmt.Fprintf(w, "%s -> %s: %d messages, %d matches, %d devices, profile %v, %d connection(s) closed\n",
+			rep.User, rep.Alias, rep.Messages, rep.Matches, rep.Devices, rep.Profile, rep.Connections)
+		if len(rep.Stores) > 0 {
+			fmt.Fprintf(w, "also removed: %v\n", rep.Stores)
+		}
+		if err != nil {
+			fmt.Fprintln(w, "error:", err)
+		}
+	case "stats":
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		fmt.Fprintf(w, "uptime:      %s\n", time.Since(con.started).Round(time.Second))
+		fmt.Fprintf(w, "clients:     %d\n", len(con.hub.Clients()))
+		fmt.Fprintf(w, "rooms:       %d\n", len(con.hub.Rooms()))
+		fmt.Fprintf(w, "received:    %d messages\n", con.received.Load())
+		fmt.Fprintf(w, "broadcasts:  %d\n", con.broadcasts.Load())
+		fmt.Fprintf(w, "goroutines:  %d\n", runtime.NumGoroutine())
+		fmt.Fprintf(w, "heap:        %.1f MiB\n", float64(mem.HeapAlloc)/(1<<20))
+	default:
+		fmt.Fprintf(w, "unknown command %q (try help)\n", cmd)
+	}
+}
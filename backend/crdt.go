@@ -0,0 +1,158 @@
+// backend/crdt.go
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+/*
+ORSet is a state-based observed-remove set without tombstones.
+Every add creates a unique tag "<node>/<incarnation>/<seq>", issued by
+the node in increasing order, and the set keeps a version vector: for
+each node, the newest tag of it the set has seen. A tag that the vector
+covers but that is not in the set was removed, so a remove just deletes
+the tag and the state stays as big as the live adds plus one entry per
+node. Merge keeps a tag both sides have, and a tag one side has that
+the other side's vector doesn't cover (the other side never saw it);
+replicas converge regardless of the order (or duplication) of merges,
+and a concurrent add wins over a remove that never saw it. A newer
+incarnation of a node covers every tag of the older ones, so those go
+once the restarted node's vector has spread.
+*/
+type ORSet struct {
+	Adds  map[string]string     `json:"adds"`  // tag -> element
+	Clock map[string]ORSetClock `json:"clock"` // node -> newest tag seen
+}
+
+// ORSetClock is a node's position in an ORSet's version vector
+type ORSetClock struct {
+	Incarnation int64  `json:"inc"`
+	Seq         uint64 `json:"seq"`
+}
+
+// covers reports whether a tag issued at (inc, seq) is at or before v
+func (v ORSetClock) covers(inc int64, seq uint64) bool {
+	return inc < v.Incarnation || (inc == v.Incarnation && seq <= v.Seq)
+}
+
+func NewORSet() *ORSet {
+	return &ORSet{Adds: make(map[string]string), Clock: make(map[string]ORSetClock)}
+}
+
+// ORSetTag is the tag of the seq'th add by incarnation inc of node
+func ORSetTag(node string, inc int64, seq uint64) string {
+	return node + "/" + strconv.FormatInt(inc, 10) + "/" + strconv.FormatUint(seq, 10)
+}
+
+func parseTag(tag string) (node string, incarnation int64, seq uint64, ok bool) {
+	parts := strings.SplitN(tag, "/", 3)
+	if len(parts) != 3 {
+		return "", 0, 0, false
+	}
+	inc, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", 0, 0, false
+	}
+	seq, err = strconv.ParseUint(parts[2], 10, 64)
+	if err != nil {
+		return "", 0, 0, false
+	}
+	return parts[0], inc, seq, true
+}
+
+// Start makes s cover every tag of node's incarnations before inc, for
+// a node that just restarted
+func (s *ORSet) Start(node string, inc int64) {
+	s.observe(node, inc, 0)
+}
+
+// observe moves node's clock forward to (inc, seq)
+func (s *ORSet) observe(node string, inc int64, seq uint64) {
+	if v, ok := s.Clock[node]; !ok || !v.covers(inc, seq) {
+		s.Clock[node] = ORSetClock{Incarnation: inc, Seq: seq}
+	}
+}
+
+// seen reports whether s has seen tag, whether or not it is still live
+func (s *ORSet) seen(tag string) bool {
+	node, inc, seq, ok := parseTag(tag)
+	if !ok {
+		return true // malformed tags are never added
+	}
+	v, known := s.Clock[node]
+	return known && v.covers(inc, seq)
+}
+
+// Add inserts elem under a tag from ORSetTag, unless s already saw it
+// removed
+func (s *ORSet) Add(tag, elem string) {
+	node, inc, seq, ok := parseTag(tag)
+	if !ok || s.seen(tag) {
+		return
+	}
+	s.Adds[tag] = elem
+	s.observe(node, inc, seq)
+}
+
+// RemoveTag removes a single add (one connection of a user, say)
+func (s *ORSet) RemoveTag(tag string) {
+	delete(s.Adds, tag)
+}
+
+// Remove removes every observed tag of elem
+func (s *ORSet) Remove(elem string) {
+	for tag, e := range s.Adds {
+		if e == elem {
+			s.RemoveTag(tag)
+		}
+	}
+}
+
+// Merge folds other into s
+func (s *ORSet) Merge(other *ORSet) {
+	// what other has and s never saw, judged by s's clock before the merge
+	var added []string
+	for tag := range other.Adds {
+		if _, ok := s.Adds[tag]; !ok && !s.seen(tag) {
+			added = append(added, tag)
+		}
+	}
+	// what s has and other saw removed
+	for tag := range s.Adds {
+		if _, ok := other.Adds[tag]; !ok && other.seen(tag) {
+			delete(s.Adds, tag)
+		}
+	}
+	for _, tag := range added {
+		s.Adds[tag] = other.Adds[tag]
+	}
+	for node, v := range other.Clock {
+		s.observe(node, v.Incarnation, v.Seq)
+	}
+	// tags of incarnations the merged clock has moved past
+	for tag := range s.Adds {
+		if node, inc, _, _ := parseTag(tag); inc < s.Clock[node].Incarnation {
+			delete(s.Adds, tag)
+		}
+	}
+}
+
+// Each calls fn for every live (tag, element) pair
+func (s *ORSet) Each(fn func(tag, elem string)) {
+	for tag, elem := range s.Adds {
+		fn(tag, elem)
+	}
+}
+
+// Clone returns a deep copy
+func (s *ORSet) Clone() *ORSet {
+	c := NewORSet()
+	for tag, elem := range s.Adds {
+		c.Adds[tag] = elem
+	}
+	for node, v := range s.Clock {
+		c.Clock[node] = v
+	}
+	return c
+}
@@ -0,0 +1,88 @@
+// backend/crdt_test.go
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// TestORSetStaysBounded connects and disconnects a user over and over on
+// one node while two others gossip; the state must not grow with it
+func TestORSetStaysBounded(t *testing.T) {
+	nodes := map[string]*ORSet{"a": NewORSet(), "b": NewORSet(), "c": NewORSet()}
+	for name, s := range nodes {
+		s.Start(name, 1)
+	}
+	gossip := func() {
+		for _, s := range nodes {
+			for _, o := range nodes {
+				s.Merge(o.Clone())
+			}
+		}
+	}
+	nodes["b"].Add(ORSetTag("b", 1, 1), "bob")
+	var size int
+	for i := uint64(1); i <= 1000; i++ {
+		tag := ORSetTag("a", 1, i)
+		nodes["a"].Add(tag, "alice")
+		gossip()
+		nodes["a"].RemoveTag(tag)
+		gossip()
+		b, _ := json.Marshal(nodes["c"])
+		if i == 1 {
+			size = len(b)
+		} else if len(b) > size+8 {
+			t.Fatalf("after %d connections the state is %d bytes, was %d", i, len(b), size)
+		}
+	}
+	for name, s := range nodes {
+		if len(s.Adds) != 1 || s.Adds[ORSetTag("b", 1, 1)] != "bob" {
+			t.Fatalf("%s has %v, want only bob", name, s.Adds)
+		}
+	}
+}
+
+// TestORSetAddWins keeps an add the remover never saw
+func TestORSetAddWins(t *testing.T) {
+	a, b := NewORSet(), NewORSet()
+	a.Start("a", 1)
+	b.Start("b", 1)
+	a.Add(ORSetTag("a", 1, 1), "alice")
+	b.Merge(a.Clone())
+	b.Remove("alice")
+	a.Add(ORSetTag("a", 1, 2), "alice") // concurrent with the remove
+	a.Merge(b.Clone())
+	b.Merge(a.Clone())
+	for name, s := range map[string]*ORSet{"a": a, "b": b} {
+		if len(s.Adds) != 1 || s.Adds[ORSetTag("a", 1, 2)] != "alice" {
+			t.Fatalf("%s has %v, want only the second add", name, s.Adds)
+		}
+	}
+	// a stale copy can't bring a removed tag back
+	stale := NewORSet()
+	stale.Add(ORSetTag("a", 1, 1), "alice")
+	b.Merge(stale)
+	if _, ok := b.Adds[ORSetTag("a", 1, 1)]; ok {
+		t.Fatal("removed tag came back from a stale replica")
+	}
+}
+
+// TestORSetRestart drops the tags of a node's old incarnation once its new
+// one has gossiped
+func TestORSetRestart(t *testing.T) {
+	old, peer := NewORSet(), NewORSet()
+	old.Start("a", 1)
+	peer.Start("b", 1)
+	old.Add(ORSetTag("a", 1, 1), "alice")
+	peer.Merge(old)
+	restarted := NewORSet()
+	restarted.Start("a", 2)
+	restarted.Merge(peer.Clone())
+	if len(restarted.Adds) != 0 {
+		t.Fatalf("restarted node took back %v", restarted.Adds)
+	}
+	peer.Merge(restarted.Clone())
+	if len(peer.Adds) != 0 {
+		t.Fatalf("peer still has %v", peer.Adds)
+	}
+}
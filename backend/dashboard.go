@@ -0,0 +1,317 @@
+// backend/dashboard.go
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+Operator dashboard at /admin (with -admin-token). The page is a single
+embedded HTML file, independent of the game SPA; the browser logs in with
+basic auth, any user name and the admin token as password. That only
+covers reads: for its controls the page asks for the token again and
+sends it as a bearer token (see admin.go). It polls
+
+	GET    /api/admin/stats                  counters, per game and in total
+	GET    /api/admin/rooms?game=/ws         rooms of one game
+	GET    /api/admin/clients?game=/ws       connections of one game
+	DELETE /api/admin/clients/{id}           kick a client id or user id, on every game
+
+and charts clients and message throughput from the counters. Its controls
+use the existing admin routes (announcements, anti-cheat mutes). For
+scripts (cmd/msgctl) there are also
+
+	POST   /api/admin/rooms?game=/ws         {"name":"finals","owner":"alice"}: a private
+	                                         room owned by alice; the reply has its join code
+	GET    /api/admin/events?game=/ws&kind=room.created,message.received
+	                                         the game's events as they happen, one JSON
+	                                         object per line, until the request is closed
+	PUT    /api/admin/clients/{id}/tags      {"beta":"true"}: tag every connection of a client
+	                                         or user id; "" removes a tag (see tags.go)
+*/
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// GameStats is one game's line of /api/admin/stats
+type GameStats struct {
+	Path    string `json:"path"`
+	Clients int    `json:"clients"`
+	Rooms   int    `json:"rooms"`
+}
+
+// DashboardStats is the /api/admin/stats document
+type DashboardStats struct {
+	Time       time.Time   `json:"time"`
+	Uptime     Duration    `json:"uptime"`
+	Clients    int         `json:"clients"`
+	Rooms      int         `json:"rooms"`
+	Received   int64       `json:"received"`   // inbound messages since start
+	Broadcasts int64       `json:"broadcasts"` // broadcasts since start
+	Goroutines int         `json:"goroutines"`
+	HeapBytes  uint64      `json:"heapBytes"`
+	Games      []GameStats `json:"games"`
+}
+
+// Dashboard serves the /admin page and the data behind it
+type Dashboard struct {
+	games      map[string]*mountedGame
+	audit      *AuditLog
+	started    time.Time
+	received   atomic.Int64
+	broadcasts atomic.Int64
+}
+
+// NewDashboard counts traffic on every game in games
+func NewDashboard(games map[string]*mountedGame) *Dashboard {
+	d := &Dashboard{games: games, started: time.Now()}
+	for _, g := range games {
+		g.hub.events.Subscribe(func(e Event) {
+			if e.Kind == EventMessageReceived {
+				d.received.Add(1)
+			} else {
+				d.broadcasts.Add(1)
+			}
+		}, EventMessageReceived, EventBroadcastSent)
+	}
+	return d
+}
+
+// Stats reads the current counters
+func (d *Dashboard) Stats() DashboardStats {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	s := DashboardStats{
+		Time:       time.Now(),
+		Uptime:     Duration(time.Since(d.started).Round(time.Second)),
+		Received:   d.received.Load(),
+		Broadcasts: d.broadcasts.Load(),
+		Goroutines: runtime.NumGoroutine(),
+		HeapBytes:  mem.HeapAlloc,
+	}
+	for path, g := range d.games {
+		gs := GameStats{Path: path, Clients: len(g.hub.Clients()), Rooms: len(g.hub.Rooms())}
+		s.Clients += gs.Clients
+		s.Rooms += gs.Rooms
+		s.Games = append(s.Games, gs)
+	}
+	sort.Slice(s.Games, func(i, j int) bool { return s.Games[i].Path < s.Games[j].Path })
+	return s
+}
+
+// game returns the game named by ?game=, /ws by default
+func (d *Dashboard) game(w http.ResponseWriter, r *http.Request) *mountedGame {
+	path := r.URL.Query().Get("game")
+	if path == "" {
+		path = "/ws"
+	}
+	g := d.games[path]
+	if g == nil {
+		writeJSONError(w, http.StatusNotFound, "no game at "+path)
+	}
+	return g
+}
+
+// RegisterAdmin mounts the dashboard's data routes
+func (d *Dashboard) RegisterAdmin(a *AdminAPI) {
+	a.Handle("/api/admin/stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, d.Stats())
+	})
+	a.Handle("/api/admin/rooms", func(w http.ResponseWriter, r *http.Request) {
+		g := d.game(w, r)
+		if g == nil {
+			return
+		}
+		if r.Method == http.MethodPost {
+			d.createRoom(w, r, g)
+			return
+		}
+		type roomInfo struct {
+			Name    string `json:"name"`
+			Members int    `json:"members"`
+		}
+		rooms := []roomInfo{}
+		for name, n := range g.hub.Rooms() {
+			rooms = append(rooms, roomInfo{name, n})
+		}
+		sort.Slice(rooms, func(i, j int) bool { return rooms[i].Name < rooms[j].Name })
+		writeJSON(w, http.StatusOK, rooms)
+	})
+	a.Handle("/api/admin/clients", func(w http.ResponseWriter, r *http.Request) {
+		g := d.game(w, r)
+		if g == nil {
+			return
+		}
+		clients := g.hub.Clients()
+		sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+		writeJSON(w, http.StatusOK, clients)
+	})
+	a.Handle("/api/admin/clients/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/api/admin/clients/")
+		if id, ok := strings.CutSuffix(id, "/tags"); ok {
+			d.setTags(w, r, id)
+			return
+		}
+		if r.Method != http.MethodDelete {
+			writeJSONError(w, http.StatusMethodNotAllowed, "use DELETE")
+			return
+		}
+		n := 0
+		for _, g := range d.games {
+			for _, c := range g.hub.FindClients(id) {
+				c.kick(websocket.ClosePolicyViolation, "kicked by operator")
+				n++
+			}
+		}
+		if n == 0 {
+			writeJSONError(w, http.StatusNotFound, "no such client")
+			return
+		}
+		log.Printf("admin: kick %s (%d connections)", id, n)
+		d.audit.Record(adminActor(r), "kick", id, fmt.Sprintf("%d connection(s)", n))
+		writeJSON(w, http.StatusOK, map[string]int{"kicked": n})
+	})
+	a.Handle("/api/admin/events", d.tailEvents)
+}
+
+// createRoom serves POST /api/admin/rooms
+func (d *Dashboard) createRoom(w http.ResponseWriter, r *http.Request, g *mountedGame) {
+	var req struct {
+		Name  string `json:"name"`
+		Owner string `json:"owner"`
+	}
+	if err := readJSON(w, r, &req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if g.hub.private == nil {
+		writeJSONError(w, http.StatusNotFound, "game has no private rooms")
+		return
+	}
+	code, err := g.hub.private.Create(req.Name, req.Owner)
+	if err != nil {
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	}
+	d.audit.Record(adminActor(r), "room.create", req.Name, "owner "+req.Owner)
+	writeJSON(w, http.StatusOK, map[string]string{"room": req.Name, "owner": req.Owner, "code": code})
+}
+
+// setTags serves PUT /api/admin/clients/{id}/tags: it merges the body into
+// the tags of every connection of client or user id
+func (d *Dashboard) setTags(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodPut {
+		writeJSONError(w, http.StatusMethodNotAllowed, "use PUT")
+		return
+	}
+	var tags map[string]string
+	if err := readJSON(w, r, &tags); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	n := 0
+	for _, g := range d.games {
+		for _, c := range g.hub.FindClients(id) {
+			if !g.hub.SetTags(c, tags) {
+				writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("bad tags: keys and values are at most %d characters, locale, room, tenant and user are reserved, at most %d per connection", maxTagLen, g.hub.tags.max()))
+				return
+			}
+			n++
+		}
+	}
+	if n == 0 {
+		writeJSONError(w, http.StatusNotFound, "no such client")
+		return
+	}
+	d.audit.Record(adminActor(r), "client.tags", id, fmt.Sprintf("%v on %d connection(s)", tags, n))
+	writeJSON(w, http.StatusOK, map[string]int{"tagged": n})
+}
+
+// eventLine is one line of /api/admin/events
+type eventLine struct {
+	Time       time.Time `json:"time"`
+	Kind       EventKind `json:"kind"`
+	Client     string    `json:"client,omitempty"`
+	User       string    `json:"user,omitempty"`
+	Room       string    `json:"room,omitempty"`
+	Type       string    `json:"type,omitempty"` // of the message
+	Recipients int       `json:"recipients,omitempty"`
+	Match      int64     `json:"match,omitempty"` // finished match id
+}
+
+// tailEvents serves GET /api/admin/events
+func (d *Dashboard) tailEvents(w http.ResponseWriter, r *http.Request) {
+	g := d.game(w, r)
+	if g == nil {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+	var kinds []EventKind
+	if k := r.URL.Query().Get("kind"); k != "" {
+		for _, kind := range strings.Split(k, ",") {
+			kinds = append(kinds, EventKind(kind))
+		}
+	}
+	lines := make(chan eventLine, 64)
+	unsubscribe := g.hub.events.Subscribe(func(e Event) {
+		l := eventLine{Time: e.Time, Kind: e.Kind, Room: e.Room, Recipients: e.Recipients}
+		if e.Client != nil {
+			l.Client, l.User = e.Client.id, e.Client.userID
+		}
+		if e.Message != nil {
+			l.Type = e.Message.Type
+		}
+		if e.Result != nil {
+			l.Room, l.Match = e.Result.Room, e.Result.ID
+		}
+		select {
+		case lines <- l:
+		default: // the reader is behind; drop like the bus does
+		}
+	}, kinds...)
+	defer unsubscribe()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case l := <-lines:
+			if enc.Encode(l) != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// Page serves the dashboard itself to holders of a's token
+func (d *Dashboard) Page(a *AdminAPI) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.authorized(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="admin"`)
+			http.Error(w, "admin token required", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(dashboardHTML)
+	}
+}
@@ -0,0 +1,335 @@
+// backend/deadletter.go
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Dead letters. Messages the server gives up on are kept with the reason
+instead of vanishing:
+
+	rejected   a client message answered with one of the "deadLetters"
+	           codes (default: bad_data, message.unknown_type,
+	           ratelimit.too_large, script.error)
+	overflow   an unread inbox item pushed out by the per-user limit
+	panic      a client message whose game handler panicked, with the
+	           stack (see recover.go)
+
+They are written to the database (-db) when there is one, else kept in
+memory, newest deadLetters.max (default 1000) only:
+
+	"deadLetters": {"max": 1000, "codes": ["bad_data", "rules.illegal"]}
+
+Operators inspect and replay them:
+
+	GET    /api/admin/deadletters?reason=panic&game=/ws&limit=100   newest first
+	GET    /api/admin/deadletters/{id}
+	POST   /api/admin/deadletters/{id}/replay
+	DELETE /api/admin/deadletters[/{id}]
+
+Replaying runs a message through its game again as its client (which
+must still be connected, otherwise 409), or redelivers an inbox item.
+Replayed letters are removed. dead_letters_total counts them by reason.
+*/
+
+// dead letter reasons
+const (
+	DeadRejected = "rejected"
+	DeadOverflow = "overflow"
+	DeadPanic    = "panic"
+)
+
+// DeadLetter is one message the server gave up on
+type DeadLetter struct {
+	ID      int64      `json:"id"`
+	Time    time.Time  `json:"time"`
+	Reason  string     `json:"reason"`
+	Code    string     `json:"code,omitempty"` // error code sent to the client
+	Error   string     `json:"error"`
+	Game    string     `json:"game,omitempty"`
+	Client  string     `json:"client,omitempty"`
+	User    string     `json:"user,omitempty"`
+	Room    string     `json:"room,omitempty"`
+	Message *Message   `json:"message,omitempty"`
+	Item    *InboxItem `json:"item,omitempty"` // overflow
+	Stack   string     `json:"stack,omitempty"`
+}
+
+// DeadLetterConfig is the "deadLetters" config block
+type DeadLetterConfig struct {
+	Max   int      `json:"max,omitempty"`   // default 1000
+	Codes []string `json:"codes,omitempty"` // error codes that dead-letter the message
+}
+
+// DeadLetters keeps dead letters, in memory and optionally the database
+type DeadLetters struct {
+	max   int
+	codes map[string]bool
+
+	mu      sync.Mutex
+	nextID  int64
+	letters []DeadLetter // oldest first
+	db      *SQLiteDB    // nil = memory only
+	counts  map[string]*Counter
+}
+
+func NewDeadLetters(cfg DeadLetterConfig) *DeadLetters {
+	if cfg.Max <= 0 {
+		cfg.Max = 1000
+	}
+	if len(cfg.Codes) == 0 {
+		cfg.Codes = []string{"bad_data", "message.unknown_type", "ratelimit.too_large", "script.error"}
+	}
+	d := &DeadLetters{max: cfg.Max, codes: make(map[string]bool), nextID: 1, counts: make(map[string]*Counter)}
+	for _, code := range cfg.Codes {
+		d.codes[code] = true
+	}
+	for _, reason := range []string{DeadRejected, DeadOverflow, DeadPanic} {
+		d.counts[reason] = &Counter{}
+	}
+	return d
+}
+
+// UseDB loads the stored dead letters and saves new ones to db
+func (d *DeadLetters) UseDB(db *SQLiteDB) error {
+	letters, err := db.deadLetters()
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.db = db
+	d.letters = letters
+	if n := len(letters); n > 0 {
+		d.nextID = letters[n-1].ID + 1
+	}
+	return d.trimLocked()
+}
+
+// Register exports dead_letters_total on m
+func (d *DeadLetters) Register(m *Metrics) {
+	m.Register("dead_letters_total", "messages dead-lettered, by reason", "counter", func() []Sample {
+		out := make([]Sample, 0, len(d.counts))
+		for reason, c := range d.counts {
+			out = append(out, Sample{Labels: `reason="` + reason + `"`, Value: float64(c.Value())})
+		}
+		sort.Slice(out, func(i, j int) bool { return out[i].Labels < out[j].Labels })
+		return out
+	})
+}
+
+// add stores dl and assigns its ID and time; nil-safe
+func (d *DeadLetters) add(dl DeadLetter) {
+	if d == nil {
+		return
+	}
+	d.counts[dl.Reason].Inc()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dl.ID, dl.Time = d.nextID, time.Now()
+	d.nextID++
+	d.letters = append(d.letters, dl)
+	if d.db != nil {
+		if err := d.db.saveDeadLetter(dl); err != nil {
+			log.Printf("dead letters: %v", err)
+		}
+	}
+	if err := d.trimLocked(); err != nil {
+		log.Printf("dead letters: %v", err)
+	}
+}
+
+// trimLocked drops the oldest letters beyond max
+func (d *DeadLetters) trimLocked() error {
+	n := len(d.letters) - d.max
+	if n <= 0 {
+		return nil
+	}
+	ids := make([]int64, n)
+	for i := range ids {
+		ids[i] = d.letters[i].ID
+	}
+	d.letters = append([]DeadLetter(nil), d.letters[n:]...)
+	if d.db != nil {
+		return d.db.deleteDeadLetters(ids)
+	}
+	return nil
+}
+
+// fromClient fills in who sent a dead-lettered message
+func fromClient(c *Client, m Message, reason, code, errText string) DeadLetter {
+	return DeadLetter{Reason: reason, Code: code, Error: errText, Game: c.hub.path, Client: c.id, User: c.userID, Room: c.hub.RoomOf(c), Message: &m}
+}
+
+// rejected records the message c is handling if code dead-letters it
+func (d *DeadLetters) rejected(c *Client, code, text string) {
+	if d == nil || !d.codes[code] {
+		return
+	}
+	if m := c.handling.Load(); m != nil {
+		d.add(fromClient(c, *m, DeadRejected, code, text))
+	}
+}
+
+// overflowed records inbox items pushed out before they were read
+func (d *DeadLetters) overflowed(items []InboxItem) {
+	for i := range items {
+		it := items[i]
+		d.add(DeadLetter{Reason: DeadOverflow, Error: fmt.Sprintf("inbox over %d items", inboxMaxItems), User: it.User, Item: &it})
+	}
+}
+
+// list returns the letters matching reason and game ("" = any), newest first
+func (d *DeadLetters) list(reason, game string, limit int) []DeadLetter {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := []DeadLetter{}
+	for i := len(d.letters) - 1; i >= 0 && (limit <= 0 || len(out) < limit); i-- {
+		dl := d.letters[i]
+		if (reason == "" || dl.Reason == reason) && (game == "" || dl.Game == game) {
+			out = append(out, dl)
+		}
+	}
+	return out
+}
+
+func (d *DeadLetters) get(id int64) (DeadLetter, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, dl := range d.letters {
+		if dl.ID == id {
+			return dl, true
+		}
+	}
+	return DeadLetter{}, false
+}
+
+// remove deletes letter id, or every letter for id 0; it returns how many
+func (d *DeadLetters) remove(id int64) (int, error) {
+	return d.removeWhere(func(dl DeadLetter) bool { return id == 0 || dl.ID == id })
+}
+
+// Forget deletes the letters of userID, for erasure (erasure.go); nil-safe
+func (d *DeadLetters) Forget(userID string) (int, error) {
+	if d == nil {
+		return 0, nil
+	}
+	return d.removeWhere(func(dl DeadLetter) bool {
+		return dl.User == userID || (dl.Item != nil && dl.Item.User == userID)
+	})
+}
+
+func (d *DeadLetters) removeWhere(match func(DeadLetter) bool) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var ids []int64
+	kept := d.letters[:0]
+	for _, dl := range d.letters {
+		if match(dl) {
+			ids = append(ids, dl.ID)
+		} else {
+			kept = append(kept, dl)
+		}
+	}
+	d.letters = kept
+	if d.db != nil && len(ids) > 0 {
+		return len(ids), d.db.deleteDeadLetters(ids)
+	}
+	return len(ids), nil
+}
+
+// replay hands dl back to its game or inbox
+func (d *DeadLetters) replay(dl DeadLetter, mounted map[string]*mountedGame, inbox *Inbox) (int, string) {
+	switch {
+	case dl.Item != nil:
+		if _, err := inbox.Send(dl.Item.User, *dl.Item, nil); err != nil {
+			return http.StatusInternalServerError, err.Error()
+		}
+		return http.StatusOK, ""
+	case dl.Message != nil:
+		mg := mounted[dl.Game]
+		if mg == nil || mg.game == nil {
+			return http.StatusConflict, "game " + dl.Game + " is not mounted"
+		}
+		var c *Client
+		id := dl.User
+		if id == "" {
+			id = dl.Client
+		}
+		for _, cand := range mg.hub.FindClients(id) {
+			if c == nil || cand.id == dl.Client {
+				c = cand
+			}
+		}
+		if c == nil {
+			return http.StatusConflict, "the sender is not connected"
+		}
+		mg.game.OnMessage(c, *dl.Message)
+		return http.StatusOK, ""
+	}
+	return http.StatusConflict, "nothing to replay"
+}
+
+// RegisterAdmin mounts /api/admin/deadletters
+func (d *DeadLetters) RegisterAdmin(a *AdminAPI, mounted map[string]*mountedGame, inbox *Inbox) {
+	a.Handle("/api/admin/deadletters", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			q := r.URL.Query()
+			limit, _ := strconv.Atoi(q.Get("limit"))
+			writeJSON(w, http.StatusOK, d.list(q.Get("reason"), q.Get("game"), limit))
+		case http.MethodDelete:
+			n, err := d.remove(0)
+			if err != nil {
+				writeJSONError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			a.audit.Record(adminActor(r), "deadletters.clear", "", strconv.Itoa(n))
+			writeJSON(w, http.StatusOK, map[string]int{"deleted": n})
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, "use GET or DELETE")
+		}
+	})
+	a.Handle("/api/admin/deadletters/", func(w http.ResponseWriter, r *http.Request) {
+		rest, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/admin/deadletters/"), "/")
+		id, err := strconv.ParseInt(rest, 10, 64)
+		if err != nil || id <= 0 {
+			writeJSONError(w, http.StatusNotFound, "want /api/admin/deadletters/{id}")
+			return
+		}
+		dl, ok := d.get(id)
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "no dead letter "+rest)
+			return
+		}
+		switch {
+		case action == "" && r.Method == http.MethodGet:
+			writeJSON(w, http.StatusOK, dl)
+		case action == "" && r.Method == http.MethodDelete:
+			if _, err := d.remove(id); err != nil {
+				writeJSONError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			a.audit.Record(adminActor(r), "deadletters.delete", rest, dl.Reason)
+			writeJSON(w, http.StatusOK, map[string]int64{"deleted": id})
+		case action == "replay" && r.Method == http.MethodPost:
+			if status, msg := d.replay(dl, mounted, inbox); status != http.StatusOK {
+				writeJSONError(w, status, msg)
+				return
+			}
+			d.remove(id)
+			a.audit.Record(adminActor(r), "deadletters.replay", rest, dl.Reason)
+			writeJSON(w, http.StatusOK, map[string]int64{"replayed": id})
+		default:
+			writeJSONError(w, http.StatusNotFound, "want GET|DELETE /api/admin/deadletters/{id} or POST .../replay")
+		}
+	})
+}
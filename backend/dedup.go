@@ -0,0 +1,79 @@
+// backend/dedup.go
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+/*
+Idempotency keys. A client may set "idempotencyKey" on any message; a message
+whose key was already seen from the same sender within the window is dropped
+and answered with {"type":"duplicate","idempotencyKey":...} so the client can
+stop retrying. Keys are scoped to the user id for authenticated clients (so
+retries survive a reconnect) and to the connection otherwise.
+*/
+
+const maxDedupEntries = 100000
+
+type dedupEntry struct {
+	key     string
+	expires time.Time
+}
+
+// Deduper remembers keys for a fixed window
+type Deduper struct {
+	window time.Duration
+
+	mu    sync.Mutex
+	seen  map[string]time.Time
+	order []dedupEntry // insertion order == expiry order, window is constant
+}
+
+func NewDeduper(window time.Duration) *Deduper {
+	return &Deduper{window: window, seen: make(map[string]time.Time)}
+}
+
+// Seen records key and reports whether it was already present
+func (d *Deduper) Seen(key string, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// expire from the front; also cap memory by evicting the oldest keys
+	for len(d.order) > 0 && (now.After(d.order[0].expires) || len(d.order) >= maxDedupEntries) {
+		e := d.order[0]
+		if d.seen[e.key] == e.expires {
+			delete(d.seen, e.key)
+		}
+		d.order = d.order[1:]
+	}
+	if exp, ok := d.seen[key]; ok && !now.After(exp) {
+		return true
+	}
+	exp := now.Add(d.window)
+	d.seen[key] = exp
+	d.order = append(d.order, dedupEntry{key: key, expires: exp})
+	return false
+}
+
+// DedupMiddleware drops messages whose idempotency key was seen recently
+func DedupMiddleware(d *Deduper) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(c *Client, m Message) {
+			if m.IdempotencyKey == "" {
+				next(c, m)
+				return
+			}
+			scope := "c:" + c.id
+			if c.userID != "" {
+				scope = "u:" + c.userID
+			}
+			if d.Seen(scope+"\x00"+m.IdempotencyKey, time.Now()) {
+				b, _ := json.Marshal(Message{Type: "duplicate", Sender: "server", IdempotencyKey: m.IdempotencyKey})
+				c.Send(b)
+				return
+			}
+			next(c, m)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+// backend/deprecation.go
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+Deprecated message types and protocol versions, for changing the protocol
+under third-party clients without breaking them unannounced:
+
+	"deprecations": [
+	  {"type": "chat.legacy", "replacement": "message", "sunset": "2027-01-01T00:00:00Z", "reject": true,
+	   "info": "https://example.com/changelog#chat"},
+	  {"protocol": "1", "replacement": "2", "sunset": "2027-03-01T00:00:00Z"}
+	]
+
+A client declares its protocol version in the handshake (/ws?protocol=2)
+or in hello ({"type":"hello","data":{"protocol":"2"}}); the server does
+nothing else with it. The first time a connection uses a deprecated type
+or declares a deprecated version it gets
+
+	{"type":"deprecation","sender":"server","code":"deprecated.notice",
+	 "payload":"chat.legacy is deprecated and will stop working after 2027-01-01",
+	 "data":{"feature":"chat.legacy","kind":"type","sunset":"2027-01-01T00:00:00Z","replacement":"message","info":"..."}}
+
+and the message is handled as before. A handshake with a deprecated
+version also gets Sunset and Link (rel="deprecation") headers.
+
+After the sunset, a rule with "reject" stops working: its messages get a
+deprecated.retired error (status 410) and are dropped, a handshake with
+its version gets HTTP 410, and declaring it in hello closes the
+connection (close code 4005). Without "reject" the notices go on.
+
+Every use is counted per rule, in ws_deprecated_uses_total and
+ws_deprecated_rejected_total{feature=...} and in
+GET /api/admin/deprecations, which also lists the User-Agents that used
+each one most recently, so operators know who to chase before the
+sunset. The first use on a connection is logged.
+*/
+
+// closeProtocolRetired closes connections that declare a retired protocol
+const closeProtocolRetired = 4005
+
+// deprecationDevices is how many User-Agents a rule remembers
+const deprecationDevices = 20
+
+// DeprecationRule marks a message type or a protocol version deprecated
+type DeprecationRule struct {
+	Type        string     `json:"type,omitempty"`
+	Protocol    string     `json:"protocol,omitempty"`
+	Sunset      *time.Time `json:"sunset,omitempty"`
+	Replacement string     `json:"replacement,omitempty"` // what to use instead
+	Info        string     `json:"info,omitempty"`        // URL with details
+	Reject      bool       `json:"reject,omitempty"`      // refuse it after the sunset
+}
+
+// DeprecationNotice is the data of "deprecation" messages
+type DeprecationNotice struct {
+	Feature     string     `json:"feature"`
+	Kind        string     `json:"kind"` // type | protocol
+	Sunset      *time.Time `json:"sunset,omitempty"`
+	Replacement string     `json:"replacement,omitempty"`
+	Info        string     `json:"info,omitempty"`
+}
+
+// deprecation is a rule and its usage
+type deprecation struct {
+	DeprecationRule
+	feature string // the type, or "protocol <version>"
+
+	uses, rejected, connections Counter
+
+	mu       sync.Mutex
+	lastUsed time.Time
+	devices  map[string]time.Time // User-Agent -> last use
+}
+
+// Deprecations applies the "deprecations" config block
+type Deprecations struct {
+	types     map[string]*deprecation
+	protocols map[string]*deprecation
+	all       []*deprecation
+}
+
+// NewDeprecations returns nil when there are no rules
+func NewDeprecations(rules []DeprecationRule) (*Deprecations, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	d := &Deprecations{types: make(map[string]*deprecation), protocols: make(map[string]*deprecation)}
+	for _, r := range rules {
+		dep := &deprecation{DeprecationRule: r, devices: make(map[string]time.Time)}
+		switch {
+		case (r.Type == "") == (r.Protocol == ""):
+			return nil, errors.New("each rule needs either type or protocol")
+		case r.Reject && r.Sunset == nil:
+			return nil, fmt.Errorf("%s%s: reject needs a sunset", r.Type, r.Protocol)
+		case r.Type != "":
+			if d.types[r.Type] != nil {
+				return nil, fmt.Errorf("type %s is listed twice", r.Type)
+			}
+			dep.feature = r.Type
+			d.types[r.Type] = dep
+		default:
+			if d.protocols[r.Protocol] != nil {
+				return nil, fmt.Errorf("protocol %s is listed twice", r.Protocol)
+			}
+			dep.feature = "protocol " + r.Protocol
+			d.protocols[r.Protocol] = dep
+		}
+		d.all = append(d.all, dep)
+	}
+	return d, nil
+}
+
+// retired reports whether dep is refused now
+func (dep *deprecation) retired(now time.Time) bool {
+	return dep.Reject && dep.Sunset != nil && !now.Before(*dep.Sunset)
+}
+
+func (dep *deprecation) kind() string {
+	if dep.Type != "" {
+		return "type"
+	}
+	return "protocol"
+}
+
+func (dep *deprecation) notice() DeprecationNotice {
+	return DeprecationNotice{Feature: dep.feature, Kind: dep.kind(), Sunset: dep.Sunset, Replacement: dep.Replacement, Info: dep.Info}
+}
+
+// used counts a use of dep by device and reports whether it is retired
+func (dep *deprecation) used(device string) bool {
+	now := time.Now()
+	dep.uses.Inc()
+	dep.mu.Lock()
+	dep.lastUsed = now
+	if _, ok := dep.devices[device]; !ok && len(dep.devices) >= deprecationDevices {
+		oldest := ""
+		for d, t := range dep.devices {
+			if oldest == "" || t.Before(dep.devices[oldest]) {
+				oldest = d
+			}
+		}
+		delete(dep.devices, oldest)
+	}
+	dep.devices[device] = now
+	dep.mu.Unlock()
+	if dep.retired(now) {
+		dep.rejected.Inc()
+		return true
+	}
+	return false
+}
+
+// handshake checks the protocol a handshake declares. It answers 410 and
+// returns false for a retired one; otherwise it returns the headers the
+// upgrade response gets.
+func (d *Deprecations) handshake(w http.ResponseWriter, r *http.Request) (http.Header, bool) {
+	if d == nil {
+		return nil, true
+	}
+	dep := d.protocols[r.URL.Query().Get("protocol")]
+	if dep == nil {
+		return nil, true
+	}
+	h := http.Header{}
+	if dep.Sunset != nil {
+		h.Set("Sunset", dep.Sunset.UTC().Format(http.TimeFormat))
+	}
+	if dep.Info != "" {
+		h.Set("Link", "<"+dep.Info+`>; rel="deprecation"`)
+	}
+	if dep.used(r.UserAgent()) {
+		for k, v := range h {
+			w.Header()[k] = v
+		}
+		msg := dep.feature + " was retired"
+		if dep.Replacement != "" {
+			msg += "; use protocol " + dep.Replacement
+		}
+		http.Error(w, msg, http.StatusGone)
+		return nil, false
+	}
+	return h, true
+}
+
+// connected warns c when its handshake declared a deprecated protocol;
+// handshake has already counted the use
+func (d *Deprecations) connected(c *Client) {
+	if d == nil {
+		return
+	}
+	if dep := d.protocols[c.Protocol()]; dep != nil {
+		d.warn(c, dep)
+	}
+}
+
+// warn sends c the notice for dep, once per connection
+func (d *Deprecations) warn(c *Client, dep *deprecation) {
+	if c.deprecated[dep.feature] {
+		return
+	}
+	if c.deprecated == nil {
+		c.deprecated = make(map[string]bool)
+	}
+	c.deprecated[dep.feature] = true
+	dep.connections.Inc()
+	log.Printf("deprecated: %s used by %s (user %q, %q)", dep.feature, c.id, c.userID, c.device)
+	code, args := "deprecated.undated", []interface{}{dep.feature}
+	if dep.Sunset != nil {
+		code, args = "deprecated.notice", []interface{}{dep.feature, dep.Sunset.UTC().Format("2006-01-02")}
+	}
+	data, _ := json.Marshal(dep.notice())
+	m := Message{Type: "deprecation", Sender: "server", Code: code, Payload: c.T(code, args...), Data: data}
+	if !c.hub.router.route("out", c, m) {
+		return
+	}
+	b, _ := json.Marshal(m)
+	c.Send(b)
+}
+
+// retiredError tells c that dep no longer works
+func retiredError(c *Client, dep *deprecation) {
+	sendErrorReply(c, "deprecated.retired", errorReply{details: dep.notice()}, dep.feature, dep.Sunset.UTC().Format("2006-01-02"))
+}
+
+// DeprecationMiddleware warns about and, after their sunset, refuses
+// deprecated message types and protocols declared in hello
+func DeprecationMiddleware(d *Deprecations) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		if d == nil {
+			return next
+		}
+		return func(c *Client, m Message) {
+			if m.Type == "hello" && len(m.Data) > 0 {
+				var req struct {
+					Protocol string `json:"protocol"`
+				}
+				if json.Unmarshal(m.Data, &req) == nil && req.Protocol != "" {
+					c.protocol.Store(req.Protocol)
+					if dep := d.protocols[req.Protocol]; dep != nil {
+						if dep.used(c.device) {
+							// the close reason says why; an error queued now would race the close
+							c.kick(closeProtocolRetired, dep.feature+" was retired")
+							return
+						}
+						d.warn(c, dep)
+					}
+				}
+			}
+			if dep := d.types[m.Type]; dep != nil {
+				if dep.used(c.device) {
+					retiredError(c, dep)
+					return
+				}
+				d.warn(c, dep)
+			}
+			next(c, m)
+		}
+	}
+}
+
+// Protocol is the protocol version c declared, or ""
+func (c *Client) Protocol() string {
+	p, _ := c.protocol.Load().(string)
+	return p
+}
+
+// deprecationUsage is one rule in GET /api/admin/deprecations
+type deprecationUsage struct {
+	DeprecationRule
+	Feature     string               `json:"feature"`
+	Retired     bool                 `json:"retired"`
+	Uses        int64                `json:"uses"`
+	Connections int64                `json:"connections"` // connections warned
+	Rejected    int64                `json:"rejected"`
+	LastUsed    *time.Time           `json:"lastUsed,omitempty"`
+	Devices     map[string]time.Time `json:"devices,omitempty"` // recent User-Agents and their last use
+}
+
+func (d *Deprecations) usage() []deprecationUsage {
+	out := []deprecationUsage{}
+	if d == nil {
+		return out
+	}
+	now := time.Now()
+	for _, dep := range d.all {
+		u := deprecationUsage{DeprecationRule: dep.DeprecationRule, Feature: dep.feature, Retired: dep.retired(now),
+			Uses: dep.uses.Value(), Connections: dep.connections.Value(), Rejected: dep.rejected.Value(), Devices: map[string]time.Time{}}
+		dep.mu.Lock()
+		if !dep.lastUsed.IsZero() {
+			t := dep.lastUsed
+			u.LastUsed = &t
+		}
+		for k, v := range dep.devices {
+			u.Devices[k] = v
+		}
+		dep.mu.Unlock()
+		out = append(out, u)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Feature < out[j].Feature })
+	return out
+}
+
+// Register exports usage counts to m
+func (d *Deprecations) Register(m *Metrics) {
+	if d == nil {
+		return
+	}
+	samples := func(counter func(*deprecation) *Counter) func() []Sample {
+		return func() []Sample {
+			out := make([]Sample, 0, len(d.all))
+			for _, dep := range d.all {
+				out = append(out, Sample{Labels: fmt.Sprintf("feature=%q", dep.feature), Value: float64(counter(dep).Value())})
+			}
+			sort.Slice(out, func(i, j int) bool { return out[i].Labels < out[j].Labels })
+			return out
+		}
+	}
+	m.Register("ws_deprecated_uses_total", "uses of deprecated message types and protocols", "counter",
+		samples(func(dep *deprecation) *Counter { return &dep.uses }))
+	m.Register("ws_deprecated_rejected_total", "uses refused after the sunset", "counter",
+		samples(func(dep *deprecation) *Counter { return &dep.rejected }))
+}
+
+// RegisterAdmin mounts GET /api/admin/deprecations
+func (d *Deprecations) RegisterAdmin(a *AdminAPI) {
+	a.Handle("/api/admin/deprecations", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, d.usage())
+	})
+}
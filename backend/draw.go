@@ -0,0 +1,194 @@
+// backend/draw.go
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"sync"
+)
+
+/*
+DrawGame (-mode=draw) is a shared canvas per room. The server gives every
+change a sequence number and relays it in that order, so all members see
+the same stacking:
+
+	{"type":"stroke","data":{...}}          any compact JSON, kept as-is
+	-> {"type":"stroke","sender":"<id>","data":{"seq":42,"by":"alice","stroke":{...}}}
+	binary frame <bytes>                    e.g. packed points
+	-> binary frame <seq uint64 big-endian><bytes>
+	{"type":"undo"}                         removes the caller's latest stroke
+	-> {"type":"undo","data":{"seq":43,"by":"alice","target":42}}
+	{"type":"canvas.clear"}
+	-> {"type":"canvas.clear","data":{"seq":44,"by":"alice"}}
+
+Joining a room (or {"type":"canvas.get"}) sends
+{"type":"canvas.snapshot","data":{"seq":44,"strokes":[...]}} with the live
+strokes (binary ones base64 in "bin"). Binary and text frames travel on
+separate queues, so clients buffer changes until the snapshot arrives,
+then apply only those with a higher seq, in seq order.
+
+Strokes in progress belong on the ephemeral path ("ephemeral.stroke"),
+which is relayed and coalesced but never stored. A canvas keeps at most
+drawMaxStrokes strokes (the oldest fall off) and is dropped when the last
+member leaves the room.
+*/
+
+const drawMaxStrokes = 5000
+
+type drawStroke struct {
+	Seq    uint64          `json:"seq"`
+	By     string          `json:"by"`
+	Stroke json.RawMessage `json:"stroke,omitempty"`
+	Bin    []byte          `json:"bin,omitempty"`
+}
+
+type canvas struct {
+	seq     uint64
+	strokes []drawStroke
+}
+
+// DrawGame keeps a canvas per room
+type DrawGame struct {
+	hub *Hub
+
+	mu       sync.Mutex // held while sequencing and queueing, so queue order is seq order
+	canvases map[string]*canvas
+}
+
+func NewDrawGame(h *Hub) *DrawGame {
+	g := &DrawGame{hub: h, canvases: make(map[string]*canvas)}
+	h.events.Subscribe(func(e Event) {
+		switch e.Kind {
+		case EventRoomJoined:
+			if h.RoomOf(e.Client) == e.Room {
+				g.sendSnapshot(e.Client, e.Room)
+			}
+		case EventRoomDeleted:
+			g.mu.Lock()
+			if h.Rooms()[e.Room] == 0 {
+				delete(g.canvases, e.Room)
+			}
+			g.mu.Unlock()
+		}
+	}, EventRoomJoined, EventRoomDeleted)
+	return g
+}
+
+func (g *DrawGame) OnConnect(c *Client) {
+	sendSystem(c, "welcome.draw")
+}
+
+func (g *DrawGame) OnMessage(c *Client, m Message) {
+	room := g.hub.RoomOf(c)
+	if room == "" {
+		sendError(c, "draw.no_room", m.Type)
+		return
+	}
+	by := presenceIdentity(c)
+	switch m.Type {
+	case "stroke":
+		if len(m.Data) == 0 {
+			sendError(c, "draw.empty_stroke")
+			return
+		}
+		g.mu.Lock()
+		cv := g.canvasLocked(room)
+		s := cv.addLocked(by, m.Data, nil)
+		data, _ := json.Marshal(s)
+		g.hub.BroadcastRoom(room, Message{Type: "stroke", Sender: c.id, Data: data, ID: m.ID, Ts: m.Ts})
+		g.mu.Unlock()
+	case "undo":
+		g.mu.Lock()
+		cv := g.canvasLocked(room)
+		target := uint64(0)
+		for i := len(cv.strokes) - 1; i >= 0; i-- {
+			if cv.strokes[i].By == by {
+				target = cv.strokes[i].Seq
+				cv.strokes = append(cv.strokes[:i], cv.strokes[i+1:]...)
+				break
+			}
+		}
+		if target == 0 {
+			g.mu.Unlock()
+			sendError(c, "draw.nothing_to_undo")
+			return
+		}
+		cv.seq++
+		data, _ := json.Marshal(map[string]interface{}{"seq": cv.seq, "by": by, "target": target})
+		g.hub.BroadcastRoom(room, Message{Type: "undo", Sender: c.id, Data: data, ID: m.ID, Ts: m.Ts})
+		g.mu.Unlock()
+	case "canvas.clear":
+		g.mu.Lock()
+		cv := g.canvasLocked(room)
+		cv.strokes = nil
+		cv.seq++
+		data, _ := json.Marshal(map[string]interface{}{"seq": cv.seq, "by": by})
+		g.hub.BroadcastRoom(room, Message{Type: "canvas.clear", Sender: c.id, Data: data, ID: m.ID, Ts: m.Ts})
+		g.mu.Unlock()
+	case "canvas.get":
+		g.sendSnapshot(c, room)
+	default:
+		sendError(c, "message.unknown_type", m.Type)
+	}
+}
+
+func (g *DrawGame) OnBinaryMessage(c *Client, data []byte) {
+	room := g.hub.RoomOf(c)
+	if room == "" {
+		sendError(c, "draw.no_room", "binary")
+		return
+	}
+	g.mu.Lock()
+	s := g.canvasLocked(room).addLocked(presenceIdentity(c), nil, data)
+	frame := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint64(frame, s.Seq)
+	copy(frame[8:], data)
+	g.hub.BroadcastBinary(room, frame, nil)
+	g.mu.Unlock()
+}
+
+func (g *DrawGame) OnDisconnect(c *Client) {
+	// the drawing stays while the room has members
+}
+
+// canvasLocked returns room's canvas, creating it; requires g.mu
+func (g *DrawGame) canvasLocked(room string) *canvas {
+	cv := g.canvases[room]
+	if cv == nil {
+		cv = &canvas{}
+		g.canvases[room] = cv
+	}
+	return cv
+}
+
+func (cv *canvas) addLocked(by string, stroke json.RawMessage, bin []byte) drawStroke {
+	cv.seq++
+	s := drawStroke{Seq: cv.seq, By: by, Stroke: stroke}
+	if bin != nil {
+		s.Bin = append([]byte(nil), bin...)
+	}
+	cv.strokes = append(cv.strokes, s)
+	if len(cv.strokes) > drawMaxStrokes {
+		cv.strokes = append(cv.strokes[:0:0], cv.strokes[len(cv.strokes)-drawMaxStrokes:]...)
+	}
+	return s
+}
+
+// SyncSnapshot sends the canvas after a sync.request that can't be replayed
+func (g *DrawGame) SyncSnapshot(c *Client, room string) { g.sendSnapshot(c, room) }
+
+// sendSnapshot queues room's canvas for c
+func (g *DrawGame) sendSnapshot(c *Client, room string) {
+	g.mu.Lock()
+	seq, strokes := uint64(0), []drawStroke{}
+	if cv := g.canvases[room]; cv != nil {
+		seq = cv.seq
+		if len(cv.strokes) > 0 {
+			strokes = cv.strokes
+		}
+	}
+	data, _ := json.Marshal(map[string]interface{}{"seq": seq, "strokes": strokes})
+	g.mu.Unlock()
+	b, _ := json.Marshal(Message{Type: "canvas.snapshot", Sender: "server", Data: data})
+	c.sendLarge(b)
+}
@@ -0,0 +1,54 @@
+// backend/dupsession.go
+package main
+
+import "fmt"
+
+// DuplicateSessionPolicy decides what happens when an authenticated user
+// opens a second connection
+type DuplicateSessionPolicy int
+
+const (
+	DupMulti   DuplicateSessionPolicy = iota // allow; messages to the user fan out to every connection
+	DupReject                                // refuse the new connection (HTTP 409)
+	DupReplace                               // accept the new connection, close the old ones
+)
+
+// application close code sent to connections displaced by DupReplace
+const closeSessionReplaced = 4001
+
+func ParseDuplicateSessionPolicy(s string) (DuplicateSessionPolicy, error) {
+	switch s {
+	case "multi", "":
+		return DupMulti, nil
+	case "reject":
+		return DupReject, nil
+	case "replace":
+		return DupReplace, nil
+	}
+	return DupMulti, fmt.Errorf("unknown duplicate session policy %q (want multi|reject|replace)", s)
+}
+
+// UserClients returns the live connections of an authenticated user
+func (h *Hub) UserClients(userID string) []*Client {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	out := make([]*Client, 0, len(h.users[userID]))
+	for c := range h.users[userID] {
+		out = append(out, c)
+	}
+	return out
+}
+
+// SendToUser delivers msg to every connection of userID and returns how many
+// got it. Connections with a full send buffer miss the message.
+func (h *Hub) SendToUser(userID string, msg []byte) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	sent := 0
+	for c := range h.users[userID] {
+		if c.trySend(msg) {
+			sent++
+		}
+	}
+	return sent
+}
@@ -0,0 +1,58 @@
+// backend/envelope.go
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Envelope metadata. The server stamps what it relays with
+
+	id   unique message id, for deduplication
+	ts   server receive time in unix milliseconds
+	seq  position in the stream it was sent on: per room for room
+	     broadcasts, hub-wide for broadcasts to everyone
+	room the room of a room broadcast, so its seq is told apart from
+	     the hub-wide one
+
+	{"type":"message","sender":"alice","payload":"hi","room":"r1","id":"3f9a1c-1k2","ts":1714550400123,"seq":42}
+
+A client remembers the last seq of its room and of the hub-wide stream;
+when the next one is not last+1 it missed something, and sync.request
+(resync.go) gets it back. Room sequences start over when a room is
+emptied and created again. Replies to a single client
+(errors, system messages, history pages) have no seq, and fast-changing
+state such as timer ticks, ephemeral events and snapshots (snapshot.go)
+isn't sequenced at all. Whatever clients put in these fields themselves is
+overwritten.
+*/
+
+var (
+	messageIDPrefix = newMessageIDPrefix()
+	messageIDSeq    atomic.Uint64
+)
+
+func newMessageIDPrefix() string {
+	b := make([]byte, 3)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newMessageID returns an id unique to this process run
+func newMessageID() string {
+	return messageIDPrefix + "-" + strconv.FormatUint(messageIDSeq.Add(1), 36)
+}
+
+// stamp gives m an id and receive time unless it has them
+func (m *Message) stamp() {
+	if m.ID == "" {
+		m.ID = newMessageID()
+	}
+	if m.Ts == 0 {
+		m.Ts = time.Now().UnixMilli()
+	}
+}
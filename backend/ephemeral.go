@@ -0,0 +1,125 @@
+// backend/ephemeral.go
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+/*
+Ephemeral events: typing indicators, cursor positions, hovers and anything
+typed "ephemeral.*". They are relayed to the sender's room and then dropped:
+they never reach the game or the history store.
+
+They are rate limited on their own, much tighter than normal messages, and
+excess events are discarded without an error reply. When a recipient's send
+buffer is filling up, new events are not queued behind the backlog; only
+the latest event per sender and type is kept and it is written once the
+buffer drains, so a slow client sees the current state instead of every
+intermediate keystroke.
+*/
+
+// EphemeralConfig is the "ephemeral" block of the config file
+type EphemeralConfig struct {
+	Types    []string `json:"types,omitempty"`    // default ["typing", "cursor", "hover"]; "ephemeral.*" always counts
+	Rate     float64  `json:"rate,omitempty"`     // per client, all ephemeral types together; default 10/sec
+	Burst    int      `json:"burst,omitempty"`    // default 10
+	Pressure float64  `json:"pressure,omitempty"` // send buffer fill ratio at which coalescing starts, default 0.5
+}
+
+const ephemeralBucket = "ephemeral" // key in Client.buckets
+
+// queueEphemeral keeps msg as the latest event for key until the send buffer drains
+func (c *Client) queueEphemeral(key string, msg []byte) {
+	c.ephMu.Lock()
+	defer c.ephMu.Unlock()
+	if c.ephPending == nil {
+		c.ephPending = make(map[string][]byte)
+	}
+	c.ephPending[key] = msg
+}
+
+// takeEphemeral returns and clears the coalesced events (writePump only)
+func (c *Client) takeEphemeral() [][]byte {
+	c.ephMu.Lock()
+	defer c.ephMu.Unlock()
+	if len(c.ephPending) == 0 {
+		return nil
+	}
+	out := make([][]byte, 0, len(c.ephPending))
+	for _, b := range c.ephPending {
+		out = append(out, b)
+	}
+	c.ephPending = nil
+	return out
+}
+
+// BroadcastEphemeral sends msg to everyone in room except from. Recipients
+// whose send buffer is at least pressure full get it coalesced under key
+// instead.
+func (h *Hub) BroadcastEphemeral(room, key string, msg []byte, from *Client, pressure float64) int {
+	rs := h.room(room)
+	if rs == nil {
+		return 0
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	sent := 0
+	for c := range rs.members {
+		if c == from {
+			continue
+		}
+		if float64(len(c.send)) >= pressure*float64(c.sendLimit.Load()) || !c.trySend(msg) {
+			c.queueEphemeral(key, msg)
+		}
+		sent++
+	}
+	return sent
+}
+
+// EphemeralMiddleware relays ephemeral events to the room and stops them there
+func EphemeralMiddleware(hub *Hub, cfg EphemeralConfig) Middleware {
+	if len(cfg.Types) == 0 {
+		cfg.Types = []string{"typing", "cursor", "hover"}
+	}
+	if cfg.Rate <= 0 {
+		cfg.Rate = 10
+	}
+	if cfg.Burst <= 0 {
+		cfg.Burst = 10
+	}
+	if cfg.Pressure <= 0 || cfg.Pressure > 1 {
+		cfg.Pressure = 0.5
+	}
+	types := make(map[string]bool)
+	for _, t := range cfg.Types {
+		types[t] = true
+	}
+	limit := RateLimit{Rate: cfg.Rate, Burst: cfg.Burst}
+	return func(next MessageHandler) MessageHandler {
+		return func(c *Client, m Message) {
+			if !types[m.Type] && !strings.HasPrefix(m.Type, "ephemeral.") {
+				next(c, m)
+				return
+			}
+			room := hub.RoomOf(c)
+			if room == "" || !hub.Feature("ephemeral", c, room) {
+				return
+			}
+			if c.buckets == nil {
+				c.buckets = make(map[string]*tokenBucket)
+			}
+			b := c.buckets[ephemeralBucket]
+			if b == nil {
+				b = &tokenBucket{}
+				c.buckets[ephemeralBucket] = b
+			}
+			if !b.allow(limit, time.Now()) {
+				return // an error reply would cost more than the event
+			}
+			out, _ := json.Marshal(Message{Type: m.Type, Sender: m.Sender, Payload: m.Payload, Data: m.Data})
+			hub.BroadcastEphemeral(room, m.Sender+"\x00"+m.Type, out, c, cfg.Pressure)
+		}
+	}
+}
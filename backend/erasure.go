@@ -0,0 +1,198 @@
+// backend/erasure.go
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+Right-to-erasure requests. Everything the server stores about a user is
+deleted or anonymized in one go:
+
+	DELETE /api/admin/users/{id}                  delete their messages
+	DELETE /api/admin/users/{id}?mode=anonymize   keep messages under an alias
+	console: forget <user id> [anonymize]
+
+Either way the profile (friend lists included), device tokens, inbox,
+quota overrides and anti-cheat mute are removed, as is whatever the
+stores registered with OnErase hold: dead letters, reports filed by or
+about the user (and their messages in other reports' context) and
+federated messages still queued for peers. Match results are kept for
+the other players with the user replaced by a random "deleted-…" alias.
+The user's session tokens are voided, their connections are closed and
+every connected client gets a tombstone
+
+	{"type":"user.deleted","data":{"user":"alice","alias":"deleted-3f9a1c02"}}
+
+so UIs can drop or relabel what they show. History logs are compacted
+right away so the old lines are gone from disk as well. The audit log is
+kept as the record that the erasure happened.
+*/
+
+// ErasureReport says what Erase removed
+type ErasureReport struct {
+	User        string `json:"user"`
+	Alias       string `json:"alias"`
+	Anonymized  bool   `json:"anonymized"`
+	Messages    int    `json:"messages"` // deleted or anonymized
+	Profile     bool   `json:"profile"`
+	Devices     int    `json:"devices"`
+	Inbox       int    `json:"inbox"` // notifications deleted
+	Matches     int    `json:"matches"`
+	Connections int    `json:"connections"`
+
+	Stores map[string]int `json:"stores,omitempty"` // entries removed per OnErase store
+}
+
+// erasureHook is a store registered with OnErase
+type erasureHook struct {
+	name   string
+	forget func(userID string) (int, error)
+}
+
+// Eraser removes a user's data from every store
+type Eraser struct {
+	hubs      []*Hub
+	histories []HistoryStore
+	users     UserStore // nil without a user store
+	push      *Push
+	inbox     *Inbox
+	friends   *Friends
+	matches   *MatchStore
+	quotas    *Quotas
+	antiCheat *AntiCheatEngine
+	sessions  *SessionManager // nil = tokens aren't voided
+	audit     *AuditLog
+	hooks     []erasureHook
+}
+
+// OnErase has Erase call forget for every erased user; name labels its
+// count in the report
+func (e *Eraser) OnErase(name string, forget func(userID string) (int, error)) {
+	e.hooks = append(e.hooks, erasureHook{name, forget})
+}
+
+func newErasureAlias() string {
+	b := make([]byte, 4)
+	io.ReadFull(rand.Reader, b)
+	return "deleted-" + hex.EncodeToString(b)
+}
+
+// Erase deletes (or, with anonymize, detaches) everything stored about
+// userID. It keeps going after a failing store and returns the first error.
+func (e *Eraser) Erase(userID string, anonymize bool, actor string) (ErasureReport, error) {
+	rep := ErasureReport{User: userID, Alias: newErasureAlias(), Anonymized: anonymize}
+	var firstErr error
+	fail := func(what string, err error) {
+		if err != nil {
+			log.Printf("erase %s: %s: %v", userID, what, err)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: %v", what, err)
+			}
+		}
+	}
+
+	if e.sessions != nil {
+		// before the kick, so the closed connections can't come back
+		fail("sessions", e.sessions.RevokeUser(userID, ""))
+	}
+	for _, h := range e.hubs {
+		for _, c := range h.UserClients(userID) {
+			c.kick(websocket.ClosePolicyViolation, "account deleted")
+			rep.Connections++
+		}
+	}
+	for _, store := range e.histories {
+		var n int
+		var err error
+		if anonymize {
+			n, err = store.Anonymize(userID, rep.Alias)
+		} else {
+			n, err = store.DeleteOldest(HistoryFilter{UserID: userID}, 0)
+			if c, ok := store.(interface{ Compact() error }); ok && err == nil && n > 0 {
+				err = c.Compact()
+			}
+		}
+		rep.Messages += n
+		fail("history", err)
+	}
+	if e.friends != nil {
+		fail("friends", e.friends.Forget(userID))
+	}
+	if e.users != nil {
+		var err error
+		rep.Profile, err = e.users.Delete(userID)
+		fail("profile", err)
+	}
+	var err error
+	rep.Devices, err = e.push.Forget(userID)
+	fail("push tokens", err)
+	if e.inbox != nil {
+		rep.Inbox, err = e.inbox.Forget(userID)
+		fail("inbox", err)
+	}
+	if e.matches != nil {
+		rep.Matches, err = e.matches.Anonymize(userID, rep.Alias)
+		fail("matches", err)
+	}
+	if e.quotas != nil {
+		fail("quotas", e.quotas.SetUser(userID, nil))
+	}
+	e.antiCheat.Unmute(userID)
+	for _, hook := range e.hooks {
+		n, err := hook.forget(userID)
+		if n > 0 {
+			if rep.Stores == nil {
+				rep.Stores = make(map[string]int)
+			}
+			rep.Stores[hook.name] = n
+		}
+		fail(hook.name, err)
+	}
+
+	data, _ := json.Marshal(map[string]string{"user": userID, "alias": rep.Alias})
+	for _, h := range e.hubs {
+		h.BroadcastGlobal(Message{Type: "user.deleted", Sender: "server", Data: data})
+	}
+	mode := "delete"
+	if anonymize {
+		mode = "anonymize"
+	}
+	e.audit.Record(actor, "user.erase", userID, fmt.Sprintf("%s: %d messages, %d matches, %d devices", mode, rep.Messages, rep.Matches, rep.Devices))
+	return rep, firstErr
+}
+
+// RegisterAdmin mounts DELETE /api/admin/users/{id}
+func (e *Eraser) RegisterAdmin(a *AdminAPI) {
+	a.Handle("/api/admin/users/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			writeJSONError(w, http.StatusMethodNotAllowed, "use DELETE")
+			return
+		}
+		id := strings.TrimPrefix(r.URL.Path, "/api/admin/users/")
+		if id == "" {
+			writeJSONError(w, http.StatusNotFound, "want /api/admin/users/{id}")
+			return
+		}
+		mode := r.URL.Query().Get("mode")
+		if mode != "" && mode != "delete" && mode != "anonymize" {
+			writeJSONError(w, http.StatusBadRequest, "mode must be delete or anonymize")
+			return
+		}
+		rep, err := e.Erase(id, mode == "anonymize", adminActor(r))
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": err.Error(), "report": rep})
+			return
+		}
+		writeJSON(w, http.StatusOK, rep)
+	})
+}
@@ -0,0 +1,146 @@
+// backend/errors.go
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+/*
+Error replies. Every error the server sends a client has one shape:
+
+	{"type":"error","sender":"server","code":"ratelimit.exceeded",
+	 "payload":"rate limit exceeded for \"chat\": max 5/sec",
+	 "data":{"status":429,"retryAfterMs":180,"details":{"type":"chat","rate":5,"burst":5}}}
+
+code is the stable id of the error and payload its text in the client's
+locale (see i18n.go). data.status is a numeric class borrowed from HTTP,
+for clients that handle errors by kind rather than one code at a time:
+
+	400  the message is malformed, or of a type nothing handles
+	401  log in first
+	403  not allowed: permissions, bans, moderators-only rooms
+	404  what the message names doesn't exist
+	409  not now: not in a room, already queued, no game running, ...
+	410  retired: a deprecated message type past its sunset (deprecation.go)
+	413  too large
+	422  refused by the game's rules or validation script
+	429  rate limited
+	500  the server failed; the message was not processed
+	503  temporarily unavailable
+
+retryAfterMs is there when the same message will be accepted after that
+long (rate limits), details when the error has arguments a client may
+want to show or act on. Codes not listed in errorStatuses are 400.
+*/
+
+// ErrorData is the data of "error" messages
+type ErrorData struct {
+	Status     int         `json:"status"`
+	RetryAfter int64       `json:"retryAfterMs,omitempty"`
+	Details    interface{} `json:"details,omitempty"`
+}
+
+// errorStatuses maps error codes to their status class; the rest are 400
+var errorStatuses = map[string]int{
+	"auth.required":           401,
+	"sessions.login_required": 401,
+
+	"room.no_permission":     403,
+	"room.private_denied":    403,
+	"room.not_owner":         403,
+	"room.banned":            403,
+	"party.not_leader":       403,
+	"report.moderators_only": 403,
+	"tags.not_allowed":       403,
+
+	"tournament.unknown":       404,
+	"sessions.not_found":       404,
+	"party.bad_code":           404,
+	"party.not_member":         404,
+	"party.user_offline":       404,
+	"friends.no_request":       404,
+	"report.message_not_found": 404,
+	"locale.unknown":           404,
+
+	"room.taken":                409,
+	"room.in_use":               409,
+	"room.not_member":           409,
+	"history.no_room":           409,
+	"history.disabled":          409,
+	"aoi.no_position":           409,
+	"trivia.no_room":            409,
+	"trivia.running":            409,
+	"trivia.not_running":        409,
+	"trivia.already_answered":   409,
+	"draw.no_room":              409,
+	"draw.nothing_to_undo":      409,
+	"rules.no_room":             409,
+	"rules.not_started":         409,
+	"timer.no_room":             409,
+	"party.already_in":          409,
+	"party.not_in":              409,
+	"party.full":                409,
+	"party.too_big":             409,
+	"party.members_away":        409,
+	"queue.already":             409,
+	"queue.not_in":              409,
+	"friends.already":           409,
+	"friends.blocked":           409,
+	"tournament.closed":         409,
+	"tournament.full":           409,
+	"tournament.not_registered": 409,
+	"report.duplicate":          409,
+
+	"deprecated.retired": 410,
+
+	"ratelimit.too_large": 413,
+
+	"rules.illegal":   422,
+	"script.rejected": 422,
+
+	"ratelimit.exceeded": 429,
+
+	"failed":       500,
+	"game.panic":   500,
+	"script.error": 500,
+
+	"history.unavailable": 503,
+}
+
+// errorStatus is code's status class
+func errorStatus(code string) int {
+	if s, ok := errorStatuses[code]; ok {
+		return s
+	}
+	return 400
+}
+
+// errorReply is the optional part of an error reply
+type errorReply struct {
+	retryAfter time.Duration
+	details    interface{}
+}
+
+// sendError replies to c with a localized "error" message
+func sendError(c *Client, code string, args ...interface{}) {
+	sendErrorReply(c, code, errorReply{}, args...)
+}
+
+// sendErrorReply is sendError with a retry hint or details
+func sendErrorReply(c *Client, code string, r errorReply, args ...interface{}) {
+	text := c.T(code, args...)
+	c.hub.deadLetters.rejected(c, code, text)
+	d := ErrorData{Status: errorStatus(code), Details: r.details}
+	if r.retryAfter > 0 {
+		// round up, so retrying right on time doesn't fail again
+		d.RetryAfter = int64((r.retryAfter + time.Millisecond - 1) / time.Millisecond)
+	}
+	data, _ := json.Marshal(d)
+	m := Message{Type: "error", Sender: "server", Code: code, Payload: text, Data: data}
+	if !c.hub.router.route("out", c, m) {
+		return
+	}
+	b, _ := json.Marshal(m)
+	c.Send(b)
+}
@@ -0,0 +1,137 @@
+// backend/events.go
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Internal publish/subscribe event bus.
+Subsystems (metrics, webhooks, moderation, ...) subscribe here instead of
+hooking into the Hub directly. Every subscriber gets its own buffered queue
+and goroutine, so a slow subscriber never blocks the hub; when its queue is
+full, events for that subscriber are dropped. Subscribers that can't lose
+events (captures, presence) use SubscribeSync instead, which runs them on
+the publisher's goroutine.
+*/
+
+// EventKind names a hub event
+type EventKind string
+
+const (
+	EventClientConnected    EventKind = "client.connected"
+	EventClientDisconnected EventKind = "client.disconnected"
+	EventMessageReceived    EventKind = "message.received"
+	EventRoomCreated        EventKind = "room.created"
+	EventRoomJoined         EventKind = "room.joined"
+	EventRoomDeleted        EventKind = "room.deleted" // last member left
+	EventBroadcastSent      EventKind = "broadcast.sent"
+	EventMatchFinished      EventKind = "match.finished"
+	EventMessageRouted      EventKind = "message.routed" // see routing.go
+)
+
+// Event is published on the bus. Only the fields relevant to Kind are set.
+type Event struct {
+	Kind       EventKind
+	Time       time.Time
+	Client     *Client     // connect/disconnect/message
+	Room       string      // room events
+	Message    *Message    // message received or routed
+	Payload    []byte      // raw broadcast payload, or the routed message
+	Recipients int         // broadcast fan-out
+	Result     *GameResult // match finished
+}
+
+const subscriberQueueSize = 256
+
+type subscription struct {
+	kinds map[EventKind]bool // empty = all kinds
+	ch    chan Event         // nil for SubscribeSync
+	fn    func(Event)        // SubscribeSync only
+	drops atomic.Int64
+}
+
+// EventBus fans events out to subscribers
+type EventBus struct {
+	mu   sync.RWMutex
+	subs map[*subscription]bool
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subs: make(map[*subscription]bool)}
+}
+
+// Subscribe calls fn for every event of the given kinds (all kinds if none given).
+// fn runs on the subscription's own goroutine. The returned func unsubscribes.
+func (b *EventBus) Subscribe(fn func(Event), kinds ...EventKind) (unsubscribe func()) {
+	s := &subscription{kinds: make(map[EventKind]bool), ch: make(chan Event, subscriberQueueSize)}
+	for _, k := range kinds {
+		s.kinds[k] = true
+	}
+	b.mu.Lock()
+	b.subs[s] = true
+	b.mu.Unlock()
+
+	go func() {
+		for e := range s.ch {
+			fn(e)
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, s)
+			close(s.ch)
+			b.mu.Unlock()
+		})
+	}
+}
+
+// SubscribeSync calls fn for every event of the given kinds (all kinds if
+// none given) before Publish returns, so no event is ever dropped. fn runs
+// on the publisher's goroutine, often the hub's, and must be quick and not
+// call back into the hub.
+func (b *EventBus) SubscribeSync(fn func(Event), kinds ...EventKind) (unsubscribe func()) {
+	s := &subscription{kinds: make(map[EventKind]bool), fn: fn}
+	for _, k := range kinds {
+		s.kinds[k] = true
+	}
+	b.mu.Lock()
+	b.subs[s] = true
+	b.mu.Unlock()
+	return func() {
+		b.mu.Lock()
+		delete(b.subs, s)
+		b.mu.Unlock()
+	}
+}
+
+// Publish delivers e to matching subscribers without blocking
+func (b *EventBus) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for s := range b.subs {
+		if len(s.kinds) > 0 && !s.kinds[e.Kind] {
+			continue
+		}
+		if s.fn != nil {
+			s.fn(e)
+			continue
+		}
+		select {
+		case s.ch <- e:
+		default:
+			if n := s.drops.Add(1); n%100 == 1 {
+				log.Printf("event bus: subscriber queue full, dropped %d events", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,207 @@
+// backend/export.go
+package main
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+History export, for compliance and data-portability requests.
+
+	GET /api/export?format=csv&room=lobby&from=2024-01-01&to=2024-02-01
+	    (session token) the caller's own messages
+	GET /api/admin/export?room=lobby&user=alice&format=zip
+	    (admin token) any room and/or user
+
+format is jsonl (default), csv or zip (export.jsonl plus manifest.json);
+from is inclusive and to exclusive, as RFC 3339 times or dates. Exports
+are rate-limited per caller (exportRate) and admin exports are audited.
+*/
+
+// exportRate allows a burst of 3 exports, then one a minute
+var exportRate = RateLimit{Rate: 1.0 / 60, Burst: 3}
+
+// Exporter streams history in export formats
+type Exporter struct {
+	store    HistoryStore
+	sessions *SessionManager
+	audit    *AuditLog
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket // caller -> bucket
+}
+
+func NewExporter(store HistoryStore, sessions *SessionManager) *Exporter {
+	return &Exporter{store: store, sessions: sessions, buckets: make(map[string]*tokenBucket)}
+}
+
+func (e *Exporter) allow(caller string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	b := e.buckets[caller]
+	if b == nil {
+		b = &tokenBucket{}
+		e.buckets[caller] = b
+	}
+	return b.allow(exportRate, time.Now())
+}
+
+// parseExportTime accepts RFC 3339 or a plain date
+func parseExportTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
+// exportFilter reads room, user, from and to from the query
+func exportFilter(r *http.Request) (HistoryFilter, error) {
+	q := r.URL.Query()
+	f := HistoryFilter{Room: q.Get("room"), UserID: q.Get("user")}
+	var err error
+	if f.Since, err = parseExportTime(q.Get("from")); err != nil {
+		return f, fmt.Errorf("from: %v", err)
+	}
+	if f.Until, err = parseExportTime(q.Get("to")); err != nil {
+		return f, fmt.Errorf("to: %v", err)
+	}
+	return f, nil
+}
+
+// serve checks the format and rate limit, then writes the export
+func (e *Exporter) serve(w http.ResponseWriter, r *http.Request, caller string, f HistoryFilter) bool {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "use GET")
+		return false
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "jsonl"
+	}
+	if format != "jsonl" && format != "csv" && format != "zip" {
+		writeJSONError(w, http.StatusBadRequest, "format must be jsonl, csv or zip")
+		return false
+	}
+	if !e.allow(caller) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(1/exportRate.Rate)))
+		writeJSONError(w, http.StatusTooManyRequests, "export rate limit exceeded")
+		return false
+	}
+	msgs, err := e.store.Query(f)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return false
+	}
+	name := "export-" + time.Now().UTC().Format("20060102-150405")
+	switch format {
+	case "jsonl":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.jsonl"`)
+		err = writeExportJSONL(w, msgs)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.csv"`)
+		err = writeExportCSV(w, msgs)
+	case "zip":
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.zip"`)
+		err = writeExportZip(w, msgs, f)
+	}
+	if err != nil {
+		// headers are gone; all we can do is cut the download short
+		panic(http.ErrAbortHandler)
+	}
+	return true
+}
+
+func writeExportJSONL(w io.Writer, msgs []StoredMessage) error {
+	enc := json.NewEncoder(w)
+	for i := range msgs {
+		if err := enc.Encode(&msgs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeExportCSV(w io.Writer, msgs []StoredMessage) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "time", "room", "sender", "userId", "type", "payload", "data"})
+	for _, m := range msgs {
+		cw.Write([]string{strconv.FormatInt(m.ID, 10), m.Time.UTC().Format(time.RFC3339Nano), m.Room, m.Sender, m.UserID, m.Type, m.Payload, string(m.Data)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeExportZip(w io.Writer, msgs []StoredMessage, f HistoryFilter) error {
+	zw := zip.NewWriter(w)
+	part, err := zw.Create("export.jsonl")
+	if err != nil {
+		return err
+	}
+	if err := writeExportJSONL(part, msgs); err != nil {
+		return err
+	}
+	if part, err = zw.Create("manifest.json"); err != nil {
+		return err
+	}
+	manifest := map[string]interface{}{
+		"generated": time.Now().UTC(),
+		"messages":  len(msgs),
+		"room":      f.Room,
+		"user":      f.UserID,
+	}
+	if !f.Since.IsZero() {
+		manifest["from"] = f.Since
+	}
+	if !f.Until.IsZero() {
+		manifest["to"] = f.Until
+	}
+	b, _ := json.MarshalIndent(manifest, "", "  ")
+	if _, err := part.Write(b); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// ServeHTTP answers GET /api/export with the caller's own messages
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	claims, err := e.sessions.FromRequest(r)
+	if err != nil || claims == nil {
+		writeJSONError(w, http.StatusUnauthorized, "log in first")
+		return
+	}
+	f, err := exportFilter(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	f.UserID = claims.Sub // users export only what they wrote
+	e.serve(w, r, "user:"+claims.Sub, f)
+}
+
+// RegisterAdmin mounts /api/admin/export
+func (e *Exporter) RegisterAdmin(a *AdminAPI) {
+	a.Handle("/api/admin/export", func(w http.ResponseWriter, r *http.Request) {
+		f, err := exportFilter(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if e.serve(w, r, "admin", f) {
+			e.audit.Record(adminActor(r), "history.export", f.Room, r.URL.RawQuery)
+		}
+	})
+}
@@ -0,0 +1,231 @@
+// backend/features.go
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+/*
+Feature flags. A flag is on or off per room, per tenant, per game
+(mount path) or for everything, the most specific setting winning in
+that order:
+
+	"features": {
+		"history":   {"default": true, "games": {"/draw": false}, "rooms": {"scratch": false}},
+		"ephemeral": {"tenants": {"acme": false}, "rooms": {"exam": false}}
+	}
+
+The tenant is the "tenant" claim of the session token of the
+connection the flag is asked for; anonymous connections have none.
+
+Operators change them at runtime through the admin API; those overrides
+are saved to -features-file and win over the config file on the same level.
+
+	GET    /api/admin/features                       config, overrides and built-in defaults
+	GET    /api/admin/features/{flag}?game=/ws&tenant=t&room=r  effective value
+	PUT    /api/admin/features/{flag}?room=r         {"enabled":false}; ?tenant=acme, ?game=/draw, or none for the default
+	DELETE /api/admin/features/{flag}?room=r         drop the override
+
+Code asks hub.Feature(flag, c) for client c in its room. Flags nobody configured fall back to
+their built-in default (featureDefaults), and unknown flags are off.
+*/
+
+// featureDefaults are the built-in flags and their values when unconfigured
+var featureDefaults = map[string]bool{
+	"history":   true, // persist room messages and answer history.get
+	"ephemeral": true, // relay typing/cursor events
+}
+
+// FeatureFlag is one flag's settings; unset levels defer to the next one
+type FeatureFlag struct {
+	Default *bool           `json:"default,omitempty"`
+	Games   map[string]bool `json:"games,omitempty"`   // by mount path, e.g. "/ws"
+	Tenants map[string]bool `json:"tenants,omitempty"` // by session token tenant
+	Rooms   map[string]bool `json:"rooms,omitempty"`
+}
+
+// Features resolves flags from the config and runtime overrides
+type Features struct {
+	config map[string]FeatureFlag
+	path   string // "" keeps overrides in memory only
+
+	mu        sync.Mutex
+	overrides map[string]FeatureFlag
+}
+
+// NewFeatures loads the overrides saved at path (a missing file is none)
+func NewFeatures(config map[string]FeatureFlag, path string) (*Features, error) {
+	f := &Features{config: config, path: path, overrides: make(map[string]FeatureFlag)}
+	if path == "" {
+		return f, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &f.overrides); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Enabled reports whether flag is on in room of game for tenant. A nil
+// Features has every flag at its built-in default.
+func (f *Features) Enabled(flag, game, tenant, room string) bool {
+	if f == nil {
+		return featureDefaults[flag]
+	}
+	f.mu.Lock()
+	over := f.overrides[flag]
+	f.mu.Unlock()
+	conf := f.config[flag]
+	// room, tenant, game, then default; on each level an override beats
+	// the config
+	if on, ok := over.Rooms[room]; ok && room != "" {
+		return on
+	}
+	if on, ok := conf.Rooms[room]; ok && room != "" {
+		return on
+	}
+	if on, ok := over.Tenants[tenant]; ok && tenant != "" {
+		return on
+	}
+	if on, ok := conf.Tenants[tenant]; ok && tenant != "" {
+		return on
+	}
+	if on, ok := over.Games[game]; ok {
+		return on
+	}
+	if on, ok := conf.Games[game]; ok {
+		return on
+	}
+	if over.Default != nil {
+		return *over.Default
+	}
+	if conf.Default != nil {
+		return *conf.Default
+	}
+	return featureDefaults[flag]
+}
+
+// Set overrides flag for room, else tenant, else game, else everything;
+// nil removes the override
+func (f *Features) Set(flag, game, tenant, room string, on *bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// copy, since Enabled reads the old value without the lock
+	old := f.overrides[flag]
+	fl := FeatureFlag{Default: old.Default, Games: copyFlagMap(old.Games), Tenants: copyFlagMap(old.Tenants), Rooms: copyFlagMap(old.Rooms)}
+	switch {
+	case room != "" && on == nil:
+		delete(fl.Rooms, room)
+	case room != "":
+		fl.Rooms[room] = *on
+	case tenant != "" && on == nil:
+		delete(fl.Tenants, tenant)
+	case tenant != "":
+		fl.Tenants[tenant] = *on
+	case game != "" && on == nil:
+		delete(fl.Games, game)
+	case game != "":
+		fl.Games[game] = *on
+	default:
+		fl.Default = on
+	}
+	if fl.Default == nil && len(fl.Games) == 0 && len(fl.Tenants) == 0 && len(fl.Rooms) == 0 {
+		delete(f.overrides, flag)
+	} else {
+		f.overrides[flag] = fl
+	}
+	if f.path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(f.overrides, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(f.path, b)
+}
+
+func copyFlagMap(m map[string]bool) map[string]bool {
+	cp := make(map[string]bool, len(m))
+	for k, v := range m {
+		cp[k] = v
+	}
+	return cp
+}
+
+// Feature reports whether flag is on for c in room of this hub's game
+func (h *Hub) Feature(flag string, c *Client, room string) bool {
+	return h.features.Enabled(flag, h.path, c.Tenant(), room)
+}
+
+// RegisterAdmin mounts the feature flag endpoints
+func (f *Features) RegisterAdmin(a *AdminAPI) {
+	a.Handle("/api/admin/features", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		overrides := make(map[string]FeatureFlag, len(f.overrides))
+		for k, v := range f.overrides {
+			overrides[k] = v
+		}
+		f.mu.Unlock()
+		writeJSON(w, http.StatusOK, map[string]interface{}{"config": f.config, "overrides": overrides, "builtin": featureDefaults})
+	})
+	a.Handle("/api/admin/features/", func(w http.ResponseWriter, r *http.Request) {
+		flag := strings.TrimPrefix(r.URL.Path, "/api/admin/features/")
+		if flag == "" || strings.Contains(flag, "/") {
+			writeJSONError(w, http.StatusNotFound, "want /api/admin/features/{flag}")
+			return
+		}
+		q := r.URL.Query()
+		game, tenant, room := q.Get("game"), q.Get("tenant"), q.Get("room")
+		var on *bool
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, map[string]bool{"enabled": f.Enabled(flag, game, tenant, room)})
+			return
+		case http.MethodPut:
+			var body struct {
+				Enabled *bool `json:"enabled"`
+			}
+			if err := readJSON(w, r, &body); err != nil || body.Enabled == nil {
+				writeJSONError(w, http.StatusBadRequest, `want {"enabled":true|false}`)
+				return
+			}
+			on = body.Enabled
+		case http.MethodDelete:
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, "use GET, PUT or DELETE")
+			return
+		}
+		if err := f.Set(flag, game, tenant, room, on); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		scope := "default"
+		if room != "" {
+			scope = "room " + room
+		} else if tenant != "" {
+			scope = "tenant " + tenant
+		} else if game != "" {
+			scope = "game " + game
+		}
+		state := "cleared"
+		if on != nil {
+			state = fmt.Sprint(*on)
+		}
+		log.Printf("admin: feature %s for %s: %s", flag, scope, state)
+		a.audit.Record(adminActor(r), "feature.set", flag, scope+": "+state)
+		writeJSON(w, http.StatusOK, map[string]bool{"enabled": f.Enabled(flag, game, tenant, room)})
+	})
+}
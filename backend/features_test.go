@@ -0,0 +1,45 @@
+// backend/features_test.go
+package main
+
+import "testing"
+
+// TestFeatureLevels resolves a flag set on every level
+func TestFeatureLevels(t *testing.T) {
+	on, off := true, false
+	f, err := NewFeatures(map[string]FeatureFlag{
+		"history": {Default: &off, Games: map[string]bool{"/ws": true}, Tenants: map[string]bool{"acme": false}},
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Set("history", "", "", "exam", &on); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		game, tenant, room string
+		want               bool
+	}{
+		{"/draw", "", "", false},
+		{"/ws", "", "r", true},
+		{"/ws", "acme", "r", false},
+		{"/ws", "acme", "exam", true},
+		{"/ws", "other", "r", true},
+	} {
+		if got := f.Enabled("history", tc.game, tc.tenant, tc.room); got != tc.want {
+			t.Errorf("game %q tenant %q room %q: %v, want %v", tc.game, tc.tenant, tc.room, got, tc.want)
+		}
+	}
+	// a tenant override beats the tenant's config, and clearing it restores it
+	if err := f.Set("history", "", "acme", "", &on); err != nil {
+		t.Fatal(err)
+	}
+	if !f.Enabled("history", "/ws", "acme", "r") {
+		t.Fatal("tenant override ignored")
+	}
+	if err := f.Set("history", "", "acme", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if f.Enabled("history", "/ws", "acme", "r") {
+		t.Fatal("cleared tenant override still applies")
+	}
+}
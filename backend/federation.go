@@ -0,0 +1,540 @@
+// backend/federation.go
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+Federation: direct messages between users of different servers. Each
+server has a domain and an ed25519 key, and lists the peers it exchanges
+messages with and their public keys:
+
+	"federation": {
+	  "domain": "chat.example.com",
+	  "keyFile": "federation.key",
+	  "maxAge": "24h",
+	  "peers": [{"domain": "games.example.org", "url": "wss://games.example.org/federation", "key": "<hex public key>"}]
+	}
+
+keyFile holds the private key seed in hex and is created on first start;
+the public key to give to peers is logged. Users of a peer are addressed
+as user@domain:
+
+	{"type":"dm","payload":"hi","data":{"to":"bob@games.example.org"}}
+
+and bob gets {"type":"dm","sender":"alice@chat.example.com",...}, to which
+he replies the same way. Addresses with our own domain are local users;
+other domains that aren't peers are left alone, since local user ids may
+contain '@' too.
+
+Messages for a peer are signed and queued (in the database with -db),
+and a link per peer, a websocket to the peer's /federation endpoint,
+sends them one at a time until the peer acknowledges each. While the peer
+is unreachable the link retries with backoff; messages still queued after
+maxAge, and messages the peer refuses (bad signature, unknown origin),
+come back to their sender as a "dm.undelivered" inbox item. Delivery is
+at least once: the receiver ignores envelope ids it has seen, but only
+remembers them until it restarts. Block lists apply to remote senders by
+their full address.
+
+	GET /api/admin/federation    our public key and the state of each link
+*/
+
+const (
+	fedAckTimeout    = 10 * time.Second
+	fedLinkIdle      = time.Minute // a link with nothing to send is closed after this
+	fedMaxBackoff    = 5 * time.Minute
+	fedMaxEnvelope   = 64 << 10
+	fedDefaultMaxAge = 24 * time.Hour
+)
+
+// FederationConfig is the "federation" config block; no domain = off
+type FederationConfig struct {
+	Domain  string           `json:"domain,omitempty"`
+	KeyFile string           `json:"keyFile,omitempty"` // default federation.key
+	MaxAge  Duration         `json:"maxAge,omitempty"`  // how long undelivered messages are retried, default 24h
+	Peers   []FederationPeer `json:"peers,omitempty"`
+}
+
+// FederationPeer is a server we exchange messages with
+type FederationPeer struct {
+	Domain string `json:"domain"`
+	URL    string `json:"url"` // its /federation endpoint, ws:// or wss://
+	Key    string `json:"key"` // its ed25519 public key, hex
+}
+
+// FedEnvelope is one message between servers
+type FedEnvelope struct {
+	ID      string    `json:"id"`
+	Origin  string    `json:"origin"` // sending domain
+	Dest    string    `json:"dest"`   // receiving domain
+	From    string    `json:"from"`   // user at origin
+	To      string    `json:"to"`     // user at dest
+	Time    time.Time `json:"time"`
+	Payload string    `json:"payload"`
+	Sig     []byte    `json:"sig,omitempty"` // ed25519 over the envelope without sig
+}
+
+func (e FedEnvelope) signedBytes() []byte {
+	e.Sig = nil
+	b, _ := json.Marshal(e)
+	return b
+}
+
+// fedAck answers an envelope; Error means it was refused for good
+type fedAck struct {
+	ID    string `json:"id"`
+	Error string `json:"error,omitempty"`
+}
+
+// Federation sends and receives direct messages of other servers' users
+type Federation struct {
+	domain  string
+	key     ed25519.PrivateKey
+	maxAge  time.Duration
+	peers   map[string]*fedPeer // domain -> peer
+	push    *Push
+	friends *Friends
+	inbox   *Inbox
+	db      *SQLiteDB // nil = queues in memory only
+
+	mu        sync.Mutex
+	seen      map[string]time.Time // received envelope ids
+	lastPrune time.Time
+}
+
+type fedPeer struct {
+	FederationPeer
+	pub  ed25519.PublicKey
+	wake chan struct{} // cap 1; signalled when something is queued
+
+	mu        sync.Mutex
+	queue     []FedEnvelope
+	connected bool
+	lastError string
+	delivered int64
+}
+
+// NewFederation returns nil when cfg sets no domain
+func NewFederation(cfg FederationConfig, push *Push, friends *Friends, inbox *Inbox) (*Federation, error) {
+	if cfg.Domain == "" {
+		return nil, nil
+	}
+	key, err := loadFederationKey(cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	f := &Federation{domain: cfg.Domain, key: key, maxAge: time.Duration(cfg.MaxAge), peers: make(map[string]*fedPeer),
+		push: push, friends: friends, inbox: inbox, seen: make(map[string]time.Time)}
+	if f.maxAge <= 0 {
+		f.maxAge = fedDefaultMaxAge
+	}
+	for _, p := range cfg.Peers {
+		pub, err := hex.DecodeString(p.Key)
+		if err != nil || len(pub) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("peer %s: key is not a hex ed25519 public key", p.Domain)
+		}
+		if p.Domain == "" || p.Domain == cfg.Domain || !strings.HasPrefix(p.URL, "ws") {
+			return nil, fmt.Errorf("peer %q: needs its own domain and a ws:// or wss:// url", p.Domain)
+		}
+		f.peers[p.Domain] = &fedPeer{FederationPeer: p, pub: pub, wake: make(chan struct{}, 1)}
+	}
+	log.Printf("federation: domain %s, public key %s, %d peer(s)", f.domain, hex.EncodeToString(key.Public().(ed25519.PublicKey)), len(f.peers))
+	return f, nil
+}
+
+// loadFederationKey reads the key seed at path, creating it if missing
+func loadFederationKey(path string) (ed25519.PrivateKey, error) {
+	if path == "" {
+		path = "federation.key"
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		seed := make([]byte, ed25519.SeedSize)
+		if _, err := rand.Read(seed); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, []byte(hex.EncodeToString(seed)+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		log.Printf("federation: created key %s", path)
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s: not a hex ed25519 seed", path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// UseDB loads the queued envelopes and queues new ones in db
+func (f *Federation) UseDB(db *SQLiteDB) error {
+	envs, err := db.fedOutbox()
+	if err != nil {
+		return err
+	}
+	f.db = db
+	for _, e := range envs {
+		p := f.peers[e.Dest]
+		if p == nil {
+			log.Printf("federation: dropping queued message %s for %s, no longer a peer", e.ID, e.Dest)
+			db.deleteFedEnvelope(e.ID)
+			continue
+		}
+		p.queue = append(p.queue, e)
+	}
+	return nil
+}
+
+// Start runs a link to every peer
+func (f *Federation) Start() {
+	for _, p := range f.peers {
+		go f.link(p)
+	}
+}
+
+// Send signs a message from user to the user to at peer and queues it
+func (f *Federation) Send(from string, p *fedPeer, to, payload string) error {
+	b := make([]byte, 16)
+	rand.Read(b)
+	e := FedEnvelope{ID: hex.EncodeToString(b), Origin: f.domain, Dest: p.Domain, From: from, To: to, Time: time.Now().UTC(), Payload: payload}
+	e.Sig = ed25519.Sign(f.key, e.signedBytes())
+	if f.db != nil {
+		if err := f.db.saveFedEnvelope(e); err != nil {
+			return err
+		}
+	}
+	p.mu.Lock()
+	p.queue = append(p.queue, e)
+	p.mu.Unlock()
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// dequeue removes envelope id from p's queue
+func (f *Federation) dequeue(p *fedPeer, id string) {
+	p.mu.Lock()
+	for i, e := range p.queue {
+		if e.ID == id {
+			p.queue = append(p.queue[:i], p.queue[i+1:]...)
+			break
+		}
+	}
+	p.mu.Unlock()
+	if f.db != nil {
+		if err := f.db.deleteFedEnvelope(id); err != nil {
+			log.Printf("federation: %v", err)
+		}
+	}
+}
+
+// Forget drops the queued messages from userID, for erasure (erasure.go).
+// One already sent and awaiting its ack may still be delivered.
+func (f *Federation) Forget(userID string) (int, error) {
+	var firstErr error
+	n := 0
+	for _, p := range f.peers {
+		p.mu.Lock()
+		var ids []string
+		kept := p.queue[:0]
+		for _, e := range p.queue {
+			if e.From == userID {
+				ids = append(ids, e.ID)
+			} else {
+				kept = append(kept, e)
+			}
+		}
+		p.queue = kept
+		p.mu.Unlock()
+		n += len(ids)
+		if f.db == nil {
+			continue
+		}
+		for _, id := range ids {
+			if err := f.db.deleteFedEnvelope(id); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return n, firstErr
+}
+
+// bounce tells e's sender that it was not delivered
+func (f *Federation) bounce(e FedEnvelope, reason string) {
+	to := e.To + "@" + e.Dest
+	log.Printf("federation: message %s from %s to %s not delivered: %s", e.ID, e.From, to, reason)
+	data, _ := json.Marshal(map[string]string{"to": to, "payload": e.Payload, "reason": reason})
+	if _, err := f.inbox.Send(e.From, InboxItem{Kind: "dm.undelivered", From: to, Title: "Message not delivered",
+		Body: "Your message to " + to + " could not be delivered: " + reason, Data: data}, nil); err != nil {
+		log.Printf("federation: inbox: %v", err)
+	}
+}
+
+// expire bounces the envelopes of p older than maxAge
+func (f *Federation) expire(p *fedPeer) {
+	cutoff := time.Now().Add(-f.maxAge)
+	p.mu.Lock()
+	var old []FedEnvelope
+	for _, e := range p.queue {
+		if e.Time.Before(cutoff) {
+			old = append(old, e)
+		}
+	}
+	p.mu.Unlock()
+	for _, e := range old {
+		f.dequeue(p, e.ID)
+		f.bounce(e, "expired; "+p.Domain+" was not reachable")
+	}
+}
+
+// link delivers p's queue, reconnecting with backoff, for as long as the
+// server runs
+func (f *Federation) link(p *fedPeer) {
+	backoff := time.Second
+	for {
+		f.expire(p)
+		p.mu.Lock()
+		n := len(p.queue)
+		p.mu.Unlock()
+		if n == 0 {
+			select {
+			case <-p.wake:
+			case <-time.After(fedLinkIdle):
+			}
+			continue
+		}
+		err := f.deliver(p)
+		p.mu.Lock()
+		p.connected = false
+		if err != nil {
+			p.lastError = err.Error()
+		}
+		p.mu.Unlock()
+		if err == nil {
+			backoff = time.Second
+			continue
+		}
+		log.Printf("federation: %s: %v; retrying in %s", p.Domain, err, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > fedMaxBackoff {
+			backoff = fedMaxBackoff
+		}
+	}
+}
+
+// deliver sends p's queue over one connection until it has been idle for
+// fedLinkIdle
+func (f *Federation) deliver(p *fedPeer) error {
+	ws, resp, err := websocket.DefaultDialer.Dial(p.URL, nil)
+	if err != nil {
+		if resp != nil {
+			err = fmt.Errorf("%v (%s)", err, resp.Status)
+		}
+		return err
+	}
+	defer ws.Close()
+	p.mu.Lock()
+	p.connected = true
+	p.lastError = ""
+	p.mu.Unlock()
+	for {
+		p.mu.Lock()
+		var e FedEnvelope
+		n := len(p.queue)
+		if n > 0 {
+			e = p.queue[0]
+		}
+		p.mu.Unlock()
+		if n == 0 {
+			select {
+			case <-p.wake:
+				continue
+			case <-time.After(fedLinkIdle):
+				ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeWait))
+				return nil
+			}
+		}
+		ws.SetWriteDeadline(time.Now().Add(writeWait))
+		if err := ws.WriteJSON(e); err != nil {
+			return err
+		}
+		var ack fedAck
+		ws.SetReadDeadline(time.Now().Add(fedAckTimeout))
+		if err := ws.ReadJSON(&ack); err != nil {
+			return err
+		}
+		if ack.ID != e.ID {
+			return fmt.Errorf("ack for %s, want %s", ack.ID, e.ID)
+		}
+		f.dequeue(p, e.ID)
+		if ack.Error != "" {
+			f.bounce(e, ack.Error)
+			continue
+		}
+		p.mu.Lock()
+		p.delivered++
+		p.mu.Unlock()
+	}
+}
+
+// ServeHTTP is the /federation endpoint peers' links connect to
+func (f *Federation) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+	ws.SetReadLimit(fedMaxEnvelope)
+	for {
+		var e FedEnvelope
+		ws.SetReadDeadline(time.Now().Add(2 * fedLinkIdle))
+		if err := ws.ReadJSON(&e); err != nil {
+			return
+		}
+		ack := fedAck{ID: e.ID}
+		if err := f.receive(e); err != nil {
+			log.Printf("federation: refused %s from %s: %v", e.ID, r.RemoteAddr, err)
+			ack.Error = err.Error()
+		}
+		ws.SetWriteDeadline(time.Now().Add(writeWait))
+		if err := ws.WriteJSON(ack); err != nil {
+			return
+		}
+	}
+}
+
+// receive checks e and delivers it to its local recipient
+func (f *Federation) receive(e FedEnvelope) error {
+	p := f.peers[e.Origin]
+	switch {
+	case p == nil:
+		return fmt.Errorf("unknown origin %q", e.Origin)
+	case !ed25519.Verify(p.pub, e.signedBytes(), e.Sig):
+		return errors.New("bad signature")
+	case e.Dest != f.domain:
+		return fmt.Errorf("wrong destination %q", e.Dest)
+	case e.From == "" || e.To == "":
+		return errors.New("missing sender or recipient")
+	case time.Since(e.Time) > f.maxAge:
+		return errors.New("expired")
+	}
+	now := time.Now()
+	f.mu.Lock()
+	if now.Sub(f.lastPrune) > time.Minute {
+		for id, t := range f.seen {
+			if now.Sub(t) > f.maxAge {
+				delete(f.seen, id)
+			}
+		}
+		f.lastPrune = now
+	}
+	_, dup := f.seen[e.Origin+"/"+e.ID]
+	f.seen[e.Origin+"/"+e.ID] = now
+	f.mu.Unlock()
+	from := e.From + "@" + e.Origin
+	if dup || (f.friends != nil && f.friends.Blocks(e.To, from)) {
+		return nil
+	}
+	data, _ := json.Marshal(map[string]string{"to": e.To})
+	b, _ := json.Marshal(Message{Type: "dm", Sender: from, Payload: e.Payload, Data: data})
+	f.push.Deliver(e.To, b, Notification{Title: from, Body: e.Payload, Data: map[string]string{"type": "dm", "from": from}})
+	return nil
+}
+
+// FederationMiddleware sends DMs to users of peers; it goes before
+// PushMiddleware, which delivers the local ones
+func FederationMiddleware(f *Federation) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		if f == nil {
+			return next
+		}
+		return func(c *Client, m Message) {
+			var req struct {
+				To string `json:"to"`
+			}
+			if m.Type != "dm" || json.Unmarshal(m.Data, &req) != nil {
+				next(c, m)
+				return
+			}
+			i := strings.LastIndexByte(req.To, '@')
+			if i < 0 {
+				next(c, m)
+				return
+			}
+			user, domain := req.To[:i], req.To[i+1:]
+			if domain == f.domain {
+				m.Data, _ = json.Marshal(map[string]string{"to": user})
+				next(c, m)
+				return
+			}
+			p := f.peers[domain]
+			if p == nil {
+				next(c, m)
+				return
+			}
+			if c.userID == "" {
+				sendError(c, "auth.required", m.Type)
+				return
+			}
+			if user == "" {
+				sendError(c, "dm.bad_target")
+				return
+			}
+			if err := f.Send(c.userID, p, user, m.Payload); err != nil {
+				log.Printf("federation: queue: %v", err)
+				sendError(c, "failed", m.Type)
+			}
+		}
+	}
+}
+
+// RegisterAdmin mounts GET /api/admin/federation
+func (f *Federation) RegisterAdmin(a *AdminAPI) {
+	a.Handle("/api/admin/federation", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "use GET")
+			return
+		}
+		type peer struct {
+			Domain    string `json:"domain"`
+			URL       string `json:"url"`
+			Connected bool   `json:"connected"`
+			Queued    int    `json:"queued"`
+			Delivered int64  `json:"delivered"`
+			LastError string `json:"lastError,omitempty"`
+		}
+		peers := make([]peer, 0, len(f.peers))
+		for _, p := range f.peers {
+			p.mu.Lock()
+			peers = append(peers, peer{p.Domain, p.URL, p.connected, len(p.queue), p.delivered, p.lastError})
+			p.mu.Unlock()
+		}
+		sort.Slice(peers, func(i, j int) bool { return peers[i].Domain < peers[j].Domain })
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"domain":    f.domain,
+			"publicKey": hex.EncodeToString(f.key.Public().(ed25519.PublicKey)),
+			"peers":     peers,
+		})
+	})
+}
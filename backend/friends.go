@@ -0,0 +1,465 @@
+// backend/friends.go
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"sync"
+)
+
+/*
+Friends and block lists for logged-in users, kept on their user records:
+
+	{"type":"friend.request","data":{"user":"bob"}}     bob gets it in his inbox
+	{"type":"friend.accept","data":{"user":"alice"}}
+	{"type":"friend.decline","data":{"user":"alice"}}
+	{"type":"friend.remove","data":{"user":"bob"}}      unfriend, or withdraw a request
+	{"type":"friend.block","data":{"user":"carol"}}     also unfriends and drops requests
+	{"type":"friend.unblock","data":{"user":"carol"}}
+	{"type":"friends.list"}
+	{"type":"friends.list","data":{"friends":[{"user":"bob","online":true}],"incoming":[],"outgoing":[],"blocked":["carol"]}}
+
+Requesting someone who already asked you accepts. Blocked users can't
+send you friend requests or DMs; both are dropped without telling them.
+Their broadcasts are hidden from you too (an outbound filter, see
+outfilter.go). Block lists are indexed in memory, loaded from the user
+store at start, so the filter never reads the store; it is only
+installed once someone has blocked someone.
+A connection that sends friends.subscribe gets
+
+	{"type":"friend.online","data":{"user":"bob"}}
+	{"type":"friend.offline","data":{"user":"bob"}}
+
+when a friend's first connection opens or last one closes, on any game,
+until it sends friends.unsubscribe.
+*/
+
+// Friends manages the social graph and friend presence
+type Friends struct {
+	users UserStore
+	inbox *Inbox
+
+	mu       sync.Mutex // serializes read-modify-write of user records
+	hubs     []*Hub
+	watchers map[string]map[*Client]bool // user id -> subscribed connections
+	hiding   bool                        // hideBlocked is installed on hubs
+
+	blockMu sync.RWMutex
+	blocked map[string]map[string]bool // user id -> the ids in their Blocked
+}
+
+func NewFriends(users UserStore, inbox *Inbox) *Friends {
+	f := &Friends{users: users, inbox: inbox, watchers: make(map[string]map[*Client]bool), blocked: make(map[string]map[string]bool)}
+	if bl, ok := users.(blockLister); ok {
+		lists, err := bl.BlockLists()
+		if err != nil {
+			log.Printf("friends: block lists: %v", err)
+		}
+		for id, list := range lists {
+			for _, other := range list {
+				f.setBlocked(id, other, true)
+			}
+		}
+	}
+	f.hiding = len(f.blocked) > 0
+	return f
+}
+
+// AddHub tracks the presence of hub's users and hides the broadcasts of
+// blocked users from them
+func (f *Friends) AddHub(hub *Hub) {
+	f.mu.Lock()
+	f.hubs = append(f.hubs, hub)
+	if f.hiding {
+		hub.AddOutboundFilter(OutboundFilterFunc(f.hideBlocked))
+	}
+	f.mu.Unlock()
+	hub.events.Subscribe(func(e Event) {
+		c := e.Client
+		if c.userID == "" {
+			return
+		}
+		n := f.connections(c.userID)
+		switch {
+		case e.Kind == EventClientConnected && n == 1:
+			f.announce(c.userID, "friend.online")
+		case e.Kind == EventClientDisconnected:
+			f.unsubscribe(c)
+			if n == 0 {
+				f.announce(c.userID, "friend.offline")
+			}
+		}
+	}, EventClientConnected, EventClientDisconnected)
+}
+
+// hide installs hideBlocked on every hub, the first time someone blocks
+func (f *Friends) hide() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.hiding {
+		return
+	}
+	f.hiding = true
+	for _, h := range f.hubs {
+		h.AddOutboundFilter(OutboundFilterFunc(f.hideBlocked))
+	}
+}
+
+// hideBlocked drops messages from users c's user blocked. It runs for
+// every recipient of every broadcast, so it only reads the index.
+func (f *Friends) hideBlocked(c *Client, m Message) (Message, bool) {
+	if c.userID == "" || m.Sender == "" || m.Sender == "server" || m.Sender == c.userID {
+		return m, true
+	}
+	return m, !f.Blocks(c.userID, m.Sender)
+}
+
+// connections counts userID's connections on every game
+func (f *Friends) connections(userID string) int {
+	f.mu.Lock()
+	hubs := f.hubs
+	f.mu.Unlock()
+	n := 0
+	for _, h := range hubs {
+		n += len(h.UserClients(userID))
+	}
+	return n
+}
+
+// announce tells userID's subscribed friends that they came online or left
+func (f *Friends) announce(userID, kind string) {
+	u := f.user(userID)
+	data, _ := json.Marshal(map[string]string{"user": userID})
+	b, _ := json.Marshal(Message{Type: kind, Sender: "server", Data: data})
+	f.mu.Lock()
+	var to []*Client
+	for _, friend := range u.Friends {
+		for c := range f.watchers[friend] {
+			to = append(to, c)
+		}
+	}
+	f.mu.Unlock()
+	for _, c := range to {
+		c.trySend(b)
+	}
+}
+
+func (f *Friends) subscribe(c *Client) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.watchers[c.userID] == nil {
+		f.watchers[c.userID] = make(map[*Client]bool)
+	}
+	f.watchers[c.userID][c] = true
+}
+
+func (f *Friends) unsubscribe(c *Client) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if w := f.watchers[c.userID]; w != nil {
+		delete(w, c)
+		if len(w) == 0 {
+			delete(f.watchers, c.userID)
+		}
+	}
+}
+
+// user returns userID's record, or a blank one for users without a profile
+func (f *Friends) user(userID string) *User {
+	if u, ok := f.users.Get(userID); ok {
+		return u
+	}
+	return &User{ID: userID}
+}
+
+// Blocks reports whether userID has blocked other
+func (f *Friends) Blocks(userID, other string) bool {
+	f.blockMu.RLock()
+	defer f.blockMu.RUnlock()
+	return f.blocked[userID][other]
+}
+
+// setBlocked updates the index after userID's Blocked changed
+func (f *Friends) setBlocked(userID, other string, on bool) {
+	f.blockMu.Lock()
+	defer f.blockMu.Unlock()
+	set := f.blocked[userID]
+	switch {
+	case on && set == nil:
+		f.blocked[userID] = map[string]bool{other: true}
+	case on:
+		set[other] = true
+	default:
+		delete(set, other)
+		if len(set) == 0 {
+			delete(f.blocked, userID)
+		}
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// without returns list minus s, always as a new slice (records share
+// their slices with the store's copy)
+func without(list []string, s string) []string {
+	out := make([]string, 0, len(list))
+	for _, x := range list {
+		if x != s {
+			out = append(out, x)
+		}
+	}
+	return out
+}
+
+// with returns list plus s, as a new slice
+func with(list []string, s string) []string {
+	if containsString(list, s) {
+		return list
+	}
+	out := append(append(make([]string, 0, len(list)+1), list...), s)
+	sort.Strings(out)
+	return out
+}
+
+// update applies fn to the records of a and b and saves both
+func (f *Friends) update(a, b string, fn func(ua, ub *User)) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ua, ub := f.user(a), f.user(b)
+	fn(ua, ub)
+	if err := f.users.Put(ua); err != nil {
+		return err
+	}
+	return f.users.Put(ub)
+}
+
+// Request has from ask to for friendship. It returns the reply code:
+// friends.request_sent, friends.added (to had asked first) or an error code.
+func (f *Friends) Request(from, to string) (string, error) {
+	code := "friends.request_sent"
+	silent := false
+	err := f.update(from, to, func(uf, ut *User) {
+		switch {
+		case containsString(uf.Blocked, to):
+			code = "friends.blocked"
+		case containsString(uf.Friends, to):
+			code = "friends.already"
+		case containsString(ut.Blocked, from):
+			silent = true // looks sent; isn't
+		case containsString(uf.FriendRequests, to):
+			befriend(uf, ut)
+			code = "friends.added"
+		default:
+			uf.SentRequests = with(uf.SentRequests, to)
+			ut.FriendRequests = with(ut.FriendRequests, from)
+		}
+	})
+	if err != nil || silent || code != "friends.request_sent" {
+		return code, err
+	}
+	data, _ := json.Marshal(map[string]string{"user": from})
+	_, err = f.inbox.Send(to, InboxItem{Kind: "friend.request", From: from, Title: "Friend request", Body: from + " wants to be your friend", Data: data}, nil)
+	return code, err
+}
+
+func befriend(a, b *User) {
+	a.Friends, b.Friends = with(a.Friends, b.ID), with(b.Friends, a.ID)
+	a.FriendRequests, a.SentRequests = without(a.FriendRequests, b.ID), without(a.SentRequests, b.ID)
+	b.FriendRequests, b.SentRequests = without(b.FriendRequests, a.ID), without(b.SentRequests, a.ID)
+}
+
+// unlink drops any friendship or pending request between a and b
+func unlink(a, b *User) {
+	a.Friends, b.Friends = without(a.Friends, b.ID), without(b.Friends, a.ID)
+	a.FriendRequests, a.SentRequests = without(a.FriendRequests, b.ID), without(a.SentRequests, b.ID)
+	b.FriendRequests, b.SentRequests = without(b.FriendRequests, a.ID), without(b.SentRequests, a.ID)
+}
+
+// Accept accepts other's request to userID; false if there was none
+func (f *Friends) Accept(userID, other string) (bool, error) {
+	ok := false
+	err := f.update(userID, other, func(u, o *User) {
+		if ok = containsString(u.FriendRequests, other); ok {
+			befriend(u, o)
+		}
+	})
+	if err != nil || !ok {
+		return ok, err
+	}
+	data, _ := json.Marshal(map[string]string{"user": userID})
+	_, err = f.inbox.Send(other, InboxItem{Kind: "friend.accepted", From: userID, Title: "Friend request accepted", Body: userID + " accepted your friend request", Data: data}, nil)
+	return true, err
+}
+
+// Decline turns down other's request to userID; false if there was none
+func (f *Friends) Decline(userID, other string) (bool, error) {
+	ok := false
+	err := f.update(userID, other, func(u, o *User) {
+		if ok = containsString(u.FriendRequests, other); ok {
+			unlink(u, o)
+		}
+	})
+	return ok, err
+}
+
+// Remove ends a friendship or withdraws userID's request to other
+func (f *Friends) Remove(userID, other string) (bool, error) {
+	ok := false
+	err := f.update(userID, other, func(u, o *User) {
+		if ok = containsString(u.Friends, other) || containsString(u.SentRequests, other); ok {
+			unlink(u, o)
+		}
+	})
+	return ok, err
+}
+
+// Block blocks (or with on false unblocks) other for userID
+func (f *Friends) Block(userID, other string, on bool) error {
+	err := f.update(userID, other, func(u, o *User) {
+		if on {
+			unlink(u, o)
+			u.Blocked = with(u.Blocked, other)
+		} else {
+			u.Blocked = without(u.Blocked, other)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	f.setBlocked(userID, other, on)
+	if on {
+		f.hide()
+	}
+	return nil
+}
+
+// Forget removes userID from the lists of everyone they were linked with;
+// the record itself goes with the profile
+func (f *Friends) Forget(userID string) error {
+	f.blockMu.Lock()
+	delete(f.blocked, userID)
+	f.blockMu.Unlock()
+	u := f.user(userID)
+	var firstErr error
+	for _, other := range append(append(append([]string(nil), u.Friends...), u.FriendRequests...), u.SentRequests...) {
+		if err := f.update(userID, other, unlink); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// friendStatus is one entry of friends.list
+type friendStatus struct {
+	User   string `json:"user"`
+	Online bool   `json:"online"`
+}
+
+func (f *Friends) list(userID string) interface{} {
+	u := f.user(userID)
+	friends := make([]friendStatus, 0, len(u.Friends))
+	for _, id := range u.Friends {
+		friends = append(friends, friendStatus{User: id, Online: f.connections(id) > 0})
+	}
+	nonNil := func(s []string) []string {
+		if s == nil {
+			return []string{}
+		}
+		return s
+	}
+	return map[string]interface{}{
+		"friends":  friends,
+		"incoming": nonNil(u.FriendRequests),
+		"outgoing": nonNil(u.SentRequests),
+		"blocked":  nonNil(u.Blocked),
+	}
+}
+
+// FriendsMiddleware handles the friend.* and friends.* types and drops
+// DMs to users who blocked the sender. It goes before PushMiddleware.
+func FriendsMiddleware(f *Friends) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(c *Client, m Message) {
+			var req struct {
+				User string `json:"user"`
+				To   string `json:"to"` // dm
+			}
+			switch m.Type {
+			case "dm":
+				if c.userID != "" && json.Unmarshal(m.Data, &req) == nil && req.To != "" && f.Blocks(req.To, c.userID) {
+					return
+				}
+				next(c, m)
+				return
+			case "friends.list", "friends.subscribe", "friends.unsubscribe",
+				"friend.request", "friend.accept", "friend.decline", "friend.remove", "friend.block", "friend.unblock":
+			default:
+				next(c, m)
+				return
+			}
+			if c.userID == "" {
+				sendError(c, "auth.required", m.Type)
+				return
+			}
+			switch m.Type {
+			case "friends.list":
+				data, _ := json.Marshal(f.list(c.userID))
+				b, _ := json.Marshal(Message{Type: "friends.list", Sender: "server", Data: data})
+				c.Send(b)
+				return
+			case "friends.subscribe":
+				f.subscribe(c)
+				sendSystem(c, "ok", m.Type)
+				return
+			case "friends.unsubscribe":
+				f.unsubscribe(c)
+				sendSystem(c, "ok", m.Type)
+				return
+			}
+			if err := json.Unmarshal(m.Data, &req); err != nil || req.User == "" || req.User == c.userID {
+				sendError(c, "friends.bad_user", m.Type)
+				return
+			}
+			var (
+				code = "ok"
+				ok   = true
+				err  error
+			)
+			switch m.Type {
+			case "friend.request":
+				code, err = f.Request(c.userID, req.User)
+			case "friend.accept":
+				ok, err = f.Accept(c.userID, req.User)
+			case "friend.decline":
+				ok, err = f.Decline(c.userID, req.User)
+			case "friend.remove":
+				ok, err = f.Remove(c.userID, req.User)
+			case "friend.block":
+				err = f.Block(c.userID, req.User, true)
+			case "friend.unblock":
+				err = f.Block(c.userID, req.User, false)
+			}
+			switch {
+			case err != nil:
+				log.Printf("friends: %s %s: %v", m.Type, c.userID, err)
+				sendError(c, "failed", m.Type)
+			case !ok:
+				sendError(c, "friends.no_request", m.Type, req.User)
+			case code == "friends.blocked" || code == "friends.already":
+				sendError(c, code, req.User)
+			case code == "ok":
+				sendSystem(c, "ok", m.Type)
+			default:
+				sendSystem(c, code, req.User)
+			}
+		}
+	}
+}
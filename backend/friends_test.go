@@ -0,0 +1,59 @@
+// backend/friends_test.go
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestBlockHidesBroadcasts checks that the friends filter is only
+// installed once someone blocks, and then hides the blocked user's
+// broadcasts from the blocker alone
+func TestBlockHidesBroadcasts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	users, err := NewFileUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := NewFriends(users, nil)
+	h := newRunningHub()
+	f.AddHub(h)
+	if h.filtering() {
+		t.Fatal("filter installed before anyone blocked")
+	}
+	alice, bob, carol := newTestUser(h, "a", "alice"), newTestUser(h, "b", "bob"), newTestUser(h, "c", "carol")
+	for _, c := range []*Client{alice, bob, carol} {
+		h.JoinRoom(c, "r")
+	}
+	if err := f.Block("alice", "bob", true); err != nil {
+		t.Fatal(err)
+	}
+	if !h.filtering() {
+		t.Fatal("filter not installed after a block")
+	}
+	h.BroadcastRoom("r", Message{Type: "chat", Sender: "bob", Payload: "hi"})
+	if m := next(t, alice); m.Type != "filtered" || m.Seq != 1 {
+		t.Fatalf("alice got %+v, want a filtered stub", m)
+	}
+	for _, c := range []*Client{bob, carol} {
+		if m := next(t, c); m.Payload != "hi" {
+			t.Fatalf("%s got %+v", c.userID, m)
+		}
+	}
+
+	// a restart loads the index from the store
+	users, err = NewFileUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f = NewFriends(users, nil)
+	if !f.Blocks("alice", "bob") || f.Blocks("bob", "alice") {
+		t.Fatal("block lists not loaded")
+	}
+	if err := f.Block("alice", "bob", false); err != nil {
+		t.Fatal(err)
+	}
+	if f.Blocks("alice", "bob") {
+		t.Fatal("unblock kept in the index")
+	}
+}
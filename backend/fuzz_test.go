@@ -0,0 +1,223 @@
+// backend/fuzz_test.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Fuzz targets for what clients send: frames, the hello handshake, session
+// tokens and sync.request (ack/resume). Run one with
+//
+//	go test -run '^$' -fuzz FuzzDecodeFrame
+//
+// plain go test runs the seeds.
+
+// sent returns what c has been sent so far, decoded
+func sent(t *testing.T, c *Client) []Message {
+	t.Helper()
+	var out []Message
+	for _, b := range c.drainSend() {
+		var m Message
+		if err := json.Unmarshal(b, &m); err != nil {
+			t.Fatalf("server sent invalid JSON %q: %v", b, err)
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+func FuzzDecodeFrame(f *testing.F) {
+	for _, seed := range []string{
+		`{"type":"message","payload":"hi"}`,
+		`{"type":"room.join","payload":"r1","room":"r2","id":"x","ts":5,"seq":9,"sender":"bob"}`,
+		`{"type":"hello","data":{"locale":"de"}}`,
+		`{"type":"sync.request","data":{"rooms":{"r1":42}}}`,
+		`not json`,
+		`{"data":`,
+		``,
+	} {
+		f.Add([]byte(seed), false)
+		f.Add([]byte(seed), true)
+	}
+	h := NewHub()
+	f.Fuzz(func(t *testing.T, raw []byte, authenticated bool) {
+		c := &Client{hub: h, id: "10.0.0.1:5000"}
+		if authenticated {
+			c.userID = "alice"
+		}
+		m := c.decodeFrame(raw)
+		if m.Room != "" || m.Seq != 0 {
+			t.Fatalf("client set room %q / seq %d", m.Room, m.Seq)
+		}
+		if m.ID == "" || m.Ts == 0 {
+			t.Fatal("message not stamped")
+		}
+		if authenticated && m.Sender != "alice" {
+			t.Fatalf("authenticated sender spoofed as %q", m.Sender)
+		}
+		if m.Sender == "" {
+			t.Fatal("empty sender")
+		}
+		if _, err := json.Marshal(m); err != nil {
+			t.Fatalf("decoded message doesn't encode: %v", err)
+		}
+	})
+}
+
+func FuzzReadCapture(f *testing.F) {
+	f.Add([]byte(`{"t":0,"kind":"connect","client":"c1","user":"alice"}
+{"t":412,"kind":"message","client":"c1","msg":{"type":"room.join","payload":"r1"}}
+{"t":530,"kind":"binary","client":"c1","data":"AAEC"}
+{"t":9120,"kind":"disconnect","client":"c1"}`))
+	f.Add([]byte(`{"kind":"header","game":"draw","schema":3}`))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		events, err := ReadCapture(bytes.NewReader(b))
+		if err != nil {
+			return
+		}
+		for _, e := range events {
+			if _, err := json.Marshal(e); err != nil {
+				t.Fatalf("event doesn't encode again: %v", err)
+			}
+		}
+	})
+}
+
+func FuzzHello(f *testing.F) {
+	f.Add([]byte(`{"locale":"de"}`))
+	f.Add([]byte(`{"maxMessageSize":128}`))
+	f.Add([]byte(`{"keepalive":{"pingInterval":"1s","pongTimeout":"1h","heartbeat":true}}`))
+	f.Add([]byte(`{"keepalive":{"pingInterval":"10m","pongTimeout":"11s"}}`))
+	f.Add([]byte(`{"locale":"xx","keepalive":{}}`))
+	f.Add([]byte(`[]`))
+	h := newRunningHub()
+	cfg := h.keepalive.withDefaults()
+	hello := HelloMiddleware(h.locales)(func(*Client, Message) {})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		c := newTestClient(h, "c1")
+		defer func() { h.unregister <- c }()
+		hello(c, Message{Type: "hello", Data: data})
+		msgs := sent(t, c)
+		if len(msgs) == 0 {
+			t.Fatal("no reply")
+		}
+		last := msgs[len(msgs)-1]
+		if last.Type == "error" {
+			if last.Code != "bad_data" {
+				t.Fatalf("unexpected error %s", last.Code)
+			}
+			return
+		}
+		if last.Type != "hello" {
+			t.Fatalf("reply is %q", last.Type)
+		}
+		var reply struct {
+			Keepalive keepaliveTerms `json:"keepalive"`
+		}
+		if err := json.Unmarshal(last.Data, &reply); err != nil {
+			t.Fatal(err)
+		}
+		k := reply.Keepalive
+		if k.PongTimeout < cfg.MinPongTimeout || k.PongTimeout > cfg.MaxPongTimeout {
+			t.Fatalf("pong timeout %v outside [%v, %v]", k.PongTimeout, cfg.MinPongTimeout, cfg.MaxPongTimeout)
+		}
+		if k.PingInterval <= 0 || k.PingInterval > k.PongTimeout*9/10 {
+			t.Fatalf("ping interval %v with pong timeout %v", k.PingInterval, k.PongTimeout)
+		}
+		if time.Duration(k.PongTimeout) != c.readTimeout() || time.Duration(k.PingInterval) != c.pingInterval() {
+			t.Fatal("reply differs from the terms in force")
+		}
+	})
+}
+
+func FuzzSessionToken(f *testing.F) {
+	sm, err := NewSessionManager("fuzz-secret", time.Hour)
+	if err != nil {
+		f.Fatal(err)
+	}
+	token, err := sm.Issue(&User{ID: "alice", Name: "Alice"})
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(token)
+	f.Add(token + "x")
+	f.Add(jwtHeader + ".e30.")
+	f.Add("a.b.c.d")
+	f.Fuzz(func(t *testing.T, tok string) {
+		claims, err := sm.Verify(tok)
+		if err != nil {
+			return
+		}
+		// alice's token is the only one signed with this secret
+		if claims.Sub != "alice" {
+			t.Fatalf("forged token accepted for %q", claims.Sub)
+		}
+	})
+}
+
+func FuzzSyncRequest(f *testing.F) {
+	f.Add(uint8(10), []byte(`{"rooms":{"r":4}}`))
+	f.Add(uint8(10), []byte(`{"rooms":{"r":10}}`))
+	f.Add(uint8(30), []byte(`{"rooms":{"r":2}}`))
+	f.Add(uint8(3), []byte(`{"rooms":{"r":9,"other":1}}`))
+	f.Add(uint8(0), []byte(`{"rooms":{"r":0}}`))
+	f.Add(uint8(5), []byte(`{"rooms":null}`))
+	f.Add(uint8(5), []byte(`{`))
+	f.Fuzz(func(t *testing.T, n uint8, data []byte) {
+		h := NewHub()
+		h.replayFrames = 16
+		c := newTestClient(h, "c1")
+		h.JoinRoom(c, "r")
+		for i := 0; i < int(n%40); i++ {
+			h.BroadcastRoom("r", Message{Type: "message", Payload: fmt.Sprint(i)})
+		}
+		c.drainSend()
+		SyncMiddleware(h, nil)(func(*Client, Message) {})(c, Message{Type: "sync.request", Data: data})
+		msgs := sent(t, c)
+		if len(msgs) == 0 {
+			t.Fatal("no reply")
+		}
+		if msgs[0].Type == "error" {
+			return
+		}
+		if msgs[0].Type != "sync.response" {
+			t.Fatalf("reply is %q", msgs[0].Type)
+		}
+		var resp struct {
+			Rooms map[string]SyncResult `json:"rooms"`
+		}
+		if err := json.Unmarshal(msgs[0].Data, &resp); err != nil {
+			t.Fatal(err)
+		}
+		replayed := msgs[1:]
+		res, asked := resp.Rooms["r"]
+		if !asked {
+			if len(replayed) > 0 {
+				t.Fatalf("%d frames replayed for no room", len(replayed))
+			}
+			return
+		}
+		seq := uint64(n % 40)
+		switch res.Status {
+		case SyncCurrent, SyncReset:
+			if len(replayed) > 0 {
+				t.Fatalf("%s with %d frames replayed", res.Status, len(replayed))
+			}
+		case SyncReplay:
+			if len(replayed) != res.Missed || res.Seq != seq {
+				t.Fatalf("replay of %d to seq %d, got %d frames, room at %d", res.Missed, res.Seq, len(replayed), seq)
+			}
+			for i, m := range replayed {
+				if want := seq - uint64(res.Missed) + uint64(i) + 1; m.Seq != want || m.Room != "r" {
+					t.Fatalf("frame %d: %s seq %d, want r seq %d", i, m.Room, m.Seq, want)
+				}
+			}
+		default:
+			t.Fatalf("status %q for a member of a room without snapshots", res.Status)
+		}
+	})
+}
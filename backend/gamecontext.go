@@ -0,0 +1,112 @@
+// backend/gamecontext.go
+package main
+
+import (
+	"context"
+	"time"
+)
+
+/*
+Context-aware games. A game implementing ContextGame instead of Game gets
+a context.Context with every callback:
+
+	func (g *MyGame) OnMessageContext(ctx context.Context, c *Client, m Message) {
+		info := CallInfoFrom(ctx) // trace id, claims, room, game
+		rows, err := db.QueryContext(ctx, ...)
+		...
+	}
+
+and is mounted through WithContext(g). The context is cancelled when the
+connection closes and carries a deadline of callbackTimeout, so storage
+and network calls made on the client's behalf don't outlive it. Its trace
+id is the id stamped on the message (see envelope.go), so a handler's log
+lines can be matched with what the clients received.
+
+Middleware can reach the same context with c.Context().
+*/
+
+// callbackTimeout bounds each callback's context
+const callbackTimeout = 10 * time.Second
+
+// ContextGame is the context-aware form of Game
+type ContextGame interface {
+	OnConnectContext(ctx context.Context, c *Client)
+	OnMessageContext(ctx context.Context, c *Client, msg Message)
+	OnBinaryMessageContext(ctx context.Context, c *Client, data []byte)
+	OnDisconnectContext(ctx context.Context, c *Client)
+}
+
+// CallInfo describes the client and message a callback is handling
+type CallInfo struct {
+	TraceID  string
+	ClientID string
+	UserID   string         // "" for anonymous clients
+	Claims   *SessionClaims // nil for anonymous clients
+	Room     string         // the client's room when the callback started
+	Game     string         // mount path, e.g. "/ws"
+}
+
+type callInfoKey struct{}
+
+// CallInfoFrom returns the CallInfo of a callback context (zero if none)
+func CallInfoFrom(ctx context.Context) CallInfo {
+	info, _ := ctx.Value(callInfoKey{}).(CallInfo)
+	return info
+}
+
+// callContext derives a callback context from base; traceID "" gets a
+// fresh id
+func (c *Client) callContext(base context.Context, traceID string) (context.Context, context.CancelFunc) {
+	return c.callContextTimeout(base, traceID, callbackTimeout)
+}
+
+// callContextTimeout is callContext with another deadline
+func (c *Client) callContextTimeout(base context.Context, traceID string, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if traceID == "" {
+		traceID = newMessageID()
+	}
+	info := CallInfo{TraceID: traceID, ClientID: c.id, UserID: c.userID, Claims: c.claims, Room: c.hub.RoomOf(c), Game: c.hub.path}
+	return context.WithTimeout(context.WithValue(base, callInfoKey{}, info), timeout)
+}
+
+// Context returns the context of the message being handled (readPump
+// only), or the connection's outside a message
+func (c *Client) Context() context.Context {
+	if c.call != nil {
+		return c.call
+	}
+	if c.ctx != nil {
+		return c.ctx
+	}
+	return context.Background()
+}
+
+// contextGame adapts a ContextGame to Game
+type contextGame struct {
+	g ContextGame
+}
+
+// WithContext mounts a ContextGame wherever a Game is expected
+func WithContext(g ContextGame) Game { return contextGame{g} }
+
+func (a contextGame) OnConnect(c *Client) {
+	ctx, cancel := c.callContext(c.Context(), "")
+	defer cancel()
+	a.g.OnConnectContext(ctx, c)
+}
+
+func (a contextGame) OnMessage(c *Client, m Message) {
+	a.g.OnMessageContext(c.Context(), c, m)
+}
+
+func (a contextGame) OnBinaryMessage(c *Client, data []byte) {
+	a.g.OnBinaryMessageContext(c.Context(), c, data)
+}
+
+// OnDisconnect runs after the connection context is cancelled, so it gets
+// a fresh one that still carries the client's CallInfo
+func (a contextGame) OnDisconnect(c *Client) {
+	ctx, cancel := c.callContext(context.Background(), "")
+	defer cancel()
+	a.g.OnDisconnectContext(ctx, c)
+}
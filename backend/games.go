@@ -0,0 +1,259 @@
+// backend/games.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/yourusername/tictactoe-server/rules"
+)
+
+/*
+Several games in one process. The -mode game is served on /ws; the "games"
+block of the config file mounts more at their own paths:
+
+	"games": [
+	  {"path": "/ws/chat", "mode": "broadcast", "history": "chat.jsonl"},
+	  {"path": "/ws/trivia", "mode": "script", "scripts": "games/trivia",
+	   "rateLimits": {"answer": {"rate": 1, "burst": 2}}},
+	  {"path": "/ws/quiz", "mode": "trivia", "trivia": {"questions": "quiz.csv"}},
+	  {"path": "/ws/draw", "mode": "draw", "ephemeral": {"rate": 30}},
+	  {"path": "/ws/chess", "mode": "process", "command": ["./chess-server", "--stdio"]}
+	]
+
+Each mount gets its own Hub, so rooms, broadcasts and AOI are separate:
+"lobby" on /ws/chat is not "lobby" on /ws/trivia. Sessions, presence,
+anti-cheat, push, parties, friends, inboxes, tournaments, reports, match
+results and locales are shared. rateLimits, ephemeral and trivia fall
+back to the top-level blocks when left out; history and scripts are per
+mount and off unless set.
+*/
+
+// GameMount is one entry of the "games" config block
+type GameMount struct {
+	Path       string               `json:"path"`                 // e.g. /ws/chat
+	Mode       string               `json:"mode"`                 // echo | broadcast | relay | script | trivia | draw | a ruleset name
+	Scripts    string               `json:"scripts,omitempty"`    // Lua scripts of this game
+	History    string               `json:"history,omitempty"`    // JSONL history file of this game
+	RateLimits map[string]RateLimit `json:"rateLimits,omitempty"` // replaces the top-level rateLimits
+	Ephemeral  *EphemeralConfig     `json:"ephemeral,omitempty"`  // replaces the top-level ephemeral
+	Trivia     *TriviaConfig        `json:"trivia,omitempty"`     // replaces the top-level trivia
+	Command    []string             `json:"command,omitempty"`    // program and arguments of a "process" game
+}
+
+// gameDeps are the services every mounted game shares
+type gameDeps struct {
+	presence     *Presence
+	push         *Push
+	parties      *Parties
+	userSessions *UserSessions
+	inbox        *Inbox
+	friends      *Friends
+	judging      *Judging // for games mounted through WithJudging
+	tournaments  *Tournaments
+	reports      *Reports
+	announcer    *Announcer
+	federation   *Federation // nil without a "federation" block
+	caches       *Caches
+	panics       *Panics
+	antiCheat    *AntiCheatEngine
+	audit        *AuditLog
+	quotas       *Quotas
+	dedupWindow  time.Duration
+
+	mounted map[string]*mountedGame // path -> game, filled by mount
+}
+
+// mountedGame is what other subsystems need to reach a mounted game
+type mountedGame struct {
+	hub     *Hub
+	history HistoryStore // nil without history
+	game    Game         // with its middleware, for replays
+	process *ProcessGame // nil unless mode "process"
+}
+
+// gameSettings are the mode-specific inputs of newGame
+type gameSettings struct {
+	scripts *ScriptEngine // required by "script"
+	trivia  TriviaConfig
+	command []string // required by "process"
+}
+
+// newGame builds the game for mode
+func newGame(mode string, hub *Hub, gs gameSettings) (Game, error) {
+	switch mode {
+	case "broadcast":
+		return NewBroadcastGame(hub), nil
+	case "relay":
+		return NewRelayGame(hub), nil
+	case "script":
+		if gs.scripts == nil {
+			return nil, errors.New("mode script requires scripts")
+		}
+		return NewScriptGame(gs.scripts), nil
+	case "trivia":
+		return NewTriviaGame(hub, gs.trivia)
+	case "draw":
+		return NewDrawGame(hub), nil
+	case "process":
+		return NewProcessGame(hub, gs.command)
+	case "echo", "":
+		return NewEchoGame(hub), nil
+	}
+	if r := rules.Lookup(mode); r != nil {
+		return NewRulesGame(hub, r), nil
+	}
+	return nil, fmt.Errorf("unknown game mode %q (want echo|broadcast|relay|script|trivia|draw|process|%s)", mode, strings.Join(rules.Names(), "|"))
+}
+
+// chain wraps game in the standard middleware stack for hub
+func (d *gameDeps) chain(game Game, hub *Hub, scripts *ScriptEngine, history HistoryStore, cfg *Config, rateLimits map[string]RateLimit, eph EphemeralConfig) Game {
+	if f, ok := game.(OutboundFilter); ok {
+		hub.AddOutboundFilter(f)
+	}
+	roles := NewRoomRoles(hub, cfg.RoomRoles)
+	private := NewPrivateRooms(hub, d.push)
+	private.roles = roles
+	private.inbox = d.inbox
+	hub.private = private
+	mws := []Middleware{
+		DeprecationMiddleware(hub.deprecations),
+		HelloMiddleware(hub.locales),
+		TagsMiddleware(hub),
+		KeepaliveMiddleware(),
+		TimeSyncMiddleware(),
+		TransferMiddleware(),
+		DedupMiddleware(NewDeduper(d.dedupWindow)),
+		RateLimitMiddleware(rateLimits),
+		AntiCheatMiddleware(d.antiCheat),
+		RouteMiddleware(hub.router),
+		ReportMiddleware(d.reports),
+		RoomRolesMiddleware(roles),
+		PrivateRoomMiddleware(private),
+		RoomMiddleware(hub),
+		SyncMiddleware(hub, game),
+		PresenceMiddleware(d.presence),
+		PartyMiddleware(d.parties, hub),
+		TournamentMiddleware(d.tournaments, hub),
+		UserSessionsMiddleware(d.userSessions),
+		AOIMiddleware(hub),
+		EphemeralMiddleware(hub, eph),
+		TimersMiddleware(hub.timers),
+		FriendsMiddleware(d.friends),
+		FederationMiddleware(d.federation),
+		PushMiddleware(d.push),
+		InboxMiddleware(d.inbox),
+		MatchHistoryMiddleware(hub.matches),
+		RoomPermissionMiddleware(roles),
+	}
+	if scripts != nil {
+		mws = append(mws, ScriptValidationMiddleware(scripts))
+	}
+	if history != nil {
+		mws = append(mws, HistoryMiddleware(hub, history, d.quotas, cfg.History))
+	}
+	return d.panics.Wrap(Chain(game, mws...))
+}
+
+// newMountedHub makes a hub for a mounted game that behaves like primary
+func newMountedHub(primary *Hub, cfg *Config) *Hub {
+	h := NewHub()
+	h.dupPolicy = primary.dupPolicy
+	h.chaos = primary.chaos
+	h.writeBatch = primary.writeBatch
+	h.snapshots = primary.snapshots
+	h.keepalive = primary.keepalive
+	h.features = primary.features
+	h.sendBuffers = primary.sendBuffers
+	h.bandwidth = primary.bandwidth
+	h.reconnects = primary.reconnects
+	h.deadLetters = primary.deadLetters
+	h.router = primary.router
+	h.replayFrames = primary.replayFrames
+	h.tags = primary.tags
+	h.bans = primary.bans
+	h.deprecations = primary.deprecations
+	h.load = primary.load
+	h.locales = primary.locales
+	h.matches = primary.matches
+	h.aoi = NewAOI(cfg.AOI)
+	h.aoi.Attach(h.events)
+	go h.Run()
+	return h
+}
+
+// mount serves the game described by gm on mux and returns its hub
+func (d *gameDeps) mount(mux *http.ServeMux, primary *Hub, sessions *SessionManager, cfg *Config, gm GameMount) (*Hub, error) {
+	if !strings.HasPrefix(gm.Path, "/") || gm.Path == "/ws" {
+		return nil, fmt.Errorf("game path %q must start with / and differ from /ws", gm.Path)
+	}
+	hub := newMountedHub(primary, cfg)
+	hub.path = gm.Path
+	hub.mode = gm.Mode
+	var scripts *ScriptEngine
+	if gm.Scripts != "" {
+		var err error
+		if scripts, err = NewScriptEngine(gm.Scripts, hub); err != nil {
+			return nil, fmt.Errorf("%s: scripts: %v", gm.Path, err)
+		}
+		scripts.audit = d.audit
+		go scripts.Watch()
+	}
+	gs := gameSettings{scripts: scripts, trivia: cfg.Trivia, command: gm.Command}
+	if gm.Trivia != nil {
+		gs.trivia = *gm.Trivia
+	}
+	game, err := newGame(gm.Mode, hub, gs)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", gm.Path, err)
+	}
+	var history HistoryStore
+	if gm.History != "" {
+		if history, err = OpenFileHistoryStore(gm.History); err != nil {
+			return nil, fmt.Errorf("%s: history: %v", gm.Path, err)
+		}
+		history = d.caches.History(gm.Path, history)
+	}
+	rateLimits := cfg.RateLimits
+	if gm.RateLimits != nil {
+		rateLimits = gm.RateLimits
+	}
+	eph := cfg.Ephemeral
+	if gm.Ephemeral != nil {
+		eph = *gm.Ephemeral
+	}
+	d.presence.AddHub(hub)
+	d.antiCheat.Attach(hub.events)
+	d.push.AddHub(hub)
+	d.parties.AddHub(hub)
+	d.userSessions.AddHub(hub)
+	d.inbox.AddHub(hub)
+	hub.bandwidth.AddHub(hub)
+	hub.reconnects.AddHub(hub)
+	hub.bans.AddHub(hub)
+	hub.load.AddHub(hub)
+	d.friends.AddHub(hub)
+	d.tournaments.AddHub(hub)
+	d.reports.AddHub(hub)
+	d.announcer.AddHub(hub)
+	process, _ := game.(*ProcessGame)
+	game = d.chain(game, hub, scripts, history, cfg, rateLimits, eph)
+	d.mounted[gm.Path] = &mountedGame{hub: hub, history: history, process: process, game: game}
+	mux.HandleFunc(gm.Path, func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, game, sessions, w, r)
+	})
+	return hub, nil
+}
+
+// mountsHistory reports whether any mounted game keeps history
+func (cfg *Config) mountsHistory() bool {
+	for _, gm := range cfg.Games {
+		if gm.History != "" {
+			return true
+		}
+	}
+	return false
+}
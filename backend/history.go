@@ -0,0 +1,459 @@
+// backend/history.go
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+Message history.
+Room messages of the configured types are appended to a HistoryStore.
+MemoryHistoryStore keeps everything in RAM; FileHistoryStore adds durability
+with an append-only JSONL log (adds and deletes) that is replayed and
+compacted on startup.
+*/
+
+// StoredMessage is one persisted room message
+type StoredMessage struct {
+	ID      int64           `json:"id"`
+	Room    string          `json:"room"`
+	Sender  string          `json:"sender"`
+	UserID  string          `json:"userId,omitempty"` // authenticated author, for per-user quotas and deletion
+	Type    string          `json:"type"`
+	Payload string          `json:"payload,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	Time    time.Time       `json:"time"`
+}
+
+// Size is what the message counts against storage quotas
+func (m *StoredMessage) Size() int64 { return int64(len(m.Payload) + len(m.Data)) }
+
+// HistoryFilter selects messages; zero fields match everything
+type HistoryFilter struct {
+	Room   string
+	UserID string
+	Since  time.Time // inclusive
+	Until  time.Time // exclusive
+	Limit  int       // Query: keep only the newest Limit matches
+}
+
+func (f HistoryFilter) match(m *StoredMessage) bool {
+	return (f.Room == "" || m.Room == f.Room) &&
+		(f.UserID == "" || m.UserID == f.UserID) &&
+		(f.Since.IsZero() || !m.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || m.Time.Before(f.Until))
+}
+
+// HistoryStore persists room messages
+type HistoryStore interface {
+	// Append stores m and assigns m.ID
+	Append(m *StoredMessage) error
+	// Query returns matching messages, oldest first
+	Query(f HistoryFilter) ([]StoredMessage, error)
+	// DeleteOldest removes up to n of the oldest matches (all if n <= 0)
+	DeleteOldest(f HistoryFilter, n int) (int, error)
+	// Usage returns the number and total size of matching messages
+	Usage(f HistoryFilter) (count int, bytes int64, err error)
+	// Anonymize detaches userID's messages from them: UserID is cleared and
+	// Sender becomes alias
+	Anonymize(userID, alias string) (int, error)
+	// Rooms lists the rooms with stored messages
+	Rooms() ([]string, error)
+}
+
+type usage struct {
+	count int
+	bytes int64
+}
+
+// MemoryHistoryStore keeps history in RAM
+type MemoryHistoryStore struct {
+	mu     sync.Mutex
+	nextID int64
+	rooms  map[string][]StoredMessage // chronological per room
+	byRoom map[string]usage
+	byUser map[string]usage // by UserID; anonymous messages aren't counted
+}
+
+func NewMemoryHistoryStore() *MemoryHistoryStore {
+	return &MemoryHistoryStore{
+		nextID: 1,
+		rooms:  make(map[string][]StoredMessage),
+		byRoom: make(map[string]usage),
+		byUser: make(map[string]usage),
+	}
+}
+
+func (s *MemoryHistoryStore) Append(m *StoredMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m.ID = s.nextID
+	s.insertLocked(*m)
+	return nil
+}
+
+// insertLocked adds m with its existing ID (used by Append and log replay)
+func (s *MemoryHistoryStore) insertLocked(m StoredMessage) {
+	if m.ID >= s.nextID {
+		s.nextID = m.ID + 1
+	}
+	s.rooms[m.Room] = append(s.rooms[m.Room], m)
+	s.account(&m, 1)
+}
+
+func (s *MemoryHistoryStore) account(m *StoredMessage, sign int) {
+	r := s.byRoom[m.Room]
+	r.count += sign
+	r.bytes += int64(sign) * m.Size()
+	if r.count == 0 {
+		delete(s.byRoom, m.Room)
+	} else {
+		s.byRoom[m.Room] = r
+	}
+	if m.UserID == "" {
+		return
+	}
+	u := s.byUser[m.UserID]
+	u.count += sign
+	u.bytes += int64(sign) * m.Size()
+	if u.count == 0 {
+		delete(s.byUser, m.UserID)
+	} else {
+		s.byUser[m.UserID] = u
+	}
+}
+
+// matchingLocked returns pointers to matches in ID (= time) order
+func (s *MemoryHistoryStore) matchingLocked(f HistoryFilter) []*StoredMessage {
+	var out []*StoredMessage
+	scan := func(msgs []StoredMessage) {
+		for i := range msgs {
+			if f.match(&msgs[i]) {
+				out = append(out, &msgs[i])
+			}
+		}
+	}
+	if f.Room != "" {
+		scan(s.rooms[f.Room])
+		return out
+	}
+	for _, msgs := range s.rooms {
+		scan(msgs)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+func (s *MemoryHistoryStore) Query(f HistoryFilter) ([]StoredMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	matches := s.matchingLocked(f)
+	if f.Limit > 0 && len(matches) > f.Limit {
+		matches = matches[len(matches)-f.Limit:]
+	}
+	out := make([]StoredMessage, len(matches))
+	for i, m := range matches {
+		out[i] = *m
+	}
+	return out, nil
+}
+
+func (s *MemoryHistoryStore) DeleteOldest(f HistoryFilter, n int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := s.deleteOldestLocked(f, n)
+	return len(ids), nil
+}
+
+// deleteOldestLocked removes the matches and returns their IDs
+func (s *MemoryHistoryStore) deleteOldestLocked(f HistoryFilter, n int) []int64 {
+	matches := s.matchingLocked(f)
+	if n > 0 && len(matches) > n {
+		matches = matches[:n]
+	}
+	if len(matches) == 0 {
+		return nil
+	}
+	doomed := make(map[int64]bool, len(matches))
+	ids := make([]int64, len(matches))
+	for i, m := range matches {
+		doomed[m.ID] = true
+		ids[i] = m.ID
+	}
+	s.deleteIDsLocked(doomed)
+	return ids
+}
+
+func (s *MemoryHistoryStore) deleteIDsLocked(doomed map[int64]bool) {
+	for room, msgs := range s.rooms {
+		kept := msgs[:0]
+		for i := range msgs {
+			if doomed[msgs[i].ID] {
+				s.account(&msgs[i], -1)
+				continue
+			}
+			kept = append(kept, msgs[i])
+		}
+		if len(kept) == 0 {
+			delete(s.rooms, room)
+		} else {
+			s.rooms[room] = kept
+		}
+	}
+}
+
+func (s *MemoryHistoryStore) Usage(f HistoryFilter) (int, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// fast paths for the quota checks
+	if f.Since.IsZero() && f.Until.IsZero() {
+		switch {
+		case f.Room != "" && f.UserID == "":
+			u := s.byRoom[f.Room]
+			return u.count, u.bytes, nil
+		case f.UserID != "" && f.Room == "":
+			u := s.byUser[f.UserID]
+			return u.count, u.bytes, nil
+		}
+	}
+	var count int
+	var bytes int64
+	for _, m := range s.matchingLocked(f) {
+		count++
+		bytes += m.Size()
+	}
+	return count, bytes, nil
+}
+
+func (s *MemoryHistoryStore) Rooms() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]string, 0, len(s.byRoom))
+	for room := range s.byRoom {
+		out = append(out, room)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+func (s *MemoryHistoryStore) Anonymize(userID, alias string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.anonymizeLocked(userID, alias), nil
+}
+
+func (s *MemoryHistoryStore) anonymizeLocked(userID, alias string) int {
+	matches := s.matchingLocked(HistoryFilter{UserID: userID})
+	for _, m := range matches {
+		s.account(m, -1)
+		m.UserID, m.Sender = "", alias
+		s.account(m, 1)
+	}
+	return len(matches)
+}
+
+// historyLogEntry is one line of the FileHistoryStore log
+type historyLogEntry struct {
+	Op  string         `json:"op"` // "add" | "del"
+	Msg *StoredMessage `json:"msg,omitempty"`
+	IDs []int64        `json:"ids,omitempty"`
+}
+
+// FileHistoryStore is a MemoryHistoryStore backed by an append-only log
+type FileHistoryStore struct {
+	*MemoryHistoryStore
+	path string
+	f    *os.File
+	w    *bufio.Writer
+}
+
+// OpenFileHistoryStore replays path (if present), compacts it and opens it for appending
+func OpenFileHistoryStore(path string) (*FileHistoryStore, error) {
+	mem := NewMemoryHistoryStore()
+	if f, err := os.Open(path); err == nil {
+		sc := bufio.NewScanner(f)
+		sc.Buffer(make([]byte, 64*1024), 16<<20)
+		line := 0
+		for sc.Scan() {
+			line++
+			var e historyLogEntry
+			if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+			}
+			switch {
+			case e.Op == "add" && e.Msg != nil:
+				mem.insertLocked(*e.Msg)
+			case e.Op == "del":
+				doomed := make(map[int64]bool, len(e.IDs))
+				for _, id := range e.IDs {
+					doomed[id] = true
+				}
+				mem.deleteIDsLocked(doomed)
+			}
+		}
+		f.Close()
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	s := &FileHistoryStore{MemoryHistoryStore: mem, path: path}
+	if err := s.compactLocked(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// compactLocked rewrites the log with only the live messages, so deleted
+// and anonymized content is gone from disk too; caller holds s.mu (or owns s)
+func (s *FileHistoryStore) compactLocked() error {
+	all := s.matchingLocked(HistoryFilter{})
+	var buf []byte
+	for _, m := range all {
+		b, err := json.Marshal(historyLogEntry{Op: "add", Msg: m})
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, b...), '\n')
+	}
+	if s.f != nil {
+		s.w.Flush()
+		s.f.Close()
+	}
+	if err := writeFileAtomic(s.path, buf); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	s.f, s.w = f, bufio.NewWriter(f)
+	return nil
+}
+
+// Compact rewrites the log now instead of at the next start
+func (s *FileHistoryStore) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.compactLocked()
+}
+
+// writeLocked appends a log entry; caller holds s.mu
+func (s *FileHistoryStore) writeLocked(e historyLogEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	s.w.Write(b)
+	s.w.WriteByte('\n')
+	return s.w.Flush()
+}
+
+func (s *FileHistoryStore) Append(m *StoredMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m.ID = s.nextID
+	if err := s.writeLocked(historyLogEntry{Op: "add", Msg: m}); err != nil {
+		return err
+	}
+	s.insertLocked(*m)
+	return nil
+}
+
+func (s *FileHistoryStore) DeleteOldest(f HistoryFilter, n int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := s.deleteOldestLocked(f, n)
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	return len(ids), s.writeLocked(historyLogEntry{Op: "del", IDs: ids})
+}
+
+func (s *FileHistoryStore) Anonymize(userID, alias string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.anonymizeLocked(userID, alias)
+	if n == 0 {
+		return 0, nil
+	}
+	return n, s.compactLocked()
+}
+
+func (s *FileHistoryStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.w.Flush()
+	return s.f.Close()
+}
+
+// HistoryConfig is the "history" block of the config file
+type HistoryConfig struct {
+	Types []string `json:"types,omitempty"` // message types to persist, default ["message", "chat"]
+}
+
+// typeSet returns the persisted types as a set
+func (cfg HistoryConfig) typeSet() map[string]bool {
+	types := make(map[string]bool)
+	if len(cfg.Types) == 0 {
+		cfg.Types = []string{"message", "chat"}
+	}
+	for _, t := range cfg.Types {
+		types[t] = true
+	}
+	return types
+}
+
+const historyPageSize = 50
+
+// HistoryMiddleware persists room messages of the configured types, keeps
+// rooms and users within quota, and answers history.get with the room's
+// most recent messages
+func HistoryMiddleware(hub *Hub, store HistoryStore, quotas *Quotas, cfg HistoryConfig) Middleware {
+	types := cfg.typeSet()
+	return func(next MessageHandler) MessageHandler {
+		return func(c *Client, m Message) {
+			room := hub.RoomOf(c)
+			if m.Type == "history.get" {
+				if room == "" {
+					sendError(c, "history.no_room")
+					return
+				}
+				if !hub.Feature("history", c, room) {
+					sendError(c, "history.disabled")
+					return
+				}
+				msgs, err := store.Query(HistoryFilter{Room: room, Limit: historyPageSize})
+				if err != nil {
+					log.Println("history query:", err)
+					sendError(c, "history.unavailable")
+					return
+				}
+				data, _ := json.Marshal(msgs)
+				b, _ := json.Marshal(Message{Type: "history", Sender: "server", Data: data})
+				c.sendLarge(b)
+				return
+			}
+			if room != "" && types[m.Type] && hub.Feature("history", c, room) {
+				sm := &StoredMessage{Room: room, Sender: m.Sender, UserID: c.userID, Type: m.Type, Payload: m.Payload, Data: m.Data, Time: time.Now()}
+				if err := store.Append(sm); err != nil {
+					log.Println("history append:", err)
+				} else if _, err := quotas.Enforce(store, room, c.userID); err != nil {
+					log.Println("quota enforce:", err)
+				}
+			}
+			next(c, m)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+// backend/i18n.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+Localized server text. System and error replies carry a stable "code"
+next to the human-readable payload, so clients can either show the
+payload or translate the code themselves (errors.go describes the data
+of errors):
+
+	{"type":"error","sender":"server","code":"room.name_invalid","payload":"room.join: room name must be 1-64 characters","data":{"status":400}}
+
+The payload is rendered in the client's locale, taken from the handshake's
+Accept-Language header and overridable at any time with
+
+	{"type":"hello","data":{"locale":"de"}}
+
+which is answered with {"type":"hello","data":{"locale":"de","locales":[...],"maxMessageSize":512}}.
+(hello can also carry the client's own maxMessageSize; see chunk.go.)
+Catalogs are JSON files named <locale>.json in -locales, mapping codes to
+fmt templates ("%[2]s"-style indexes let translations reorder arguments).
+Missing codes fall back from "de-AT" to "de" to the built-in English.
+*/
+
+const defaultLocale = "en"
+
+// englishCatalog is the built-in text for every code the server sends
+var englishCatalog = map[string]string{
+	"welcome.echo":              "Welcome! (EchoGame). Your id: %s",
+	"welcome.broadcast":         "Welcome! (BroadcastGame).",
+	"welcome.rules":             "Welcome! (%s). Join a room and send game.start.",
+	"echo":                      "Echo: %s",
+	"bad_data":                  "%s: bad data: %s",
+	"auth.required":             "%s: log in first",
+	"failed":                    "%s: failed",
+	"ok":                        "%s ok",
+	"room.joined":               "joined room %s",
+	"room.left":                 "left room",
+	"room.name_invalid":         "%s: room name must be 1-64 characters",
+	"room.private":              "room %s is private",
+	"room.private_denied":       "room.join: %s is private; ask the owner for an invite or the join code",
+	"room.taken":                "room.private: %s already belongs to someone else",
+	"room.in_use":               "room.private: %s is in use",
+	"room.not_owner":            "%s: you don't own a private room %s",
+	"room.invite_bad":           `room.invite: data must be {"room":...,"user":...}`,
+	"room.invited":              "invited %s",
+	"room.revoked":              "revoked %s",
+	"room.removed":              "removed from room %s",
+	"room.new_code":             "new join code for %s",
+	"room.banned":               "you were removed from room %s",
+	"room.not_member":           "%s: you are not in a room",
+	"room.role_bad":             `room.role: data must be {"user":...,"role":...}; role %q is unknown`,
+	"room.no_permission":        "%s: not allowed in %s",
+	"room.role_changed":         "your role in %s is now %s",
+	"room.role_set":             "%s is now %s",
+	"room.kicked":               "removed from room %s by a moderator",
+	"room.kick_done":            "removed %s (%d connection(s))",
+	"push.bad_token":            `%s: data must be {"platform":...,"token":...}`,
+	"dm.bad_target":             `dm: data must be {"to":"<user id>"}`,
+	"ratelimit.too_large":       "payload too large for %q: %d bytes (max %d)",
+	"ratelimit.exceeded":        "rate limit exceeded for %q: max %g/sec",
+	"history.no_room":           "history.get: join a room first",
+	"history.unavailable":       "history.get: unavailable",
+	"history.disabled":          "history.get: history is turned off in this room",
+	"aoi.bad_position":          `aoi.position: expected data {"x":number,"y":number}`,
+	"aoi.no_position":           "aoi.update: send aoi.position first",
+	"script.rejected":           "%s: %s",
+	"script.error":              "%s: script error",
+	"message.unknown_type":      "unknown message type %s",
+	"binary.unhandled":          "binary frames are not handled",
+	"welcome.trivia":            "Welcome to trivia! %d questions in the bank. Join a room and send trivia.start.",
+	"trivia.no_room":            "%s: join a room first",
+	"trivia.running":            "trivia.start: a quiz is already running in this room",
+	"trivia.not_running":        "answer: no question is open",
+	"trivia.already_answered":   "answer: you already answered this round",
+	"welcome.draw":              "Welcome to the shared canvas! Join a room to start drawing.",
+	"draw.no_room":              "%s: join a room first",
+	"draw.empty_stroke":         "stroke: data is required",
+	"draw.nothing_to_undo":      "undo: you have no strokes on this canvas",
+	"rules.no_room":             "%s: join a room first",
+	"rules.not_started":         "%s: no game in this room; send game.start",
+	"rules.illegal":             "%s: %s",
+	"timer.no_room":             "timer.list: join a room first",
+	"party.already_in":          "leave your current party first",
+	"party.not_in":              "%s: you are not in a party",
+	"party.not_leader":          "%s: only the party leader can do that",
+	"party.not_member":          "party.kick: %s is not in your party",
+	"party.user_offline":        "party.invite: %s is not online",
+	"party.invited":             "invited %s to your party",
+	"party.bad_code":            "party.join: no party with that code",
+	"party.full":                "party.join: the party is full (%d players)",
+	"party.left":                "left the party",
+	"party.kicked":              "you were removed from the party",
+	"party.too_big":             "queue.join: only parties of up to %d can queue",
+	"party.members_away":        "queue.join: waiting for %s to connect to this game",
+	"queue.already":             "queue.join: you are already queued",
+	"queue.not_in":              "queue.leave: you are not queued",
+	"queue.joined":              "waiting for a match",
+	"queue.left":                "left the queue",
+	"sessions.login_required":   "sessions: log in first",
+	"sessions.not_found":        "sessions.revoke: no session %s",
+	"sessions.revoked":          "closed %d session(s)",
+	"inbox.updated":             "%s: %d item(s) updated",
+	"friends.bad_user":          `%s: data must be {"user":...} naming someone else`,
+	"friends.request_sent":      "friend request sent to %s",
+	"friends.added":             "you and %s are now friends",
+	"friends.already":           "%s is already your friend",
+	"friends.blocked":           "you blocked %s; unblock them first",
+	"friends.no_request":        "%s: nothing pending with %s",
+	"tournament.unknown":        "no tournament %s",
+	"tournament.closed":         "%s: registration is closed",
+	"tournament.full":           "%s is full",
+	"tournament.not_registered": "you are not registered for %s",
+	"tournament.registered":     "registered for %s",
+	"tournament.unregistered":   "no longer registered for %s",
+	"game.panic":                "%s: internal error; the message was not processed",
+	"locale.unknown":            "hello: no catalog for locale %q, using %s",
+	"report.bad":                `%s: data must be {"user":...} or {"message":...}`,
+	"report.message_not_found":  "%s: that message is no longer in this room's recent history; report the user instead",
+	"report.self":               "%s: you can't report yourself",
+	"report.duplicate":          "%s: you already reported that and it is still open",
+	"report.moderators_only":    "%s: %s is for moderators",
+	"tags.not_allowed":          "%s: clients can't set the tag %s",
+	"deprecated.notice":         "%s is deprecated and will stop working after %s",
+	"deprecated.undated":        "%s is deprecated",
+	"deprecated.retired":        "%s was retired on %s",
+	"tags.invalid":              "%s: tag keys and values must be at most %d characters, locale, room, tenant and user are reserved, and a connection has at most %d tags",
+}
+
+// Locales holds the message catalogs
+type Locales struct {
+	catalogs map[string]map[string]string // locale -> code -> template
+}
+
+// LoadLocales reads <locale>.json files from dir ("" = English only)
+func LoadLocales(dir string) (*Locales, error) {
+	l := &Locales{catalogs: map[string]map[string]string{defaultLocale: englishCatalog}}
+	if dir == "" {
+		return l, nil
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		cat := make(map[string]string)
+		if err := json.Unmarshal(b, &cat); err != nil {
+			return nil, fmt.Errorf("%s: %v", f, err)
+		}
+		locale := strings.ToLower(strings.TrimSuffix(filepath.Base(f), ".json"))
+		for code := range cat {
+			if _, ok := englishCatalog[code]; !ok {
+				log.Printf("locales: %s: unknown code %q", filepath.Base(f), code)
+			}
+		}
+		if locale == defaultLocale {
+			// allow overriding individual English strings
+			merged := make(map[string]string, len(englishCatalog))
+			for k, v := range englishCatalog {
+				merged[k] = v
+			}
+			for k, v := range cat {
+				merged[k] = v
+			}
+			cat = merged
+		}
+		l.catalogs[locale] = cat
+	}
+	return l, nil
+}
+
+// Available lists the loaded locales
+func (l *Locales) Available() []string {
+	out := make([]string, 0, len(l.catalogs))
+	for k := range l.catalogs {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// resolve returns the best loaded locale for tag, or "" if none matches
+func (l *Locales) resolve(tag string) string {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	for tag != "" {
+		if _, ok := l.catalogs[tag]; ok {
+			return tag
+		}
+		i := strings.LastIndexAny(tag, "-_")
+		if i < 0 {
+			break
+		}
+		tag = tag[:i]
+	}
+	return ""
+}
+
+// Match picks a locale from an Accept-Language header
+func (l *Locales) Match(acceptLanguage string) string {
+	best, bestQ := defaultLocale, -1.0
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		if loc := l.resolve(tag); loc != "" && q > bestQ {
+			best, bestQ = loc, q
+		}
+	}
+	return best
+}
+
+// Translate renders code in locale, falling back to English and then to the code
+func (l *Locales) Translate(locale, code string, args ...interface{}) string {
+	tmpl, ok := "", false
+	for loc := locale; loc != "" && !ok; {
+		tmpl, ok = l.catalogs[loc][code]
+		i := strings.LastIndexAny(loc, "-_")
+		if i < 0 {
+			break
+		}
+		loc = loc[:i]
+	}
+	if !ok {
+		if tmpl, ok = englishCatalog[code]; !ok {
+			return code
+		}
+	}
+	return fmt.Sprintf(tmpl, args...)
+}
+
+// Locale is the client's current locale
+func (c *Client) Locale() string {
+	if s, ok := c.locale.Load().(string); ok {
+		return s
+	}
+	return defaultLocale
+}
+
+// T renders code in the client's locale
+func (c *Client) T(code string, args ...interface{}) string {
+	return c.hub.locales.Translate(c.Locale(), code, args...)
+}
+
+// sendSystem sends c a localized "system" message
+func sendSystem(c *Client, code string, args ...interface{}) {
+	m := Message{Type: "system", Sender: "server", Code: code, Payload: c.T(code, args...)}
+	if !c.hub.router.route("out", c, m) {
+		return
+	}
+	b, _ := json.Marshal(m)
+	c.Send(b)
+}
+
+// HelloMiddleware handles hello, which sets the client's locale
+func HelloMiddleware(l *Locales) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(c *Client, m Message) {
+			if m.Type != "hello" {
+				next(c, m)
+				return
+			}
+			var req struct {
+				Locale         string          `json:"locale"`
+				MaxMessageSize int             `json:"maxMessageSize"`
+				Keepalive      *keepaliveTerms `json:"keepalive"`
+			}
+			if len(m.Data) > 0 {
+				if err := json.Unmarshal(m.Data, &req); err != nil {
+					sendError(c, "bad_data", m.Type, err.Error())
+					return
+				}
+			}
+			if req.Locale != "" {
+				loc := l.resolve(req.Locale)
+				if loc == "" {
+					sendError(c, "locale.unknown", req.Locale, c.Locale())
+				} else {
+					c.locale.Store(loc)
+				}
+			}
+			if req.MaxMessageSize > 0 {
+				c.setMaxFrame(req.MaxMessageSize)
+			}
+			reply := map[string]interface{}{"locale": c.Locale(), "locales": l.Available(), "maxMessageSize": maxMessageSize}
+			if req.Keepalive != nil {
+				reply["keepalive"] = c.negotiateKeepalive(*req.Keepalive)
+			} else {
+				reply["keepalive"] = keepaliveTerms{PingInterval: Duration(c.pingInterval()), PongTimeout: Duration(c.readTimeout())}
+			}
+			data, _ := json.Marshal(reply)
+			b, _ := json.Marshal(Message{Type: "hello", Sender: "server", Data: data})
+			c.Send(b)
+		}
+	}
+}
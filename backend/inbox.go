@@ -0,0 +1,355 @@
+// backend/inbox.go
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+Per-user notification inbox. Game invites, match results and other things
+addressed to a logged-in user are stored (in the database when -db is set,
+else in memory) and delivered right away when the user is online, pushed
+when not. A client that reconnects catches up with
+
+	{"type":"inbox.list","data":{"unread":true,"before":<id>,"limit":20}}
+	{"type":"inbox.list","data":{"items":[{"id":12,"kind":"match.result","title":"...","read":false,...}],"unread":3,"next":0}}
+
+	{"type":"inbox.read","data":{"ids":[12,13]}}      or {"all":true}
+	{"type":"inbox.delete","data":{"ids":[12]}}       or {"all":true}
+
+New items arrive live as {"type":"inbox","data":<item>}; room invites keep
+their room.invite message, which carries the item's "inboxId". Match
+results go to the players who are logged in when the game reports them.
+Each user keeps their newest inboxMaxItems items; unread ones pushed out
+become dead letters (deadletter.go). Operators can send
+notices with
+
+	POST /api/admin/inbox  {"user":"alice","title":"Maintenance","body":"Back at 10:00"}
+	GET  /api/admin/inbox?user=alice
+*/
+
+const (
+	inboxPageSize    = 20
+	maxInboxPageSize = 100
+	inboxMaxItems    = 500 // per user; older items are dropped
+)
+
+// InboxItem is one notification
+type InboxItem struct {
+	ID    int64           `json:"id"`
+	User  string          `json:"user"`
+	Kind  string          `json:"kind"` // room.invite | match.result | notice | ...
+	From  string          `json:"from,omitempty"`
+	Title string          `json:"title"`
+	Body  string          `json:"body,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+	Time  time.Time       `json:"time"`
+	Read  bool            `json:"read"`
+}
+
+// InboxFilter selects a user's items, newest first
+type InboxFilter struct {
+	UnreadOnly bool
+	Before     int64 // only items with a smaller ID
+	Limit      int
+}
+
+// InboxStore keeps inbox items. MarkRead and Delete with nil ids apply to
+// all of the user's items and return how many changed.
+type InboxStore interface {
+	Add(it *InboxItem) (dropped []InboxItem, err error) // sets it.ID; dropped are unread items over inboxMaxItems
+	List(user string, f InboxFilter) (items []InboxItem, unread int, err error)
+	MarkRead(user string, ids []int64) (int, error)
+	Delete(user string, ids []int64) (int, error)
+}
+
+// memoryInboxStore is used without a database
+type memoryInboxStore struct {
+	mu     sync.Mutex
+	nextID int64
+	items  map[string][]InboxItem // user -> items, oldest first
+}
+
+func newMemoryInboxStore() *memoryInboxStore {
+	return &memoryInboxStore{items: make(map[string][]InboxItem)}
+}
+
+func (s *memoryInboxStore) Add(it *InboxItem) ([]InboxItem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	it.ID = s.nextID
+	items := append(s.items[it.User], *it)
+	var dropped []InboxItem
+	if n := len(items) - inboxMaxItems; n > 0 {
+		for _, old := range items[:n] {
+			if !old.Read {
+				dropped = append(dropped, old)
+			}
+		}
+		items = append([]InboxItem(nil), items[n:]...)
+	}
+	s.items[it.User] = items
+	return dropped, nil
+}
+
+func (s *memoryInboxStore) List(user string, f InboxFilter) ([]InboxItem, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	items := s.items[user]
+	out := []InboxItem{}
+	unread := 0
+	for i := len(items) - 1; i >= 0; i-- {
+		it := items[i]
+		if !it.Read {
+			unread++
+		}
+		if (f.Before > 0 && it.ID >= f.Before) || (f.UnreadOnly && it.Read) || len(out) >= f.Limit {
+			continue
+		}
+		out = append(out, it)
+	}
+	return out, unread, nil
+}
+
+// matchIDs reports whether id is selected by ids (nil selects all)
+func matchIDs(ids []int64, id int64) bool {
+	if ids == nil {
+		return true
+	}
+	for _, x := range ids {
+		if x == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memoryInboxStore) MarkRead(user string, ids []int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	items := s.items[user]
+	for i := range items {
+		if !items[i].Read && matchIDs(ids, items[i].ID) {
+			items[i].Read = true
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memoryInboxStore) Delete(user string, ids []int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	items := s.items[user]
+	kept := items[:0]
+	for _, it := range items {
+		if !matchIDs(ids, it.ID) {
+			kept = append(kept, it)
+		}
+	}
+	n := len(items) - len(kept)
+	if len(kept) == 0 {
+		delete(s.items, user)
+	} else {
+		s.items[user] = kept
+	}
+	return n, nil
+}
+
+// Inbox stores notifications and delivers them to users on every game
+type Inbox struct {
+	store       InboxStore
+	push        *Push
+	deadLetters *DeadLetters // gets unread items dropped by the limit; may be nil
+}
+
+func NewInbox(store InboxStore, push *Push) *Inbox {
+	return &Inbox{store: store, push: push}
+}
+
+// AddHub sends the results of hub's matches to the players' inboxes
+func (in *Inbox) AddHub(hub *Hub) {
+	hub.events.Subscribe(func(e Event) {
+		r := e.Result
+		for _, p := range r.Players {
+			if len(hub.UserClients(p.ID)) == 0 {
+				continue // anonymous, or gone before the end
+			}
+			data, _ := json.Marshal(map[string]interface{}{"match": r.ID, "game": r.Game, "room": r.Room, "outcome": p.Outcome, "rank": p.Rank, "score": p.Score})
+			body := "Match in " + r.Game + " finished"
+			if p.Outcome != "" {
+				body += ": " + p.Outcome
+			}
+			if _, err := in.Send(p.ID, InboxItem{Kind: "match.result", Title: "Match result", Body: body, Data: data}, nil); err != nil {
+				log.Printf("inbox: %s: %v", p.ID, err)
+			}
+		}
+	}, EventMatchFinished)
+}
+
+// Send stores it for userID and delivers it as the message live builds
+// from the item's id, or as an "inbox" message when live is nil. It
+// reports whether the user was online.
+func (in *Inbox) Send(userID string, it InboxItem, live func(id int64) []byte) (bool, error) {
+	it.User, it.Time, it.Read = userID, time.Now(), false
+	dropped, err := in.store.Add(&it)
+	if err != nil {
+		return false, err
+	}
+	in.deadLetters.overflowed(dropped)
+	var msg []byte
+	if live != nil {
+		msg = live(it.ID)
+	} else {
+		data, _ := json.Marshal(it)
+		msg, _ = json.Marshal(Message{Type: "inbox", Sender: "server", Data: data})
+	}
+	return in.push.Deliver(userID, msg, Notification{
+		Title: it.Title,
+		Body:  it.Body,
+		Data:  map[string]string{"type": it.Kind, "inboxId": strconv.FormatInt(it.ID, 10)},
+	}), nil
+}
+
+// Forget deletes every item of userID
+func (in *Inbox) Forget(userID string) (int, error) {
+	return in.store.Delete(userID, nil)
+}
+
+// inboxPage is the inbox.list reply and the admin GET response
+type inboxPage struct {
+	Items  []InboxItem `json:"items"`
+	Unread int         `json:"unread"`
+	Next   int64       `json:"next"` // pass as before; 0 when done
+}
+
+func (in *Inbox) page(user string, f InboxFilter) (inboxPage, error) {
+	if f.Limit <= 0 {
+		f.Limit = inboxPageSize
+	}
+	if f.Limit > maxInboxPageSize {
+		f.Limit = maxInboxPageSize
+	}
+	items, unread, err := in.store.List(user, f)
+	if err != nil {
+		return inboxPage{}, err
+	}
+	p := inboxPage{Items: items, Unread: unread}
+	if len(items) == f.Limit {
+		p.Next = items[len(items)-1].ID
+	}
+	return p, nil
+}
+
+// InboxMiddleware handles inbox.list, inbox.read and inbox.delete
+func InboxMiddleware(in *Inbox) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(c *Client, m Message) {
+			if m.Type != "inbox.list" && m.Type != "inbox.read" && m.Type != "inbox.delete" {
+				next(c, m)
+				return
+			}
+			if c.userID == "" {
+				sendError(c, "auth.required", m.Type)
+				return
+			}
+			var req struct {
+				Unread bool    `json:"unread"`
+				Before int64   `json:"before"`
+				Limit  int     `json:"limit"`
+				IDs    []int64 `json:"ids"`
+				All    bool    `json:"all"`
+			}
+			if len(m.Data) > 0 {
+				if err := json.Unmarshal(m.Data, &req); err != nil {
+					sendError(c, "bad_data", m.Type, err.Error())
+					return
+				}
+			}
+			if m.Type == "inbox.list" {
+				p, err := in.page(c.userID, InboxFilter{UnreadOnly: req.Unread, Before: req.Before, Limit: req.Limit})
+				if err != nil {
+					log.Println("inbox:", err)
+					sendError(c, "failed", m.Type)
+					return
+				}
+				data, _ := json.Marshal(p)
+				b, _ := json.Marshal(Message{Type: "inbox.list", Sender: "server", Data: data})
+				c.sendLarge(b)
+				return
+			}
+			if !req.All && len(req.IDs) == 0 {
+				sendError(c, "bad_data", m.Type, "ids or all required")
+				return
+			}
+			ids := req.IDs
+			if req.All {
+				ids = nil
+			}
+			var n int
+			var err error
+			if m.Type == "inbox.read" {
+				n, err = in.store.MarkRead(c.userID, ids)
+			} else {
+				n, err = in.store.Delete(c.userID, ids)
+			}
+			if err != nil {
+				log.Println("inbox:", err)
+				sendError(c, "failed", m.Type)
+				return
+			}
+			sendSystem(c, "inbox.updated", m.Type, n)
+		}
+	}
+}
+
+// RegisterAdmin mounts /api/admin/inbox
+func (in *Inbox) RegisterAdmin(a *AdminAPI) {
+	a.Handle("/api/admin/inbox", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			user := r.URL.Query().Get("user")
+			if user == "" {
+				writeJSONError(w, http.StatusBadRequest, "user required")
+				return
+			}
+			p, err := in.page(user, InboxFilter{Limit: maxInboxPageSize})
+			if err != nil {
+				writeJSONError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			writeJSON(w, http.StatusOK, p)
+		case http.MethodPost:
+			var req struct {
+				User  string          `json:"user"`
+				Title string          `json:"title"`
+				Body  string          `json:"body"`
+				Data  json.RawMessage `json:"data"`
+			}
+			if err := readJSON(w, r, &req); err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if req.User == "" || req.Title == "" {
+				writeJSONError(w, http.StatusBadRequest, "user and title required")
+				return
+			}
+			online, err := in.Send(req.User, InboxItem{Kind: "notice", From: "admin", Title: req.Title, Body: req.Body, Data: req.Data}, nil)
+			if err != nil {
+				writeJSONError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			a.audit.Record(adminActor(r), "inbox.send", req.User, req.Title)
+			writeJSON(w, http.StatusOK, map[string]bool{"online": online})
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, "use GET or POST")
+		}
+	})
+}
@@ -0,0 +1,111 @@
+// backend/inject.go
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/*
+Message injection for backends that don't hold a WebSocket (cron jobs,
+payment webhooks, ...). Service accounts are listed in the config file:
+
+	"services": {"billing": "<long random token>"}
+
+and post to a room with their token:
+
+	POST /api/rooms/{room}/messages[?game=/ws/chat]
+	Authorization: Bearer <token>
+	{"type":"notification","payload":"Your purchase went through","data":{...}}
+
+The room's members get the message with sender "service:billing" exactly
+like a room message from a player, and it is kept in the game's history if
+its type is persisted there. type defaults to "message"; game selects a
+mounted game's rooms (default /ws). The reply is
+{"delivered":<connections>}. Every injection is audited.
+*/
+
+// injectRequest is the POST body
+type injectRequest struct {
+	Type    string          `json:"type"`
+	Payload string          `json:"payload"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// InjectAPI serves POST /api/rooms/{room}/messages
+type InjectAPI struct {
+	services     map[string]string // name -> token
+	games        map[string]*mountedGame
+	quotas       *Quotas
+	historyTypes map[string]bool
+	audit        *AuditLog
+}
+
+func NewInjectAPI(services map[string]string, games map[string]*mountedGame, quotas *Quotas, history HistoryConfig) *InjectAPI {
+	return &InjectAPI{services: services, games: games, quotas: quotas, historyTypes: history.typeSet()}
+}
+
+// service returns the name of the account whose token r carries
+func (a *InjectAPI) service(r *http.Request) (string, bool) {
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || got == "" {
+		return "", false
+	}
+	for name, token := range a.services {
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1 {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func (a *InjectAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	room, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/api/rooms/"), "/messages")
+	if !ok || room == "" || strings.Contains(room, "/") || len(room) > maxRoomNameLen {
+		writeJSONError(w, http.StatusNotFound, "want /api/rooms/{room}/messages")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	name, ok := a.service(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="services"`)
+		writeJSONError(w, http.StatusUnauthorized, "service token required")
+		return
+	}
+	path := r.URL.Query().Get("game")
+	if path == "" {
+		path = "/ws"
+	}
+	game := a.games[path]
+	if game == nil {
+		writeJSONError(w, http.StatusNotFound, "no game at "+path)
+		return
+	}
+	var req injectRequest
+	if err := readJSON(w, r, &req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad message: "+err.Error())
+		return
+	}
+	if req.Type == "" {
+		req.Type = "message"
+	}
+	sender := "service:" + name
+	delivered := game.hub.BroadcastRoom(room, Message{Type: req.Type, Sender: sender, Payload: req.Payload, Data: req.Data})
+	if game.history != nil && a.historyTypes[req.Type] {
+		sm := &StoredMessage{Room: room, Sender: sender, Type: req.Type, Payload: req.Payload, Data: req.Data, Time: time.Now()}
+		if err := game.history.Append(sm); err != nil {
+			log.Println("history append:", err)
+		} else if _, err := a.quotas.Enforce(game.history, room, ""); err != nil {
+			log.Println("quota enforce:", err)
+		}
+	}
+	a.audit.Record(sender, "room.inject", room, req.Type)
+	writeJSON(w, http.StatusAccepted, map[string]int{"delivered": delivered})
+}
@@ -0,0 +1,321 @@
+// backend/judging.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Deferred verdicts. A game implementing JudgedGame decides each message
+instead of just handling it, and may put the decision off:
+
+	func (g *Quiz) OnJudgedMessage(c *Client, m Message) Decision {
+		switch m.Type {
+		case "answer":
+			return Defer(func(ctx context.Context) (Ruling, error) {
+				return g.checker.Check(ctx, m.Payload) // external API
+			})
+		case "appeal":
+			return AwaitModerator()                  // an operator decides
+		case "skip":
+			return Decide(Ruling{Status: RulingRejected, Reason: "not allowed"})
+		}
+		...
+		return Handled                                 // replied itself
+	}
+
+	func (g *Quiz) OnRuling(c *Client, m Message, v Ruling) { ...apply it... }
+
+and is mounted through WithJudging(g, judging). Deferred checks run in
+their own goroutine with a timeout per attempt, retried with backoff while
+they return an error (the "judging" config block):
+
+	"judging": {"timeout": "10s", "retries": 2, "retryBackoff": "1s", "moderatorTimeout": "10m"}
+
+A pending decision is announced to the client and the outcome follows:
+
+	{"type":"verdict.pending","data":{"id":"3f9a1c-2b","for":"<message id>","type":"answer"}}
+	{"type":"verdict","data":{"id":"3f9a1c-2b","for":"<message id>","type":"answer","status":"accepted"}}
+
+status is accepted, rejected, timeout (no verdict in time) or error (every
+attempt failed). OnRuling then runs, from the judging goroutine and even
+if the client has left in the meantime (c.Closed()), so games must lock
+their state. Immediate decisions get the same "verdict" message and
+OnRuling call, without the pending notice. Moderators work through
+
+	GET  /api/admin/verdicts                 decisions waiting for a moderator
+	POST /api/admin/verdicts/{id}            {"status":"accepted","reason":"..."}
+*/
+
+// ruling statuses
+const (
+	RulingAccepted = "accepted"
+	RulingRejected = "rejected"
+	RulingTimeout  = "timeout"
+	RulingError    = "error"
+)
+
+// Ruling is the verdict on a judged message
+type Ruling struct {
+	Status string          `json:"status"`
+	Reason string          `json:"reason,omitempty"`
+	Data   json.RawMessage `json:"data,omitempty"` // game-specific, passed on to the client
+}
+
+// Decision is what OnJudgedMessage returns
+type Decision struct {
+	ruling    *Ruling
+	check     func(ctx context.Context) (Ruling, error)
+	moderator bool
+	timeout   time.Duration // 0 = the configured default
+	retries   int           // -1 = the configured default
+}
+
+// Handled means the game dealt with the message itself; nothing is sent
+var Handled = Decision{}
+
+// Decide returns an immediate verdict
+func Decide(v Ruling) Decision { return Decision{ruling: &v} }
+
+// Defer runs check in the background, retrying while it returns an error
+func Defer(check func(ctx context.Context) (Ruling, error)) Decision {
+	return Decision{check: check, retries: -1}
+}
+
+// AwaitModerator leaves the verdict to an operator
+func AwaitModerator() Decision { return Decision{moderator: true} }
+
+// Within overrides the per-attempt (or moderator) timeout
+func (d Decision) Within(timeout time.Duration) Decision {
+	d.timeout = timeout
+	return d
+}
+
+// Retries overrides how often a failing check is retried
+func (d Decision) Retries(n int) Decision {
+	d.retries = n
+	return d
+}
+
+// JudgedGame is a Game whose messages get verdicts, possibly later
+type JudgedGame interface {
+	OnConnect(c *Client)
+	OnJudgedMessage(c *Client, msg Message) Decision
+	OnRuling(c *Client, msg Message, v Ruling)
+	OnBinaryMessage(c *Client, data []byte)
+	OnDisconnect(c *Client)
+}
+
+// JudgingConfig is the "judging" config block
+type JudgingConfig struct {
+	Timeout          Duration `json:"timeout,omitempty"`          // per attempt, default 10s
+	Retries          int      `json:"retries,omitempty"`          // after the first attempt, default 2
+	RetryBackoff     Duration `json:"retryBackoff,omitempty"`     // doubled per retry, default 1s
+	ModeratorTimeout Duration `json:"moderatorTimeout,omitempty"` // default 10m
+}
+
+func (cfg JudgingConfig) withDefaults() JudgingConfig {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = Duration(10 * time.Second)
+	}
+	if cfg.Retries <= 0 {
+		cfg.Retries = 2
+	}
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = Duration(time.Second)
+	}
+	if cfg.ModeratorTimeout <= 0 {
+		cfg.ModeratorTimeout = Duration(10 * time.Minute)
+	}
+	return cfg
+}
+
+// pendingVerdict is a decision waiting for a moderator
+type pendingVerdict struct {
+	ID      string    `json:"id"`
+	Game    string    `json:"game"`
+	Client  string    `json:"client"`
+	User    string    `json:"user,omitempty"`
+	Message Message   `json:"message"`
+	Since   time.Time `json:"since"`
+
+	result chan Ruling
+}
+
+// Judging carries out deferred decisions for every judged game
+type Judging struct {
+	cfg JudgingConfig
+
+	mu      sync.Mutex
+	pending map[string]*pendingVerdict // moderator decisions by id
+}
+
+func NewJudging(cfg JudgingConfig) *Judging {
+	return &Judging{cfg: cfg.withDefaults(), pending: make(map[string]*pendingVerdict)}
+}
+
+// judgedGame adapts a JudgedGame to Game
+type judgedGame struct {
+	JudgedGame
+	j *Judging
+}
+
+// WithJudging mounts a JudgedGame wherever a Game is expected
+func WithJudging(g JudgedGame, j *Judging) Game { return judgedGame{g, j} }
+
+func (a judgedGame) OnMessage(c *Client, m Message) {
+	d := a.OnJudgedMessage(c, m)
+	switch {
+	case d.ruling != nil:
+		a.j.deliver(a.JudgedGame, c, m, newMessageID(), *d.ruling)
+	case d.check != nil || d.moderator:
+		id := newMessageID()
+		a.j.notify(c, "verdict.pending", id, m, nil)
+		go a.j.await(a.JudgedGame, c, m, id, d)
+	}
+}
+
+// notify sends c a verdict.pending or verdict message about m
+func (j *Judging) notify(c *Client, kind, id string, m Message, v *Ruling) {
+	out := struct {
+		ID   string `json:"id"`
+		For  string `json:"for,omitempty"`
+		Type string `json:"type"`
+		*Ruling
+	}{id, m.ID, m.Type, v}
+	data, _ := json.Marshal(out)
+	b, _ := json.Marshal(Message{Type: kind, Sender: "server", Data: data})
+	c.trySend(b)
+}
+
+func (j *Judging) deliver(g JudgedGame, c *Client, m Message, id string, v Ruling) {
+	j.notify(c, "verdict", id, m, &v)
+	g.OnRuling(c, m, v)
+}
+
+// await resolves d and delivers the verdict
+func (j *Judging) await(g JudgedGame, c *Client, m Message, id string, d Decision) {
+	var v Ruling
+	if d.moderator {
+		v = j.moderate(c, m, id, d.timeout)
+	} else {
+		v = j.run(c, m, d)
+	}
+	j.deliver(g, c, m, id, v)
+}
+
+// run calls d.check until it succeeds or runs out of retries
+func (j *Judging) run(c *Client, m Message, d Decision) Ruling {
+	timeout, retries := d.timeout, d.retries
+	if timeout <= 0 {
+		timeout = time.Duration(j.cfg.Timeout)
+	}
+	if retries < 0 {
+		retries = j.cfg.Retries
+	}
+	backoff := time.Duration(j.cfg.RetryBackoff)
+	var err error
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := c.callContextTimeout(context.Background(), m.ID, timeout)
+		var v Ruling
+		v, err = d.check(ctx)
+		timedOut := ctx.Err() == context.DeadlineExceeded
+		cancel()
+		if err == nil {
+			return v
+		}
+		if attempt >= retries {
+			log.Printf("judging %s %s from %s: %v", c.hub.path, m.Type, c.id, err)
+			if timedOut {
+				return Ruling{Status: RulingTimeout}
+			}
+			return Ruling{Status: RulingError, Reason: err.Error()}
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// moderate waits for an operator to decide, up to timeout
+func (j *Judging) moderate(c *Client, m Message, id string, timeout time.Duration) Ruling {
+	if timeout <= 0 {
+		timeout = time.Duration(j.cfg.ModeratorTimeout)
+	}
+	p := &pendingVerdict{ID: id, Game: c.hub.path, Client: c.id, User: c.userID, Message: m, Since: time.Now(), result: make(chan Ruling, 1)}
+	j.mu.Lock()
+	j.pending[id] = p
+	j.mu.Unlock()
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case v := <-p.result:
+		return v
+	case <-t.C:
+		j.mu.Lock()
+		delete(j.pending, id)
+		j.mu.Unlock()
+		select {
+		case v := <-p.result: // resolved just now
+			return v
+		default:
+			return Ruling{Status: RulingTimeout}
+		}
+	}
+}
+
+// Resolve gives the moderator decision id its verdict; false if there is
+// no such decision (anymore)
+func (j *Judging) Resolve(id string, v Ruling) bool {
+	j.mu.Lock()
+	p := j.pending[id]
+	delete(j.pending, id)
+	j.mu.Unlock()
+	if p == nil {
+		return false
+	}
+	p.result <- v
+	return true
+}
+
+// RegisterAdmin mounts /api/admin/verdicts
+func (j *Judging) RegisterAdmin(a *AdminAPI) {
+	a.Handle("/api/admin/verdicts", func(w http.ResponseWriter, r *http.Request) {
+		j.mu.Lock()
+		out := make([]*pendingVerdict, 0, len(j.pending))
+		for _, p := range j.pending {
+			out = append(out, p)
+		}
+		j.mu.Unlock()
+		sort.Slice(out, func(i, k int) bool { return out[i].Since.Before(out[k].Since) })
+		writeJSON(w, http.StatusOK, out)
+	})
+	a.Handle("/api/admin/verdicts/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSONError(w, http.StatusMethodNotAllowed, "use POST")
+			return
+		}
+		id := strings.TrimPrefix(r.URL.Path, "/api/admin/verdicts/")
+		var v Ruling
+		if err := readJSON(w, r, &v); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if v.Status != RulingAccepted && v.Status != RulingRejected {
+			writeJSONError(w, http.StatusBadRequest, "status must be accepted or rejected")
+			return
+		}
+		if !j.Resolve(id, v) {
+			writeJSONError(w, http.StatusNotFound, "no pending verdict "+id)
+			return
+		}
+		a.audit.Record(adminActor(r), "verdict."+v.Status, id, v.Reason)
+		writeJSON(w, http.StatusOK, map[string]string{"id": id, "status": v.Status})
+	})
+}
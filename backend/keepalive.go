@@ -0,0 +1,139 @@
+// backend/keepalive.go
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+Keepalive negotiation. By default the server pings every 54s and drops a
+connection that shows no sign of life for 60s. NATs and mobile networks
+often forget idle flows sooner, and some proxies strip ping/pong frames
+altogether, so the client may ask for other timing in hello:
+
+	{"type":"hello","data":{"keepalive":{"pingInterval":"20s","pongTimeout":"45s","heartbeat":true}}}
+
+The server clamps the values to the "keepalive" config bounds
+
+	"keepalive": {"minPingInterval":"5s","maxPingInterval":"2m","minPongTimeout":"10s","maxPongTimeout":"5m"}
+
+(the defaults) and answers with what it applied in hello's "keepalive".
+The ping interval is kept below the pong timeout. With "heartbeat": true
+the server also sends {"type":"heartbeat"} text frames on every ping.
+
+Any frame from the client counts as a sign of life, so a client behind
+such a proxy can send its own
+
+	{"type":"heartbeat"}    answered with {"type":"heartbeat.ack","data":{"ts":<unix ms>}}
+
+to keep the connection open and to notice a dead server.
+*/
+
+// KeepaliveConfig bounds what clients may negotiate
+type KeepaliveConfig struct {
+	MinPingInterval Duration `json:"minPingInterval,omitempty"`
+	MaxPingInterval Duration `json:"maxPingInterval,omitempty"`
+	MinPongTimeout  Duration `json:"minPongTimeout,omitempty"`
+	MaxPongTimeout  Duration `json:"maxPongTimeout,omitempty"`
+}
+
+func (cfg KeepaliveConfig) withDefaults() KeepaliveConfig {
+	if cfg.MinPingInterval <= 0 {
+		cfg.MinPingInterval = Duration(5 * time.Second)
+	}
+	if cfg.MaxPingInterval <= 0 {
+		cfg.MaxPingInterval = Duration(2 * time.Minute)
+	}
+	if cfg.MinPongTimeout <= 0 {
+		cfg.MinPongTimeout = Duration(10 * time.Second)
+	}
+	if cfg.MaxPongTimeout <= 0 {
+		cfg.MaxPongTimeout = Duration(5 * time.Minute)
+	}
+	return cfg
+}
+
+// keepaliveTerms is the keepalive part of hello, in both directions
+type keepaliveTerms struct {
+	PingInterval Duration `json:"pingInterval,omitempty"`
+	PongTimeout  Duration `json:"pongTimeout,omitempty"`
+	Heartbeat    bool     `json:"heartbeat,omitempty"`
+}
+
+func clampDuration(d, lo, hi Duration) Duration {
+	if d < lo {
+		return lo
+	}
+	if d > hi {
+		return hi
+	}
+	return d
+}
+
+// pingInterval is how often writePump pings c
+func (c *Client) pingInterval() time.Duration {
+	if d := c.pingEvery.Load(); d > 0 {
+		return time.Duration(d)
+	}
+	return pingPeriod
+}
+
+// readTimeout is how long c may stay silent
+func (c *Client) readTimeout() time.Duration {
+	if d := c.pongTimeout.Load(); d > 0 {
+		return time.Duration(d)
+	}
+	return pongWait
+}
+
+// negotiateKeepalive applies req within the hub's bounds and returns the
+// terms now in force
+func (c *Client) negotiateKeepalive(req keepaliveTerms) keepaliveTerms {
+	cfg := c.hub.keepalive.withDefaults()
+	got := keepaliveTerms{PingInterval: Duration(c.pingInterval()), PongTimeout: Duration(c.readTimeout()), Heartbeat: req.Heartbeat}
+	if req.PongTimeout > 0 {
+		got.PongTimeout = clampDuration(req.PongTimeout, cfg.MinPongTimeout, cfg.MaxPongTimeout)
+	}
+	if req.PingInterval > 0 {
+		got.PingInterval = clampDuration(req.PingInterval, cfg.MinPingInterval, cfg.MaxPingInterval)
+	}
+	if limit := got.PongTimeout * 9 / 10; got.PingInterval > limit {
+		got.PingInterval = limit
+	}
+	c.pongTimeout.Store(int64(got.PongTimeout))
+	c.pingEvery.Store(int64(got.PingInterval))
+	c.appHeartbeat.Store(got.Heartbeat)
+	if c.conn != nil {
+		c.conn.SetReadDeadline(time.Now().Add(time.Duration(got.PongTimeout)))
+	}
+	select {
+	case c.keepaliveChanged <- struct{}{}:
+	default: // writePump hasn't picked up the last change yet
+	}
+	return got
+}
+
+// writeHeartbeat sends an application-level heartbeat (writePump only)
+func (c *Client) writeHeartbeat() error {
+	b, _ := json.Marshal(Message{Type: "heartbeat", Sender: "server"})
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.conn.WriteMessage(websocket.TextMessage, b)
+}
+
+// KeepaliveMiddleware answers client heartbeats
+func KeepaliveMiddleware() Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(c *Client, m Message) {
+			if m.Type != "heartbeat" {
+				next(c, m)
+				return
+			}
+			data, _ := json.Marshal(map[string]int64{"ts": time.Now().UnixMilli()})
+			b, _ := json.Marshal(Message{Type: "heartbeat.ack", Sender: "server", Data: data})
+			c.trySend(b)
+		}
+	}
+}
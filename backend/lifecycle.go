@@ -0,0 +1,89 @@
+// backend/lifecycle.go
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+/*
+Client lifecycle. A client is registered when its connection is upgraded
+and unregistered once, by the hub, when its read pump ends or it falls
+too far behind on a broadcast. Unregistering closes c.done, never c.send:
+a Game, timer or middleware may still hold the client and send to it
+from another goroutine, and a send on a closed channel panics.
+
+Code that queues messages uses
+
+	c.Send(b)       waits for room in the queue; ErrClientClosed once gone
+	c.trySend(b)    drops b if the queue is full or the client is gone
+
+and never writes to c.send directly. "Full" is c's current send limit
+(sendbuffer.go), not the channel's capacity. When done closes, the write
+pump flushes whatever is still queued, sends a close frame and exits. A
+write pump that stops on its own (a write error or timeout) unregisters
+the client, so nothing waits in Send for a queue nobody drains.
+*/
+
+// sendPoll is how often Send looks for room under c's send limit
+const sendPoll = 5 * time.Millisecond
+
+// ErrClientClosed is returned by Send once the client has been unregistered
+var ErrClientClosed = errors.New("client closed")
+
+// Send queues msg for c, waiting while c's queue is at its limit. It
+// returns ErrClientClosed instead of waiting forever (or panicking) once c
+// is unregistered.
+func (c *Client) Send(msg []byte) error {
+	select {
+	case <-c.done:
+		return ErrClientClosed
+	default:
+	}
+	if limit := c.sendLimit.Load(); limit > 0 && len(c.send) >= int(limit) {
+		t := time.NewTicker(sendPoll)
+		for len(c.send) >= int(c.sendLimit.Load()) {
+			select {
+			case <-t.C:
+			case <-c.done:
+				t.Stop()
+				return ErrClientClosed
+			}
+		}
+		t.Stop()
+	}
+	select {
+	case c.send <- msg:
+		return nil
+	case <-c.done:
+		return ErrClientClosed
+	}
+}
+
+// Closed reports whether c has been unregistered
+func (c *Client) Closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// shutdown marks c unregistered; only the first call has an effect
+func (c *Client) shutdown() {
+	c.closeOnce.Do(func() { close(c.done) })
+}
+
+// drainSend returns what is still queued in c.send, without waiting
+func (c *Client) drainSend() [][]byte {
+	var out [][]byte
+	for {
+		select {
+		case b := <-c.send:
+			out = append(out, b)
+		default:
+			return out
+		}
+	}
+}
@@ -0,0 +1,189 @@
+// backend/lifecycle_test.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestClient returns a registered client of h without a connection;
+// tests read what it is sent from c.send
+func newTestClient(h *Hub, id string) *Client {
+	return newTestUser(h, id, "")
+}
+
+// newTestUser is newTestClient logged in as user
+func newTestUser(h *Hub, id, user string) *Client {
+	send, limit := h.sendBuffers.newSendChan()
+	c := &Client{
+		hub:        h,
+		send:       send,
+		sendBinary: make(chan []byte, binarySendBuffer),
+		done:       make(chan struct{}),
+		snapReady:  make(chan struct{}, 1),
+		id:         id,
+		userID:     user,
+		connected:  time.Now(),
+	}
+	c.sendLimit.Store(limit)
+	c.locale.Store(defaultLocale)
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	h.Register(c)
+	return c
+}
+
+// drain reads c's queue until c is unregistered and reports how many
+// messages it got
+func drain(c *Client) <-chan int {
+	n := make(chan int, 1)
+	go func() {
+		got := 0
+		for {
+			select {
+			case <-c.send:
+				got++
+			case <-c.done:
+				n <- got + len(c.drainSend())
+				return
+			}
+		}
+	}()
+	return n
+}
+
+func newRunningHub() *Hub {
+	h := NewHub()
+	go h.Run()
+	return h
+}
+
+// TestLifecycleUnderLoad registers, moves and unregisters clients while
+// others broadcast; run with -race
+func TestLifecycleUnderLoad(t *testing.T) {
+	h := newRunningHub()
+	const workers, rounds = 16, 50
+	var broadcasters sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		broadcasters.Add(1)
+		go func(i int) {
+			defer broadcasters.Done()
+			for n := 0; n < 2000; n++ {
+				m := Message{Type: "message", Payload: fmt.Sprint(n)}
+				switch n % 3 {
+				case 0:
+					h.BroadcastGlobal(m)
+				case 1:
+					h.BroadcastRoom(fmt.Sprintf("r%d", n%4), m)
+				default:
+					// a game holding a client that may be gone by now
+					for _, c := range h.FindClients(fmt.Sprintf("w%d-%d", i, n%rounds)) {
+						c.Send([]byte(`{"type":"direct"}`))
+					}
+				}
+			}
+		}(i)
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for r := 0; r < rounds; r++ {
+				c := newTestClient(h, fmt.Sprintf("w%d-%d", w, r))
+				got := drain(c)
+				h.JoinRoom(c, fmt.Sprintf("r%d", r%4))
+				if r%2 == 0 {
+					h.LeaveRoom(c)
+				}
+				h.unregister <- c
+				<-got
+				if err := c.Send([]byte(`{}`)); err != ErrClientClosed {
+					t.Errorf("Send after unregister: %v, want ErrClientClosed", err)
+				}
+				if c.trySend([]byte(`{}`)) {
+					t.Error("trySend after unregister succeeded")
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	broadcasters.Wait()
+	if n := len(h.Clients()); n != 0 {
+		t.Fatalf("%d clients still registered", n)
+	}
+	if n := len(h.Rooms()); n != 0 {
+		t.Fatalf("%d rooms left: %v", n, h.Rooms())
+	}
+}
+
+// TestUnregisterTwice checks that the hub tolerates a client unregistered
+// by both pumps
+func TestUnregisterTwice(t *testing.T) {
+	h := newRunningHub()
+	c := newTestClient(h, "c1")
+	h.unregister <- c
+	h.unregister <- c
+	if !c.Closed() {
+		t.Fatal("client not closed")
+	}
+	if n := len(h.Clients()); n != 0 {
+		t.Fatalf("%d clients registered", n)
+	}
+}
+
+// TestSendReleasedByUnregister checks that a Send waiting on a full queue
+// returns once the client is unregistered
+func TestSendReleasedByUnregister(t *testing.T) {
+	h := newRunningHub()
+	c := newTestClient(h, "c1")
+	for c.trySend([]byte(`{}`)) {
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- c.Send([]byte(`{}`)) }()
+	select {
+	case err := <-errc:
+		t.Fatalf("Send on a full queue returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	h.unregister <- c
+	select {
+	case err := <-errc:
+		if err != ErrClientClosed {
+			t.Fatalf("Send: %v, want ErrClientClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Send still blocked after unregister")
+	}
+}
+
+// TestSendHonoursLimit checks that Send waits at the send limit, not at
+// the channel's capacity
+func TestSendHonoursLimit(t *testing.T) {
+	h := newRunningHub()
+	c := newTestClient(h, "c1")
+	c.sendLimit.Store(2)
+	c.Send([]byte(`1`))
+	c.Send([]byte(`2`))
+	errc := make(chan error, 1)
+	go func() { errc <- c.Send([]byte(`3`)) }()
+	select {
+	case <-errc:
+		t.Fatalf("Send went past the limit (%d queued)", len(c.send))
+	case <-time.After(50 * time.Millisecond):
+	}
+	<-c.send
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Send still blocked with room under the limit")
+	}
+	if n := len(c.send); n != 2 {
+		t.Fatalf("%d queued, want 2", n)
+	}
+}
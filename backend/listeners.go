@@ -0,0 +1,128 @@
+// backend/listeners.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strconv"
+)
+
+/*
+Listeners come from the "listeners" block of the config file; without it the
+server listens on -addr only. Example: a UDS for a local reverse proxy, a
+public TLS port and a loopback-only pprof port.
+
+	"listeners": [
+	  {"network": "unix", "addr": "/run/gows/gows.sock", "socketMode": "0660"},
+	  {"addr": ":8443", "tlsCert": "cert.pem", "tlsKey": "key.pem"},
+	  {"addr": "127.0.0.1:6060", "debug": true}
+	]
+*/
+
+// ListenerConfig describes one address the server listens on
+type ListenerConfig struct {
+	Network    string `json:"network,omitempty"`    // "tcp" (default), "unix" or "uplink"
+	Addr       string `json:"addr"`                 // host:port, socket path or the central server's ws(s):// URL
+	TLSCert    string `json:"tlsCert,omitempty"`    // serve TLS when cert and key are set
+	TLSKey     string `json:"tlsKey,omitempty"`     //
+	SocketMode string `json:"socketMode,omitempty"` // octal permissions for unix sockets, default 0660
+	Debug      bool   `json:"debug,omitempty"`      // serve pprof and /metrics instead of the app
+	Node       string `json:"node,omitempty"`       // uplink: the name to register as
+	Token      string `json:"token,omitempty"`      // uplink: the node's token
+}
+
+func (lc ListenerConfig) String() string {
+	s := lc.Network + ":" + lc.Addr
+	if lc.TLSCert != "" {
+		s += " (tls)"
+	}
+	if lc.Debug {
+		s += " (debug)"
+	}
+	return s
+}
+
+// debugMux serves pprof and metrics; it is only mounted on listeners marked debug
+func debugMux(metrics http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// listen opens the socket for lc
+func listen(lc ListenerConfig) (net.Listener, error) {
+	switch lc.Network {
+	case "unix":
+		if err := os.Remove(lc.Addr); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		ln, err := net.Listen("unix", lc.Addr)
+		if err != nil {
+			return nil, err
+		}
+		mode := uint64(0660)
+		if lc.SocketMode != "" {
+			if mode, err = strconv.ParseUint(lc.SocketMode, 8, 32); err != nil {
+				ln.Close()
+				return nil, fmt.Errorf("socketMode: %v", err)
+			}
+		}
+		if err := os.Chmod(lc.Addr, os.FileMode(mode)); err != nil {
+			ln.Close()
+			return nil, err
+		}
+		return ln, nil
+	case "tcp", "":
+		return net.Listen("tcp", lc.Addr)
+	case "uplink":
+		return listenUplink(lc)
+	}
+	return nil, fmt.Errorf("unknown network %q", lc.Network)
+}
+
+// ServeListeners serves app (or pprof and metrics) on every listener and
+// returns when any of them fails
+func ServeListeners(listeners []ListenerConfig, app, metrics http.Handler) error {
+	if len(listeners) == 0 {
+		return errors.New("no listeners configured")
+	}
+	errc := make(chan error, len(listeners))
+	for _, lc := range listeners {
+		if lc.Network == "" {
+			lc.Network = "tcp"
+		}
+		if (lc.TLSCert == "") != (lc.TLSKey == "") {
+			return fmt.Errorf("listener %s: tlsCert and tlsKey must be set together", lc)
+		}
+		ln, err := listen(lc)
+		if err != nil {
+			return fmt.Errorf("listener %s: %v", lc, err)
+		}
+		h := app
+		if lc.Debug {
+			h = debugMux(metrics)
+		}
+		srv := &http.Server{Handler: h}
+		log.Printf("listening on %s", lc)
+		go func(lc ListenerConfig) {
+			var err error
+			if lc.TLSCert != "" {
+				err = srv.ServeTLS(ln, lc.TLSCert, lc.TLSKey)
+			} else {
+				err = srv.Serve(ln)
+			}
+			errc <- fmt.Errorf("listener %s: %v", lc, err)
+		}(lc)
+	}
+	return <-errc
+}
@@ -0,0 +1,234 @@
+// backend/loadmetrics.go
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+Traffic counters labelled by game, game type, room and tenant, to see
+which rooms generate load. Off unless the "loadMetrics" config block
+picks labels:
+
+	"loadMetrics": {"labels": ["game", "room", "tenant"], "maxSeries": 1000, "rooms": ["lobby", "tournament-*"]}
+
+	game    where the game is mounted (/ws, /ws/chat)
+	mode    the game type (broadcast, trivia, tictactoe, ...)
+	room    the client's room at the time; "" outside rooms
+	tenant  the "tenant" claim of the session token; "" without one
+
+and exports
+
+	ws_load_messages_received_total{game="/ws",room="lobby",tenant="acme"} 1042
+	ws_load_messages_sent_total{...}
+	ws_load_bytes_received_total{...}
+	ws_load_bytes_sent_total{...}
+
+Labels left out are aggregated over. Room and tenant names come from
+clients, so their cardinality is bounded:
+
+  - with "rooms", only the rooms listed (a trailing * matches a prefix)
+    are labelled by name; traffic in any other room counts as room="other"
+  - when a room is deleted its series are folded into room="other", so
+    finished rooms don't linger
+  - at most maxSeries (default 1000) label sets are kept; traffic that
+    would need another one counts with room and tenant "other", and
+    ws_load_series_overflow_total says how often that happened
+*/
+
+// LoadMetricsConfig is the "loadMetrics" config block
+type LoadMetricsConfig struct {
+	Labels    []string `json:"labels,omitempty"`    // game | mode | room | tenant; none = off
+	MaxSeries int      `json:"maxSeries,omitempty"` // label sets kept, default 1000
+	Rooms     []string `json:"rooms,omitempty"`     // rooms labelled by name; empty = all
+}
+
+// otherLabel stands for the rooms and tenants that aren't labelled by name
+const otherLabel = "other"
+
+type loadKey struct{ game, mode, room, tenant string }
+
+type loadCounts struct{ msgsIn, msgsOut, bytesIn, bytesOut int64 }
+
+// LoadMetrics counts traffic per label set
+type LoadMetrics struct {
+	game, mode, room, tenant bool // labels in use
+	maxSeries                int
+	rooms                    []string
+
+	overflow Counter
+
+	mu     sync.Mutex
+	series map[loadKey]*loadCounts
+}
+
+// NewLoadMetrics returns nil when cfg picks no labels
+func NewLoadMetrics(cfg LoadMetricsConfig) (*LoadMetrics, error) {
+	if len(cfg.Labels) == 0 {
+		return nil, nil
+	}
+	l := &LoadMetrics{maxSeries: cfg.MaxSeries, rooms: cfg.Rooms, series: make(map[loadKey]*loadCounts)}
+	if l.maxSeries <= 0 {
+		l.maxSeries = 1000
+	}
+	for _, label := range cfg.Labels {
+		switch label {
+		case "game":
+			l.game = true
+		case "mode":
+			l.mode = true
+		case "room":
+			l.room = true
+		case "tenant":
+			l.tenant = true
+		default:
+			return nil, fmt.Errorf("unknown label %q (want game|mode|room|tenant)", label)
+		}
+	}
+	return l, nil
+}
+
+// AddHub folds the series of hub's rooms away as they are deleted
+func (l *LoadMetrics) AddHub(hub *Hub) {
+	if l == nil || !l.room {
+		return
+	}
+	hub.events.Subscribe(func(e Event) {
+		if hub.RoomSize(e.Room) == 0 {
+			l.fold(hub, e.Room)
+		}
+	}, EventRoomDeleted)
+}
+
+// fold moves the counts of hub's room into room="other"
+func (l *LoadMetrics) fold(hub *Hub, room string) {
+	room = l.roomLabel(room)
+	if room == "" || room == otherLabel {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for k, s := range l.series {
+		if k.room != room || (l.game && k.game != hub.path) || (l.mode && k.mode != hub.mode) {
+			continue
+		}
+		delete(l.series, k)
+		k.room = otherLabel
+		into := l.series[k]
+		if into == nil {
+			into = &loadCounts{}
+			l.series[k] = into
+		}
+		into.msgsIn += s.msgsIn
+		into.msgsOut += s.msgsOut
+		into.bytesIn += s.bytesIn
+		into.bytesOut += s.bytesOut
+	}
+}
+
+// roomLabel is the room label of traffic in room
+func (l *LoadMetrics) roomLabel(room string) string {
+	if room == "" || len(l.rooms) == 0 {
+		return room
+	}
+	for _, r := range l.rooms {
+		if r == room || (strings.HasSuffix(r, "*") && strings.HasPrefix(room, r[:len(r)-1])) {
+			return room
+		}
+	}
+	return otherLabel
+}
+
+// count adds msgs messages of n bytes to or from c; nil-safe
+func (l *LoadMetrics) count(c *Client, in bool, msgs, n int) {
+	if l == nil {
+		return
+	}
+	var k loadKey
+	if l.game {
+		k.game = c.hub.path
+	}
+	if l.mode {
+		k.mode = c.hub.mode
+	}
+	if l.room {
+		k.room = l.roomLabel(c.hub.RoomOf(c))
+	}
+	if l.tenant && c.claims != nil {
+		k.tenant = c.claims.Tenant
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := l.series[k]
+	if s == nil {
+		if len(l.series) >= l.maxSeries {
+			l.overflow.Inc()
+			if l.room && k.room != "" {
+				k.room = otherLabel
+			}
+			if l.tenant && k.tenant != "" {
+				k.tenant = otherLabel
+			}
+			s = l.series[k]
+		}
+		// the "other" sets may go over maxSeries, by one per game and mode
+		if s == nil {
+			s = &loadCounts{}
+			l.series[k] = s
+		}
+	}
+	if in {
+		s.msgsIn += int64(msgs)
+		s.bytesIn += int64(n)
+	} else {
+		s.msgsOut += int64(msgs)
+		s.bytesOut += int64(n)
+	}
+}
+
+// labelEscaper escapes Prometheus label values
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels formats k's labels in use
+func (l *LoadMetrics) labels(k loadKey) string {
+	var parts []string
+	add := func(on bool, name, v string) {
+		if on {
+			parts = append(parts, name+`="`+labelEscaper.Replace(v)+`"`)
+		}
+	}
+	add(l.game, "game", k.game)
+	add(l.mode, "mode", k.mode)
+	add(l.room, "room", k.room)
+	add(l.tenant, "tenant", k.tenant)
+	return strings.Join(parts, ",")
+}
+
+// Register exports the counters on m; nil-safe
+func (l *LoadMetrics) Register(m *Metrics) {
+	if l == nil {
+		return
+	}
+	samples := func(v func(*loadCounts) int64) func() []Sample {
+		return func() []Sample {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			out := make([]Sample, 0, len(l.series))
+			for k, s := range l.series {
+				out = append(out, Sample{Labels: l.labels(k), Value: float64(v(s))})
+			}
+			sort.Slice(out, func(i, j int) bool { return out[i].Labels < out[j].Labels })
+			return out
+		}
+	}
+	m.Register("ws_load_messages_received_total", "messages received from clients, by label set", "counter", samples(func(s *loadCounts) int64 { return s.msgsIn }))
+	m.Register("ws_load_messages_sent_total", "messages sent to clients, by label set", "counter", samples(func(s *loadCounts) int64 { return s.msgsOut }))
+	m.Register("ws_load_bytes_received_total", "websocket payload bytes received from clients, by label set", "counter", samples(func(s *loadCounts) int64 { return s.bytesIn }))
+	m.Register("ws_load_bytes_sent_total", "websocket payload bytes sent to clients, by label set", "counter", samples(func(s *loadCounts) int64 { return s.bytesOut }))
+	m.Register("ws_load_series_overflow_total", "traffic counted under \"other\" because loadMetrics.maxSeries was reached", "counter", func() []Sample {
+		return []Sample{{Value: float64(l.overflow.Value())}}
+	})
+}
@@ -2,12 +2,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -16,7 +21,8 @@ import (
 /*
 Minimal WebSocket server with a Hub (connection manager) and a modular Game interface.
 - Default game is EchoGame (sends replies only to the sender).
-- Swap in BroadcastGame to broadcast to all clients.
+- Swap in BroadcastGame to broadcast to the sender's room (or all clients),
+  or RelayGame to do the same without echoing to the sender.
 */
 
 // websocket timing constants
@@ -38,17 +44,72 @@ var upgrader = websocket.Upgrader{
 
 // Message is the JSON envelope for messages
 type Message struct {
-	Type    string `json:"type"`              // e.g., "message", "guess", "system"
-	Sender  string `json:"sender,omitempty"`  // e.g., user id
-	Payload string `json:"payload,omitempty"` // freeform payload
+	Type    string          `json:"type"`              // e.g., "message", "guess", "system"
+	Sender  string          `json:"sender,omitempty"`  // e.g., user id
+	Payload string          `json:"payload,omitempty"` // freeform payload
+	Data    json.RawMessage `json:"data,omitempty"`    // structured payload (server replies, game data)
+
+	IdempotencyKey string `json:"idempotencyKey,omitempty"` // client-chosen; retries with the same key are dropped
+	Code           string `json:"code,omitempty"`           // stable id of server text, for client-side translation
+
+	// server-assigned, see envelope.go; Seq must stay last (broadcast.go)
+	Room string `json:"room,omitempty"`
+	ID   string `json:"id,omitempty"`
+	Ts   int64  `json:"ts,omitempty"`
+	Seq  uint64 `json:"seq,omitempty"`
 }
 
 // Client represents a connected websocket client
 type Client struct {
-	hub  *Hub
-	conn *websocket.Conn
-	send chan []byte
-	id   string
+	hub        *Hub
+	conn       *websocket.Conn
+	send       chan []byte   // never closed; queue with Send or trySend (see lifecycle.go)
+	sendBinary chan []byte   // binary frames; never closed, writePump exits on send
+	done       chan struct{} // closed when the hub unregisters the client
+	closeOnce  sync.Once
+	id         string
+	userID     string // set when the handshake carried a valid session token
+	name       string
+	room       string            // guarded by hub.mu
+	tags       map[string]string // guarded by hub.mu, see tags.go
+	device     string            // User-Agent of the handshake
+	ip         string
+	connected  time.Time
+
+	sendLimit atomic.Int32 // queued messages allowed in send (see SendBuffers)
+	sendPeak  atomic.Int32 // highest occupancy since the last sample
+	sendIdle  int          // consecutive idle samples; guarded by hub.mu
+	locale    atomic.Value // string; see i18n.go
+	protocol  atomic.Value // string, the declared protocol version; see deprecation.go
+	maxFrame  atomic.Int32 // largest frame the client accepts, 0 = any (see chunk.go)
+	chunks    chunkedTransfers
+
+	buckets    map[string]*tokenBucket // per message-type rate limits (readPump only)
+	deprecated map[string]bool         // deprecated features c was warned about (serveWs, then readPump)
+
+	claims *SessionClaims  // nil for anonymous clients
+	ctx    context.Context // cancelled when the connection closes
+	cancel context.CancelFunc
+	call   context.Context // context of the message being handled (readPump only, see gamecontext.go)
+
+	handling atomic.Pointer[Message] // the message readPump is handling, for dead letters
+
+	ephMu      sync.Mutex
+	ephPending map[string][]byte // coalesced ephemeral events, latest per sender+type
+
+	snapMu      sync.Mutex
+	snapPending map[string][]byte // latest unsent snapshot per type (see snapshot.go)
+	snapReady   chan struct{}     // signalled when snapPending gets an entry
+
+	pingEvery        atomic.Int64 // negotiated ping interval in ns, 0 = pingPeriod (see keepalive.go)
+	pongTimeout      atomic.Int64 // negotiated read timeout in ns, 0 = pongWait
+	appHeartbeat     atomic.Bool  // also send "heartbeat" text frames
+	keepaliveChanged chan struct{}
+
+	bytesIn, bytesOut   atomic.Int64 // frame bytes, see bandwidth.go
+	pingSent            atomic.Int64 // unix ns of the last ping, for the rtt (see timesync.go)
+	clock               clockEstimate
+	inBucket, outBucket byteBucket // owned by readPump / writePump
 }
 
 // readPump reads messages from the websocket and passes them to the game
@@ -56,121 +117,331 @@ func (c *Client) readPump(game Game) {
 	defer func() {
 		c.hub.unregister <- c
 		c.conn.Close()
+		c.cancel()
 		game.OnDisconnect(c)
 	}()
 
 	c.conn.SetReadLimit(maxMessageSize)
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetReadDeadline(time.Now().Add(c.readTimeout()))
 	c.conn.SetPongHandler(func(string) error {
-		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		c.conn.SetReadDeadline(time.Now().Add(c.readTimeout()))
+		if sent := c.pingSent.Swap(0); sent != 0 {
+			c.clock.observeRTT(time.Since(time.Unix(0, sent)))
+		}
 		return nil
 	})
 
 	for {
-		_, raw, err := c.conn.ReadMessage()
+		kind, raw, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("unexpected close: %v", err)
 			}
 			break
 		}
-		var m Message
-		if err := json.Unmarshal(raw, &m); err != nil {
-			// if not JSON, wrap as a simple message
-			m = Message{Type: "message", Sender: c.id, Payload: string(raw)}
+		// any frame is a sign of life, for clients whose pongs get lost
+		c.conn.SetReadDeadline(time.Now().Add(c.readTimeout()))
+		if !c.received(len(raw)) {
+			break
 		}
-		if m.Sender == "" {
-			m.Sender = c.id
+		c.hub.load.count(c, true, 1, len(raw))
+		if kind == websocket.BinaryMessage {
+			c.hub.events.Publish(Event{Kind: EventMessageReceived, Client: c, Message: &Message{Type: "binary", Sender: c.id}, Payload: raw})
+			ctx, cancel := c.callContext(c.ctx, "")
+			c.call = ctx
+			game.OnBinaryMessage(c, raw)
+			c.call = nil
+			cancel()
+			continue
 		}
+		m := c.decodeFrame(raw)
+		c.hub.events.Publish(Event{Kind: EventMessageReceived, Client: c, Message: &m})
+		ctx, cancel := c.callContext(c.ctx, m.ID)
+		c.call = ctx
+		c.handling.Store(&m)
 		game.OnMessage(c, m)
+		c.handling.Store(nil)
+		c.call = nil
+		cancel()
 	}
 }
 
 // writePump writes messages from the send channel to the websocket
 func (c *Client) writePump() {
-	ticker := time.NewTicker(pingPeriod)
+	ticker := time.NewTicker(c.pingInterval())
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
+		if !c.Closed() {
+			// the write failed: release senders blocked in Send now rather
+			// than when readPump notices the closed connection
+			c.hub.unregister <- c
+		}
 	}()
 
 	for {
 		select {
-		case message, ok := <-c.send:
+		case message := <-c.send:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				// hub closed the channel
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+			batch := c.collectBatch(message)
+			if len(c.send) == 0 {
+				// backlog cleared: deliver the ephemeral events held back meanwhile
+				batch = append(batch, c.takeEphemeral()...)
+			}
+			if err := c.writeBatch(batch); err != nil {
 				return
 			}
-			// write a single TextMessage (JSON expected)
-			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+		case <-c.done:
+			// unregistered: flush what is queued, then say goodbye
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if rest := c.drainSend(); len(rest) > 0 && c.writeBatch(rest) != nil {
+				return
+			}
+			c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+			return
+		case b := <-c.sendBinary:
+			if err := c.writeBinary(b); err != nil {
+				return
+			}
+		case <-c.snapReady:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.writeBatch(c.takeSnapshots()); err != nil {
 				return
 			}
+		case <-c.keepaliveChanged:
+			ticker.Reset(c.pingInterval())
 		case <-ticker.C:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			// send ping
+			c.pingSent.Store(time.Now().UnixNano())
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
+			if c.appHeartbeat.Load() {
+				if err := c.writeHeartbeat(); err != nil {
+					return
+				}
+			}
+			// backstop for events coalesced just as the backlog emptied
+			if err := c.writeBatch(c.takeEphemeral()); err != nil {
+				return
+			}
 		}
 	}
 }
 
+// decodeFrame turns a text frame from c into the stamped Message the game
+// sees; what the server sets (room, id, ts, seq, an authenticated sender)
+// is never taken from the client
+func (c *Client) decodeFrame(raw []byte) Message {
+	var m Message
+	if err := json.Unmarshal(raw, &m); err != nil {
+		// if not JSON, wrap as a simple message
+		m = Message{Type: "message", Sender: c.id, Payload: string(raw)}
+	}
+	m.Room, m.ID, m.Ts, m.Seq = "", "", 0, 0
+	m.stamp()
+	if c.userID != "" {
+		// authenticated clients can't spoof the sender
+		m.Sender = c.userID
+	} else if m.Sender == "" {
+		m.Sender = c.id
+	}
+	return m
+}
+
+// kick sends a close frame and drops the connection; readPump then unregisters
+// the client. Safe to call from any goroutine.
+func (c *Client) kick(code int, reason string) {
+	if c.conn == nil {
+		return // replayed client (capture.go)
+	}
+	c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(writeWait))
+	c.conn.Close()
+}
+
 // Hub holds registered clients and broadcasts messages.
 type Hub struct {
-	clients    map[*Client]bool
-	register   chan *Client
-	unregister chan *Client
-	broadcast  chan []byte
-	mu         sync.Mutex
+	clients      map[*Client]bool
+	rooms        map[string]*roomState       // see rooms.go for the locking
+	users        map[string]map[*Client]bool // authenticated user id -> connections
+	unregister   chan *Client
+	broadcast    chan outbound
+	events       *EventBus
+	chaos        *Chaos // failure injection, nil when disabled
+	aoi          *AOI   // spatial index for BroadcastNear
+	sendBuffers  *SendBuffers
+	locales      *Locales
+	matches      *MatchStore // finished games, nil when disabled
+	timers       *Timers
+	dupPolicy    DuplicateSessionPolicy
+	writeBatch   WriteBatchConfig
+	snapshots    map[string]bool // message types coalesced per client, see snapshot.go
+	keepalive    KeepaliveConfig
+	features     *Features    // nil = built-in defaults
+	bandwidth    *Bandwidth   // nil = not counted
+	reconnects   *Reconnects  // upgrade admission and drains, nil = admit all
+	deadLetters  *DeadLetters // nil = not kept
+	router       *Router      // "routes" rules, nil = none
+	replayFrames int          // room frames kept for sync.request
+	private      *PrivateRooms
+	bans         *Bans
+	deprecations *Deprecations
+	load         *LoadMetrics // labelled traffic counters, nil = off
+	path         string       // where the game is mounted, for feature flags
+	mode         string       // game type, for load metrics
+	mu           sync.RWMutex // clients, users and rooms; see rooms.go
+
+	seqMu     sync.Mutex // orders BroadcastGlobal
+	globalSeq uint64
+
+	filters atomic.Pointer[[]OutboundFilter] // per-recipient views of broadcasts (outfilter.go)
+
+	tags   TagsConfig                  // what clients may tag themselves with (tags.go)
+	tagged map[string]map[*Client]bool // "key=value" -> clients; guarded by mu
 }
 
 func NewHub() *Hub {
-	return &Hub{
-		clients:    make(map[*Client]bool),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		broadcast:  make(chan []byte, 256),
+	h := &Hub{
+		clients:     make(map[*Client]bool),
+		rooms:       make(map[string]*roomState),
+		snapshots:   SnapshotConfig{}.typeSet(),
+		users:       make(map[string]map[*Client]bool),
+		tagged:      make(map[string]map[*Client]bool),
+		unregister:  make(chan *Client),
+		broadcast:   make(chan outbound, 256),
+		events:      NewEventBus(),
+		sendBuffers: NewSendBuffers(SendBufferConfig{}),
+		locales:     &Locales{catalogs: map[string]map[string]string{defaultLocale: englishCatalog}},
 	}
+	h.timers = NewTimers(h)
+	return h
+}
+
+// Register adds c. It is synchronous so that c is visible to lookups
+// (FindClients, SendToUser, ...) by the time Game.OnConnect runs.
+func (h *Hub) Register(c *Client) {
+	h.mu.Lock()
+	h.clients[c] = true
+	if c.userID != "" {
+		if h.users[c.userID] == nil {
+			h.users[c.userID] = make(map[*Client]bool)
+		}
+		h.users[c.userID][c] = true
+	}
+	if c.claims != nil && len(c.claims.Tags) > 0 && !h.setTagsLocked(c, c.claims.Tags) {
+		log.Printf("client %s: ignoring invalid tags claim", c.id)
+	}
+	total := len(h.clients)
+	h.mu.Unlock()
+	log.Printf("client registered: %s (total %d)", c.id, total)
+	h.events.Publish(Event{Kind: EventClientConnected, Client: c})
 }
 
 func (h *Hub) Run() {
 	for {
 		select {
-		case c := <-h.register:
-			h.mu.Lock()
-			h.clients[c] = true
-			h.mu.Unlock()
-			log.Printf("client registered: %s (total %d)", c.id, len(h.clients))
 		case c := <-h.unregister:
 			h.mu.Lock()
-			if _, ok := h.clients[c]; ok {
-				delete(h.clients, c)
-				close(c.send)
+			_, ok := h.clients[c]
+			if ok {
+				h.removeClientLocked(c)
 				log.Printf("client unregistered: %s (total %d)", c.id, len(h.clients))
 			}
 			h.mu.Unlock()
-		case msg := <-h.broadcast:
+			if ok {
+				h.events.Publish(Event{Kind: EventClientDisconnected, Client: c})
+			}
+		case out := <-h.broadcast:
 			h.mu.Lock()
+			sent := 0
+			var dropped []*Client
 			for client := range h.clients {
-				select {
-				case client.send <- msg:
-				default:
+				if client == out.except {
+					continue
+				}
+				frame := out.msg
+				if h.filtering() {
+					if frame = h.filterFor(client, out.m, out.msg); frame == nil {
+						continue
+					}
+				}
+				if client.trySend(frame) {
+					sent++
+				} else {
 					// if client send buffer full, close connection
-					close(client.send)
-					delete(h.clients, client)
+					h.removeClientLocked(client)
+					dropped = append(dropped, client)
 				}
 			}
 			h.mu.Unlock()
+			h.events.Publish(Event{Kind: EventBroadcastSent, Payload: out.msg, Recipients: sent})
+			for _, c := range dropped {
+				h.events.Publish(Event{Kind: EventClientDisconnected, Client: c})
+			}
 		}
 	}
 }
 
+// removeClientLocked drops c from every index and shuts it down.
+// Requires h.mu.
+func (h *Hub) removeClientLocked(c *Client) {
+	h.leaveRoomLocked(c)
+	if conns := h.users[c.userID]; conns != nil {
+		delete(conns, c)
+		if len(conns) == 0 {
+			delete(h.users, c.userID)
+		}
+	}
+	h.untagLocked(c)
+	delete(h.clients, c)
+	c.shutdown()
+}
+
+// ClientInfo is a point-in-time view of a client for operators
+type ClientInfo struct {
+	ID       string            `json:"id"`
+	UserID   string            `json:"userId,omitempty"`
+	Name     string            `json:"name,omitempty"`
+	Room     string            `json:"room,omitempty"`
+	Buffered int               `json:"buffered"`  // messages waiting in the send channel
+	Limit    int               `json:"sendLimit"` // current send-buffer limit
+	RTT      int64             `json:"rttMs,omitempty"`
+	Offset   int64             `json:"clockOffsetMs,omitempty"` // server clock minus the client's, from time.sync
+	Tags     map[string]string `json:"tags,omitempty"`
+}
+
+// Clients returns a snapshot of every registered client
+func (h *Hub) Clients() []ClientInfo {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	out := make([]ClientInfo, 0, len(h.clients))
+	for c := range h.clients {
+		offset, rtt, _ := c.ClockOffset()
+		out = append(out, ClientInfo{ID: c.id, UserID: c.userID, Name: c.name, Room: c.room, Buffered: len(c.send), Limit: int(c.sendLimit.Load()),
+			RTT: rtt.Milliseconds(), Offset: offset.Milliseconds(), Tags: c.tagsLocked()})
+	}
+	return out
+}
+
+// FindClients returns clients whose client id or user id equals id
+func (h *Hub) FindClients(id string) []*Client {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var out []*Client
+	for c := range h.clients {
+		if c.id == id || c.userID == id {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
 // Game interface - plug-in game logic
 type Game interface {
 	OnConnect(c *Client)
 	OnMessage(c *Client, msg Message)
+	OnBinaryMessage(c *Client, data []byte)
 	OnDisconnect(c *Client)
 }
 
@@ -186,39 +457,60 @@ type EchoGame struct {
 func NewEchoGame(h *Hub) *EchoGame { return &EchoGame{hub: h} }
 
 func (g *EchoGame) OnConnect(c *Client) {
-	s := Message{Type: "system", Payload: "Welcome! (EchoGame). Your id: " + c.id}
-	b, _ := json.Marshal(s)
-	c.send <- b
+	sendSystem(c, "welcome.echo", c.id)
 }
 
 func (g *EchoGame) OnMessage(c *Client, msg Message) {
-	// simple behavior: send echo to the sending client
-	out := Message{Type: "echo", Sender: "server", Payload: "Echo: " + msg.Payload}
+	// simple behavior: send echo to the sending client (all of its devices when logged in)
+	out := Message{Type: "echo", Sender: "server", Code: "echo", Payload: c.T("echo", msg.Payload)}
 	b, _ := json.Marshal(out)
-	c.send <- b
+	if c.userID != "" && g.hub.SendToUser(c.userID, b) > 0 {
+		return
+	}
+	c.Send(b)
+}
+
+func (g *EchoGame) OnBinaryMessage(c *Client, data []byte) {
+	c.SendBinary(data)
 }
 
 func (g *EchoGame) OnDisconnect(c *Client) {
 	// nothing for now
 }
 
-// BroadcastGame publishes any incoming message to all connected clients
+// BroadcastGame publishes any incoming message to the sender's room, or to
+// all connected clients when the sender is in none. In mode "relay" the
+// sender doesn't get its own messages back.
 type BroadcastGame struct {
-	hub *Hub
+	hub        *Hub
+	skipSender bool
 }
 
 func NewBroadcastGame(h *Hub) *BroadcastGame { return &BroadcastGame{hub: h} }
 
+// NewRelayGame is a BroadcastGame that leaves out the sender
+func NewRelayGame(h *Hub) *BroadcastGame { return &BroadcastGame{hub: h, skipSender: true} }
+
 func (g *BroadcastGame) OnConnect(c *Client) {
-	s := Message{Type: "system", Payload: "Welcome! (BroadcastGame)."}
-	b, _ := json.Marshal(s)
-	c.send <- b
+	sendSystem(c, "welcome.broadcast")
 }
 
 func (g *BroadcastGame) OnMessage(c *Client, msg Message) {
-	// broadcast message to everyone (converted to JSON)
-	b, _ := json.Marshal(msg)
-	g.hub.broadcast <- b
+	if g.skipSender {
+		g.hub.BroadcastExcept(c, msg)
+	} else if room := g.hub.RoomOf(c); room != "" {
+		g.hub.BroadcastRoom(room, msg)
+	} else {
+		g.hub.BroadcastGlobal(msg)
+	}
+}
+
+func (g *BroadcastGame) OnBinaryMessage(c *Client, data []byte) {
+	var except *Client
+	if g.skipSender {
+		except = c
+	}
+	g.hub.BroadcastBinary(g.hub.RoomOf(c), data, except)
 }
 
 func (g *BroadcastGame) OnDisconnect(c *Client) {
@@ -229,19 +521,67 @@ func (g *BroadcastGame) OnDisconnect(c *Client) {
    WebSocket upgrade / HTTP
    ---------------------------- */
 
-func serveWs(hub *Hub, game Game, w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+func serveWs(hub *Hub, game Game, sessions *SessionManager, w http.ResponseWriter, r *http.Request) {
+	if hub.reconnects != nil && !hub.reconnects.Admit(w, r) {
+		return
+	}
+	// reject bad tokens before upgrading; no token means an anonymous client
+	claims, err := sessions.FromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if claims != nil {
+		if ban, banned := hub.bans.Banned(claims.Sub); banned {
+			http.Error(w, "banned: "+ban.Reason, http.StatusForbidden)
+			return
+		}
+	}
+	if claims != nil && hub.dupPolicy == DupReject && len(hub.UserClients(claims.Sub)) > 0 {
+		http.Error(w, "already connected from another session", http.StatusConflict)
+		return
+	}
+	upgradeHeader, ok := hub.deprecations.handshake(w, r)
+	if !ok {
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, upgradeHeader)
 	if err != nil {
 		log.Println("upgrade error:", err)
 		return
 	}
+	send, limit := hub.sendBuffers.newSendChan()
 	client := &Client{
-		hub:  hub,
-		conn: conn,
-		send: make(chan []byte, 256),
-		id:   r.RemoteAddr,
+		hub:              hub,
+		conn:             conn,
+		send:             send,
+		sendBinary:       make(chan []byte, binarySendBuffer),
+		done:             make(chan struct{}),
+		snapReady:        make(chan struct{}, 1),
+		id:               clientID(r),
+		keepaliveChanged: make(chan struct{}, 1),
+		claims:           claims,
+		device:           r.UserAgent(),
+		ip:               remoteIP(r),
+		connected:        time.Now(),
 	}
-	hub.register <- client
+	client.ctx, client.cancel = context.WithCancel(context.Background())
+	client.sendLimit.Store(limit)
+	client.locale.Store(hub.locales.Match(r.Header.Get("Accept-Language")))
+	client.protocol.Store(r.URL.Query().Get("protocol"))
+	if claims != nil {
+		client.userID = claims.Sub
+		client.name = claims.Name
+	}
+	var replaced []*Client
+	if client.userID != "" && hub.dupPolicy == DupReplace {
+		replaced = hub.UserClients(client.userID)
+	}
+	hub.Register(client)
+	for _, old := range replaced {
+		old.kick(closeSessionReplaced, "session replaced by a new connection")
+	}
+	hub.deprecations.connected(client)
 	game.OnConnect(client)
 
 	// start pumps
@@ -249,47 +589,489 @@ func serveWs(hub *Hub, game Game, w http.ResponseWriter, r *http.Request) {
 	go client.readPump(game)
 }
 
-func spaHandler(distDir string) http.HandlerFunc {
-	fs := http.FileServer(http.Dir(distDir))
-	return func(w http.ResponseWriter, r *http.Request) {
-		// If the requested file exists, serve it; otherwise serve index.html (SPA fallback)
-		path := distDir + r.URL.Path
-		if info, err := os.Stat(path); err == nil && !info.IsDir() {
-			fs.ServeHTTP(w, r)
-			return
-		}
-		http.ServeFile(w, r, distDir+"/index.html")
+var unixClientSeq atomic.Int64
+
+// clientID is the remote address, which unix-socket connections don't have
+func clientID(r *http.Request) string {
+	if r.RemoteAddr == "" || r.RemoteAddr == "@" {
+		return fmt.Sprintf("unix-%d", unixClientSeq.Add(1))
+	}
+	return r.RemoteAddr
+}
+
+// remoteIP is the address part of r.RemoteAddr ("" on unix sockets)
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// defaultNodeID is the hostname, which is unique enough for small clusters
+func defaultNodeID() string {
+	if h, err := os.Hostname(); err == nil && h != "" {
+		return h
 	}
+	return "node"
 }
 
 func main() {
-	addr := flag.String("addr", ":8080", "http service address")
+	addr := flag.String("addr", ":8080", "http service address (ignored when the config file lists listeners)")
 	staticDir := flag.String("static", "../frontend/dist", "path to frontend build (Vite: dist)")
-	mode := flag.String("mode", "echo", "game mode: echo|broadcast")
+	mode := flag.String("mode", "echo", "game mode on /ws: echo|broadcast|relay|script|trivia|draw|process, or a ruleset such as tictactoe (more games can be mounted from the config file)")
+	gameCommand := flag.String("game-command", "", "program and arguments of the -mode=process game, split on spaces")
+	scriptsDir := flag.String("scripts", "", "directory of Lua game scripts (validators in any mode, handlers in -mode=script)")
+	oauthProvider := flag.String("oauth-provider", "", "enable /auth/login with an OAuth provider: google|github")
+	oauthClientID := flag.String("oauth-client-id", "", "OAuth client id")
+	oauthClientSecret := flag.String("oauth-client-secret", os.Getenv("OAUTH_CLIENT_SECRET"), "OAuth client secret (default $OAUTH_CLIENT_SECRET)")
+	oauthRedirect := flag.String("oauth-redirect", "", "OAuth callback URL, e.g. https://example.com/auth/callback")
+	jwtSecret := flag.String("jwt-secret", os.Getenv("JWT_SECRET"), "session token signing key (default $JWT_SECRET, random if empty)")
+	usersFile := flag.String("users", "", "keep users in this JSON file instead of the database (users.json if -db is empty)")
+	dupSession := flag.String("dup-session", "multi", "when a user connects twice: multi|reject|replace")
+	configFile := flag.String("config", "", "path to JSON config file (rate limits, ...)")
+	nodeID := flag.String("node-id", defaultNodeID(), "this instance's id in a cluster")
+	peers := flag.String("peers", "", "comma-separated base URLs of peer instances, e.g. http://10.0.0.2:8080")
+	clusterSecret := flag.String("cluster-secret", os.Getenv("CLUSTER_SECRET"), "shared secret for peer-to-peer endpoints (default $CLUSTER_SECRET)")
+	console := flag.Bool("console", false, "read operator commands from stdin")
+	consoleSocket := flag.String("console-socket", "", "serve the operator console on this unix socket path")
+	dedupWindow := flag.Duration("dedup-window", 2*time.Minute, "how long idempotency keys are remembered")
+	dbFile := flag.String("db", "server.db", "embedded SQLite database for history, users, mutes and matches (disabled if empty)")
+	historyFile := flag.String("history", "", "keep room message history in this JSONL file instead of the database (disabled if both are empty)")
+	quotaFile := flag.String("quota-file", "quotas.json", "where admin-set quota overrides are saved")
+	featuresFile := flag.String("features-file", "features.json", "where admin-set feature flag overrides are saved")
+	adminToken := flag.String("admin-token", os.Getenv("ADMIN_TOKEN"), "bearer token for /api/admin (default $ADMIN_TOKEN, API disabled if empty)")
+	announcementsFile := flag.String("announcements", "announcements.json", "where scheduled announcements are saved")
+	pushProvider := flag.String("push-provider", "", "push notifications for offline users: log|fcm|webhook (disabled if empty)")
+	pushKey := flag.String("push-key", os.Getenv("PUSH_KEY"), "FCM server key, or bearer token for the push webhook (default $PUSH_KEY)")
+	pushURL := flag.String("push-url", "", "endpoint for -push-provider=webhook")
+	pushTokens := flag.String("push-tokens", "push.json", "where device tokens are saved")
+	revokedFile := flag.String("revoked-sessions", "revoked.json", "where revoked session tokens are remembered (memory only if empty)")
+	matchesFile := flag.String("matches", "", "keep finished match results in this JSONL file instead of the database (memory only if both are empty)")
+	localesDir := flag.String("locales", "locales", "directory of <locale>.json message catalogs (English is built in)")
+	auditFile := flag.String("audit-log", "audit.jsonl", "append-only log of privileged actions (disabled if empty)")
+	recordFile := flag.String("record", "", "append client traffic on /ws to this capture file (see capture.go)")
+	replayFile := flag.String("replay", "", "replay a capture through the /ws game and print the transcript instead of serving")
+	replayExpect := flag.String("replay-expect", "", "with -replay, compare the transcript to this file and exit 1 on a difference")
+	simulateFile := flag.String("simulate", "", "run a scenario through the /ws game on a virtual clock and print the log instead of serving (see simulate.go)")
+	simulateExpect := flag.String("simulate-expect", "", "with -simulate, compare the log to this file and exit 1 on a difference")
+	chaosSpec := flag.String("chaos", "", "inject failures for testing, e.g. latency=200ms,jitter=100ms,drop=0.05,sever=0.001")
 	flag.Parse()
 
+	cfg, err := LoadConfig(*configFile)
+	if err != nil {
+		log.Fatal("config:", err)
+	}
+
+	sessions, err := NewSessionManager(*jwtSecret, 24*time.Hour)
+	if err != nil {
+		log.Fatal("session manager:", err)
+	}
+	if *revokedFile != "" {
+		if err := sessions.LoadRevocations(*revokedFile); err != nil {
+			log.Fatal("revoked sessions:", err)
+		}
+	}
+	if *jwtSecret == "" {
+		log.Printf("no -jwt-secret set; session tokens will not survive a restart")
+	}
+
 	hub := NewHub()
+	if hub.dupPolicy, err = ParseDuplicateSessionPolicy(*dupSession); err != nil {
+		log.Fatal(err)
+	}
+	if hub.chaos, err = ParseChaos(*chaosSpec); err != nil {
+		log.Fatal(err)
+	}
+	if hub.chaos != nil {
+		log.Printf("CHAOS MODE enabled: %s", hub.chaos)
+	}
+	hub.writeBatch = cfg.WriteBatch
+	hub.snapshots = cfg.Snapshots.typeSet()
+	hub.keepalive = cfg.Keepalive
+	hub.replayFrames = cfg.Sync.frames()
+	hub.tags = cfg.Tags
+	hub.path = "/ws"
+	hub.mode = *mode
+	if hub.features, err = NewFeatures(cfg.Features, *featuresFile); err != nil {
+		log.Fatal("features:", err)
+	}
+	if hub.locales, err = LoadLocales(*localesDir); err != nil {
+		log.Fatal("locales:", err)
+	}
+	hub.sendBuffers = NewSendBuffers(cfg.SendBuffer)
+	metrics := NewMetrics()
+	hubs := []*Hub{hub} // plus one per mounted game
+	metrics.Gauge("ws_clients", "connected clients", func() float64 {
+		n := 0
+		for _, h := range hubs {
+			n += len(h.Clients())
+		}
+		return float64(n)
+	})
+	metrics.Gauge("ws_rooms", "rooms with at least one member", func() float64 {
+		n := 0
+		for _, h := range hubs {
+			n += len(h.Rooms())
+		}
+		return float64(n)
+	})
+	hub.sendBuffers.Register(metrics)
+	hub.bandwidth = NewBandwidth(cfg.Bandwidth)
+	hub.bandwidth.AddHub(hub)
+	hub.bandwidth.Register(metrics)
+	hub.reconnects = NewReconnects(cfg.Reconnect)
+	hub.reconnects.AddHub(hub)
+	hub.reconnects.Register(metrics)
+	hub.bans = NewBans()
+	hub.bans.AddHub(hub)
+	if hub.load, err = NewLoadMetrics(cfg.LoadMetrics); err != nil {
+		log.Fatal("loadMetrics:", err)
+	}
+	hub.load.AddHub(hub)
+	hub.load.Register(metrics)
+	if hub.deprecations, err = NewDeprecations(cfg.Deprecations); err != nil {
+		log.Fatal("deprecations: ", err)
+	}
+	hub.deprecations.Register(metrics)
 	go hub.Run()
+	log.Printf("send buffers: %s", hub.sendBuffers)
+
+	var peerList []string
+	for _, p := range strings.Split(*peers, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			peerList = append(peerList, p)
+		}
+	}
+	if len(peerList) > 0 && *clusterSecret == "" {
+		log.Fatal(errNoClusterSecret)
+	}
+	presence, err := NewPresence(*nodeID, peerList, *clusterSecret)
+	if err != nil {
+		log.Fatal(err)
+	}
+	presence.AddHub(hub)
+	go presence.Gossip()
+
+	hub.aoi = NewAOI(cfg.AOI)
+	hub.aoi.Attach(hub.events)
+
+	var audit *AuditLog
+	if *auditFile != "" {
+		if audit, err = OpenAuditLog(*auditFile); err != nil {
+			log.Fatal("audit log:", err)
+		}
+	}
+
+	var admin *AdminAPI
+	if *adminToken != "" {
+		admin = NewAdminAPI(*adminToken)
+		admin.audit = audit
+		admin.Handle("/api/admin/metrics", metrics.ServeHTTP)
+		hub.bandwidth.RegisterAdmin(admin)
+		hub.reconnects.RegisterAdmin(admin)
+		hub.deprecations.RegisterAdmin(admin)
+		if audit != nil {
+			audit.RegisterAdmin(admin)
+		}
+	}
+
+	if admin != nil {
+		hub.features.RegisterAdmin(admin)
+	}
+
+	announcer, err := NewAnnouncer(*announcementsFile)
+	if err != nil {
+		log.Fatal("announcements:", err)
+	}
+	announcer.AddHub(hub)
+	go announcer.Run()
+	if admin != nil {
+		announcer.RegisterAdmin(admin)
+	}
+
+	provider, err := NewPushProvider(*pushProvider, *pushKey, *pushURL)
+	if err != nil {
+		log.Fatal("push:", err)
+	}
+	push, err := NewPush(hub, provider, *pushTokens)
+	if err != nil {
+		log.Fatal("push tokens:", err)
+	}
+
+	var db *SQLiteDB
+	if *dbFile != "" {
+		if db, err = OpenSQLite(*dbFile); err != nil {
+			log.Fatal("db:", err)
+		}
+		log.Printf("database: %s", *dbFile)
+	}
+
+	if *matchesFile == "" && db != nil {
+		warnLegacyFile("matches.jsonl", "matches")
+		hub.matches, err = OpenSQLiteMatchStore(db)
+	} else {
+		hub.matches, err = OpenMatchStore(*matchesFile)
+	}
+	if err != nil {
+		log.Fatal("matches:", err)
+	}
+
+	antiCheat, err := NewAntiCheatEngine(cfg.AntiCheat, hub.events)
+	if err != nil {
+		log.Fatal("anticheat:", err)
+	}
+	if db != nil {
+		if err := antiCheat.UseMuteStore(db); err != nil {
+			log.Fatal("anticheat mutes:", err)
+		}
+	}
+	if admin != nil {
+		antiCheat.RegisterAdmin(admin)
+	}
+	hub.deadLetters = NewDeadLetters(cfg.DeadLetters)
+	hub.deadLetters.Register(metrics)
+	panics := NewPanics()
+	panics.Register(metrics)
+	if hub.router, err = NewRouter(cfg.Routes); err != nil {
+		log.Fatal("routes:", err)
+	}
+	hub.router.Register(metrics)
+	if db != nil {
+		if err := hub.deadLetters.UseDB(db); err != nil {
+			log.Fatal("dead letters:", err)
+		}
+		if err := hub.bans.UseDB(db); err != nil {
+			log.Fatal("bans:", err)
+		}
+	}
+
+	var history HistoryStore
+	if *historyFile != "" {
+		if history, err = OpenFileHistoryStore(*historyFile); err != nil {
+			log.Fatal("history:", err)
+		}
+	} else if db != nil {
+		history = db.History()
+	}
+	caches := NewCaches(cfg.Cache)
+	caches.Register(metrics)
+	history = caches.History("/ws", history)
+	var quotas *Quotas
+	if history != nil || cfg.mountsHistory() {
+		if quotas, err = NewQuotas(cfg.Quotas, *quotaFile); err != nil {
+			log.Fatal("quotas:", err)
+		}
+		if admin != nil && history != nil {
+			quotas.RegisterAdmin(admin, history)
+		}
+	}
+	var exporter *Exporter
+	if history != nil {
+		exporter = NewExporter(history, sessions)
+		exporter.audit = audit
+		if admin != nil {
+			exporter.RegisterAdmin(admin)
+		}
+	}
 
-	// choose game
-	var game Game
-	switch *mode {
-	case "broadcast":
-		game = NewBroadcastGame(hub)
+	var scripts *ScriptEngine
+	if *scriptsDir != "" {
+		if scripts, err = NewScriptEngine(*scriptsDir, hub); err != nil {
+			log.Fatal("scripts:", err)
+		}
+		scripts.audit = audit
+		go scripts.Watch()
+	}
+
+	parties := NewParties(cfg.Parties)
+	parties.AddHub(hub)
+	userSessions := NewUserSessions(sessions, audit)
+	userSessions.AddHub(hub)
+	if admin != nil {
+		userSessions.RegisterAdmin(admin)
+	}
+	// friend lists live on user records, so the store is needed without OAuth too
+	var users UserStore
+	switch {
+	case *usersFile == "" && db != nil:
+		warnLegacyFile("users.json", "users")
+		users = db.Users()
+	case *usersFile == "":
+		*usersFile = "users.json"
+		fallthrough
 	default:
-		game = NewEchoGame(hub)
+		if users, err = NewFileUserStore(*usersFile); err != nil {
+			log.Fatal("user store:", err)
+		}
 	}
+	users = caches.Users(users)
 
-	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		serveWs(hub, game, w, r)
+	var inboxStore InboxStore = newMemoryInboxStore()
+	if db != nil {
+		inboxStore = db.Inbox()
+	}
+	inbox := NewInbox(inboxStore, push)
+	inbox.deadLetters = hub.deadLetters
+	inbox.AddHub(hub)
+	if admin != nil {
+		inbox.RegisterAdmin(admin)
+	}
+	friends := NewFriends(users, inbox)
+	friends.AddHub(hub)
+	judging := NewJudging(cfg.Judging)
+	tournaments := NewTournaments()
+	tournaments.AddHub(hub)
+	reports := NewReports(cfg.Reports)
+	reports.AddHub(hub)
+	if db != nil {
+		if err := reports.UseDB(db); err != nil {
+			log.Fatal("reports:", err)
+		}
+	}
+	federation, err := NewFederation(cfg.Federation, push, friends, inbox)
+	if err != nil {
+		log.Fatal("federation: ", err)
+	}
+	if federation != nil && db != nil {
+		if err := federation.UseDB(db); err != nil {
+			log.Fatal("federation:", err)
+		}
+	}
+	if admin != nil {
+		judging.RegisterAdmin(admin)
+		tournaments.RegisterAdmin(admin)
+		reports.RegisterAdmin(admin)
+		if federation != nil {
+			federation.RegisterAdmin(admin)
+		}
+	}
+	deps := &gameDeps{presence: presence, push: push, parties: parties, userSessions: userSessions, inbox: inbox, friends: friends, judging: judging, tournaments: tournaments, reports: reports, announcer: announcer, federation: federation, caches: caches, panics: panics, antiCheat: antiCheat, audit: audit, quotas: quotas, dedupWindow: *dedupWindow, mounted: make(map[string]*mountedGame)}
+	game, err := newGame(*mode, hub, gameSettings{scripts: scripts, trivia: cfg.Trivia, command: strings.Fields(*gameCommand)})
+	if err != nil {
+		log.Fatal("-mode: ", err)
+	}
+	process, _ := game.(*ProcessGame)
+	schema := gameSchema(game)
+	game = deps.chain(game, hub, scripts, history, cfg, cfg.RateLimits, cfg.Ephemeral)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, game, sessions, w, r)
 	})
+	for _, gm := range cfg.Games {
+		h, err := deps.mount(mux, hub, sessions, cfg, gm)
+		if err != nil {
+			log.Fatal("games: ", err)
+		}
+		hubs = append(hubs, h)
+		log.Printf("game %s: mode=%s", gm.Path, gm.Mode)
+	}
+	go hub.sendBuffers.Run(hubs...)
+
+	deps.mounted["/ws"] = &mountedGame{hub: hub, history: history, process: process, game: game}
+	eraser := &Eraser{hubs: hubs, users: users, push: push, inbox: inbox, friends: friends, matches: hub.matches, quotas: quotas, antiCheat: antiCheat, sessions: sessions, audit: audit}
+	eraser.OnErase("deadLetters", hub.deadLetters.Forget)
+	eraser.OnErase("reports", reports.Forget)
+	if federation != nil {
+		eraser.OnErase("federation", federation.Forget)
+	}
+	for _, g := range deps.mounted {
+		if g.history != nil {
+			eraser.histories = append(eraser.histories, g.history)
+		}
+	}
+	if quotas != nil {
+		go quotas.RunRetention(func() map[string]HistoryStore { return historyStores(deps.mounted) })
+	}
+	if admin != nil {
+		eraser.RegisterAdmin(admin)
+		hub.deadLetters.RegisterAdmin(admin, deps.mounted, inbox)
+		hub.bans.RegisterAdmin(admin)
+		RegisterProcessAdmin(admin, deps.mounted)
+		RegisterRetentionAdmin(admin, deps.mounted)
+		dash := NewDashboard(deps.mounted)
+		dash.audit = audit
+		dash.RegisterAdmin(admin)
+		mux.HandleFunc("/admin", dash.Page(admin))
+	}
+
+	if *console || *consoleSocket != "" {
+		con := NewConsole(hub)
+		con.audit = audit
+		con.eraser = eraser
+		if *console {
+			go con.Serve(os.Stdin, os.Stdout)
+		}
+		if *consoleSocket != "" {
+			if err := con.ListenUnix(*consoleSocket); err != nil {
+				log.Fatal("console socket:", err)
+			}
+			log.Printf("console listening on %s", *consoleSocket)
+		}
+	}
+
+	mux.Handle("/api/matches", hub.matches)
+	if exporter != nil {
+		mux.Handle("/api/export", exporter)
+	}
+	if len(cfg.Services) > 0 {
+		inject := NewInjectAPI(cfg.Services, deps.mounted, quotas, cfg.History)
+		inject.audit = audit
+		mux.Handle("/api/rooms/", inject)
+	}
+	if federation != nil {
+		mux.Handle("/federation", federation)
+		federation.Start()
+	}
+	if len(cfg.Uplinks) > 0 {
+		uplinks := NewUplinks(cfg.Uplinks)
+		uplinks.Register(mux)
+		if admin != nil {
+			uplinks.RegisterAdmin(admin)
+		}
+	}
+
+	if len(peerList) > 0 {
+		mux.Handle("/cluster/presence", presence)
+	}
+	if admin != nil {
+		mux.Handle("/api/admin/", admin)
+	}
+
+	mux.HandleFunc("/auth/session", sessions.HandleSession)
+	if *oauthProvider != "" {
+		oauth, err := NewOAuthHandler(*oauthProvider, *oauthClientID, *oauthClientSecret, *oauthRedirect, users, sessions)
+		if err != nil {
+			log.Fatal("oauth:", err)
+		}
+		mux.HandleFunc("/auth/login", oauth.HandleLogin)
+		mux.HandleFunc("/auth/callback", oauth.HandleCallback)
+		log.Printf("oauth login enabled (provider=%s)", *oauthProvider)
+	}
+
+	if *replayFile != "" {
+		os.Exit(runReplay(hub, game, schema, *replayFile, *replayExpect, nil))
+	}
+	if *simulateFile != "" {
+		os.Exit(runReplay(hub, game, schema, *simulateFile, *simulateExpect, NewSimClock()))
+	}
+	if *recordFile != "" {
+		if err := StartRecording(hub, *recordFile, *mode, schema); err != nil {
+			log.Fatal("record:", err)
+		}
+		log.Printf("recording /ws traffic to %s", *recordFile)
+	}
 
 	// serve frontend static files if present
 	log.Printf("serving static from %s", *staticDir)
-	http.HandleFunc("/", spaHandler(*staticDir))
+	mux.Handle("/", NewStatic(*staticDir, cfg.Static))
 
-	log.Printf("listening on %s (mode=%s)", *addr, *mode)
-	if err := http.ListenAndServe(*addr, nil); err != nil {
-		log.Fatal("ListenAndServe:", err)
+	listeners := cfg.Listeners
+	if len(listeners) == 0 {
+		listeners = []ListenerConfig{{Network: "tcp", Addr: *addr}}
 	}
+	log.Printf("mode=%s", *mode)
+	go drainOnSignal(hub.reconnects)
+	log.Fatal(ServeListeners(listeners, mux, metrics))
 }
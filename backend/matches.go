@@ -0,0 +1,315 @@
+// backend/matches.go
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+Match results and history.
+A game reports a finished match with Hub.ReportResult(GameResult{...});
+results are appended to -matches (JSONL) and indexed by room and player.
+Players are identified like presence: user id when logged in, else client id.
+
+	GET /api/matches?player=alice&room=r&before=<id>&limit=20
+	{"type":"match.history","data":{"player":"alice","before":120,"limit":20}}
+
+both return {"matches":[...newest first...],"next":<id to pass as before, 0 when done>}.
+match.history defaults to the caller's own matches.
+*/
+
+const (
+	matchPageSize    = 20
+	maxMatchPageSize = 100
+)
+
+// PlayerResult is one participant's outcome
+type PlayerResult struct {
+	ID      string  `json:"id"`
+	Name    string  `json:"name,omitempty"`
+	Score   float64 `json:"score"`
+	Rank    int     `json:"rank,omitempty"`    // 1 = winner; ties share a rank
+	Outcome string  `json:"outcome,omitempty"` // "win" | "loss" | "draw" | ...
+}
+
+// GameResult is what a game emits when a match ends
+type GameResult struct {
+	ID       int64          `json:"id"`
+	Game     string         `json:"game"`
+	Room     string         `json:"room,omitempty"`
+	Players  []PlayerResult `json:"players"`
+	Started  time.Time      `json:"started"`
+	Ended    time.Time      `json:"ended"`
+	Duration Duration       `json:"duration"`
+}
+
+// MatchFilter selects matches; zero fields match everything
+type MatchFilter struct {
+	Player string
+	Room   string
+	Before int64 // only matches with a smaller ID
+	Limit  int
+}
+
+// MatchStore keeps results in memory, backed by an append-only file or
+// the database (sqlite.go)
+type MatchStore struct {
+	mu       sync.Mutex
+	path     string
+	f        *os.File  // nil = memory only
+	db       *SQLiteDB // instead of f
+	matches  []GameResult
+	byPlayer map[string][]int // indexes into matches, ascending
+	byRoom   map[string][]int
+}
+
+// OpenMatchStore loads path (if it exists) and appends new results to it;
+// an empty path keeps results in memory only
+func OpenMatchStore(path string) (*MatchStore, error) {
+	s := &MatchStore{byPlayer: make(map[string][]int), byRoom: make(map[string][]int)}
+	if path == "" {
+		return s, nil
+	}
+	if f, err := os.Open(path); err == nil {
+		sc := bufio.NewScanner(f)
+		sc.Buffer(make([]byte, 64*1024), 4<<20)
+		line := 0
+		for sc.Scan() {
+			line++
+			var r GameResult
+			if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+			}
+			s.indexLocked(r)
+		}
+		f.Close()
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.path, s.f = path, f
+	return s, nil
+}
+
+func (s *MatchStore) indexLocked(r GameResult) {
+	i := len(s.matches)
+	s.matches = append(s.matches, r)
+	if r.Room != "" {
+		s.byRoom[r.Room] = append(s.byRoom[r.Room], i)
+	}
+	for _, p := range r.Players {
+		s.byPlayer[p.ID] = append(s.byPlayer[p.ID], i)
+	}
+}
+
+// Record assigns r an ID, fills in Started/Ended/Duration if unset and stores it
+func (s *MatchStore) Record(r *GameResult) error {
+	if r.Ended.IsZero() {
+		r.Ended = time.Now()
+	}
+	if r.Started.IsZero() {
+		r.Started = r.Ended
+	}
+	if r.Duration == 0 {
+		r.Duration = Duration(r.Ended.Sub(r.Started))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r.ID = 1
+	if n := len(s.matches); n > 0 {
+		r.ID = s.matches[n-1].ID + 1
+	}
+	if s.f != nil {
+		b, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		if _, err := s.f.Write(append(b, '\n')); err != nil {
+			return err
+		}
+	}
+	if s.db != nil {
+		if err := s.db.saveMatches(*r); err != nil {
+			return err
+		}
+	}
+	s.indexLocked(*r)
+	return nil
+}
+
+// Anonymize replaces player id with alias in every result and rewrites
+// the file; other players' results are kept
+func (s *MatchStore) Anonymize(id, alias string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	idx := s.byPlayer[id]
+	if len(idx) == 0 {
+		return 0, nil
+	}
+	for _, i := range idx {
+		players := append([]PlayerResult(nil), s.matches[i].Players...)
+		for j := range players {
+			if players[j].ID == id {
+				players[j].ID, players[j].Name = alias, ""
+			}
+		}
+		s.matches[i].Players = players
+	}
+	s.byPlayer[alias] = append(s.byPlayer[alias], idx...)
+	sort.Ints(s.byPlayer[alias])
+	delete(s.byPlayer, id)
+	if s.db != nil {
+		changed := make([]GameResult, len(idx))
+		for k, i := range idx {
+			changed[k] = s.matches[i]
+		}
+		return len(idx), s.db.saveMatches(changed...)
+	}
+	if s.f == nil {
+		return len(idx), nil
+	}
+	var buf []byte
+	for _, r := range s.matches {
+		b, err := json.Marshal(r)
+		if err != nil {
+			return 0, err
+		}
+		buf = append(append(buf, b...), '\n')
+	}
+	s.f.Close()
+	if err := writeFileAtomic(s.path, buf); err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	s.f = f
+	return len(idx), nil
+}
+
+// Query returns matching results newest first, plus the cursor for the next page
+func (s *MatchStore) Query(f MatchFilter) ([]GameResult, int64) {
+	if f.Limit <= 0 {
+		f.Limit = matchPageSize
+	}
+	if f.Limit > maxMatchPageSize {
+		f.Limit = maxMatchPageSize
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var idx []int
+	switch {
+	case f.Player != "":
+		idx = s.byPlayer[f.Player]
+	case f.Room != "":
+		idx = s.byRoom[f.Room]
+	default:
+		idx = make([]int, len(s.matches))
+		for i := range idx {
+			idx[i] = i
+		}
+	}
+	out := []GameResult{}
+	for i := len(idx) - 1; i >= 0; i-- {
+		r := s.matches[idx[i]]
+		if (f.Before > 0 && r.ID >= f.Before) || (f.Room != "" && r.Room != f.Room) {
+			continue
+		}
+		if len(out) == f.Limit {
+			return out, out[len(out)-1].ID
+		}
+		out = append(out, r)
+	}
+	return out, 0
+}
+
+type matchPage struct {
+	Matches []GameResult `json:"matches"`
+	Next    int64        `json:"next"`
+}
+
+// ServeHTTP answers GET /api/matches
+func (s *MatchStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	q := r.URL.Query()
+	f := MatchFilter{Player: q.Get("player"), Room: q.Get("room")}
+	var err error
+	if v := q.Get("before"); v != "" {
+		if f.Before, err = strconv.ParseInt(v, 10, 64); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "before must be a match id")
+			return
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "limit must be an integer")
+			return
+		}
+	}
+	matches, next := s.Query(f)
+	writeJSON(w, http.StatusOK, matchPage{Matches: matches, Next: next})
+}
+
+// ReportResult stores a finished match; games call it when a match ends
+func (h *Hub) ReportResult(r GameResult) {
+	if h.matches == nil {
+		return
+	}
+	if err := h.matches.Record(&r); err != nil {
+		log.Println("match result:", err)
+		return
+	}
+	h.events.Publish(Event{Kind: EventMatchFinished, Result: &r})
+}
+
+// MatchHistoryMiddleware answers match.history
+func MatchHistoryMiddleware(s *MatchStore) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(c *Client, m Message) {
+			if m.Type != "match.history" {
+				next(c, m)
+				return
+			}
+			var req struct {
+				Player string `json:"player"`
+				Room   string `json:"room"`
+				Before int64  `json:"before"`
+				Limit  int    `json:"limit"`
+			}
+			if len(m.Data) > 0 {
+				if err := json.Unmarshal(m.Data, &req); err != nil {
+					sendError(c, "bad_data", m.Type, err.Error())
+					return
+				}
+			}
+			if req.Player == "" && req.Room == "" {
+				req.Player = presenceIdentity(c)
+			}
+			matches, nxt := s.Query(MatchFilter{Player: req.Player, Room: req.Room, Before: req.Before, Limit: req.Limit})
+			data, _ := json.Marshal(matchPage{Matches: matches, Next: nxt})
+			b, _ := json.Marshal(Message{Type: "match.history", Sender: "server", Data: data})
+			c.sendLarge(b)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// backend/metrics.go
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+Metrics in the Prometheus text format, served at /metrics on debug
+listeners and at /api/admin/metrics. No client library: counters are
+atomics and everything else is read by a collect function at scrape time.
+*/
+
+// Counter is a monotonically increasing metric
+type Counter struct{ v atomic.Int64 }
+
+func (c *Counter) Inc()         { c.v.Add(1) }
+func (c *Counter) Add(n int64)  { c.v.Add(n) }
+func (c *Counter) Value() int64 { return c.v.Load() }
+
+// Sample is one labelled value of a metric
+type Sample struct {
+	Labels string // preformatted, e.g. `quantile="0.99"`; "" for none
+	Value  float64
+}
+
+type metric struct {
+	name, help, kind string
+	collect          func() []Sample
+}
+
+// Metrics is a registry of named metrics
+type Metrics struct {
+	mu      sync.Mutex
+	metrics []*metric
+}
+
+func NewMetrics() *Metrics { return &Metrics{} }
+
+// Counter registers and returns a new counter
+func (m *Metrics) Counter(name, help string) *Counter {
+	c := &Counter{}
+	m.Register(name, help, "counter", func() []Sample { return []Sample{{Value: float64(c.Value())}} })
+	return c
+}
+
+// Gauge registers a single value read at scrape time
+func (m *Metrics) Gauge(name, help string, fn func() float64) {
+	m.Register(name, help, "gauge", func() []Sample { return []Sample{{Value: fn()}} })
+}
+
+// Register adds a metric of kind (counter, gauge, summary) whose samples
+// come from collect
+func (m *Metrics) Register(name, help, kind string, collect func() []Sample) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.metrics = append(m.metrics, &metric{name: name, help: help, kind: kind, collect: collect})
+}
+
+// Write writes every metric in the Prometheus text format
+func (m *Metrics) Write(w io.Writer) {
+	m.mu.Lock()
+	list := append([]*metric(nil), m.metrics...)
+	m.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	for _, mt := range list {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", mt.name, mt.help, mt.name, mt.kind)
+		for _, s := range mt.collect() {
+			if s.Labels == "" {
+				fmt.Fprintf(w, "%s %g\n", mt.name, s.Value)
+			} else {
+				fmt.Fprintf(w, "%s{%s} %g\n", mt.name, s.Labels, s.Value)
+			}
+		}
+	}
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.Write(w)
+}
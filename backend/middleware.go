@@ -0,0 +1,35 @@
+// backend/middleware.go
+package main
+
+/*
+Middleware chain for inbound messages.
+Each middleware wraps the next handler and can inspect, rewrite or drop a
+message before it reaches Game.OnMessage.
+*/
+
+// MessageHandler handles one inbound message
+type MessageHandler func(c *Client, m Message)
+
+// Middleware wraps a MessageHandler
+type Middleware func(next MessageHandler) MessageHandler
+
+// chainedGame routes OnMessage through the middleware chain; the other
+// callbacks go straight to the wrapped game.
+type chainedGame struct {
+	Game
+	handle MessageHandler
+}
+
+func (g *chainedGame) OnMessage(c *Client, m Message) { g.handle(c, m) }
+
+// Chain wraps game so messages pass through mws in order (first runs first)
+func Chain(game Game, mws ...Middleware) Game {
+	if len(mws) == 0 {
+		return game
+	}
+	h := game.OnMessage
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return &chainedGame{Game: game, handle: h}
+}
@@ -0,0 +1,118 @@
+// backend/outfilter.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+/*
+Per-recipient views of broadcasts. A game that hides things from some
+players (the cards in other hands, the moves of a muted user) filters its
+broadcasts per recipient instead of sending every player a copy of their
+own:
+
+	func (g *CardGame) FilterOutbound(c *Client, m Message) (Message, bool) {
+		if m.Type == "deal" {
+			m.Data = g.handOf(m.Data, c.userID) // a new slice; m.Data is shared
+		}
+		return m, true // false: c doesn't get m at all
+	}
+
+Games that implement OutboundFilter are installed for their hub by
+chain (games.go); middleware and other code call hub.AddOutboundFilter,
+which is safe while serving, so a filter only some deployments need can
+be added once it is (friends.go does when someone first blocks someone).
+A hub without filters skips all of this. Filters run in the order they were added, for every
+recipient of BroadcastRoom, BroadcastExcept and BroadcastGlobal, and for
+the frames of sync replays, so a resync doesn't show what the live
+broadcast hid. They see m as stamped; changes to room, id, ts and seq
+are ignored. A recipient whose copy comes back unchanged gets the frame
+everyone shares; only changed copies are encoded again.
+
+A room message suppressed for c still used up a seq, so in its place c gets
+
+	{"type":"filtered","room":"r1","seq":58}
+
+which keeps its seq stream free of gaps (a gap makes clients resync, see
+resync.go). Clients skip it; the Go client does. The sender left out by
+BroadcastExcept gets the same stub for its own message. Suppressed snapshots and
+global broadcasts are just not sent.
+
+Filters run under the room's lock, which keeps seq order and send order
+the same: they must be quick and must not call back into the hub
+(broadcasts, joins, RoomOf). Raw and binary broadcasts (BroadcastRoomRaw,
+BroadcastBinary, BroadcastNear) and sends to one client (c.Send,
+SendToUser) are not filtered.
+*/
+
+// OutboundFilter customizes or suppresses what each recipient of a
+// broadcast sees
+type OutboundFilter interface {
+	FilterOutbound(c *Client, msg Message) (Message, bool)
+}
+
+// OutboundFilterFunc adapts a function to OutboundFilter
+type OutboundFilterFunc func(c *Client, msg Message) (Message, bool)
+
+func (f OutboundFilterFunc) FilterOutbound(c *Client, msg Message) (Message, bool) { return f(c, msg) }
+
+// AddOutboundFilter installs f for h's broadcasts; broadcasts already
+// under way may go out without it
+func (h *Hub) AddOutboundFilter(f OutboundFilter) {
+	for {
+		old := h.filters.Load()
+		var next []OutboundFilter
+		if old != nil {
+			next = append(next, *old...)
+		}
+		next = append(next, f)
+		if h.filters.CompareAndSwap(old, &next) {
+			return
+		}
+	}
+}
+
+// filtering reports whether h has outbound filters
+func (h *Hub) filtering() bool {
+	fs := h.filters.Load()
+	return fs != nil && len(*fs) > 0
+}
+
+// filteredStub stands in for a room message a client doesn't get
+func filteredStub(room string, seq uint64) []byte {
+	b, _ := json.Marshal(Message{Type: "filtered", Room: room, Seq: seq})
+	return b
+}
+
+// sameContent reports whether a filter left m as it was; the fields the
+// hub sets are ignored
+func sameContent(a, b Message) bool {
+	return a.Type == b.Type && a.Sender == b.Sender && a.Payload == b.Payload &&
+		a.IdempotencyKey == b.IdempotencyKey && a.Code == b.Code && bytes.Equal(a.Data, b.Data)
+}
+
+// filterFor returns the frame c gets for m, the stamped message encoded
+// as shared, or nil when it gets none
+func (h *Hub) filterFor(c *Client, m Message, shared []byte) []byte {
+	out := m
+	fs := h.filters.Load()
+	if fs == nil {
+		return shared
+	}
+	for _, f := range *fs {
+		var ok bool
+		if out, ok = f.FilterOutbound(c, out); !ok {
+			if m.Room == "" || m.Seq == 0 {
+				return nil
+			}
+			return filteredStub(m.Room, m.Seq)
+		}
+	}
+	if sameContent(out, m) {
+		return shared
+	}
+	out.Room, out.ID, out.Ts, out.Seq = m.Room, m.ID, m.Ts, m.Seq
+	b, _ := json.Marshal(out)
+	return b
+}
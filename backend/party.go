@@ -0,0 +1,519 @@
+// backend/party.go
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync"
+)
+
+/*
+Parties: players who play together. A party outlives matches and rooms,
+so friends stay grouped from one game to the next:
+
+	{"type":"party.create"}
+	{"type":"party.invite","data":{"user":"bob"}}    bob gets "party.invite" with the code
+	{"type":"party.join","data":{"code":"K7QX2M"}}
+	{"type":"party.chat","payload":"ready?"}        to every member, whatever room or game they're in
+	{"type":"party.kick","data":{"user":"bob"}}      leader only
+	{"type":"party.leave"}
+
+Members get {"type":"party.update","data":{"id":...,"leader":...,"members":[...],"code":...,"queued":false}}
+on every change. Matchmaking is per game:
+
+	{"type":"queue.join"}    solo, or the leader for the whole party
+	{"type":"queue.leave"}
+
+Once the queue holds enough players for "teams" teams of "teamSize", they
+are moved into a fresh room and told
+
+	{"type":"match.found","data":{"room":"match-3f9a1c02","team":0,"teams":[["alice","bob"],["carol","dan"]]}}
+
+Party members always land on the same team. A party can only queue when
+all of its members are connected to that game. Configured with
+
+	"parties": {"maxSize": 4, "teamSize": 2, "teams": 2}
+
+Logged-in members stay in their party across reconnects; anonymous ones
+leave it when their last connection closes.
+*/
+
+// PartyConfig is the "parties" config block
+type PartyConfig struct {
+	MaxSize  int `json:"maxSize,omitempty"`  // default 4
+	TeamSize int `json:"teamSize,omitempty"` // players per team, default 2
+	Teams    int `json:"teams,omitempty"`    // teams per match, default 2
+}
+
+func (cfg PartyConfig) withDefaults() PartyConfig {
+	if cfg.MaxSize <= 0 {
+		cfg.MaxSize = 4
+	}
+	if cfg.TeamSize <= 0 {
+		cfg.TeamSize = 2
+	}
+	if cfg.Teams <= 0 {
+		cfg.Teams = 2
+	}
+	return cfg
+}
+
+type party struct {
+	id      string
+	leader  string
+	members []string          // identities, in joining order
+	names   map[string]string // identity -> display name
+	code    string
+	queued  *Hub // game the party is queued in, nil if not
+}
+
+// queueEntry is a solo player or a whole party waiting for a match
+type queueEntry struct {
+	members []string
+	party   *party // nil for solo players
+}
+
+// partyReply is what the caller is told once the lock is released
+type partyReply struct {
+	code string // catalog code, "" for nothing
+	args []interface{}
+	err  bool
+}
+
+func partyOK(code string, args ...interface{}) partyReply {
+	return partyReply{code: code, args: args}
+}
+
+func partyErr(code string, args ...interface{}) partyReply {
+	return partyReply{code: code, args: args, err: true}
+}
+
+// PartyMember is one line of party.update
+type PartyMember struct {
+	ID     string `json:"id"`
+	Name   string `json:"name,omitempty"`
+	Online bool   `json:"online"`
+}
+
+// Parties tracks parties across all games and runs each game's queue
+type Parties struct {
+	cfg PartyConfig
+
+	mu       sync.Mutex
+	hubs     []*Hub
+	parties  map[string]*party // code -> party
+	byMember map[string]*party
+	queues   map[*Hub][]*queueEntry
+}
+
+func NewParties(cfg PartyConfig) *Parties {
+	return &Parties{
+		cfg:      cfg.withDefaults(),
+		parties:  make(map[string]*party),
+		byMember: make(map[string]*party),
+		queues:   make(map[*Hub][]*queueEntry),
+	}
+}
+
+// AddHub lets members in h's game reach their party and queue there
+func (p *Parties) AddHub(h *Hub) {
+	p.mu.Lock()
+	p.hubs = append(p.hubs, h)
+	p.mu.Unlock()
+	h.events.Subscribe(func(e Event) { p.disconnected(h, e.Client) }, EventClientDisconnected)
+}
+
+// connectionsLocked returns id's connections on every game
+func (p *Parties) connectionsLocked(id string) []*Client {
+	var out []*Client
+	for _, h := range p.hubs {
+		out = append(out, h.FindClients(id)...)
+	}
+	return out
+}
+
+// sendLocked sends msg to every connection of pt's members
+func (p *Parties) sendLocked(pt *party, msg []byte) {
+	for _, id := range pt.members {
+		for _, c := range p.connectionsLocked(id) {
+			c.trySend(msg)
+		}
+	}
+}
+
+// updateLocked tells pt's members its current state
+func (p *Parties) updateLocked(pt *party) {
+	members := make([]PartyMember, 0, len(pt.members))
+	for _, id := range pt.members {
+		members = append(members, PartyMember{ID: id, Name: pt.names[id], Online: len(p.connectionsLocked(id)) > 0})
+	}
+	data, _ := json.Marshal(map[string]interface{}{
+		"id":      pt.id,
+		"leader":  pt.leader,
+		"members": members,
+		"code":    pt.code,
+		"queued":  pt.queued != nil,
+	})
+	b, _ := json.Marshal(Message{Type: "party.update", Sender: "server", Data: data})
+	p.sendLocked(pt, b)
+}
+
+func (p *Parties) create(c *Client) partyReply {
+	id := presenceIdentity(c)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.byMember[id] != nil {
+		return partyErr("party.already_in")
+	}
+	b := make([]byte, 4)
+	rand.Read(b)
+	pt := &party{id: "party-" + hex.EncodeToString(b), leader: id, members: []string{id}, names: map[string]string{id: c.name}, code: newJoinCode()}
+	for p.parties[pt.code] != nil {
+		pt.code = newJoinCode()
+	}
+	p.parties[pt.code] = pt
+	p.byMember[id] = pt
+	p.updateLocked(pt)
+	return partyReply{}
+}
+
+func (p *Parties) invite(c *Client, user string) partyReply {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pt := p.byMember[presenceIdentity(c)]
+	if pt == nil {
+		return partyErr("party.not_in", "party.invite")
+	}
+	targets := p.connectionsLocked(user)
+	if len(targets) == 0 {
+		return partyErr("party.user_offline", user)
+	}
+	data, _ := json.Marshal(map[string]string{"party": pt.id, "from": presenceIdentity(c), "code": pt.code})
+	b, _ := json.Marshal(Message{Type: "party.invite", Sender: "server", Data: data})
+	for _, t := range targets {
+		t.trySend(b)
+	}
+	return partyOK("party.invited", user)
+}
+
+func (p *Parties) join(c *Client, code string) partyReply {
+	id := presenceIdentity(c)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.byMember[id] != nil {
+		return partyErr("party.already_in")
+	}
+	pt := p.parties[strings.ToUpper(code)]
+	if pt == nil {
+		return partyErr("party.bad_code")
+	}
+	if len(pt.members) >= p.cfg.MaxSize {
+		return partyErr("party.full", p.cfg.MaxSize)
+	}
+	p.unqueueLocked(pt)
+	pt.members = append(pt.members, id)
+	pt.names[id] = c.name
+	p.byMember[id] = pt
+	p.updateLocked(pt)
+	return partyReply{}
+}
+
+// removeLocked takes id out of pt, handing over the lead and dissolving
+// the party when it is empty
+func (p *Parties) removeLocked(pt *party, id string) {
+	p.unqueueLocked(pt)
+	for i, m := range pt.members {
+		if m == id {
+			pt.members = append(pt.members[:i], pt.members[i+1:]...)
+			break
+		}
+	}
+	delete(pt.names, id)
+	delete(p.byMember, id)
+	if len(pt.members) == 0 {
+		delete(p.parties, pt.code)
+		return
+	}
+	if pt.leader == id {
+		pt.leader = pt.members[0]
+	}
+	p.updateLocked(pt)
+}
+
+func (p *Parties) leave(c *Client) partyReply {
+	id := presenceIdentity(c)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pt := p.byMember[id]
+	if pt == nil {
+		return partyErr("party.not_in", "party.leave")
+	}
+	p.removeLocked(pt, id)
+	return partyOK("party.left")
+}
+
+// kick removes user from the caller's party and returns user's connections
+func (p *Parties) kick(c *Client, user string) ([]*Client, partyReply) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pt := p.byMember[presenceIdentity(c)]
+	if pt == nil || pt.leader != presenceIdentity(c) {
+		return nil, partyErr("party.not_leader", "party.kick")
+	}
+	if p.byMember[user] != pt || user == pt.leader {
+		return nil, partyErr("party.not_member", user)
+	}
+	p.removeLocked(pt, user)
+	return p.connectionsLocked(user), partyReply{}
+}
+
+func (p *Parties) chat(c *Client, m Message) partyReply {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pt := p.byMember[presenceIdentity(c)]
+	if pt == nil {
+		return partyErr("party.not_in", m.Type)
+	}
+	b, _ := json.Marshal(Message{Type: "party.chat", Sender: m.Sender, Payload: m.Payload, Data: m.Data})
+	p.sendLocked(pt, b)
+	return partyReply{}
+}
+
+// queue puts c, or c's party, in hub's matchmaking queue
+func (p *Parties) queue(c *Client, hub *Hub) partyReply {
+	id := presenceIdentity(c)
+	p.mu.Lock()
+	entry := &queueEntry{members: []string{id}}
+	if pt := p.byMember[id]; pt != nil {
+		if pt.leader != id {
+			p.mu.Unlock()
+			return partyErr("party.not_leader", "queue.join")
+		}
+		if len(pt.members) > p.cfg.TeamSize {
+			p.mu.Unlock()
+			return partyErr("party.too_big", p.cfg.TeamSize)
+		}
+		var away []string
+		for _, m := range pt.members {
+			if len(hub.FindClients(m)) == 0 {
+				away = append(away, m)
+			}
+		}
+		if len(away) > 0 {
+			p.mu.Unlock()
+			return partyErr("party.members_away", strings.Join(away, ", "))
+		}
+		entry = &queueEntry{members: append([]string(nil), pt.members...), party: pt}
+	}
+	if p.queuedLocked(hub, id) {
+		p.mu.Unlock()
+		return partyErr("queue.already")
+	}
+	p.queues[hub] = append(p.queues[hub], entry)
+	if entry.party != nil {
+		entry.party.queued = hub
+		p.updateLocked(entry.party)
+	}
+	teams := p.matchLocked(hub)
+	p.mu.Unlock()
+	if teams == nil {
+		return partyOK("queue.joined")
+	}
+	p.start(hub, teams)
+	return partyReply{}
+}
+
+func (p *Parties) unqueue(c *Client, hub *Hub) partyReply {
+	id := presenceIdentity(c)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pt := p.byMember[id]; pt != nil && pt.queued == hub {
+		p.unqueueLocked(pt)
+		return partyOK("queue.left")
+	}
+	if !p.dropLocked(hub, id) {
+		return partyErr("queue.not_in")
+	}
+	return partyOK("queue.left")
+}
+
+// queuedLocked reports whether id is waiting in hub's queue
+func (p *Parties) queuedLocked(hub *Hub, id string) bool {
+	for _, e := range p.queues[hub] {
+		for _, m := range e.members {
+			if m == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// unqueueLocked takes pt out of the queue it is in, if any
+func (p *Parties) unqueueLocked(pt *party) {
+	if pt.queued == nil {
+		return
+	}
+	q := p.queues[pt.queued]
+	for i, e := range q {
+		if e.party == pt {
+			p.queues[pt.queued] = append(q[:i], q[i+1:]...)
+			break
+		}
+	}
+	pt.queued = nil
+	p.updateLocked(pt)
+}
+
+// dropLocked removes id's solo entry from hub's queue
+func (p *Parties) dropLocked(hub *Hub, id string) bool {
+	q := p.queues[hub]
+	for i, e := range q {
+		if e.party == nil && e.members[0] == id {
+			p.queues[hub] = append(q[:i], q[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// matchLocked fills teams from hub's queue, oldest entries first, and takes
+// the matched entries out. It returns nil while there aren't enough players.
+func (p *Parties) matchLocked(hub *Hub) [][]string {
+	want := p.cfg.Teams * p.cfg.TeamSize
+	teams := make([][]string, p.cfg.Teams)
+	used := make(map[*queueEntry]bool)
+	placed := 0
+	for _, e := range p.queues[hub] {
+		// best fit: the fullest team the entry still fits in
+		best := -1
+		for i, t := range teams {
+			if len(t)+len(e.members) <= p.cfg.TeamSize && (best < 0 || len(t) > len(teams[best])) {
+				best = i
+			}
+		}
+		if best < 0 {
+			continue
+		}
+		teams[best] = append(teams[best], e.members...)
+		used[e] = true
+		if placed += len(e.members); placed == want {
+			break
+		}
+	}
+	if placed < want {
+		return nil
+	}
+	rest := p.queues[hub][:0:0]
+	for _, e := range p.queues[hub] {
+		if !used[e] {
+			rest = append(rest, e)
+		} else if e.party != nil {
+			e.party.queued = nil
+		}
+	}
+	p.queues[hub] = rest
+	return teams
+}
+
+// start moves a match's players into a new room of hub
+func (p *Parties) start(hub *Hub, teams [][]string) {
+	b := make([]byte, 4)
+	rand.Read(b)
+	room := "match-" + hex.EncodeToString(b)
+	for team, members := range teams {
+		data, _ := json.Marshal(map[string]interface{}{"room": room, "team": team, "teams": teams})
+		msg, _ := json.Marshal(Message{Type: "match.found", Sender: "server", Data: data})
+		for _, id := range members {
+			for _, c := range hub.FindClients(id) {
+				hub.JoinRoom(c, room)
+				c.trySend(msg)
+			}
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, members := range teams {
+		for _, id := range members {
+			if pt := p.byMember[id]; pt != nil && pt.leader == id {
+				p.updateLocked(pt) // no longer queued
+			}
+		}
+	}
+}
+
+// disconnected takes id out of h's queue once its last connection there is
+// gone, and anonymous players out of their party
+func (p *Parties) disconnected(h *Hub, c *Client) {
+	id := presenceIdentity(c)
+	if len(h.FindClients(id)) > 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pt := p.byMember[id]
+	if pt == nil {
+		p.dropLocked(h, id)
+		return
+	}
+	if pt.queued == h {
+		p.unqueueLocked(pt)
+	}
+	if c.userID == "" && len(p.connectionsLocked(id)) == 0 {
+		p.removeLocked(pt, id)
+		return
+	}
+	p.updateLocked(pt) // online flags changed
+}
+
+// PartyMiddleware handles party.* and queue.* for hub's game
+func PartyMiddleware(p *Parties, hub *Hub) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(c *Client, m Message) {
+			var req struct {
+				User string `json:"user"`
+				Code string `json:"code"`
+			}
+			switch m.Type {
+			case "party.invite", "party.join", "party.kick":
+				if err := json.Unmarshal(m.Data, &req); err != nil {
+					sendError(c, "bad_data", m.Type, err.Error())
+					return
+				}
+			}
+			var r partyReply
+			switch m.Type {
+			case "party.create":
+				r = p.create(c)
+			case "party.invite":
+				r = p.invite(c, req.User)
+			case "party.join":
+				r = p.join(c, req.Code)
+			case "party.leave":
+				r = p.leave(c)
+			case "party.kick":
+				var kicked []*Client
+				kicked, r = p.kick(c, req.User)
+				for _, k := range kicked {
+					sendSystem(k, "party.kicked")
+				}
+			case "party.chat":
+				r = p.chat(c, m)
+			case "queue.join":
+				r = p.queue(c, hub)
+			case "queue.leave":
+				r = p.unqueue(c, hub)
+			default:
+				next(c, m)
+				return
+			}
+			if r.err {
+				sendError(c, r.code, r.args...)
+			} else if r.code != "" {
+				sendSystem(c, r.code, r.args...)
+			}
+		}
+	}
+}
@@ -0,0 +1,296 @@
+// backend/presence.go
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Cluster-wide presence.
+Each node tracks its connections in an ORSet (tag = "<node>/<incarnation>/<seq>")
+and periodically push-pulls its full state with every peer in -peers
+(POST /cluster/presence). Because ORSet merges commute, nodes on either side
+of a partition keep serving their last merged view and converge once the
+partition heals. The ORSet keeps no tombstones, so the state is the
+connections online plus a clock per node, however many came and went.
+
+Local connections are added and removed as the hubs publish connects
+and disconnects (EventBus.SubscribeSync, which never drops them), and
+every presenceReconcileInterval the set is checked against the hubs'
+clients anyway, so a connection can't be left online by a missed event.
+
+Crashed nodes: every node also gossips a heartbeat (merged by max); tags of
+nodes whose heartbeat is older than presenceNodeTimeout are hidden from
+presence.list, and a restarted node's clock drops the tags of its old
+incarnations everywhere.
+*/
+
+const (
+	presenceGossipInterval    = 2 * time.Second
+	presenceReconcileInterval = 30 * time.Second
+	presenceNodeTimeout       = 30 * time.Second
+	presenceMaxState          = 8 << 20 // bytes of a peer's state
+	clusterSecretHeader       = "X-Cluster-Secret"
+)
+
+// presenceState is the replicated state exchanged between nodes
+type presenceState struct {
+	Set        *ORSet           `json:"set"`
+	Heartbeats map[string]int64 `json:"heartbeats"` // node -> unix millis, merged by max
+}
+
+// Presence tracks who is online across the cluster
+type Presence struct {
+	node        string
+	incarnation int64
+	peers       []string
+	secret      string
+	httpClient  *http.Client
+
+	mu    sync.Mutex
+	hubs  []*Hub
+	state presenceState
+	seq   uint64
+	tags  map[*Client]string // local connections -> their add tag
+}
+
+func NewPresence(node string, peers []string, secret string) (*Presence, error) {
+	if node == "" || strings.Contains(node, "/") {
+		return nil, fmt.Errorf("presence: invalid node id %q", node)
+	}
+	p := &Presence{
+		node:        node,
+		incarnation: time.Now().UnixNano(),
+		peers:       peers,
+		secret:      secret,
+		httpClient:  &http.Client{Timeout: presenceGossipInterval},
+		state:       presenceState{Set: NewORSet(), Heartbeats: make(map[string]int64)},
+		tags:        make(map[*Client]string),
+	}
+	p.state.Heartbeats[node] = time.Now().UnixMilli()
+	p.state.Set.Start(node, p.incarnation)
+	return p, nil
+}
+
+// AddHub keeps presence in sync with hub's connections
+func (p *Presence) AddHub(hub *Hub) {
+	p.mu.Lock()
+	p.hubs = append(p.hubs, hub)
+	p.mu.Unlock()
+	hub.events.SubscribeSync(func(e Event) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		switch e.Kind {
+		case EventClientConnected:
+			p.addLocked(e.Client)
+		case EventClientDisconnected:
+			p.removeLocked(e.Client)
+		}
+	}, EventClientConnected, EventClientDisconnected)
+}
+
+// addLocked adds c unless a reconcile beat its connect event to it.
+// Requires p.mu.
+func (p *Presence) addLocked(c *Client) {
+	if _, ok := p.tags[c]; ok {
+		return
+	}
+	p.seq++
+	tag := ORSetTag(p.node, p.incarnation, p.seq)
+	p.tags[c] = tag
+	p.state.Set.Add(tag, presenceIdentity(c))
+}
+
+// removeLocked removes c. Requires p.mu.
+func (p *Presence) removeLocked(c *Client) {
+	if tag, ok := p.tags[c]; ok {
+		delete(p.tags, c)
+		p.state.Set.RemoveTag(tag)
+	}
+}
+
+// reconcile makes the local connections in the set those of the hubs
+func (p *Presence) reconcile() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// under p.mu, so connect and disconnect events wait for us; one
+	// whose client we already handled does nothing
+	live := make(map[*Client]bool)
+	for _, h := range p.hubs {
+		h.mu.RLock()
+		for c := range h.clients {
+			live[c] = true
+		}
+		h.mu.RUnlock()
+	}
+	added, removed := 0, 0
+	for c := range live {
+		if _, ok := p.tags[c]; !ok {
+			p.addLocked(c)
+			added++
+		}
+	}
+	for c := range p.tags {
+		if !live[c] {
+			p.removeLocked(c)
+			removed++
+		}
+	}
+	if added+removed > 0 {
+		log.Printf("presence: reconciled %d connection(s) in, %d out", added, removed)
+	}
+}
+
+// presenceIdentity is the user id for authenticated clients, else the client id
+func presenceIdentity(c *Client) string {
+	if c.userID != "" {
+		return c.userID
+	}
+	return c.id
+}
+
+// List returns the sorted, de-duplicated identities online on live nodes
+func (p *Presence) List() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cutoff := time.Now().Add(-presenceNodeTimeout).UnixMilli()
+	seen := make(map[string]bool)
+	p.state.Set.Each(func(tag, elem string) {
+		node, _, _, _ := parseTag(tag)
+		if node == p.node || p.state.Heartbeats[node] >= cutoff {
+			seen[elem] = true
+		}
+	})
+	out := make([]string, 0, len(seen))
+	for elem := range seen {
+		out = append(out, elem)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// merge folds a peer's state into ours. Caller holds p.mu.
+func (p *Presence) merge(other presenceState) {
+	if other.Set != nil {
+		p.state.Set.Merge(other.Set)
+	}
+	for node, hb := range other.Heartbeats {
+		if hb > p.state.Heartbeats[node] {
+			p.state.Heartbeats[node] = hb
+		}
+	}
+}
+
+// snapshot bumps our heartbeat and returns a copy of the state. Caller holds p.mu.
+func (p *Presence) snapshot() presenceState {
+	p.state.Heartbeats[p.node] = time.Now().UnixMilli()
+	hb := make(map[string]int64, len(p.state.Heartbeats))
+	for k, v := range p.state.Heartbeats {
+		hb[k] = v
+	}
+	return presenceState{Set: p.state.Set.Clone(), Heartbeats: hb}
+}
+
+// Gossip push-pulls state with every peer, and reconciles the local
+// connections, until the process exits
+func (p *Presence) Gossip() {
+	gossip := time.NewTicker(presenceGossipInterval)
+	defer gossip.Stop()
+	reconcile := time.NewTicker(presenceReconcileInterval)
+	defer reconcile.Stop()
+	for {
+		select {
+		case <-gossip.C:
+			for _, peer := range p.peers {
+				if err := p.exchange(peer); err != nil {
+					log.Printf("presence: gossip with %s: %v", peer, err)
+				}
+			}
+		case <-reconcile.C:
+			p.reconcile()
+		}
+	}
+}
+
+func (p *Presence) exchange(peer string) error {
+	p.mu.Lock()
+	body, err := json.Marshal(p.snapshot())
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(peer, "/")+"/cluster/presence", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(clusterSecretHeader, p.secret)
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var theirs presenceState
+	if err := json.NewDecoder(io.LimitReader(resp.Body, presenceMaxState)).Decode(&theirs); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.merge(theirs)
+	p.mu.Unlock()
+	return nil
+}
+
+// ServeHTTP handles POST /cluster/presence from peers
+func (p *Presence) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(clusterSecretHeader)), []byte(p.secret)) != 1 {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	var theirs presenceState
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, presenceMaxState)).Decode(&theirs); err != nil {
+		log.Printf("presence: state from %s rejected: %v", r.RemoteAddr, err)
+		http.Error(w, "bad state", http.StatusBadRequest)
+		return
+	}
+	p.mu.Lock()
+	p.merge(theirs)
+	mine := p.snapshot()
+	p.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(mine)
+}
+
+var errNoClusterSecret = errors.New("presence: -cluster-secret is required when -peers is set")
+
+// PresenceMiddleware answers presence.list with the cluster-wide list
+func PresenceMiddleware(p *Presence) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(c *Client, m Message) {
+			if m.Type != "presence.list" {
+				next(c, m)
+				return
+			}
+			data, _ := json.Marshal(p.List())
+			b, _ := json.Marshal(Message{Type: "presence.list", Sender: "server", Data: data})
+			c.Send(b)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+// backend/presence_test.go
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestPresenceFollowsHub connects and disconnects more clients at once
+// than an event bus queue holds; presence must see every one
+func TestPresenceFollowsHub(t *testing.T) {
+	h := newRunningHub()
+	p, err := NewPresence("n1", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.AddHub(h)
+	const n = 4 * subscriberQueueSize
+	clients := make([]*Client, n)
+	for i := range clients {
+		clients[i] = newTestUser(h, fmt.Sprint("c", i), fmt.Sprint("u", i))
+	}
+	if got := len(p.List()); got != n {
+		t.Fatalf("%d online after connecting, want %d", got, n)
+	}
+	for _, c := range clients {
+		h.unregister <- c
+	}
+	for deadline := time.Now().Add(time.Second); len(p.List()) > 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if got := p.List(); len(got) != 0 {
+		t.Fatalf("%d still online after disconnecting", len(got))
+	}
+}
+
+// TestPresenceReconcile repairs a set that missed events
+func TestPresenceReconcile(t *testing.T) {
+	h := newRunningHub()
+	p, err := NewPresence("n1", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.AddHub(h)
+	alice := newTestUser(h, "a", "alice")
+	ghost := &Client{id: "g", userID: "ghost"}
+	p.mu.Lock()
+	p.removeLocked(alice) // a lost connect
+	p.addLocked(ghost)    // a lost disconnect
+	p.mu.Unlock()
+	p.reconcile()
+	if got := p.List(); len(got) != 1 || got[0] != "alice" {
+		t.Fatalf("online after reconcile: %v, want alice", got)
+	}
+	// a second one has nothing to do
+	p.reconcile()
+	if len(p.state.Set.Adds) != 1 {
+		t.Fatalf("set has %v", p.state.Set.Adds)
+	}
+}
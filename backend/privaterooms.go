@@ -0,0 +1,276 @@
+// backend/privaterooms.go
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+/*
+Private rooms. Any client may make a room private while no one else has:
+
+	{"type":"room.private","payload":"<room>"}
+
+The caller becomes the owner and gets a join code back. From then on
+room.join needs one of: being the owner, a live invite, or the code:
+
+	{"type":"room.join","payload":"<room>","data":{"code":"K7QX2M"}}
+
+The owner manages access with
+
+	{"type":"room.invite","data":{"room":"r","user":"<user id>","ttl":"1h"}}
+	{"type":"room.revoke","data":{"room":"r","user":"<user id>"}}   drop the invite and remove the user
+	{"type":"room.revoke","data":{"room":"r"}}                      issue a new code
+
+Invites are addressed to logged-in user ids and delivered as "room.invite"
+(pushed when the user is offline). Anonymous clients join with the code.
+*/
+
+const (
+	joinCodeLen      = 6
+	joinCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789" // no 0/O or 1/I
+	defaultInviteTTL = 24 * time.Hour
+	maxInviteTTL     = 7 * 24 * time.Hour
+)
+
+type privateRoom struct {
+	owner   string // presenceIdentity of the creator
+	code    string
+	invites map[string]time.Time // user id -> expiry
+}
+
+// PrivateRooms tracks access rules for private rooms
+type PrivateRooms struct {
+	hub   *Hub
+	push  *Push
+	roles *RoomRoles // lets roles with "invite" invite too; nil = owner only
+	inbox *Inbox     // keeps invites for later; nil = deliver only
+
+	mu    sync.Mutex
+	rooms map[string]*privateRoom
+}
+
+func NewPrivateRooms(hub *Hub, push *Push) *PrivateRooms {
+	return &PrivateRooms{hub: hub, push: push, rooms: make(map[string]*privateRoom)}
+}
+
+func newJoinCode() string {
+	b := make([]byte, joinCodeLen)
+	rand.Read(b)
+	for i := range b {
+		b[i] = joinCodeAlphabet[int(b[i])%len(joinCodeAlphabet)]
+	}
+	return string(b)
+}
+
+// Create makes room private, owned by owner, for operators; it returns
+// the join code
+func (p *PrivateRooms) Create(room, owner string) (string, error) {
+	if room == "" || len(room) > maxRoomNameLen || owner == "" {
+		return "", errors.New("want a room name of 1 to 64 bytes and an owner")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pr := p.rooms[room]; pr != nil {
+		if pr.owner != owner {
+			return "", fmt.Errorf("room %s is owned by %s", room, pr.owner)
+		}
+		return pr.code, nil
+	}
+	if p.hub.RoomSize(room) > 0 {
+		return "", fmt.Errorf("room %s is in use", room)
+	}
+	pr := &privateRoom{owner: owner, code: newJoinCode(), invites: make(map[string]time.Time)}
+	p.rooms[room] = pr
+	return pr.code, nil
+}
+
+// canJoin reports whether c may enter room with the given code
+func (p *PrivateRooms) canJoin(c *Client, room, code string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pr := p.rooms[room]
+	if pr == nil || pr.owner == presenceIdentity(c) {
+		return true
+	}
+	if code != "" && subtle.ConstantTimeCompare([]byte(code), []byte(pr.code)) == 1 {
+		return true
+	}
+	if exp, ok := pr.invites[c.userID]; ok && c.userID != "" {
+		if time.Now().Before(exp) {
+			return true
+		}
+		delete(pr.invites, c.userID)
+	}
+	return false
+}
+
+// ownedRoomLocked returns the private room if c owns it; requires p.mu
+func (p *PrivateRooms) ownedRoomLocked(c *Client, room string) *privateRoom {
+	pr := p.rooms[room]
+	if pr == nil || pr.owner != presenceIdentity(c) {
+		return nil
+	}
+	return pr
+}
+
+func (p *PrivateRooms) reply(c *Client, typ string, data interface{}, code string, args ...interface{}) {
+	m := Message{Type: typ, Sender: "server", Code: code, Payload: c.T(code, args...)}
+	if data != nil {
+		m.Data, _ = json.Marshal(data)
+	}
+	b, _ := json.Marshal(m)
+	c.Send(b)
+}
+
+// PrivateRoomMiddleware guards room.join and handles room.private,
+// room.invite and room.revoke. It must run before RoomMiddleware.
+func PrivateRoomMiddleware(p *PrivateRooms) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(c *Client, m Message) {
+			switch m.Type {
+			case "room.join", "room.private", "room.invite", "room.revoke":
+			default:
+				next(c, m)
+				return
+			}
+			var req struct {
+				Room string   `json:"room"`
+				User string   `json:"user"`
+				Code string   `json:"code"`
+				TTL  Duration `json:"ttl"`
+			}
+			if len(m.Data) > 0 {
+				if err := json.Unmarshal(m.Data, &req); err != nil {
+					sendError(c, "bad_data", m.Type, err.Error())
+					return
+				}
+			}
+			switch m.Type {
+			case "room.join":
+				if !p.canJoin(c, m.Payload, req.Code) {
+					sendError(c, "room.private_denied", m.Payload)
+					return
+				}
+				next(c, m)
+			case "room.private":
+				room := m.Payload
+				if room == "" || len(room) > maxRoomNameLen {
+					sendError(c, "room.name_invalid", m.Type)
+					return
+				}
+				p.mu.Lock()
+				pr := p.rooms[room]
+				if pr != nil && pr.owner != presenceIdentity(c) {
+					p.mu.Unlock()
+					sendError(c, "room.taken", room)
+					return
+				}
+				if pr == nil {
+					// claiming a room other people are already in would lock them in with a stranger
+					if n := p.hub.Rooms()[room]; n > 1 || (n == 1 && p.hub.RoomOf(c) != room) {
+						p.mu.Unlock()
+						sendError(c, "room.in_use", room)
+						return
+					}
+					pr = &privateRoom{owner: presenceIdentity(c), code: newJoinCode(), invites: make(map[string]time.Time)}
+					p.rooms[room] = pr
+				}
+				code := pr.code
+				p.mu.Unlock()
+				p.reply(c, "room.private", map[string]string{"room": room, "code": code}, "room.private", room)
+			case "room.invite":
+				if req.User == "" {
+					sendError(c, "room.invite_bad")
+					return
+				}
+				ttl := time.Duration(req.TTL)
+				if ttl <= 0 {
+					ttl = defaultInviteTTL
+				}
+				if ttl > maxInviteTTL {
+					ttl = maxInviteTTL
+				}
+				exp := time.Now().Add(ttl)
+				p.mu.Lock()
+				pr := p.ownedRoomLocked(c, req.Room)
+				if pr == nil && p.roles != nil && p.hub.RoomOf(c) == req.Room && p.roles.Allowed(c, req.Room, "invite") {
+					pr = p.rooms[req.Room]
+				}
+				if pr != nil {
+					pr.invites[req.User] = exp
+				}
+				p.mu.Unlock()
+				if pr == nil {
+					sendError(c, "room.not_owner", m.Type, req.Room)
+					return
+				}
+				invite := map[string]interface{}{"room": req.Room, "from": presenceIdentity(c), "expires": exp}
+				from := c.name
+				if from == "" {
+					from = presenceIdentity(c)
+				}
+				var online bool
+				if p.inbox != nil {
+					item := InboxItem{Kind: "room.invite", From: presenceIdentity(c), Title: "Room invite", Body: from + " invited you to " + req.Room}
+					item.Data, _ = json.Marshal(invite)
+					var err error
+					online, err = p.inbox.Send(req.User, item, func(id int64) []byte {
+						invite["inboxId"] = id
+						data, _ := json.Marshal(invite)
+						b, _ := json.Marshal(Message{Type: "room.invite", Sender: "server", Payload: req.Room, Data: data})
+						return b
+					})
+					if err != nil {
+						log.Println("inbox:", err)
+					}
+				} else {
+					data, _ := json.Marshal(invite)
+					b, _ := json.Marshal(Message{Type: "room.invite", Sender: "server", Payload: req.Room, Data: data})
+					online = p.push.Deliver(req.User, b, Notification{
+						Title: "Room invite",
+						Body:  from + " invited you to " + req.Room,
+						Data:  map[string]string{"type": "room.invite", "room": req.Room},
+					})
+				}
+				p.reply(c, "system", map[string]interface{}{"room": req.Room, "user": req.User, "online": online, "expires": exp}, "room.invited", req.User)
+			case "room.revoke":
+				p.mu.Lock()
+				pr := p.ownedRoomLocked(c, req.Room)
+				code := ""
+				if pr != nil {
+					if req.User != "" {
+						delete(pr.invites, req.User)
+					} else {
+						pr.code = newJoinCode()
+						code = pr.code
+					}
+				}
+				p.mu.Unlock()
+				if pr == nil {
+					sendError(c, "room.not_owner", m.Type, req.Room)
+					return
+				}
+				if req.User == "" {
+					p.reply(c, "room.private", map[string]string{"room": req.Room, "code": code}, "room.new_code", req.Room)
+					return
+				}
+				removed := 0
+				for _, u := range p.hub.UserClients(req.User) {
+					if p.hub.RoomOf(u) == req.Room {
+						p.hub.LeaveRoom(u)
+						sendSystem(u, "room.removed", req.Room)
+						removed++
+					}
+				}
+				p.reply(c, "system", map[string]interface{}{"room": req.Room, "user": req.User, "removed": removed}, "room.revoked", req.User)
+			}
+		}
+	}
+}
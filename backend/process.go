@@ -0,0 +1,363 @@
+// backend/process.go
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os/exec"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+Out-of-process games (mode "process"), so a game can be written in any
+language and shipped without rebuilding the server. (Go plugins are not an
+option: a plugin can't import this package main, so it couldn't implement
+Game.) The server runs the command and talks to it in JSON lines:
+
+	-mode process -game-command "./mygame --level hard"
+	"games": [{"path": "/ws/mygame", "mode": "process", "command": ["./mygame", "--level", "hard"]}]
+
+on the game's stdin, one event per line:
+
+	{"event":"connect","client":"10.0.0.7:51234","user":"alice","name":"Alice","room":""}
+	{"event":"message","client":"10.0.0.7:51234","msg":{"type":"move","payload":"4",...}}
+	{"event":"binary","client":"10.0.0.7:51234","data":"<base64>"}
+	{"event":"disconnect","client":"10.0.0.7:51234"}
+
+and on its stdout, one operation per line:
+
+	{"op":"send","client":"<id>","msg":{"type":"state","data":{...}}}
+	{"op":"room","room":"r1","msg":{...}}            to every member, with a room seq
+	{"op":"broadcast","msg":{...}}                    to every client of the game
+	{"op":"binary","client":"<id>","data":"<base64>"} or "room" instead of "client"
+	{"op":"join","client":"<id>","room":"r1"}
+	{"op":"leave","client":"<id>"}
+	{"op":"kick","client":"<id>","reason":"cheating"}
+	{"op":"result","result":{"game":"mygame","room":"r1","players":[...]}}
+
+Lines on stderr go to the server log. Messages reach the game after the
+usual middleware (rooms, rate limits, ...) just like built-in games.
+
+If the process exits it is restarted, backing off up to
+processMaxBackoff, and gets a connect event for every client still
+connected so it can rebuild its state. The same happens on
+
+	POST /api/admin/processes/reload?game=/ws/mygame    e.g. after installing a new binary
+	GET  /api/admin/processes                           command, pid, restarts per game
+
+Events are queued up to processQueueSize; beyond that (a stuck process)
+they are dropped and logged.
+*/
+
+// application close code for clients a process game kicks
+const closeKickedByGame = 4003
+
+const (
+	processQueueSize  = 1024
+	processMaxBackoff = 30 * time.Second
+	processStableRun  = time.Minute // a run this long resets the backoff
+)
+
+// processEvent is a line on the game's stdin
+type processEvent struct {
+	Event  string   `json:"event"`
+	Client string   `json:"client"`
+	User   string   `json:"user,omitempty"`
+	Name   string   `json:"name,omitempty"`
+	Room   *string  `json:"room,omitempty"`
+	Msg    *Message `json:"msg,omitempty"`
+	Data   []byte   `json:"data,omitempty"`
+}
+
+// processOp is a line on the game's stdout
+type processOp struct {
+	Op     string      `json:"op"`
+	Client string      `json:"client"`
+	Room   string      `json:"room"`
+	Msg    *Message    `json:"msg"`
+	Data   []byte      `json:"data"`
+	Reason string      `json:"reason"`
+	Result *GameResult `json:"result"`
+}
+
+// ProcessGame runs a game as a child process
+type ProcessGame struct {
+	hub     *Hub
+	command []string
+	events  chan []byte
+	reload  chan struct{}
+
+	mu       sync.Mutex
+	clients  map[string]*Client
+	cmd      *exec.Cmd // current run; nil between runs
+	stdin    io.WriteCloser
+	started  time.Time
+	restarts int
+}
+
+// NewProcessGame starts command and keeps it running
+func NewProcessGame(hub *Hub, command []string) (*ProcessGame, error) {
+	if len(command) == 0 {
+		return nil, errors.New("mode process requires a command")
+	}
+	if _, err := exec.LookPath(command[0]); err != nil {
+		return nil, err
+	}
+	g := &ProcessGame{
+		hub:     hub,
+		command: command,
+		events:  make(chan []byte, processQueueSize),
+		reload:  make(chan struct{}, 1),
+		clients: make(map[string]*Client),
+	}
+	go g.supervise()
+	go g.writeEvents()
+	return g, nil
+}
+
+// supervise runs the process over and over
+func (g *ProcessGame) supervise() {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := g.run()
+		if time.Since(start) >= processStableRun {
+			backoff = time.Second
+		}
+		select {
+		case <-g.reload:
+			log.Printf("game %s: reloading", g.hub.path)
+			backoff = time.Second
+			continue
+		default:
+		}
+		log.Printf("game %s: process exited (%v); restarting in %s", g.hub.path, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-g.reload:
+		}
+		if backoff *= 2; backoff > processMaxBackoff {
+			backoff = processMaxBackoff
+		}
+	}
+}
+
+// run starts the process, replays the connected clients and waits for it
+func (g *ProcessGame) run() error {
+	cmd := exec.Command(g.command[0], g.command[1:]...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	g.mu.Lock()
+	if !g.started.IsZero() {
+		g.restarts++
+	}
+	g.cmd, g.stdin, g.started = cmd, stdin, time.Now()
+	clients := make([]*Client, 0, len(g.clients))
+	for _, c := range g.clients {
+		clients = append(clients, c)
+	}
+	g.mu.Unlock()
+	log.Printf("game %s: started %s (pid %d)", g.hub.path, g.command[0], cmd.Process.Pid)
+	for _, c := range clients {
+		g.connectEvent(c)
+	}
+
+	go func() {
+		sc := bufio.NewScanner(stderr)
+		for sc.Scan() {
+			log.Printf("game %s: %s", g.hub.path, sc.Text())
+		}
+	}()
+	sc := bufio.NewScanner(stdout)
+	sc.Buffer(make([]byte, 64*1024), 16<<20)
+	for sc.Scan() {
+		var op processOp
+		if err := json.Unmarshal(sc.Bytes(), &op); err != nil {
+			log.Printf("game %s: bad output line: %v", g.hub.path, err)
+			continue
+		}
+		g.apply(op)
+	}
+	err = cmd.Wait()
+	g.mu.Lock()
+	g.cmd, g.stdin = nil, nil
+	g.mu.Unlock()
+	return err
+}
+
+// writeEvents copies queued events to the current process
+func (g *ProcessGame) writeEvents() {
+	for b := range g.events {
+		g.mu.Lock()
+		stdin := g.stdin
+		g.mu.Unlock()
+		if stdin == nil {
+			continue // between runs; connect events are replayed on start
+		}
+		stdin.Write(append(b, '\n'))
+	}
+}
+
+func (g *ProcessGame) queue(e processEvent) {
+	b, _ := json.Marshal(e)
+	select {
+	case g.events <- b:
+	default:
+		log.Printf("game %s: event queue full, dropping %s from %s", g.hub.path, e.Event, e.Client)
+	}
+}
+
+func (g *ProcessGame) connectEvent(c *Client) {
+	room := g.hub.RoomOf(c)
+	g.queue(processEvent{Event: "connect", Client: c.id, User: c.userID, Name: c.name, Room: &room})
+}
+
+// client returns the connected client with id
+func (g *ProcessGame) client(id string) *Client {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.clients[id]
+}
+
+// apply carries out one operation from the process
+func (g *ProcessGame) apply(op processOp) {
+	if op.Msg != nil && op.Msg.Sender == "" {
+		op.Msg.Sender = "server"
+	}
+	var c *Client
+	if op.Client != "" {
+		if c = g.client(op.Client); c == nil {
+			return // gone already
+		}
+	}
+	switch {
+	case op.Op == "send" && c != nil && op.Msg != nil:
+		m := *op.Msg
+		m.stamp()
+		b, _ := json.Marshal(m)
+		c.trySend(b)
+	case op.Op == "room" && op.Room != "" && op.Msg != nil:
+		g.hub.BroadcastRoom(op.Room, *op.Msg)
+	case op.Op == "broadcast" && op.Msg != nil:
+		g.hub.BroadcastGlobal(*op.Msg)
+	case op.Op == "binary" && c != nil:
+		c.SendBinary(op.Data)
+	case op.Op == "binary" && op.Room != "":
+		g.hub.BroadcastBinary(op.Room, op.Data, nil)
+	case op.Op == "join" && c != nil && op.Room != "" && len(op.Room) <= maxRoomNameLen:
+		g.hub.JoinRoom(c, op.Room)
+	case op.Op == "leave" && c != nil:
+		g.hub.LeaveRoom(c)
+	case op.Op == "kick" && c != nil:
+		c.kick(closeKickedByGame, op.Reason)
+	case op.Op == "result" && op.Result != nil:
+		g.hub.ReportResult(*op.Result)
+	default:
+		log.Printf("game %s: ignoring op %q", g.hub.path, op.Op)
+	}
+}
+
+func (g *ProcessGame) OnConnect(c *Client) {
+	g.mu.Lock()
+	g.clients[c.id] = c
+	g.mu.Unlock()
+	g.connectEvent(c)
+}
+
+func (g *ProcessGame) OnMessage(c *Client, m Message) {
+	g.queue(processEvent{Event: "message", Client: c.id, Msg: &m})
+}
+
+func (g *ProcessGame) OnBinaryMessage(c *Client, data []byte) {
+	g.queue(processEvent{Event: "binary", Client: c.id, Data: data})
+}
+
+func (g *ProcessGame) OnDisconnect(c *Client) {
+	g.mu.Lock()
+	delete(g.clients, c.id)
+	g.mu.Unlock()
+	g.queue(processEvent{Event: "disconnect", Client: c.id})
+}
+
+// Reload restarts the process right away
+func (g *ProcessGame) Reload() {
+	select {
+	case g.reload <- struct{}{}:
+	default:
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.cmd != nil {
+		g.cmd.Process.Kill()
+	}
+}
+
+// processStatus is one entry of GET /api/admin/processes
+type processStatus struct {
+	Game     string    `json:"game"`
+	Command  []string  `json:"command"`
+	PID      int       `json:"pid,omitempty"` // 0 while restarting
+	Started  time.Time `json:"started"`
+	Restarts int       `json:"restarts"`
+	Clients  int       `json:"clients"`
+}
+
+func (g *ProcessGame) status() processStatus {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	s := processStatus{Game: g.hub.path, Command: g.command, Started: g.started, Restarts: g.restarts, Clients: len(g.clients)}
+	if g.cmd != nil {
+		s.PID = g.cmd.Process.Pid
+	}
+	return s
+}
+
+// RegisterProcessAdmin mounts /api/admin/processes for the process games
+// among mounted
+func RegisterProcessAdmin(a *AdminAPI, mounted map[string]*mountedGame) {
+	a.Handle("/api/admin/processes", func(w http.ResponseWriter, r *http.Request) {
+		out := []processStatus{}
+		for _, mg := range mounted {
+			if mg.process != nil {
+				out = append(out, mg.process.status())
+			}
+		}
+		sort.Slice(out, func(i, j int) bool { return out[i].Game < out[j].Game })
+		writeJSON(w, http.StatusOK, out)
+	})
+	a.Handle("/api/admin/processes/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSONError(w, http.StatusMethodNotAllowed, "use POST")
+			return
+		}
+		path := r.URL.Query().Get("game")
+		mg := mounted[path]
+		if mg == nil || mg.process == nil {
+			writeJSONError(w, http.StatusNotFound, fmt.Sprintf("no process game at %q", path))
+			return
+		}
+		mg.process.Reload()
+		a.audit.Record(adminActor(r), "process.reload", path, "")
+		writeJSON(w, http.StatusOK, map[string]string{"reloading": path})
+	})
+}
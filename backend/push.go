@@ -0,0 +1,347 @@
+// backend/push.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+Push notifications for offline users.
+Logged-in clients register device tokens with
+	{"type":"push.register","data":{"platform":"android","token":"..."}}
+	{"type":"push.unregister","data":{"token":"..."}}
+and the tokens are saved to -push-tokens. When something addressed to a
+user (a "dm", a game invite) finds none of their connections online,
+Push.Notify hands it to the configured provider instead:
+
+	-push-provider=log      log notifications (development)
+	-push-provider=fcm      Firebase Cloud Messaging, server key in -push-key
+	-push-provider=webhook  POST JSON to -push-url, for bridging to APNs, web push, ...
+
+Direct messages: {"type":"dm","payload":"hi","data":{"to":"<user id>"}},
+authenticated senders only. "to" may be user@domain of a federated
+server (federation.go).
+*/
+
+var errInvalidDeviceToken = errors.New("device token is no longer valid")
+
+const pushTimeout = 10 * time.Second
+
+// DeviceToken is one registered device of a user
+type DeviceToken struct {
+	Platform string    `json:"platform"` // android | ios | web | ...
+	Token    string    `json:"token"`
+	Added    time.Time `json:"added"`
+}
+
+// Notification is what a provider delivers
+type Notification struct {
+	Title string            `json:"title"`
+	Body  string            `json:"body"`
+	Data  map[string]string `json:"data,omitempty"`
+}
+
+// PushProvider delivers a notification to one device. It returns
+// errInvalidDeviceToken when the token should be forgotten.
+type PushProvider interface {
+	Send(ctx context.Context, userID string, dev DeviceToken, n Notification) error
+}
+
+// NewPushProvider builds the provider named by -push-provider ("" = disabled)
+func NewPushProvider(name, key, url string) (PushProvider, error) {
+	switch name {
+	case "":
+		return nil, nil
+	case "log":
+		return logPushProvider{}, nil
+	case "fcm":
+		if key == "" {
+			return nil, errors.New("-push-provider=fcm requires -push-key")
+		}
+		return &fcmPushProvider{key: key, client: &http.Client{Timeout: pushTimeout}}, nil
+	case "webhook":
+		if url == "" {
+			return nil, errors.New("-push-provider=webhook requires -push-url")
+		}
+		return &webhookPushProvider{url: url, key: key, client: &http.Client{Timeout: pushTimeout}}, nil
+	}
+	return nil, fmt.Errorf("unknown push provider %q (want log|fcm|webhook)", name)
+}
+
+type logPushProvider struct{}
+
+func (logPushProvider) Send(_ context.Context, userID string, dev DeviceToken, n Notification) error {
+	log.Printf("push to %s (%s): %s: %s", userID, dev.Platform, n.Title, n.Body)
+	return nil
+}
+
+// fcmPushProvider uses the FCM HTTP API with a server key
+type fcmPushProvider struct {
+	key    string
+	client *http.Client
+}
+
+func (p *fcmPushProvider) Send(ctx context.Context, _ string, dev DeviceToken, n Notification) error {
+	body, _ := json.Marshal(map[string]interface{}{
+		"to":           dev.Token,
+		"notification": map[string]string{"title": n.Title, "body": n.Body},
+		"data":         n.Data,
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://fcm.googleapis.com/fcm/send", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "key="+p.key)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fcm: %s", resp.Status)
+	}
+	var out struct {
+		Results []struct {
+			Error string `json:"error"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return fmt.Errorf("fcm: %v", err)
+	}
+	if len(out.Results) > 0 {
+		switch out.Results[0].Error {
+		case "":
+			return nil
+		case "NotRegistered", "InvalidRegistration":
+			return errInvalidDeviceToken
+		default:
+			return fmt.Errorf("fcm: %s", out.Results[0].Error)
+		}
+	}
+	return nil
+}
+
+// webhookPushProvider POSTs each notification to a URL; a 410 response
+// means the token is gone
+type webhookPushProvider struct {
+	url    string
+	key    string // sent as a bearer token when set
+	client *http.Client
+}
+
+func (p *webhookPushProvider) Send(ctx context.Context, userID string, dev DeviceToken, n Notification) error {
+	body, _ := json.Marshal(map[string]interface{}{
+		"user":         userID,
+		"platform":     dev.Platform,
+		"token":        dev.Token,
+		"notification": n,
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.key != "" {
+		req.Header.Set("Authorization", "Bearer "+p.key)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusGone:
+		return errInvalidDeviceToken
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("push webhook: %s", resp.Status)
+	}
+	return nil
+}
+
+// Push keeps device tokens and sends notifications to offline users
+type Push struct {
+	hubs     []*Hub       // set up before serving; not locked
+	provider PushProvider // nil when disabled
+	path     string
+
+	mu      sync.Mutex
+	devices map[string][]DeviceToken // user id -> devices
+}
+
+func NewPush(hub *Hub, provider PushProvider, path string) (*Push, error) {
+	p := &Push{hubs: []*Hub{hub}, provider: provider, path: path, devices: make(map[string][]DeviceToken)}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &p.devices); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// AddHub lets Deliver reach the clients of another game's hub
+func (p *Push) AddHub(h *Hub) {
+	p.hubs = append(p.hubs, h)
+}
+
+func (p *Push) saveLocked() error {
+	b, err := json.MarshalIndent(p.devices, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(p.path, b)
+}
+
+// Register adds (or refreshes) a device of userID
+func (p *Push) Register(userID string, dev DeviceToken) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.removeLocked(userID, dev.Token)
+	dev.Added = time.Now()
+	p.devices[userID] = append(p.devices[userID], dev)
+	return p.saveLocked()
+}
+
+// Unregister forgets a device token of userID
+func (p *Push) Unregister(userID, token string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.removeLocked(userID, token) {
+		return nil
+	}
+	return p.saveLocked()
+}
+
+// Forget drops every device of userID and returns how many there were
+func (p *Push) Forget(userID string) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := len(p.devices[userID])
+	if n == 0 {
+		return 0, nil
+	}
+	delete(p.devices, userID)
+	return n, p.saveLocked()
+}
+
+func (p *Push) removeLocked(userID, token string) bool {
+	devs := p.devices[userID]
+	for i, d := range devs {
+		if d.Token == token {
+			devs = append(devs[:i], devs[i+1:]...)
+			if len(devs) == 0 {
+				delete(p.devices, userID)
+			} else {
+				p.devices[userID] = devs
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Notify pushes n to every device of userID in the background
+func (p *Push) Notify(userID string, n Notification) {
+	if p.provider == nil {
+		return
+	}
+	p.mu.Lock()
+	devs := append([]DeviceToken(nil), p.devices[userID]...)
+	p.mu.Unlock()
+	for _, dev := range devs {
+		go func(dev DeviceToken) {
+			ctx, cancel := context.WithTimeout(context.Background(), pushTimeout)
+			defer cancel()
+			err := p.provider.Send(ctx, userID, dev, n)
+			if errors.Is(err, errInvalidDeviceToken) {
+				log.Printf("push: dropping stale %s token of %s", dev.Platform, userID)
+				if err := p.Unregister(userID, dev.Token); err != nil {
+					log.Println("push: save:", err)
+				}
+			} else if err != nil {
+				log.Printf("push to %s: %v", userID, err)
+			}
+		}(dev)
+	}
+}
+
+// Deliver sends msg to userID's live connections, or pushes n if there are none.
+// It reports whether the user was online.
+func (p *Push) Deliver(userID string, msg []byte, n Notification) bool {
+	sent := 0
+	for _, h := range p.hubs {
+		sent += h.SendToUser(userID, msg)
+	}
+	if sent > 0 {
+		return true
+	}
+	p.Notify(userID, n)
+	return false
+}
+
+// PushMiddleware handles push.register, push.unregister and dm
+func PushMiddleware(p *Push) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(c *Client, m Message) {
+			switch m.Type {
+			case "push.register", "push.unregister":
+				if c.userID == "" {
+					sendError(c, "auth.required", m.Type)
+					return
+				}
+				var dev DeviceToken
+				if err := json.Unmarshal(m.Data, &dev); err != nil || dev.Token == "" {
+					sendError(c, "push.bad_token", m.Type)
+					return
+				}
+				var err error
+				if m.Type == "push.register" {
+					err = p.Register(c.userID, dev)
+				} else {
+					err = p.Unregister(c.userID, dev.Token)
+				}
+				if err != nil {
+					log.Println("push tokens:", err)
+					sendError(c, "failed", m.Type)
+					return
+				}
+				sendSystem(c, "ok", m.Type)
+			case "dm":
+				if c.userID == "" {
+					sendError(c, "auth.required", m.Type)
+					return
+				}
+				var to struct {
+					To string `json:"to"`
+				}
+				if err := json.Unmarshal(m.Data, &to); err != nil || to.To == "" {
+					sendError(c, "dm.bad_target")
+					return
+				}
+				data, _ := json.Marshal(map[string]string{"to": to.To})
+				b, _ := json.Marshal(Message{Type: "dm", Sender: c.userID, Payload: m.Payload, Data: data})
+				title := c.name
+				if title == "" {
+					title = c.userID
+				}
+				p.Deliver(to.To, b, Notification{Title: title, Body: m.Payload, Data: map[string]string{"type": "dm", "from": c.userID}})
+			default:
+				next(c, m)
+			}
+		}
+	}
+}
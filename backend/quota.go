@@ -0,0 +1,264 @@
+// backend/quota.go
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Storage quotas for message history, per room and per user.
+Defaults come from the "quotas" config block; per-room and per-user
+overrides are set through the admin API and saved to -quota-file.
+History is never rejected for being over quota: the oldest messages of the
+room (or user) are pruned until usage fits again. A limit with maxAge is
+also a retention policy; see retention.go.
+*/
+
+// QuotaLimit caps stored messages; zero fields are unlimited
+type QuotaLimit struct {
+	MaxMessages int      `json:"maxMessages,omitempty"`
+	MaxBytes    int64    `json:"maxBytes,omitempty"`
+	MaxAge      Duration `json:"maxAge,omitempty"` // e.g. "720h" keeps 30 days
+}
+
+// QuotaConfig is the "quotas" block of the config file
+type QuotaConfig struct {
+	Room       QuotaLimit `json:"room"`
+	User       QuotaLimit `json:"user"`
+	PruneEvery Duration   `json:"pruneEvery,omitempty"` // retention sweep interval, default 5m
+}
+
+// quotaOverrides is what the quota file stores
+type quotaOverrides struct {
+	Rooms map[string]QuotaLimit `json:"rooms"`
+	Users map[string]QuotaLimit `json:"users"`
+}
+
+// Quotas resolves limits and prunes history that exceeds them
+type Quotas struct {
+	defaults QuotaConfig
+	path     string // "" keeps overrides in memory only
+
+	mu        sync.Mutex
+	overrides quotaOverrides
+}
+
+func NewQuotas(defaults QuotaConfig, path string) (*Quotas, error) {
+	q := &Quotas{
+		defaults:  defaults,
+		path:      path,
+		overrides: quotaOverrides{Rooms: make(map[string]QuotaLimit), Users: make(map[string]QuotaLimit)},
+	}
+	if path == "" {
+		return q, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &q.overrides); err != nil {
+		return nil, err
+	}
+	if q.overrides.Rooms == nil {
+		q.overrides.Rooms = make(map[string]QuotaLimit)
+	}
+	if q.overrides.Users == nil {
+		q.overrides.Users = make(map[string]QuotaLimit)
+	}
+	return q, nil
+}
+
+// RoomLimit returns the effective limit for room
+func (q *Quotas) RoomLimit(room string) QuotaLimit {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if l, ok := q.overrides.Rooms[room]; ok {
+		return l
+	}
+	return q.defaults.Room
+}
+
+// UserLimit returns the effective limit for user
+func (q *Quotas) UserLimit(user string) QuotaLimit {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if l, ok := q.overrides.Users[user]; ok {
+		return l
+	}
+	return q.defaults.User
+}
+
+// SetRoom overrides the limit for room; nil restores the default
+func (q *Quotas) SetRoom(room string, l *QuotaLimit) error {
+	return q.set(q.overrides.Rooms, room, l)
+}
+
+// SetUser overrides the limit for user; nil restores the default
+func (q *Quotas) SetUser(user string, l *QuotaLimit) error {
+	return q.set(q.overrides.Users, user, l)
+}
+
+func (q *Quotas) set(m map[string]QuotaLimit, key string, l *QuotaLimit) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if l == nil {
+		delete(m, key)
+	} else {
+		m[key] = *l
+	}
+	if q.path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(q.overrides, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(q.path, b)
+}
+
+// Snapshot returns defaults and overrides (for the admin API)
+func (q *Quotas) Snapshot() (QuotaConfig, map[string]QuotaLimit, map[string]QuotaLimit) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	rooms := make(map[string]QuotaLimit, len(q.overrides.Rooms))
+	for k, v := range q.overrides.Rooms {
+		rooms[k] = v
+	}
+	users := make(map[string]QuotaLimit, len(q.overrides.Users))
+	for k, v := range q.overrides.Users {
+		users[k] = v
+	}
+	return q.defaults, rooms, users
+}
+
+// Enforce prunes the oldest history of room and userID ("" = anonymous,
+// not limited per user) until both fit; it returns how many messages were removed
+func (q *Quotas) Enforce(store HistoryStore, room, userID string) (int, error) {
+	n, err := prune(store, HistoryFilter{Room: room}, q.RoomLimit(room))
+	if err != nil || userID == "" {
+		return n, err
+	}
+	m, err := prune(store, HistoryFilter{UserID: userID}, q.UserLimit(userID))
+	return n + m, err
+}
+
+func prune(store HistoryStore, f HistoryFilter, l QuotaLimit) (int, error) {
+	expired := 0
+	if l.MaxAge > 0 {
+		old := f
+		old.Until = time.Now().Add(-time.Duration(l.MaxAge))
+		n, err := store.DeleteOldest(old, 0)
+		if err != nil {
+			return 0, err
+		}
+		expired = n
+	}
+	count, bytes, err := store.Usage(f)
+	if err != nil {
+		return expired, err
+	}
+	excess := 0
+	if l.MaxMessages > 0 && count > l.MaxMessages {
+		excess = count - l.MaxMessages
+	}
+	if l.MaxBytes > 0 && bytes > l.MaxBytes {
+		// walk from the oldest until enough bytes are freed
+		msgs, err := store.Query(f)
+		if err != nil {
+			return expired, err
+		}
+		freed, n := int64(0), 0
+		for n < len(msgs) && bytes-freed > l.MaxBytes {
+			freed += msgs[n].Size()
+			n++
+		}
+		if n > excess {
+			excess = n
+		}
+	}
+	if excess == 0 {
+		return expired, nil
+	}
+	n, err := store.DeleteOldest(f, excess)
+	return expired + n, err
+}
+
+// RegisterAdmin mounts the quota endpoints:
+//
+//	GET    /api/admin/quotas                  defaults and all overrides
+//	GET    /api/admin/quotas/rooms/{room}     effective limit and current usage
+//	PUT    /api/admin/quotas/rooms/{room}     set override, body {"maxMessages":..,"maxBytes":..,"maxAge":"168h"}
+//	DELETE /api/admin/quotas/rooms/{room}     back to the default
+//
+// and the same under /users/{user id}. Lowering a limit prunes immediately.
+func (q *Quotas) RegisterAdmin(a *AdminAPI, store HistoryStore) {
+	a.Handle("/api/admin/quotas", func(w http.ResponseWriter, r *http.Request) {
+		defaults, rooms, users := q.Snapshot()
+		writeJSON(w, http.StatusOK, map[string]interface{}{"defaults": defaults, "rooms": rooms, "users": users})
+	})
+	a.Handle("/api/admin/quotas/", func(w http.ResponseWriter, r *http.Request) {
+		kind, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/admin/quotas/"), "/")
+		if key == "" || (kind != "rooms" && kind != "users") {
+			writeJSONError(w, http.StatusNotFound, "want /api/admin/quotas/rooms/{room} or /users/{user}")
+			return
+		}
+		filter, limit, set := HistoryFilter{Room: key}, q.RoomLimit, q.SetRoom
+		if kind == "users" {
+			filter, limit, set = HistoryFilter{UserID: key}, q.UserLimit, q.SetUser
+		}
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var l QuotaLimit
+			if err := readJSON(w, r, &l); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "bad quota: "+err.Error())
+				return
+			}
+			if l.MaxMessages < 0 || l.MaxBytes < 0 || l.MaxAge < 0 {
+				writeJSONError(w, http.StatusBadRequest, "limits must not be negative")
+				return
+			}
+			if err := set(key, &l); err != nil {
+				writeJSONError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			detail, _ := json.Marshal(l)
+			a.audit.Record(adminActor(r), "quota.set", kind+"/"+key, string(detail))
+			if _, err := prune(store, filter, l); err != nil {
+				writeJSONError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		case http.MethodDelete:
+			if err := set(key, nil); err != nil {
+				writeJSONError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			a.audit.Record(adminActor(r), "quota.reset", kind+"/"+key, "")
+			if _, err := prune(store, filter, limit(key)); err != nil {
+				writeJSONError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, "use GET, PUT or DELETE")
+			return
+		}
+		count, bytes, err := store.Usage(filter)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"limit": limit(key),
+			"usage": map[string]interface{}{"messages": count, "bytes": bytes},
+		})
+	})
+}
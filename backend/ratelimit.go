@@ -0,0 +1,90 @@
+// backend/ratelimit.go
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// RateLimit is the QoS class for one message type
+type RateLimit struct {
+	Rate    float64 `json:"rate"`              // sustained messages per second (0 = unlimited)
+	Burst   int     `json:"burst,omitempty"`   // bucket size, defaults to ceil(rate)
+	MaxSize int     `json:"maxSize,omitempty"` // max payload bytes (0 = only maxMessageSize applies)
+}
+
+// tokenBucket is a classic token bucket; only touched from the client's readPump
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (l RateLimit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Ceil(l.Rate)
+}
+
+func (b *tokenBucket) allow(l RateLimit, now time.Time) bool {
+	burst := l.burst()
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*l.Rate)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// wait is how long until allow would pass again
+func (b *tokenBucket) wait(l RateLimit) time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / l.Rate * float64(time.Second))
+}
+
+// RateLimitMiddleware enforces per-type size and rate limits.
+// Messages over the limit are dropped and the sender gets an error reply,
+// with retryAfterMs when it was the rate.
+func RateLimitMiddleware(limits map[string]RateLimit) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(c *Client, m Message) {
+			l, ok := limits[m.Type]
+			class := m.Type
+			if !ok {
+				if l, ok = limits["*"]; !ok {
+					next(c, m)
+					return
+				}
+				class = "*"
+			}
+			if l.MaxSize > 0 && len(m.Payload) > l.MaxSize {
+				sendErrorReply(c, "ratelimit.too_large", errorReply{details: map[string]interface{}{"type": m.Type, "size": len(m.Payload), "max": l.MaxSize}},
+					m.Type, len(m.Payload), l.MaxSize)
+				return
+			}
+			if l.Rate > 0 {
+				if c.buckets == nil {
+					c.buckets = make(map[string]*tokenBucket)
+				}
+				b := c.buckets[class]
+				if b == nil {
+					b = &tokenBucket{}
+					c.buckets[class] = b
+				}
+				if !b.allow(l, time.Now()) {
+					sendErrorReply(c, "ratelimit.exceeded", errorReply{retryAfter: b.wait(l), details: map[string]interface{}{"type": m.Type, "rate": l.Rate, "burst": l.burst()}},
+						m.Type, l.Rate)
+					return
+				}
+			}
+			next(c, m)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+// backend/reconnect.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+Reconnect storm protection. When the server restarts every client tends
+to come back at once; two things spread them out.
+
+Per-IP connection attempts at the websocket endpoints are rate limited
+before the upgrade:
+
+	"reconnect": {"attemptRate": 1, "attemptBurst": 10, "retryAfter": "1s", "jitter": "10s"}
+
+An IP over its limit gets 429 with a Retry-After header. On SIGTERM or
+SIGINT, or on
+
+	POST   /api/admin/drain    stop admitting and disconnect everyone
+	DELETE /api/admin/drain    admit again (after a drain that wasn't a shutdown)
+
+the server drains: new upgrades get 503 with Retry-After, and each
+connected client is sent
+
+	{"type":"server.draining","data":{"retryAfterMs":7342}}
+
+and is then closed with 1012 (service restart) and the reason
+"retry after 7342ms". Every hint is retryAfter plus a random share of
+jitter, different per client, so clients that follow it don't reconnect
+in lockstep. Rejections are counted in ws_connect_rejected_total.
+*/
+
+const (
+	defaultAttemptBurst = 10
+	defaultRetryAfter   = time.Second
+	defaultRetryJitter  = 10 * time.Second
+	drainGrace          = time.Second // for server.draining to be written before the close
+	attemptSweepEvery   = time.Minute
+)
+
+// ReconnectConfig is the "reconnect" config block
+type ReconnectConfig struct {
+	AttemptRate  float64  `json:"attemptRate,omitempty"`  // upgrades/s per IP, 0 = no limit
+	AttemptBurst float64  `json:"attemptBurst,omitempty"` // default defaultAttemptBurst
+	RetryAfter   Duration `json:"retryAfter,omitempty"`   // least retry hint, default 1s
+	Jitter       Duration `json:"jitter,omitempty"`       // random extra on every hint, default 10s
+}
+
+// Reconnects admits websocket upgrades and drains the games
+type Reconnects struct {
+	cfg ReconnectConfig
+
+	limited Counter
+	refused Counter // while draining
+
+	mu        sync.Mutex
+	hubs      []*Hub
+	attempts  map[string]*byteBucket // ip -> attempts, one token per upgrade
+	lastSweep time.Time
+	draining  bool
+}
+
+func NewReconnects(cfg ReconnectConfig) *Reconnects {
+	if cfg.AttemptBurst <= 0 {
+		cfg.AttemptBurst = defaultAttemptBurst
+	}
+	if cfg.RetryAfter <= 0 {
+		cfg.RetryAfter = Duration(defaultRetryAfter)
+	}
+	if cfg.Jitter <= 0 {
+		cfg.Jitter = Duration(defaultRetryJitter)
+	}
+	return &Reconnects{cfg: cfg, attempts: make(map[string]*byteBucket), lastSweep: time.Now()}
+}
+
+// AddHub includes hub's clients in drains
+func (rc *Reconnects) AddHub(hub *Hub) {
+	rc.mu.Lock()
+	rc.hubs = append(rc.hubs, hub)
+	rc.mu.Unlock()
+}
+
+// retryHint is at least wait, plus retryAfter and a random share of jitter
+func (rc *Reconnects) retryHint(wait time.Duration) time.Duration {
+	return wait + time.Duration(rc.cfg.RetryAfter) + time.Duration(rand.Int63n(int64(rc.cfg.Jitter)+1))
+}
+
+// refuse answers an upgrade request with status and a Retry-After header
+func refuse(w http.ResponseWriter, status int, hint time.Duration, msg string) {
+	secs := int((hint + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	http.Error(w, msg, status)
+}
+
+// Admit reports whether r may be upgraded; if not it has already answered
+func (rc *Reconnects) Admit(w http.ResponseWriter, r *http.Request) bool {
+	ip := remoteIP(r)
+	now := time.Now()
+	rc.mu.Lock()
+	if rc.draining {
+		rc.mu.Unlock()
+		rc.refused.Inc()
+		refuse(w, http.StatusServiceUnavailable, rc.retryHint(0), "server is restarting")
+		return false
+	}
+	if rc.cfg.AttemptRate <= 0 || ip == "" {
+		rc.mu.Unlock()
+		return true // no limit, or a unix socket
+	}
+	if now.Sub(rc.lastSweep) >= attemptSweepEvery {
+		rc.sweep(now)
+	}
+	b := rc.attempts[ip]
+	if b == nil {
+		b = &byteBucket{}
+		rc.attempts[ip] = b
+	}
+	wait := b.take(1, rc.cfg.AttemptRate, rc.cfg.AttemptBurst, now)
+	if wait > 0 {
+		b.tokens++ // a refused attempt doesn't count against the next one
+	}
+	rc.mu.Unlock()
+	if wait > 0 {
+		rc.limited.Inc()
+		refuse(w, http.StatusTooManyRequests, rc.retryHint(wait), "too many connection attempts")
+		return false
+	}
+	return true
+}
+
+// sweep drops the buckets that have refilled; rc.mu is held
+func (rc *Reconnects) sweep(now time.Time) {
+	full := time.Duration(rc.cfg.AttemptBurst / rc.cfg.AttemptRate * float64(time.Second))
+	for ip, b := range rc.attempts {
+		if now.Sub(b.last) >= full {
+			delete(rc.attempts, ip)
+		}
+	}
+	rc.lastSweep = now
+}
+
+// Drain stops admitting new connections and disconnects every client
+// with its own retry hint. It returns how many were disconnected, once
+// they have been closed.
+func (rc *Reconnects) Drain() int {
+	rc.mu.Lock()
+	rc.draining = true
+	hubs := rc.hubs
+	rc.mu.Unlock()
+	type drained struct {
+		c    *Client
+		hint time.Duration
+	}
+	var all []drained
+	for _, hub := range hubs {
+		hub.mu.Lock()
+		for c := range hub.clients {
+			all = append(all, drained{c, rc.retryHint(0)})
+		}
+		hub.mu.Unlock()
+	}
+	if len(all) == 0 {
+		return 0
+	}
+	log.Printf("draining %d connections", len(all))
+	for _, d := range all {
+		data, _ := json.Marshal(map[string]int64{"retryAfterMs": d.hint.Milliseconds()})
+		b, _ := json.Marshal(Message{Type: "server.draining", Sender: "server", Data: data})
+		d.c.trySend(b)
+	}
+	time.Sleep(drainGrace)
+	for _, d := range all {
+		d.c.kick(websocket.CloseServiceRestart, fmt.Sprintf("retry after %dms", d.hint.Milliseconds()))
+	}
+	return len(all)
+}
+
+// Resume admits connections again after a drain
+func (rc *Reconnects) Resume() {
+	rc.mu.Lock()
+	rc.draining = false
+	rc.mu.Unlock()
+}
+
+// Draining reports whether a drain is in progress or done
+func (rc *Reconnects) Draining() bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.draining
+}
+
+// Register exports the rejection counts on m
+func (rc *Reconnects) Register(m *Metrics) {
+	m.Register("ws_connect_rejected_total", "websocket upgrades refused before connecting", "counter", func() []Sample {
+		return []Sample{
+			{Labels: `reason="draining"`, Value: float64(rc.refused.Value())},
+			{Labels: `reason="rate"`, Value: float64(rc.limited.Value())},
+		}
+	})
+}
+
+// RegisterAdmin mounts /api/admin/drain
+func (rc *Reconnects) RegisterAdmin(a *AdminAPI) {
+	a.Handle("/api/admin/drain", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, map[string]interface{}{"draining": rc.Draining(), "config": rc.cfg})
+		case http.MethodPost:
+			n := rc.Drain()
+			a.audit.Record(adminActor(r), "server.drain", "", strconv.Itoa(n))
+			writeJSON(w, http.StatusOK, map[string]int{"disconnected": n})
+		case http.MethodDelete:
+			rc.Resume()
+			a.audit.Record(adminActor(r), "server.resume", "", "")
+			writeJSON(w, http.StatusOK, map[string]bool{"draining": false})
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, "use GET, POST or DELETE")
+		}
+	})
+}
+
+// drainOnSignal drains on SIGTERM or SIGINT and exits; a second signal
+// exits right away
+func drainOnSignal(rc *Reconnects) {
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	log.Printf("%s: draining before exit", <-sig)
+	go func() {
+		log.Printf("%s: exiting now", <-sig)
+		os.Exit(1)
+	}()
+	rc.Drain()
+	os.Exit(0)
+}
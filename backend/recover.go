@@ -0,0 +1,112 @@
+// backend/recover.go
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sort"
+	"sync"
+)
+
+/*
+Panic isolation. A bug in one game callback shouldn't take every other
+connection down with it: each game is wrapped so that a panic in
+OnConnect, OnMessage, OnBinaryMessage or OnDisconnect (middleware
+included) is recovered, logged with its stack trace and counted in
+
+	game_panics_total{game="/ws",callback="OnMessage"}
+
+The client is told
+
+	{"type":"error","sender":"server","code":"game.panic","payload":"chat: internal error; the message was not processed","data":{"status":500}}
+
+and stays connected; the message goes to the dead letters (deadletter.go).
+Panics in goroutines a game starts itself are still its own business.
+*/
+
+// panicKey identifies a counter of Panics
+type panicKey struct{ game, callback string }
+
+// Panics recovers and counts game panics
+type Panics struct {
+	mu     sync.Mutex
+	counts map[panicKey]int64
+}
+
+func NewPanics() *Panics { return &Panics{counts: make(map[panicKey]int64)} }
+
+// Register exports game_panics_total on m
+func (p *Panics) Register(m *Metrics) {
+	m.Register("game_panics_total", "panics recovered in game callbacks", "counter", func() []Sample {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		out := make([]Sample, 0, len(p.counts))
+		for k, n := range p.counts {
+			out = append(out, Sample{Labels: fmt.Sprintf("game=%q,callback=%q", k.game, k.callback), Value: float64(n)})
+		}
+		sort.Slice(out, func(i, j int) bool { return out[i].Labels < out[j].Labels })
+		return out
+	})
+}
+
+// Wrap returns game with its callbacks guarded; nil p leaves game as is
+func (p *Panics) Wrap(game Game) Game {
+	if p == nil {
+		return game
+	}
+	return &recoveringGame{Game: game, p: p}
+}
+
+// recover is deferred around a callback of c's game; m is the message
+// being handled, if any
+func (p *Panics) recover(c *Client, callback string, m *Message) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	stack := debug.Stack()
+	log.Printf("panic in %s %s (client %s): %v\n%s", c.hub.path, callback, c.id, v, stack)
+	p.mu.Lock()
+	p.counts[panicKey{c.hub.path, callback}]++
+	p.mu.Unlock()
+	if m != nil {
+		dl := fromClient(c, *m, DeadPanic, "game.panic", fmt.Sprint(v))
+		dl.Stack = string(stack)
+		c.hub.deadLetters.add(dl)
+	}
+	if callback == "OnDisconnect" {
+		return
+	}
+	what := callback
+	if m != nil {
+		what = m.Type
+	}
+	sendError(c, "game.panic", what)
+}
+
+// recoveringGame guards every callback of Game
+type recoveringGame struct {
+	Game
+	p *Panics
+}
+
+func (g *recoveringGame) OnConnect(c *Client) {
+	defer g.p.recover(c, "OnConnect", nil)
+	g.Game.OnConnect(c)
+}
+
+func (g *recoveringGame) OnMessage(c *Client, m Message) {
+	defer g.p.recover(c, "OnMessage", &m)
+	g.Game.OnMessage(c, m)
+}
+
+func (g *recoveringGame) OnBinaryMessage(c *Client, data []byte) {
+	defer g.p.recover(c, "OnBinaryMessage", nil)
+	g.Game.OnBinaryMessage(c, data)
+}
+
+func (g *recoveringGame) OnDisconnect(c *Client) {
+	defer g.p.recover(c, "OnDisconnect", nil)
+	g.Game.OnDisconnect(c)
+}
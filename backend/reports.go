@@ -0,0 +1,431 @@
+// backend/reports.go
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+Abuse reports. Any client may report a player, or a message of its room
+by id:
+
+	{"type":"report","data":{"user":"github:42","reason":"harassment","note":"..."}}
+	{"type":"report","data":{"message":"5f2a9c-7","reason":"spam"}}
+
+A reported message is looked up among the room's recent messages (the
+sync.replay buffer, see resync.go) and its sender is the reported user.
+Each report keeps, as they were at the time, the reported message and the
+last reports.context (default 20) messages of the reporter's room. The
+reporter gets
+
+	{"type":"report.received","sender":"server","data":{"id":17}}
+
+Moderators, the user ids in reports.moderators, are told of each report as
+it comes in when they are in the moderation room (reports.room) of any
+game, which no one else may join:
+
+	"reports": {"room": "moderation", "moderators": ["github:42"], "context": 20, "max": 10000}
+
+	{"type":"report.new","sender":"server","data":{...the report...}}
+	{"type":"report.updated","sender":"server","data":{...}}   resolved or dismissed
+
+Reports are written to the database (-db) when there is one, else kept in
+memory, newest reports.max only. Operators work through
+
+	GET  /api/admin/reports?status=open&user=github:42&limit=100   newest first
+	GET  /api/admin/reports/{id}
+	POST /api/admin/reports/{id}   {"status":"resolved","resolution":"banned for a day"}
+
+status is open, resolved or dismissed. Reporting the same target again
+while an earlier report is open is refused; rateLimits can throttle
+"report" like any other type.
+*/
+
+// report statuses
+const (
+	ReportOpen      = "open"
+	ReportResolved  = "resolved"
+	ReportDismissed = "dismissed"
+)
+
+const (
+	maxReportReason = 64
+	maxReportNote   = 1000
+)
+
+// Report is one user's complaint about a player or message
+type Report struct {
+	ID         int64             `json:"id"`
+	Time       time.Time         `json:"time"`
+	Status     string            `json:"status"`
+	Reporter   string            `json:"reporter"` // user id, or client id when anonymous
+	User       string            `json:"user,omitempty"`
+	MessageID  string            `json:"messageId,omitempty"`
+	Message    json.RawMessage   `json:"message,omitempty"` // the reported message as sent
+	Reason     string            `json:"reason,omitempty"`
+	Note       string            `json:"note,omitempty"`
+	Game       string            `json:"game"`
+	Room       string            `json:"room,omitempty"`
+	Context    []json.RawMessage `json:"context,omitempty"` // the room's last messages, oldest first
+	Resolution string            `json:"resolution,omitempty"`
+	ResolvedBy string            `json:"resolvedBy,omitempty"`
+	ResolvedAt *time.Time        `json:"resolvedAt,omitempty"`
+}
+
+// ReportConfig is the "reports" config block
+type ReportConfig struct {
+	Room       string   `json:"room,omitempty"`       // moderation room, default "moderation"
+	Moderators []string `json:"moderators,omitempty"` // user ids allowed in it
+	Context    int      `json:"context,omitempty"`    // room messages kept with a report, default 20
+	Max        int      `json:"max,omitempty"`        // reports kept, default 10000
+}
+
+// Reports stores reports and tells moderators about them
+type Reports struct {
+	room       string
+	moderators map[string]bool
+	context    int
+	max        int
+	hubs       []*Hub // set up before serving; not locked
+
+	mu      sync.Mutex
+	nextID  int64
+	reports []Report  // oldest first
+	db      *SQLiteDB // nil = memory only
+}
+
+func NewReports(cfg ReportConfig) *Reports {
+	r := &Reports{room: cfg.Room, moderators: make(map[string]bool), context: cfg.Context, max: cfg.Max, nextID: 1}
+	if r.room == "" {
+		r.room = "moderation"
+	}
+	if r.context <= 0 {
+		r.context = 20
+	}
+	if r.max <= 0 {
+		r.max = 10000
+	}
+	for _, id := range cfg.Moderators {
+		r.moderators[id] = true
+	}
+	return r
+}
+
+// UseDB loads the stored reports and saves changes to db
+func (r *Reports) UseDB(db *SQLiteDB) error {
+	reports, err := db.reports()
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.db = db
+	r.reports = reports
+	if n := len(reports); n > 0 {
+		r.nextID = reports[n-1].ID + 1
+	}
+	return r.trimLocked()
+}
+
+// AddHub lets moderators on h hear about reports
+func (r *Reports) AddHub(h *Hub) { r.hubs = append(r.hubs, h) }
+
+// notify sends a report message to every moderation room
+func (r *Reports) notify(typ string, rep Report) {
+	data, _ := json.Marshal(rep)
+	for _, h := range r.hubs {
+		h.BroadcastRoom(r.room, Message{Type: typ, Sender: "server", Data: data})
+	}
+}
+
+// snapshot returns the last n sequenced messages of room on h and the
+// one with id msgID, if it is among them
+func snapshot(h *Hub, room, msgID string, n int) (context []json.RawMessage, found json.RawMessage, sender string) {
+	rs := h.room(room)
+	if rs == nil {
+		return nil, nil, ""
+	}
+	rs.mu.Lock()
+	recent := rs.recent
+	rs.mu.Unlock()
+	// frames are never changed once queued, so they can be read unlocked
+	if msgID != "" {
+		for i := len(recent) - 1; i >= 0; i-- {
+			var m Message
+			if json.Unmarshal(recent[i].b, &m) == nil && m.ID == msgID {
+				found, sender = recent[i].b, m.Sender
+				break
+			}
+		}
+	}
+	if len(recent) > n {
+		recent = recent[len(recent)-n:]
+	}
+	for _, f := range recent {
+		context = append(context, json.RawMessage(f.b))
+	}
+	return context, found, sender
+}
+
+// file stores the report c made with m; it returns an error code, or ""
+func (r *Reports) file(c *Client, m Message) (Report, string) {
+	var req struct {
+		User    string `json:"user"`
+		Message string `json:"message"`
+		Reason  string `json:"reason"`
+		Note    string `json:"note"`
+	}
+	if json.Unmarshal(m.Data, &req) != nil || (req.User == "" && req.Message == "") {
+		return Report{}, "report.bad"
+	}
+	reporter := c.userID
+	if reporter == "" {
+		reporter = c.id
+	}
+	room := c.hub.RoomOf(c)
+	rep := Report{Status: ReportOpen, Reporter: reporter, User: req.User, MessageID: req.Message,
+		Reason: truncate(req.Reason, maxReportReason), Note: truncate(req.Note, maxReportNote), Game: c.hub.path, Room: room}
+	if room != "" {
+		var sender string
+		rep.Context, rep.Message, sender = snapshot(c.hub, room, req.Message, r.context)
+		if req.Message != "" && rep.Message == nil {
+			return Report{}, "report.message_not_found"
+		}
+		if rep.User == "" {
+			rep.User = sender
+		}
+	} else if req.Message != "" {
+		return Report{}, "report.message_not_found"
+	}
+	if rep.User == reporter {
+		return Report{}, "report.self"
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, old := range r.reports {
+		if old.Status == ReportOpen && old.Reporter == reporter && old.User == rep.User && old.MessageID == rep.MessageID {
+			return Report{}, "report.duplicate"
+		}
+	}
+	rep.ID, rep.Time = r.nextID, time.Now()
+	r.nextID++
+	r.reports = append(r.reports, rep)
+	if r.db != nil {
+		if err := r.db.saveReport(rep); err != nil {
+			log.Printf("reports: %v", err)
+		}
+	}
+	if err := r.trimLocked(); err != nil {
+		log.Printf("reports: %v", err)
+	}
+	return rep, ""
+}
+
+// truncate cuts s to at most n bytes, on a rune boundary
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// trimLocked drops the oldest reports beyond max
+func (r *Reports) trimLocked() error {
+	n := len(r.reports) - r.max
+	if n <= 0 {
+		return nil
+	}
+	ids := make([]int64, n)
+	for i := range ids {
+		ids[i] = r.reports[i].ID
+	}
+	r.reports = append([]Report(nil), r.reports[n:]...)
+	if r.db != nil {
+		return r.db.deleteReports(ids)
+	}
+	return nil
+}
+
+// list returns the reports matching status and user ("" = any), newest first
+func (r *Reports) list(status, user string, limit int) []Report {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := []Report{}
+	for i := len(r.reports) - 1; i >= 0 && (limit <= 0 || len(out) < limit); i-- {
+		rep := r.reports[i]
+		if (status == "" || rep.Status == status) && (user == "" || rep.User == user || rep.Reporter == user) {
+			out = append(out, rep)
+		}
+	}
+	return out
+}
+
+func (r *Reports) get(id int64) (Report, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, rep := range r.reports {
+		if rep.ID == id {
+			return rep, true
+		}
+	}
+	return Report{}, false
+}
+
+// resolve closes report id with status
+func (r *Reports) resolve(id int64, status, resolution, by string) (Report, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.reports {
+		rep := &r.reports[i]
+		if rep.ID != id {
+			continue
+		}
+		now := time.Now()
+		rep.Status, rep.Resolution, rep.ResolvedBy, rep.ResolvedAt = status, resolution, by, &now
+		if status == ReportOpen {
+			rep.ResolvedBy, rep.ResolvedAt = "", nil
+		}
+		if r.db != nil {
+			return *rep, true, r.db.saveReport(*rep)
+		}
+		return *rep, true, nil
+	}
+	return Report{}, false, nil
+}
+
+// Forget deletes the reports userID filed or that are about them, and
+// drops their messages from the context of the others, for erasure
+// (erasure.go). It returns how many reports it deleted or changed.
+func (r *Reports) Forget(userID string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var deleted []int64
+	var changed []Report
+	kept := r.reports[:0]
+	for _, rep := range r.reports {
+		if rep.Reporter == userID || rep.User == userID {
+			deleted = append(deleted, rep.ID)
+			continue
+		}
+		context := rep.Context[:0:0]
+		for _, f := range rep.Context {
+			var m Message
+			if json.Unmarshal(f, &m) == nil && m.Sender == userID {
+				continue
+			}
+			context = append(context, f)
+		}
+		if len(context) != len(rep.Context) {
+			rep.Context = context
+			changed = append(changed, rep)
+		}
+		kept = append(kept, rep)
+	}
+	r.reports = kept
+	if r.db == nil {
+		return len(deleted) + len(changed), nil
+	}
+	var err error
+	if len(deleted) > 0 {
+		err = r.db.deleteReports(deleted)
+	}
+	for _, rep := range changed {
+		if e := r.db.saveReport(rep); e != nil && err == nil {
+			err = e
+		}
+	}
+	return len(deleted) + len(changed), err
+}
+
+// ReportMiddleware files reports and keeps the moderation room to
+// moderators
+func ReportMiddleware(r *Reports) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(c *Client, m Message) {
+			switch {
+			case m.Type == "report":
+				rep, code := r.file(c, m)
+				if code != "" {
+					sendError(c, code, m.Type)
+					return
+				}
+				log.Printf("reports: #%d by %s against %q (%s)", rep.ID, rep.Reporter, rep.User, rep.Reason)
+				data, _ := json.Marshal(map[string]int64{"id": rep.ID})
+				b, _ := json.Marshal(Message{Type: "report.received", Sender: "server", Data: data})
+				c.Send(b)
+				r.notify("report.new", rep)
+			case (m.Type == "room.join" || m.Type == "room.private") && m.Payload == r.room && !r.moderators[c.userID]:
+				sendError(c, "report.moderators_only", m.Type, r.room)
+			default:
+				next(c, m)
+			}
+		}
+	}
+}
+
+// RegisterAdmin mounts /api/admin/reports
+func (r *Reports) RegisterAdmin(a *AdminAPI) {
+	a.Handle("/api/admin/reports", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "use GET")
+			return
+		}
+		q := req.URL.Query()
+		limit, _ := strconv.Atoi(q.Get("limit"))
+		writeJSON(w, http.StatusOK, r.list(q.Get("status"), q.Get("user"), limit))
+	})
+	a.Handle("/api/admin/reports/", func(w http.ResponseWriter, req *http.Request) {
+		rest := strings.TrimPrefix(req.URL.Path, "/api/admin/reports/")
+		id, err := strconv.ParseInt(rest, 10, 64)
+		if err != nil || id <= 0 {
+			writeJSONError(w, http.StatusNotFound, "want /api/admin/reports/{id}")
+			return
+		}
+		switch req.Method {
+		case http.MethodGet:
+			rep, ok := r.get(id)
+			if !ok {
+				writeJSONError(w, http.StatusNotFound, "no report "+rest)
+				return
+			}
+			writeJSON(w, http.StatusOK, rep)
+		case http.MethodPost:
+			var body struct {
+				Status     string `json:"status"`
+				Resolution string `json:"resolution"`
+			}
+			if err := readJSON(w, req, &body); err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if body.Status != ReportOpen && body.Status != ReportResolved && body.Status != ReportDismissed {
+				writeJSONError(w, http.StatusBadRequest, "status must be open, resolved or dismissed")
+				return
+			}
+			rep, ok, err := r.resolve(id, body.Status, body.Resolution, adminActor(req))
+			switch {
+			case !ok:
+				writeJSONError(w, http.StatusNotFound, "no report "+rest)
+				return
+			case err != nil:
+				writeJSONError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			a.audit.Record(adminActor(req), "report."+body.Status, rest, body.Resolution)
+			r.notify("report.updated", rep)
+			writeJSON(w, http.StatusOK, rep)
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, "use GET or POST")
+		}
+	})
+}
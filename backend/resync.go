@@ -0,0 +1,181 @@
+// backend/resync.go
+package main
+
+import "encoding/json"
+
+/*
+State reconciliation after a reconnect. A client that comes back joins
+its room again and reports the last room seq it saw (see envelope.go):
+
+	{"type":"sync.request","data":{"rooms":{"r1":42}}}
+
+and is told, per room, how it will catch up:
+
+	{"type":"sync.response","sender":"server","data":{"rooms":{"r1":{"status":"replay","seq":57,"missed":15}}}}
+
+	current     nothing was missed
+	replay      the missed messages follow, unchanged but for outbound
+	            filters (seq 43..57), before anything newer; the client's
+	            own relayed messages come as "filtered" stubs
+	snapshot    the gap can't be replayed (too old, or the room was
+	            emptied and started over); the game's current state follows
+	            (canvas.snapshot, game.state) and the stream goes on from seq
+	reset       as snapshot, but the game keeps no state to send; reload
+	            what is needed (history) and go on from seq
+	not_member  the client is not in that room; join it first
+
+The server keeps the last sync.replay (default 256, -1 = none) sequenced
+frames of each room:
+
+	"sync": {"replay": 256}
+
+A replay that would not fit in the client's send buffer is answered with
+a snapshot instead. The Go client in package client does all of this by
+itself on reconnect.
+*/
+
+// SyncConfig is the "sync" config block
+type SyncConfig struct {
+	Replay int `json:"replay,omitempty"` // frames kept per room; default 256, -1 = none
+}
+
+// frames is how many frames each room keeps
+func (cfg SyncConfig) frames() int {
+	switch {
+	case cfg.Replay < 0:
+		return 0
+	case cfg.Replay == 0:
+		return 256
+	}
+	return cfg.Replay
+}
+
+// SnapshotGame is a Game that can send a client the current state of a
+// room, for sync.request
+type SnapshotGame interface {
+	Game
+	SyncSnapshot(c *Client, room string)
+}
+
+// sync statuses
+const (
+	SyncCurrent   = "current"
+	SyncReplay    = "replay"
+	SyncSnapshot  = "snapshot"
+	SyncReset     = "reset"
+	SyncNotMember = "not_member"
+)
+
+// SyncResult is the outcome of sync.request for one room
+type SyncResult struct {
+	Status string `json:"status"`
+	Seq    uint64 `json:"seq,omitempty"`    // the room's seq at the time of the response
+	Missed int    `json:"missed,omitempty"` // replay: how many messages follow
+}
+
+// remember keeps frame, which except didn't get, for replays, at most max
+// of them; requires rs.mu
+func (rs *roomState) remember(frame []byte, except *Client, max int) {
+	if max <= 0 {
+		return
+	}
+	rs.recent = append(rs.recent, recentFrame{b: frame, except: except})
+	if len(rs.recent) > max {
+		rs.recent = rs.recent[len(rs.recent)-max:]
+	}
+}
+
+// resync answers c's sync.request for rooms (room -> last seen seq);
+// game provides snapshots when it is a SnapshotGame
+func (h *Hub) resync(c *Client, rooms map[string]uint64, game Game) {
+	out := make(map[string]SyncResult, len(rooms))
+	current := h.RoomOf(c)
+	for room := range rooms {
+		if room != current {
+			out[room] = SyncResult{Status: SyncNotMember}
+		}
+	}
+	last, ok := rooms[current]
+	if !ok || current == "" {
+		h.sendSyncResponse(c, out, nil)
+		return
+	}
+	sg, hasState := game.(SnapshotGame)
+	res := SyncResult{Status: SyncReset}
+	if hasState {
+		res.Status = SyncSnapshot
+	}
+	rs := h.room(current)
+	if rs == nil {
+		out[current] = res
+		h.sendSyncResponse(c, out, nil)
+	} else {
+		// the response and the replay are queued under the room's lock, so
+		// nothing newer gets in between
+		rs.mu.Lock()
+		res.Seq = rs.seq
+		missed := int(rs.seq - last)
+		free := int(c.sendLimit.Load()) - len(c.send) - 1
+		var replay []recentFrame
+		switch {
+		case last == rs.seq:
+			res.Status = SyncCurrent
+		case last < rs.seq && missed <= len(rs.recent) && missed <= free:
+			res.Status, res.Missed = SyncReplay, missed
+			replay = rs.recent[len(rs.recent)-missed:]
+		}
+		out[current] = res
+		h.sendSyncResponse(c, out, replay)
+		rs.mu.Unlock()
+	}
+	if res.Status == SyncSnapshot {
+		sg.SyncSnapshot(c, current)
+	}
+}
+
+// sendSyncResponse queues the sync.response and the frames replayed after
+// it. c's own messages, which it was left out of, come back as stubs.
+func (h *Hub) sendSyncResponse(c *Client, rooms map[string]SyncResult, replay []recentFrame) {
+	data, _ := json.Marshal(map[string]interface{}{"rooms": rooms})
+	b, _ := json.Marshal(Message{Type: "sync.response", Sender: "server", Data: data})
+	c.trySend(b)
+	for _, rf := range replay {
+		frame := rf.b
+		switch {
+		case rf.except == c:
+			var m Message
+			if json.Unmarshal(frame, &m) != nil {
+				continue
+			}
+			frame = filteredStub(m.Room, m.Seq)
+		case h.filtering():
+			var m Message
+			if json.Unmarshal(frame, &m) != nil {
+				continue
+			}
+			frame = h.filterFor(c, m, frame)
+		}
+		c.trySend(frame)
+	}
+}
+
+// SyncMiddleware answers sync.request; game is the unwrapped game, which
+// may be a SnapshotGame
+func SyncMiddleware(hub *Hub, game Game) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(c *Client, m Message) {
+			if m.Type != "sync.request" {
+				next(c, m)
+				return
+			}
+			var req struct {
+				Rooms map[string]uint64 `json:"rooms"`
+			}
+			if err := json.Unmarshal(m.Data, &req); err != nil {
+				sendError(c, "bad_data", m.Type, err.Error())
+				return
+			}
+			hub.resync(c, req.Rooms, game)
+		}
+	}
+}
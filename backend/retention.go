@@ -0,0 +1,135 @@
+// backend/retention.go
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+History retention. A quota limit (quota.go) can keep the last N messages
+(maxMessages), the last so many bytes (maxBytes), the last D (maxAge), or
+any mix:
+
+	"quotas": {"room": {"maxMessages": 1000, "maxAge": "720h"}, "pruneEvery": "5m"}
+	PUT /api/admin/quotas/rooms/support  {"maxAge": "168h"}
+
+Counts and sizes are enforced as messages are stored; ages also need the
+clock, so every pruneEvery each game's store is swept room by room
+against the room's limit. (Per-user maxAge is applied when the user next
+posts.) An operator can drop a room's history outright with
+
+	DELETE /api/admin/history/rooms/{room}?game=/ws                 everything
+	DELETE /api/admin/history/rooms/{room}?game=/ws&before=<RFC 3339> older messages only
+*/
+
+const defaultPruneEvery = 5 * time.Minute
+
+// RunRetention prunes every room of the stores stores returns, every
+// q's pruneEvery, forever
+func (q *Quotas) RunRetention(stores func() map[string]HistoryStore) {
+	every := time.Duration(q.defaults.PruneEvery)
+	if every <= 0 {
+		every = defaultPruneEvery
+	}
+	for range time.Tick(every) {
+		for game, store := range stores() {
+			if n, err := q.PruneRooms(store); err != nil {
+				log.Printf("retention %s: %v", game, err)
+			} else if n > 0 {
+				log.Printf("retention %s: pruned %d messages", game, n)
+			}
+		}
+	}
+}
+
+// PruneRooms applies each room's limit to store and returns how many
+// messages it removed
+func (q *Quotas) PruneRooms(store HistoryStore) (int, error) {
+	rooms, err := store.Rooms()
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, room := range rooms {
+		n, err := prune(store, HistoryFilter{Room: room}, q.RoomLimit(room))
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// historyStores returns the stores of the mounted games that keep history
+func historyStores(mounted map[string]*mountedGame) map[string]HistoryStore {
+	out := make(map[string]HistoryStore)
+	for path, mg := range mounted {
+		if mg.history != nil {
+			out[path] = mg.history
+		}
+	}
+	return out
+}
+
+// RegisterRetentionAdmin mounts /api/admin/history/ for the games among
+// mounted
+func RegisterRetentionAdmin(a *AdminAPI, mounted map[string]*mountedGame) {
+	a.Handle("/api/admin/history", func(w http.ResponseWriter, r *http.Request) {
+		games := []string{}
+		for path := range historyStores(mounted) {
+			games = append(games, path)
+		}
+		sort.Strings(games)
+		writeJSON(w, http.StatusOK, map[string][]string{"games": games})
+	})
+	a.Handle("/api/admin/history/rooms/", func(w http.ResponseWriter, r *http.Request) {
+		room := strings.TrimPrefix(r.URL.Path, "/api/admin/history/rooms/")
+		if room == "" {
+			writeJSONError(w, http.StatusNotFound, "want /api/admin/history/rooms/{room}")
+			return
+		}
+		game := r.URL.Query().Get("game")
+		if game == "" {
+			game = "/ws"
+		}
+		mg := mounted[game]
+		if mg == nil || mg.history == nil {
+			writeJSONError(w, http.StatusNotFound, "no history for "+game)
+			return
+		}
+		f := HistoryFilter{Room: room}
+		if s := r.URL.Query().Get("before"); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, "bad before: "+err.Error())
+				return
+			}
+			f.Until = t
+		}
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodDelete:
+			n, err := mg.history.DeleteOldest(f, 0)
+			if err != nil {
+				writeJSONError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			a.audit.Record(adminActor(r), "history.purge", game+" "+room, r.URL.Query().Get("before"))
+			writeJSON(w, http.StatusOK, map[string]int{"deleted": n})
+			return
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, "use GET or DELETE")
+			return
+		}
+		count, bytes, err := mg.history.Usage(f)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"messages": count, "bytes": bytes})
+	})
+}
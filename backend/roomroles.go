@@ -0,0 +1,351 @@
+// backend/roomroles.go
+package main
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+/*
+Room roles. Whoever creates a room (joins it while it's empty) owns it;
+everyone after them joins as a member, or as a spectator if they ask:
+
+	{"type":"room.join","payload":"r1","data":{"as":"spectator"}}
+
+Roles rank owner > moderator > member > spectator. Each permission needs
+a minimum role, by default
+
+	"roomRoles": {"permissions": {"kick":"moderator","topic":"moderator","start":"owner",
+	              "invite":"moderator","chat":"spectator","play":"member"}}
+
+	{"type":"room.role","data":{"user":"<id>","role":"moderator"}}   owner only; "owner" hands the room over
+	{"type":"room.kick","data":{"user":"<id>"}}                      only users ranked below you; they can't rejoin until the room empties
+	{"type":"room.topic","payload":"Finals tonight"}                 broadcast to the room as room.topic
+	{"type":"room.start"}                                            passed on to the game when allowed
+	{"type":"room.info"}                                             owner, topic and roles
+
+"invite" lets non-owners invite to a private room (privaterooms.go).
+"chat" covers the chat types ("message" and "chat" unless "chatTypes" says
+otherwise); "play" covers every other message a game gets, so spectators
+can watch and talk but not move. Users are identified as in presence: user
+id when logged in, else client id. Anyone without a recorded role (say,
+players placed by matchmaking) counts as a member. Roles end when the room
+empties.
+*/
+
+// Role is a member's standing in a room
+type Role int
+
+const (
+	RoleNone Role = iota
+	RoleSpectator
+	RoleMember
+	RoleModerator
+	RoleOwner
+)
+
+var roleNames = []string{"", "spectator", "member", "moderator", "owner"}
+
+func (r Role) String() string { return roleNames[r] }
+
+func (r Role) MarshalJSON() ([]byte, error) { return json.Marshal(r.String()) }
+
+func parseRole(s string) Role {
+	for i, n := range roleNames {
+		if n == s && i > 0 {
+			return Role(i)
+		}
+	}
+	return RoleNone
+}
+
+// RoomRolesConfig is the "roomRoles" config block
+type RoomRolesConfig struct {
+	Permissions map[string]string `json:"permissions,omitempty"` // permission -> minimum role
+	ChatTypes   []string          `json:"chatTypes,omitempty"`
+}
+
+var defaultRoomPermissions = map[string]Role{
+	"kick":   RoleModerator,
+	"topic":  RoleModerator,
+	"start":  RoleOwner,
+	"invite": RoleModerator,
+	"chat":   RoleSpectator,
+	"play":   RoleMember,
+}
+
+type roomACL struct {
+	owner  string
+	topic  string
+	roles  map[string]Role // identity -> role
+	banned map[string]bool
+}
+
+// RoomRoles keeps the roles of one hub's rooms
+type RoomRoles struct {
+	hub       *Hub
+	perms     map[string]Role
+	chatTypes map[string]bool
+
+	mu    sync.Mutex
+	rooms map[string]*roomACL
+}
+
+func NewRoomRoles(hub *Hub, cfg RoomRolesConfig) *RoomRoles {
+	r := &RoomRoles{hub: hub, perms: make(map[string]Role), chatTypes: make(map[string]bool), rooms: make(map[string]*roomACL)}
+	for p, role := range defaultRoomPermissions {
+		r.perms[p] = role
+	}
+	for p, name := range cfg.Permissions {
+		if role := parseRole(name); role != RoleNone {
+			r.perms[p] = role
+		}
+	}
+	if len(cfg.ChatTypes) == 0 {
+		cfg.ChatTypes = []string{"message", "chat"}
+	}
+	for _, t := range cfg.ChatTypes {
+		r.chatTypes[t] = true
+	}
+	hub.events.Subscribe(func(e Event) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		// the room may have been created again since
+		if hub.RoomSize(e.Room) == 0 {
+			delete(r.rooms, e.Room)
+		}
+	}, EventRoomDeleted)
+	return r
+}
+
+// Role returns c's role in room
+func (r *RoomRoles) Role(c *Client, room string) Role {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.roleLocked(r.rooms[room], presenceIdentity(c))
+}
+
+// roleLocked is id's role under acl (which may be nil); requires r.mu
+func (r *RoomRoles) roleLocked(acl *roomACL, id string) Role {
+	if acl != nil {
+		if role, ok := acl.roles[id]; ok {
+			return role
+		}
+	}
+	return RoleMember
+}
+
+// Allowed reports whether c's role in room grants perm
+func (r *RoomRoles) Allowed(c *Client, room, perm string) bool {
+	need, ok := r.perms[perm]
+	return ok && r.Role(c, room) >= need
+}
+
+// join records c having entered room as want ("spectator" or member);
+// whoever enters it empty becomes the owner
+func (r *RoomRoles) join(c *Client, room, want string) {
+	id := presenceIdentity(c)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	acl := r.rooms[room]
+	if acl == nil || r.hub.RoomSize(room) == 1 {
+		r.rooms[room] = &roomACL{owner: id, roles: map[string]Role{id: RoleOwner}, banned: make(map[string]bool)}
+		return
+	}
+	if id == acl.owner {
+		return
+	}
+	if want == "spectator" {
+		acl.roles[id] = RoleSpectator
+	} else if _, ok := acl.roles[id]; !ok {
+		acl.roles[id] = RoleMember
+	}
+}
+
+// setRole changes target's role in room on behalf of c
+func (r *RoomRoles) setRole(c *Client, room, target string, role Role) (Role, bool) {
+	id := presenceIdentity(c)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	acl := r.rooms[room]
+	if acl == nil || acl.owner != id || target == id {
+		return RoleNone, false
+	}
+	if role == RoleOwner {
+		acl.owner = target
+		acl.roles[id] = RoleModerator
+	}
+	acl.roles[target] = role
+	return role, true
+}
+
+// kick bans target from room if c outranks them and may kick
+func (r *RoomRoles) kick(c *Client, room, target string) bool {
+	id := presenceIdentity(c)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	acl := r.rooms[room]
+	if acl == nil {
+		return false
+	}
+	if mine := r.roleLocked(acl, id); mine < r.perms["kick"] || r.roleLocked(acl, target) >= mine {
+		return false
+	}
+	acl.banned[target] = true
+	delete(acl.roles, target)
+	return true
+}
+
+// roomInfo is the room.info reply
+type roomInfo struct {
+	Room  string          `json:"room"`
+	Owner string          `json:"owner"`
+	Topic string          `json:"topic,omitempty"`
+	Roles map[string]Role `json:"roles"`
+	You   Role            `json:"you"`
+}
+
+func (r *RoomRoles) info(c *Client, room string) roomInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	info := roomInfo{Room: room, Roles: map[string]Role{}}
+	if acl := r.rooms[room]; acl != nil {
+		info.Owner, info.Topic = acl.owner, acl.topic
+		for id, role := range acl.roles {
+			info.Roles[id] = role
+		}
+	}
+	info.You = r.roleLocked(r.rooms[room], presenceIdentity(c))
+	return info
+}
+
+// RoomRolesMiddleware handles the room.* role commands and checks joins.
+// It must run before PrivateRoomMiddleware and RoomMiddleware.
+func RoomRolesMiddleware(r *RoomRoles) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(c *Client, m Message) {
+			var req struct {
+				User string `json:"user"`
+				Role string `json:"role"`
+				As   string `json:"as"`
+				Room string `json:"room"`
+			}
+			switch m.Type {
+			case "room.join", "room.role", "room.kick", "room.topic", "room.start", "room.info":
+				if len(m.Data) > 0 {
+					if err := json.Unmarshal(m.Data, &req); err != nil {
+						sendError(c, "bad_data", m.Type, err.Error())
+						return
+					}
+				}
+			default:
+				next(c, m)
+				return
+			}
+			room := r.hub.RoomOf(c)
+			switch m.Type {
+			case "room.join":
+				// checked here, recorded once RoomMiddleware let c in
+				if r.banned(c, m.Payload) {
+					sendErrorReply(c, "room.banned", errorReply{details: map[string]string{"room": m.Payload}}, m.Payload)
+					return
+				}
+				next(c, m)
+				if r.hub.RoomOf(c) == m.Payload {
+					r.join(c, m.Payload, req.As)
+				}
+				return
+			}
+			if room == "" {
+				sendError(c, "room.not_member", m.Type)
+				return
+			}
+			switch m.Type {
+			case "room.info":
+				data, _ := json.Marshal(r.info(c, room))
+				b, _ := json.Marshal(Message{Type: "room.info", Sender: "server", Data: data})
+				c.Send(b)
+			case "room.role":
+				role := parseRole(req.Role)
+				if req.User == "" || role == RoleNone {
+					sendError(c, "room.role_bad", req.Role)
+					return
+				}
+				if _, ok := r.setRole(c, room, req.User, role); !ok {
+					sendError(c, "room.no_permission", m.Type, room)
+					return
+				}
+				for _, t := range r.hub.FindClients(req.User) {
+					if r.hub.RoomOf(t) == room {
+						sendSystem(t, "room.role_changed", room, role.String())
+					}
+				}
+				sendSystem(c, "room.role_set", req.User, role.String())
+			case "room.kick":
+				if req.User == "" || !r.kick(c, room, req.User) {
+					sendError(c, "room.no_permission", m.Type, room)
+					return
+				}
+				removed := 0
+				for _, t := range r.hub.FindClients(req.User) {
+					if r.hub.RoomOf(t) == room {
+						r.hub.LeaveRoom(t)
+						sendSystem(t, "room.kicked", room)
+						removed++
+					}
+				}
+				sendSystem(c, "room.kick_done", req.User, removed)
+			case "room.topic":
+				if !r.Allowed(c, room, "topic") {
+					sendError(c, "room.no_permission", m.Type, room)
+					return
+				}
+				r.mu.Lock()
+				if acl := r.rooms[room]; acl != nil {
+					acl.topic = m.Payload
+				}
+				r.mu.Unlock()
+				r.hub.BroadcastRoom(room, Message{Type: "room.topic", Sender: m.Sender, Payload: m.Payload})
+			case "room.start":
+				if !r.Allowed(c, room, "start") {
+					sendError(c, "room.no_permission", m.Type, room)
+					return
+				}
+				next(c, m)
+			}
+		}
+	}
+}
+
+// banned reports whether c was kicked from room
+func (r *RoomRoles) banned(c *Client, room string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	acl := r.rooms[room]
+	return acl != nil && acl.banned[presenceIdentity(c)] && r.hub.RoomSize(room) > 0
+}
+
+// RoomPermissionMiddleware holds back messages the sender's role doesn't
+// allow: chat types need "chat", everything else "play". It goes after the
+// middleware that handles its own types but before history, so refused
+// messages aren't stored.
+func RoomPermissionMiddleware(r *RoomRoles) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(c *Client, m Message) {
+			room := r.hub.RoomOf(c)
+			if room == "" || m.Type == "history.get" {
+				next(c, m)
+				return
+			}
+			perm := "play"
+			if r.chatTypes[m.Type] {
+				perm = "chat"
+			}
+			if !r.Allowed(c, room, perm) {
+				sendError(c, "room.no_permission", m.Type, room)
+				return
+			}
+			next(c, m)
+		}
+	}
+}
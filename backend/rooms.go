@@ -0,0 +1,162 @@
+// backend/rooms.go
+package main
+
+import "sync"
+
+/*
+Room membership. A client is in at most one room; "" means no room.
+Clients join with {"type":"room.join","payload":"<room>"} and leave with
+{"type":"room.leave"}. Empty rooms are dropped.
+
+Each room has its own lock, so broadcasts to different rooms don't wait
+for each other. The hub's mu guards which rooms exist and every client's
+room; joining and leaving hold it and then the room's lock, so members
+may be read under either. Room broadcasts look the room up and hold only
+its lock while they fan out.
+*/
+
+const maxRoomNameLen = 64
+
+// roomState is one room's members and seq (see envelope.go)
+type roomState struct {
+	mu      sync.Mutex // after Hub.mu when both are held
+	members map[*Client]bool
+	seq     uint64
+	recent  []recentFrame // the last sequenced frames, oldest first, for sync.request
+}
+
+// recentFrame is a sequenced frame kept for replays
+type recentFrame struct {
+	b      []byte
+	except *Client // the sender BroadcastExcept left out, nil = nobody
+}
+
+// room returns the state of room, nil when it has no members
+func (h *Hub) room(room string) *roomState {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.rooms[room]
+}
+
+// JoinRoom moves c into room, leaving its current room first. A client
+// the hub has already removed (see lifecycle.go) joins nothing.
+func (h *Hub) JoinRoom(c *Client, room string) {
+	h.mu.Lock()
+	if _, ok := h.clients[c]; !ok {
+		// nothing would take it out of the room again
+		h.mu.Unlock()
+		return
+	}
+	h.leaveRoomLocked(c)
+	rs, existed := h.rooms[room]
+	if !existed {
+		rs = &roomState{members: make(map[*Client]bool)}
+		h.rooms[room] = rs
+	}
+	rs.mu.Lock()
+	rs.members[c] = true
+	rs.mu.Unlock()
+	c.room = room
+	h.mu.Unlock()
+
+	if !existed {
+		h.events.Publish(Event{Kind: EventRoomCreated, Room: room, Client: c})
+	}
+	h.events.Publish(Event{Kind: EventRoomJoined, Room: room, Client: c})
+}
+
+// LeaveRoom removes c from its current room, if any
+func (h *Hub) LeaveRoom(c *Client) {
+	h.mu.Lock()
+	h.leaveRoomLocked(c)
+	h.mu.Unlock()
+}
+
+// leaveRoomLocked requires h.mu
+func (h *Hub) leaveRoomLocked(c *Client) {
+	if c.room == "" {
+		return
+	}
+	if rs := h.rooms[c.room]; rs != nil {
+		rs.mu.Lock()
+		delete(rs.members, c)
+		empty := len(rs.members) == 0
+		rs.mu.Unlock()
+		if empty {
+			delete(h.rooms, c.room)
+			// Publish never blocks, so it is safe under h.mu
+			h.events.Publish(Event{Kind: EventRoomDeleted, Room: c.room})
+		}
+	}
+	c.room = ""
+}
+
+// RoomOf returns the room c is in ("" if none)
+func (h *Hub) RoomOf(c *Client) string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return c.room
+}
+
+// RoomSize returns the number of members of room
+func (h *Hub) RoomSize(room string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if rs := h.rooms[room]; rs != nil {
+		return len(rs.members)
+	}
+	return 0
+}
+
+// Rooms returns a snapshot of room name -> member count
+func (h *Hub) Rooms() map[string]int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	out := make(map[string]int, len(h.rooms))
+	for name, rs := range h.rooms {
+		out[name] = len(rs.members)
+	}
+	return out
+}
+
+// RoomMiddleware handles room.join / room.leave before the game sees them
+func RoomMiddleware(hub *Hub) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(c *Client, m Message) {
+			switch m.Type {
+			case "room.join":
+				if m.Payload == "" || len(m.Payload) > maxRoomNameLen {
+					sendError(c, "room.name_invalid", m.Type)
+					return
+				}
+				hub.JoinRoom(c, m.Payload)
+				sendSystem(c, "room.joined", m.Payload)
+			case "room.leave":
+				hub.LeaveRoom(c)
+				sendSystem(c, "room.left")
+			default:
+				next(c, m)
+			}
+		}
+	}
+}
+
+// BroadcastRoomRaw sends an already encoded msg to every member of room
+// and returns how many got it, without a seq (see BroadcastRoom). Members
+// with a full send buffer miss the message. msg is shared by every
+// recipient's queue and must not be changed afterwards.
+func (h *Hub) BroadcastRoomRaw(room string, msg []byte) int {
+	rs := h.room(room)
+	if rs == nil {
+		return 0
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	sent := 0
+	for c := range rs.members {
+		if c.trySend(msg) {
+			sent++
+		}
+	}
+	return sent
+}
@@ -0,0 +1,250 @@
+// backend/routing.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+Message routing rules. The "routes" config block sends messages somewhere
+other than (or as well as) their usual destination, without code changes:
+
+	"routes": [
+	  {"direction": "out", "type": "error", "to": ["game", "room:ops"]},
+	  {"type": "report.*", "to": ["webhook:https://mod.example.com/hook"]},
+	  {"type": "chat", "room": "spam", "to": ["drop"]},
+	  {"type": "score", "game": "/ws/quiz", "to": ["game", "events"]}
+	]
+
+A rule matches on direction ("in", the default: messages clients send;
+"out": error and system replies the server sends), type (exact, or a
+prefix ending in "*"), sender (client id or user id; for "out" the client
+the reply is for), room (the client's room) and game (mount path); empty
+fields match anything. The first matching rule wins and the message goes
+to each of its sinks:
+
+	game          where it was going anyway: the game for "in", the
+	              client for "out"; leave it out to divert the message
+	room:NAME     a copy to every member of room NAME of the same game
+	webhook:URL   POSTed as JSON, in the background; failures are logged
+	events        published on the event bus as message.routed, for
+	              subsystems and bridges that subscribe there
+	drop          nowhere (same as an empty list)
+
+Copies are wrapped with where they came from:
+
+	{"type":"routed","sender":"server","data":{"direction":"out","game":"/ws",
+	 "client":"10.0.0.7:51234","user":"alice","room":"r1",
+	 "message":{"type":"error","sender":"server","code":"rules.illegal",...}}}
+
+routed_messages_total counts deliveries by sink.
+*/
+
+// RouteRule is one entry of the "routes" config block
+type RouteRule struct {
+	Direction string   `json:"direction,omitempty"` // in (default) | out
+	Type      string   `json:"type,omitempty"`      // exact, or prefix with a trailing *
+	Sender    string   `json:"sender,omitempty"`    // client or user id
+	Room      string   `json:"room,omitempty"`
+	Game      string   `json:"game,omitempty"` // mount path, e.g. /ws/chat
+	To        []string `json:"to"`
+}
+
+// routeSinks are the sinks a route sends to
+const routeSinks = "game|room:NAME|webhook:URL|events|drop"
+
+// webhookQueueSize bounds routed messages waiting for their webhook
+const webhookQueueSize = 256
+
+// route is a parsed RouteRule
+type route struct {
+	RouteRule
+	game     bool // keeps its usual destination
+	rooms    []string
+	webhooks []string
+	events   bool
+}
+
+func (r *route) matches(dir string, c *Client, m Message) bool {
+	switch {
+	case r.Direction != dir:
+		return false
+	case r.Type != "" && r.Type != m.Type && !(strings.HasSuffix(r.Type, "*") && strings.HasPrefix(m.Type, strings.TrimSuffix(r.Type, "*"))):
+		return false
+	case r.Sender != "" && r.Sender != c.id && r.Sender != c.userID:
+		return false
+	case r.Game != "" && r.Game != c.hub.path:
+		return false
+	case r.Room != "" && r.Room != c.hub.RoomOf(c):
+		return false
+	}
+	return true
+}
+
+// RoutedMessage is the data of a routed copy and the body of its webhook
+type RoutedMessage struct {
+	Direction string  `json:"direction"`
+	Game      string  `json:"game"`
+	Client    string  `json:"client"`
+	User      string  `json:"user,omitempty"`
+	Room      string  `json:"room,omitempty"`
+	Message   Message `json:"message"`
+}
+
+// webhookPost is a routed message waiting for its webhook
+type webhookPost struct {
+	url  string
+	body []byte
+}
+
+// Router applies the routing rules; a nil Router routes nothing
+type Router struct {
+	routes   []route
+	webhooks chan webhookPost
+	client   *http.Client
+	counts   map[string]*Counter // by sink
+}
+
+// NewRouter checks rules and starts the webhook sender if any rule needs it
+func NewRouter(rules []RouteRule) (*Router, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	r := &Router{counts: make(map[string]*Counter)}
+	for _, sink := range []string{"game", "room", "webhook", "events", "drop"} {
+		r.counts[sink] = &Counter{}
+	}
+	for i, rule := range rules {
+		rt := route{RouteRule: rule}
+		switch rt.Direction {
+		case "":
+			rt.Direction = "in"
+		case "in", "out":
+		default:
+			return nil, fmt.Errorf("route %d: direction %q (want in|out)", i, rule.Direction)
+		}
+		for _, to := range rule.To {
+			kind, arg, _ := strings.Cut(to, ":")
+			switch {
+			case to == "game":
+				rt.game = true
+			case to == "events":
+				rt.events = true
+			case to == "drop":
+			case kind == "room" && arg != "":
+				rt.rooms = append(rt.rooms, arg)
+			case kind == "webhook" && (strings.HasPrefix(arg, "http://") || strings.HasPrefix(arg, "https://")):
+				rt.webhooks = append(rt.webhooks, arg)
+			default:
+				return nil, fmt.Errorf("route %d: sink %q (want %s)", i, to, routeSinks)
+			}
+		}
+		if len(rt.webhooks) > 0 && r.webhooks == nil {
+			r.webhooks = make(chan webhookPost, webhookQueueSize)
+			r.client = &http.Client{Timeout: 10 * time.Second}
+			go r.postWebhooks()
+		}
+		r.routes = append(r.routes, rt)
+	}
+	return r, nil
+}
+
+// Register exports routed_messages_total on m
+func (r *Router) Register(m *Metrics) {
+	if r == nil {
+		return
+	}
+	m.Register("routed_messages_total", "messages delivered by routing rules, by sink", "counter", func() []Sample {
+		out := make([]Sample, 0, len(r.counts))
+		for sink, c := range r.counts {
+			out = append(out, Sample{Labels: `sink="` + sink + `"`, Value: float64(c.Value())})
+		}
+		sort.Slice(out, func(i, j int) bool { return out[i].Labels < out[j].Labels })
+		return out
+	})
+}
+
+// route sends m, going dir from or to c, where the first matching rule
+// says and reports whether it should also go its usual way
+func (r *Router) route(dir string, c *Client, m Message) bool {
+	if r == nil {
+		return true
+	}
+	for i := range r.routes {
+		rt := &r.routes[i]
+		if !rt.matches(dir, c, m) {
+			continue
+		}
+		if rt.game {
+			r.counts["game"].Inc()
+		} else if len(rt.rooms)+len(rt.webhooks) == 0 && !rt.events {
+			r.counts["drop"].Inc()
+		}
+		if len(rt.rooms)+len(rt.webhooks) > 0 || rt.events {
+			r.deliver(rt, dir, c, m)
+		}
+		return rt.game
+	}
+	return true
+}
+
+// deliver sends a copy of m to the rooms, webhooks and bus of rt
+func (r *Router) deliver(rt *route, dir string, c *Client, m Message) {
+	rm := RoutedMessage{Direction: dir, Game: c.hub.path, Client: c.id, User: c.userID, Room: c.hub.RoomOf(c), Message: m}
+	data, _ := json.Marshal(rm)
+	if len(rt.rooms) > 0 {
+		b, _ := json.Marshal(Message{Type: "routed", Sender: "server", Data: data})
+		for _, room := range rt.rooms {
+			c.hub.BroadcastRoomRaw(room, b)
+			r.counts["room"].Inc()
+		}
+	}
+	for _, url := range rt.webhooks {
+		select {
+		case r.webhooks <- webhookPost{url: url, body: data}:
+			r.counts["webhook"].Inc()
+		default:
+			log.Printf("routing: webhook queue full, dropped %s for %s", m.Type, url)
+		}
+	}
+	if rt.events {
+		c.hub.events.Publish(Event{Kind: EventMessageRouted, Client: c, Room: rm.Room, Message: &m, Payload: data})
+		r.counts["events"].Inc()
+	}
+}
+
+// postWebhooks sends queued webhook posts one at a time
+func (r *Router) postWebhooks() {
+	for p := range r.webhooks {
+		resp, err := r.client.Post(p.url, "application/json", bytes.NewReader(p.body))
+		if err != nil {
+			log.Printf("routing: webhook %s: %v", p.url, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("routing: webhook %s: %s", p.url, resp.Status)
+		}
+	}
+}
+
+// RouteMiddleware applies the "in" routing rules to client messages
+func RouteMiddleware(r *Router) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		if r == nil {
+			return next
+		}
+		return func(c *Client, m Message) {
+			if r.route("in", c, m) {
+				next(c, m)
+			}
+		}
+	}
+}
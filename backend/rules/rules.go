@@ -0,0 +1,79 @@
+// backend/rules/rules.go
+
+/*
+Package rules holds game rules as pure functions over JSON state, with no
+server dependencies, so the same code runs on the server (authoritative)
+and in the browser compiled to WebAssembly (prediction and instant
+feedback; see rules/wasm).
+
+A Ruleset turns a state and a move into the next state or an error:
+
+	r := rules.Lookup("tictactoe")
+	s, _ := r.Init([]string{"alice", "bob"})
+	s, err := r.Apply(s, rules.Move{Player: "alice", Data: []byte(`{"cell":4}`)})
+	over, winner := r.Result(s)
+
+States and moves are JSON so they cross the JS boundary and the wire
+unchanged.
+*/
+package rules
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// ErrIllegal wraps every rejected move; errors.Is(err, ErrIllegal) tells a
+// rule violation from malformed input
+var ErrIllegal = errors.New("illegal move")
+
+// Move is one player's action
+type Move struct {
+	Player string          `json:"player"`
+	Data   json.RawMessage `json:"data"` // ruleset-specific JSON
+}
+
+// Ruleset is the rules of one game. Implementations must be deterministic
+// and free of I/O so client and server agree.
+type Ruleset interface {
+	Name() string
+	// Init returns the starting state for players, in turn order
+	Init(players []string) ([]byte, error)
+	// Apply validates m against state and returns the next state
+	Apply(state []byte, m Move) ([]byte, error)
+	// Result reports whether the game is over and who won ("" = draw)
+	Result(state []byte) (over bool, winner string)
+}
+
+var (
+	mu       sync.RWMutex
+	registry = make(map[string]Ruleset)
+)
+
+// Register makes r available to Lookup; it replaces a ruleset of the same name
+func Register(r Ruleset) {
+	mu.Lock()
+	defer mu.Unlock()
+	registry[r.Name()] = r
+}
+
+// Lookup returns the ruleset called name, or nil
+func Lookup(name string) Ruleset {
+	mu.RLock()
+	defer mu.RUnlock()
+	return registry[name]
+}
+
+// Names lists the registered rulesets
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	out := make([]string, 0, len(registry))
+	for name := range registry {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,90 @@
+// backend/rules/tictactoe.go
+package rules
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+func init() { Register(TicTacToe{}) }
+
+// TicTacToe is two players on a 3x3 board; moves are {"cell":0..8},
+// cells numbered row by row
+type TicTacToe struct{}
+
+// TicTacToeState is the JSON state of a TicTacToe game
+type TicTacToeState struct {
+	Players [2]string `json:"players"` // X, O
+	Board   [9]string `json:"board"`   // "" | "X" | "O"
+	Turn    int       `json:"turn"`    // index into Players
+	Winner  string    `json:"winner,omitempty"`
+	Over    bool      `json:"over,omitempty"`
+}
+
+var ticTacToeLines = [8][3]int{
+	{0, 1, 2}, {3, 4, 5}, {6, 7, 8},
+	{0, 3, 6}, {1, 4, 7}, {2, 5, 8},
+	{0, 4, 8}, {2, 4, 6},
+}
+
+func (TicTacToe) Name() string { return "tictactoe" }
+
+func (TicTacToe) Init(players []string) ([]byte, error) {
+	if len(players) != 2 || players[0] == players[1] {
+		return nil, errors.New("tictactoe needs two distinct players")
+	}
+	return json.Marshal(TicTacToeState{Players: [2]string{players[0], players[1]}})
+}
+
+func (TicTacToe) Apply(state []byte, m Move) ([]byte, error) {
+	var s TicTacToeState
+	if err := json.Unmarshal(state, &s); err != nil {
+		return nil, fmt.Errorf("tictactoe state: %v", err)
+	}
+	var mv struct {
+		Cell *int `json:"cell"`
+	}
+	if err := json.Unmarshal(m.Data, &mv); err != nil || mv.Cell == nil {
+		return nil, errors.New(`tictactoe move must be {"cell":0..8}`)
+	}
+	switch {
+	case s.Over:
+		return nil, fmt.Errorf("%w: game is over", ErrIllegal)
+	case m.Player != s.Players[s.Turn]:
+		return nil, fmt.Errorf("%w: not your turn", ErrIllegal)
+	case *mv.Cell < 0 || *mv.Cell > 8:
+		return nil, fmt.Errorf("%w: cell %d is off the board", ErrIllegal, *mv.Cell)
+	case s.Board[*mv.Cell] != "":
+		return nil, fmt.Errorf("%w: cell %d is taken", ErrIllegal, *mv.Cell)
+	}
+	mark := "X"
+	if s.Turn == 1 {
+		mark = "O"
+	}
+	s.Board[*mv.Cell] = mark
+	s.Turn = 1 - s.Turn
+	for _, l := range ticTacToeLines {
+		if s.Board[l[0]] == mark && s.Board[l[1]] == mark && s.Board[l[2]] == mark {
+			s.Winner, s.Over = m.Player, true
+		}
+	}
+	if !s.Over {
+		s.Over = true
+		for _, v := range s.Board {
+			if v == "" {
+				s.Over = false
+				break
+			}
+		}
+	}
+	return json.Marshal(s)
+}
+
+func (TicTacToe) Result(state []byte) (bool, string) {
+	var s TicTacToeState
+	if json.Unmarshal(state, &s) != nil {
+		return false, ""
+	}
+	return s.Over, s.Winner
+}
@@ -0,0 +1,95 @@
+// backend/rules/wasm/main.go
+
+//go:build js && wasm
+
+/*
+rules.wasm exposes package rules to the browser:
+
+	GOOS=js GOARCH=wasm go build -o ../frontend/public/rules.wasm ./rules/wasm
+	cp "$(go env GOROOT)/misc/wasm/wasm_exec.js" ../frontend/public/
+
+After loading it (see wasm_exec.js), the page gets a global goRules:
+
+	goRules.names()                              // ["tictactoe"]
+	goRules.init("tictactoe", ["alice", "bob"])  // {state: "..."} or {error: "..."}
+	goRules.apply("tictactoe", state, {player: "alice", data: {cell: 4}})
+	goRules.result("tictactoe", state)           // {over: true, winner: "alice"}
+
+States are JSON strings; a prediction that apply accepts is confirmed or
+corrected by the server's game.state.
+*/
+package main
+
+import (
+	"encoding/json"
+	"syscall/js"
+
+	"github.com/yourusername/tictactoe-server/rules"
+)
+
+func errorResult(msg string) interface{} {
+	return map[string]interface{}{"error": msg}
+}
+
+func lookup(args []js.Value, n int) (rules.Ruleset, interface{}) {
+	if len(args) < n {
+		return nil, errorResult("missing arguments")
+	}
+	r := rules.Lookup(args[0].String())
+	if r == nil {
+		return nil, errorResult("unknown ruleset " + args[0].String())
+	}
+	return r, nil
+}
+
+func main() {
+	js.Global().Set("goRules", js.ValueOf(map[string]interface{}{
+		"names": js.FuncOf(func(js.Value, []js.Value) interface{} {
+			out := []interface{}{}
+			for _, n := range rules.Names() {
+				out = append(out, n)
+			}
+			return out
+		}),
+		"init": js.FuncOf(func(_ js.Value, args []js.Value) interface{} {
+			r, errv := lookup(args, 2)
+			if r == nil {
+				return errv
+			}
+			var players []string
+			for i := 0; i < args[1].Length(); i++ {
+				players = append(players, args[1].Index(i).String())
+			}
+			s, err := r.Init(players)
+			if err != nil {
+				return errorResult(err.Error())
+			}
+			return map[string]interface{}{"state": string(s)}
+		}),
+		"apply": js.FuncOf(func(_ js.Value, args []js.Value) interface{} {
+			r, errv := lookup(args, 3)
+			if r == nil {
+				return errv
+			}
+			var m rules.Move
+			move := js.Global().Get("JSON").Call("stringify", args[2]).String()
+			if err := json.Unmarshal([]byte(move), &m); err != nil {
+				return errorResult(err.Error())
+			}
+			s, err := r.Apply([]byte(args[1].String()), m)
+			if err != nil {
+				return errorResult(err.Error())
+			}
+			return map[string]interface{}{"state": string(s)}
+		}),
+		"result": js.FuncOf(func(_ js.Value, args []js.Value) interface{} {
+			r, errv := lookup(args, 2)
+			if r == nil {
+				return errv
+			}
+			over, winner := r.Result([]byte(args[1].String()))
+			return map[string]interface{}{"over": over, "winner": winner}
+		}),
+	}))
+	select {} // keep the callbacks alive
+}
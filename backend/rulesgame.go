@@ -0,0 +1,193 @@
+// backend/rulesgame.go
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/yourusername/tictactoe-server/rules"
+)
+
+/*
+RulesGame runs a ruleset from package rules authoritatively, one match per
+room. Any registered ruleset name is a game mode (-mode=tictactoe). In a room:
+
+	{"type":"game.start"}                      players are the room's members, caller first
+	{"type":"game.start","data":{"players":["alice","bob"]}}
+	{"type":"game.move","data":{"cell":4}}
+	{"type":"game.state"}                      resend the current state to the caller
+
+Every accepted start or move is broadcast to the room as
+
+	{"type":"game.state","data":{"rules":"tictactoe","state":{...},"over":false}}
+
+Illegal moves get a "rules.illegal" error; clients running the same rules
+as WebAssembly (rules/wasm) can reject them before sending. Finished
+matches are reported to match history.
+*/
+
+type rulesMatch struct {
+	state   []byte
+	players []string
+	started time.Time
+}
+
+type rulesStateData struct {
+	Rules  string          `json:"rules"`
+	State  json.RawMessage `json:"state"`
+	Over   bool            `json:"over"`
+	Winner string          `json:"winner,omitempty"`
+}
+
+// RulesGame hosts one match of a ruleset per room
+type RulesGame struct {
+	hub   *Hub
+	rules rules.Ruleset
+
+	mu      sync.Mutex
+	matches map[string]*rulesMatch // room -> match
+}
+
+func NewRulesGame(h *Hub, r rules.Ruleset) *RulesGame {
+	return &RulesGame{hub: h, rules: r, matches: make(map[string]*rulesMatch)}
+}
+
+func (g *RulesGame) OnConnect(c *Client) {
+	sendSystem(c, "welcome.rules", g.rules.Name())
+}
+
+func (g *RulesGame) OnMessage(c *Client, m Message) {
+	room := g.hub.RoomOf(c)
+	if room == "" {
+		sendError(c, "rules.no_room", m.Type)
+		return
+	}
+	switch m.Type {
+	case "game.start":
+		var req struct {
+			Players []string `json:"players"`
+		}
+		if len(m.Data) > 0 {
+			if err := json.Unmarshal(m.Data, &req); err != nil {
+				sendError(c, "bad_data", m.Type, err.Error())
+				return
+			}
+		}
+		if len(req.Players) == 0 {
+			req.Players = g.roomPlayers(room, c)
+		}
+		state, err := g.rules.Init(req.Players)
+		if err != nil {
+			sendErrorReply(c, "rules.illegal", errorReply{details: map[string]string{"reason": err.Error()}}, m.Type, err.Error())
+			return
+		}
+		g.mu.Lock()
+		g.matches[room] = &rulesMatch{state: state, players: req.Players, started: g.hub.Now()}
+		g.mu.Unlock()
+		g.broadcastState(room, state)
+	case "game.move":
+		g.mu.Lock()
+		match := g.matches[room]
+		if match == nil {
+			g.mu.Unlock()
+			sendError(c, "rules.not_started", m.Type)
+			return
+		}
+		state, err := g.rules.Apply(match.state, rules.Move{Player: presenceIdentity(c), Data: m.Data})
+		if err != nil {
+			g.mu.Unlock()
+			if errors.Is(err, rules.ErrIllegal) {
+				sendErrorReply(c, "rules.illegal", errorReply{details: map[string]string{"reason": err.Error()}}, m.Type, err.Error())
+			} else {
+				sendError(c, "bad_data", m.Type, err.Error())
+			}
+			return
+		}
+		match.state = state
+		over, winner := g.rules.Result(state)
+		if over {
+			delete(g.matches, room)
+		}
+		g.mu.Unlock()
+		g.broadcastState(room, state)
+		if over {
+			g.report(room, match, winner)
+		}
+	case "game.state":
+		g.mu.Lock()
+		match := g.matches[room]
+		g.mu.Unlock()
+		if match == nil {
+			sendError(c, "rules.not_started", m.Type)
+			return
+		}
+		b, _ := json.Marshal(g.stateMessage(match.state))
+		c.Send(b)
+	default:
+		sendError(c, "message.unknown_type", m.Type)
+	}
+}
+
+func (g *RulesGame) OnBinaryMessage(c *Client, data []byte) {
+	sendError(c, "binary.unhandled")
+}
+
+func (g *RulesGame) OnDisconnect(c *Client) {
+	// the match stays; the player may reconnect and continue
+}
+
+// roomPlayers lists the identities in room, first first
+func (g *RulesGame) roomPlayers(room string, first *Client) []string {
+	var others []string
+	if rs := g.hub.room(room); rs != nil {
+		rs.mu.Lock()
+		for c := range rs.members {
+			if c != first {
+				others = append(others, presenceIdentity(c))
+			}
+		}
+		rs.mu.Unlock()
+	}
+	sort.Strings(others)
+	return append([]string{presenceIdentity(first)}, others...)
+}
+
+// SyncSnapshot sends room's match state, if a match is running, after a
+// sync.request
+func (g *RulesGame) SyncSnapshot(c *Client, room string) {
+	g.mu.Lock()
+	match := g.matches[room]
+	g.mu.Unlock()
+	if match != nil {
+		b, _ := json.Marshal(g.stateMessage(match.state))
+		c.Send(b)
+	}
+}
+
+func (g *RulesGame) stateMessage(state []byte) Message {
+	over, winner := g.rules.Result(state)
+	data, _ := json.Marshal(rulesStateData{Rules: g.rules.Name(), State: state, Over: over, Winner: winner})
+	return Message{Type: "game.state", Sender: "server", Data: data}
+}
+
+func (g *RulesGame) broadcastState(room string, state []byte) {
+	g.hub.BroadcastRoom(room, g.stateMessage(state))
+}
+
+func (g *RulesGame) report(room string, match *rulesMatch, winner string) {
+	res := GameResult{Game: g.rules.Name(), Room: room, Started: match.started}
+	for _, p := range match.players {
+		pr := PlayerResult{ID: p, Outcome: "draw", Rank: 1}
+		switch {
+		case winner == p:
+			pr.Outcome, pr.Score = "win", 1
+		case winner != "":
+			pr.Outcome, pr.Rank = "loss", 2
+		}
+		res.Players = append(res.Players, pr)
+	}
+	g.hub.ReportResult(res)
+}
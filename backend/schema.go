@@ -0,0 +1,146 @@
+// backend/schema.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+/*
+Versioned game state. A game whose state outlives the process (saved
+snapshots, recorded captures) will change its structs sooner or later. A
+Schema records the current version and how to get there from each older
+one, one step at a time:
+
+	var boardSchema = NewSchema(3).
+		MigrateState(1, func(v1 json.RawMessage) (json.RawMessage, error) { ...to v2... }).
+		MigrateState(2, func(v2 json.RawMessage) (json.RawMessage, error) { ...to v3... }).
+		MigrateMessage(2, func(m Message) (Message, error) { ...v2 "place" had "pos"... })
+
+	b, err := boardSchema.Marshal(board)     // {"schema":3,"state":{...}}
+	err = boardSchema.Unmarshal(b, &board)   // upgrades v1 and v2 data first
+
+Data without a "schema" field is version 1, so state saved before a game
+had a schema loads as the oldest version. Data newer than the running
+code is refused rather than misread. A game declares its schema by
+implementing SchemaGame; then
+
+  - the state.snapshot messages of a StateSync built WithSchema carry
+    "schema", so clients can tell which shape they got
+  - -record starts each capture run with
+    {"kind":"header","game":"draw","schema":3}, and -replay passes messages
+    recorded under an older schema through the message migrations, so old
+    captures keep replaying after the protocol moves on
+*/
+
+// SchemaGame is a Game whose state and messages are versioned
+type SchemaGame interface {
+	Game
+	Schema() *Schema
+}
+
+// gameSchema returns g's schema, or nil if it has none
+func gameSchema(g Game) *Schema {
+	if sg, ok := g.(SchemaGame); ok {
+		return sg.Schema()
+	}
+	return nil
+}
+
+// Schema is the current version of a game's state and its migrations
+type Schema struct {
+	Version  int
+	state    map[int]func(json.RawMessage) (json.RawMessage, error) // from version -> next
+	messages map[int]func(Message) (Message, error)
+}
+
+// NewSchema starts a schema at version (1 for the first)
+func NewSchema(version int) *Schema {
+	return &Schema{Version: version, state: make(map[int]func(json.RawMessage) (json.RawMessage, error)), messages: make(map[int]func(Message) (Message, error))}
+}
+
+// MigrateState sets how state of version from becomes version from+1
+func (s *Schema) MigrateState(from int, fn func(json.RawMessage) (json.RawMessage, error)) *Schema {
+	s.state[from] = fn
+	return s
+}
+
+// MigrateMessage sets how a client message sent under version from
+// becomes one of version from+1; versions without one pass unchanged
+func (s *Schema) MigrateMessage(from int, fn func(Message) (Message, error)) *Schema {
+	s.messages[from] = fn
+	return s
+}
+
+// versioned is persisted state with its version
+type versioned struct {
+	Schema int             `json:"schema"`
+	State  json.RawMessage `json:"state"`
+}
+
+// Marshal encodes state at the current version
+func (s *Schema) Marshal(state interface{}) ([]byte, error) {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(versioned{Schema: s.Version, State: b})
+}
+
+// Unmarshal decodes data written by Marshal (or unversioned state, as
+// version 1) into state, migrating it to the current version first
+func (s *Schema) Unmarshal(data []byte, state interface{}) error {
+	var v versioned
+	if err := json.Unmarshal(data, &v); err != nil || v.Schema == 0 || v.State == nil {
+		v = versioned{Schema: 1, State: data}
+	}
+	b, err := s.Upgrade(v.Schema, v.State)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, state)
+}
+
+// Upgrade migrates raw state of version from to the current version
+func (s *Schema) Upgrade(from int, raw json.RawMessage) (json.RawMessage, error) {
+	if err := s.check(from); err != nil {
+		return nil, err
+	}
+	for v := from; v < s.Version; v++ {
+		fn := s.state[v]
+		if fn == nil {
+			return nil, fmt.Errorf("schema: no state migration from version %d", v)
+		}
+		var err error
+		if raw, err = fn(raw); err != nil {
+			return nil, fmt.Errorf("schema: migrating state from version %d: %v", v, err)
+		}
+	}
+	return raw, nil
+}
+
+// UpgradeMessage migrates a message sent under version from
+func (s *Schema) UpgradeMessage(from int, m Message) (Message, error) {
+	if err := s.check(from); err != nil {
+		return m, err
+	}
+	for v := from; v < s.Version; v++ {
+		if fn := s.messages[v]; fn != nil {
+			var err error
+			if m, err = fn(m); err != nil {
+				return m, fmt.Errorf("schema: migrating %s from version %d: %v", m.Type, v, err)
+			}
+		}
+	}
+	return m, nil
+}
+
+func (s *Schema) check(from int) error {
+	switch {
+	case from < 1:
+		return fmt.Errorf("schema: bad version %d", from)
+	case from > s.Version:
+		return fmt.Errorf("schema: version %d is newer than this server's %d", from, s.Version)
+	}
+	return nil
+}
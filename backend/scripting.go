@@ -0,0 +1,393 @@
+// backend/scripting.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+/*
+Lua scripting (gopher-lua). Every *.lua file in -scripts is loaded, in name
+order, into one sandboxed state (base, table, string and math libs only; no
+io/os, no dofile/loadfile). The directory is polled and reloaded when a file
+changes; a script that fails to load leaves the previous version running.
+
+Scripts register callbacks in two global tables and may define hooks:
+
+	validators["guess"] = function(client, msg)   -- runs in every mode
+	  if #msg.payload ~= 1 then return false, "guess one letter" end
+	  return true
+	end
+	handlers["guess"] = function(client, msg)     -- runs in -mode=script
+	  broadcast("guess", client.id .. " guessed " .. msg.payload)
+	end
+	function on_connect(client) send(client.id, "system", "hi " .. client.id) end
+	function on_disconnect(client) end
+
+client = {id, user, name, room}; msg = {type, sender, payload, data}.
+Host functions: send(client_id, type, payload), broadcast(type, payload),
+send_binary(client_id, bytes), log(...),
+report_result(game, room, {{id=..., score=..., rank=..., outcome=...}, ...}, started_unix),
+start_timer(room, name, seconds) (calls on_timer(room, name) on expiry),
+cancel_timer(room, name).
+Calls are serialized (one Lua state) and limited to scriptCallTimeout each.
+*/
+
+const (
+	scriptCallTimeout  = 100 * time.Millisecond
+	scriptPollInterval = 2 * time.Second
+)
+
+// ScriptEngine owns the Lua state and reloads it from dir
+type ScriptEngine struct {
+	dir   string
+	hub   *Hub
+	audit *AuditLog
+
+	mu  sync.Mutex
+	L   *lua.LState
+	sig string // file names, sizes and mtimes of the loaded set
+}
+
+func NewScriptEngine(dir string, hub *Hub) (*ScriptEngine, error) {
+	e := &ScriptEngine{dir: dir, hub: hub}
+	sig, err := e.signature()
+	if err != nil {
+		return nil, err
+	}
+	L, err := e.load()
+	if err != nil {
+		return nil, err
+	}
+	e.L, e.sig = L, sig
+	return e, nil
+}
+
+// signature summarizes the script files so changes can be detected cheaply
+func (e *ScriptEngine) signature() (string, error) {
+	files, err := filepath.Glob(filepath.Join(e.dir, "*.lua"))
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(files)
+	var b strings.Builder
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "%s:%d:%d;", f, info.Size(), info.ModTime().UnixNano())
+	}
+	return b.String(), nil
+}
+
+// load builds a fresh sandboxed state with every script executed
+func (e *ScriptEngine) load() (*lua.LState, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, unsafe := range []string{"dofile", "loadfile", "load", "loadstring", "collectgarbage"} {
+		L.SetGlobal(unsafe, lua.LNil)
+	}
+	L.SetGlobal("handlers", L.NewTable())
+	L.SetGlobal("validators", L.NewTable())
+	L.SetGlobal("send", L.NewFunction(e.luaSend))
+	L.SetGlobal("broadcast", L.NewFunction(e.luaBroadcast))
+	L.SetGlobal("send_binary", L.NewFunction(e.luaSendBinary))
+	L.SetGlobal("report_result", L.NewFunction(e.luaReportResult))
+	L.SetGlobal("start_timer", L.NewFunction(e.luaStartTimer))
+	L.SetGlobal("cancel_timer", L.NewFunction(e.luaCancelTimer))
+	L.SetGlobal("log", L.NewFunction(luaLog))
+
+	files, err := filepath.Glob(filepath.Join(e.dir, "*.lua"))
+	if err != nil {
+		L.Close()
+		return nil, err
+	}
+	sort.Strings(files)
+	for _, f := range files {
+		src, err := os.ReadFile(f)
+		if err != nil {
+			L.Close()
+			return nil, err
+		}
+		fn, err := L.Load(strings.NewReader(string(src)), filepath.Base(f))
+		if err != nil {
+			L.Close()
+			return nil, err
+		}
+		L.Push(fn)
+		if err := e.pcall(L, 0, 0); err != nil {
+			L.Close()
+			return nil, fmt.Errorf("%s: %v", filepath.Base(f), err)
+		}
+	}
+	log.Printf("scripts: loaded %d file(s) from %s", len(files), e.dir)
+	return L, nil
+}
+
+// Watch reloads the scripts whenever the directory contents change
+func (e *ScriptEngine) Watch() {
+	ticker := time.NewTicker(scriptPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		sig, err := e.signature()
+		if err != nil {
+			log.Println("scripts:", err)
+			continue
+		}
+		e.mu.Lock()
+		unchanged := sig == e.sig
+		e.mu.Unlock()
+		if unchanged {
+			continue
+		}
+		L, err := e.load()
+		e.mu.Lock()
+		e.sig = sig // don't retry a broken set until it changes again
+		if err != nil {
+			e.mu.Unlock()
+			log.Println("scripts: reload failed, keeping previous version:", err)
+			e.audit.Record("system", "scripts.reload", e.dir, "failed: "+err.Error())
+			continue
+		}
+		old := e.L
+		e.L = L
+		e.mu.Unlock()
+		old.Close()
+		e.audit.Record("system", "scripts.reload", e.dir, "ok")
+	}
+}
+
+// pcall runs the function on the stack with a time limit
+func (e *ScriptEngine) pcall(L *lua.LState, nargs, nret int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), scriptCallTimeout)
+	defer cancel()
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+	return L.PCall(nargs, nret, nil)
+}
+
+// callback looks up a function in a global table ("" = a global function)
+func callback(L *lua.LState, table, name string) *lua.LFunction {
+	var v lua.LValue
+	if table == "" {
+		v = L.GetGlobal(name)
+	} else if t, ok := L.GetGlobal(table).(*lua.LTable); ok {
+		v = t.RawGetString(name)
+	}
+	fn, _ := v.(*lua.LFunction)
+	return fn
+}
+
+func clientTable(L *lua.LState, c *Client) *lua.LTable {
+	t := L.NewTable()
+	t.RawSetString("id", lua.LString(c.id))
+	t.RawSetString("user", lua.LString(c.userID))
+	t.RawSetString("name", lua.LString(c.name))
+	t.RawSetString("room", lua.LString(c.hub.RoomOf(c)))
+	return t
+}
+
+func messageTable(L *lua.LState, m Message) *lua.LTable {
+	t := L.NewTable()
+	t.RawSetString("type", lua.LString(m.Type))
+	t.RawSetString("sender", lua.LString(m.Sender))
+	t.RawSetString("payload", lua.LString(m.Payload))
+	t.RawSetString("data", lua.LString(m.Data))
+	return t
+}
+
+// Validate runs validators[m.Type]; no validator means the message is allowed
+func (e *ScriptEngine) Validate(c *Client, m Message) (bool, string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	fn := callback(e.L, "validators", m.Type)
+	if fn == nil {
+		return true, ""
+	}
+	e.L.Push(fn)
+	e.L.Push(clientTable(e.L, c))
+	e.L.Push(messageTable(e.L, m))
+	if err := e.pcall(e.L, 2, 2); err != nil {
+		log.Printf("scripts: validators[%q]: %v", m.Type, err)
+		return false, "rejected: validation script failed"
+	}
+	ok, reason := lua.LVAsBool(e.L.Get(-2)), lua.LVAsString(e.L.Get(-1))
+	e.L.Pop(2)
+	if !ok && reason == "" {
+		reason = "rejected by game rules"
+	}
+	return ok, reason
+}
+
+// invoke calls a hook with (client[, msg]) and reports whether it existed
+func (e *ScriptEngine) invoke(table, name string, c *Client, m *Message) (bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	fn := callback(e.L, table, name)
+	if fn == nil {
+		return false, nil
+	}
+	e.L.Push(fn)
+	e.L.Push(clientTable(e.L, c))
+	nargs := 1
+	if m != nil {
+		e.L.Push(messageTable(e.L, *m))
+		nargs = 2
+	}
+	return true, e.pcall(e.L, nargs, 0)
+}
+
+func (e *ScriptEngine) luaSend(L *lua.LState) int {
+	id, typ, payload := L.CheckString(1), L.CheckString(2), L.OptString(3, "")
+	b, _ := json.Marshal(Message{Type: typ, Sender: "server", Payload: payload})
+	n := 0
+	for _, c := range e.hub.FindClients(id) {
+		if c.trySend(b) {
+			n++
+		}
+	}
+	L.Push(lua.LNumber(n))
+	return 1
+}
+
+func (e *ScriptEngine) luaBroadcast(L *lua.LState) int {
+	typ, payload := L.CheckString(1), L.OptString(2, "")
+	e.hub.BroadcastGlobal(Message{Type: typ, Sender: "server", Payload: payload})
+	return 0
+}
+
+func (e *ScriptEngine) luaReportResult(L *lua.LState) int {
+	r := GameResult{Game: L.CheckString(1), Room: L.OptString(2, "")}
+	L.CheckTable(3).ForEach(func(_, v lua.LValue) {
+		t, ok := v.(*lua.LTable)
+		if !ok {
+			return
+		}
+		r.Players = append(r.Players, PlayerResult{
+			ID:      lua.LVAsString(t.RawGetString("id")),
+			Name:    lua.LVAsString(t.RawGetString("name")),
+			Score:   float64(lua.LVAsNumber(t.RawGetString("score"))),
+			Rank:    int(lua.LVAsNumber(t.RawGetString("rank"))),
+			Outcome: lua.LVAsString(t.RawGetString("outcome")),
+		})
+	})
+	if started := L.OptNumber(4, 0); started > 0 {
+		r.Started = time.Unix(int64(started), 0)
+	}
+	e.hub.ReportResult(r)
+	return 0
+}
+
+func (e *ScriptEngine) luaStartTimer(L *lua.LState) int {
+	room, name, secs := L.CheckString(1), L.CheckString(2), L.CheckNumber(3)
+	e.hub.timers.Start(room, name, time.Duration(float64(secs)*float64(time.Second)), func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		fn := callback(e.L, "", "on_timer")
+		if fn == nil {
+			return
+		}
+		e.L.Push(fn)
+		e.L.Push(lua.LString(room))
+		e.L.Push(lua.LString(name))
+		if err := e.pcall(e.L, 2, 0); err != nil {
+			log.Println("scripts: on_timer:", err)
+		}
+	})
+	return 0
+}
+
+func (e *ScriptEngine) luaCancelTimer(L *lua.LState) int {
+	L.Push(lua.LBool(e.hub.timers.Cancel(L.CheckString(1), L.CheckString(2))))
+	return 1
+}
+
+func luaLog(L *lua.LState) int {
+	parts := make([]string, 0, L.GetTop())
+	for i := 1; i <= L.GetTop(); i++ {
+		parts = append(parts, L.ToStringMeta(L.Get(i)).String())
+	}
+	log.Println("script:", strings.Join(parts, " "))
+	return 0
+}
+
+// ScriptValidationMiddleware rejects messages that fail a Lua validator
+func ScriptValidationMiddleware(e *ScriptEngine) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(c *Client, m Message) {
+			if ok, reason := e.Validate(c, m); !ok {
+				sendErrorReply(c, "script.rejected", errorReply{details: map[string]string{"reason": reason}}, m.Type, reason)
+				return
+			}
+			next(c, m)
+		}
+	}
+}
+
+// ScriptGame is a Game whose logic lives entirely in Lua (-mode=script)
+type ScriptGame struct {
+	engine *ScriptEngine
+}
+
+func NewScriptGame(e *ScriptEngine) *ScriptGame { return &ScriptGame{engine: e} }
+
+func (g *ScriptGame) OnConnect(c *Client) {
+	if _, err := g.engine.invoke("", "on_connect", c, nil); err != nil {
+		log.Println("scripts: on_connect:", err)
+	}
+}
+
+func (g *ScriptGame) OnMessage(c *Client, msg Message) {
+	found, err := g.engine.invoke("handlers", msg.Type, c, &msg)
+	if !found {
+		found, err = g.engine.invoke("handlers", "*", c, &msg)
+	}
+	switch {
+	case err != nil:
+		log.Printf("scripts: handlers[%q]: %v", msg.Type, err)
+		sendError(c, "script.error", msg.Type)
+	case !found:
+		sendError(c, "message.unknown_type", msg.Type)
+	}
+}
+
+func (g *ScriptGame) OnBinaryMessage(c *Client, data []byte) {
+	msg := Message{Type: "binary", Sender: c.id, Payload: string(data)}
+	found, err := g.engine.invoke("handlers", "binary", c, &msg)
+	switch {
+	case err != nil:
+		log.Printf("scripts: handlers[\"binary\"]: %v", err)
+		sendError(c, "script.error", "binary")
+	case !found:
+		sendError(c, "binary.unhandled")
+	}
+}
+
+func (g *ScriptGame) OnDisconnect(c *Client) {
+	if _, err := g.engine.invoke("", "on_disconnect", c, nil); err != nil {
+		log.Println("scripts: on_disconnect:", err)
+	}
+}
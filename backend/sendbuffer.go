@@ -0,0 +1,197 @@
+// backend/sendbuffer.go
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+Send-buffer accounting. Every client's send channel is sampled once a
+second; the peak occupancy seen since the last sample feeds the
+ws_send_buffer_occupancy summary (p50/p90/p99 across clients, as a
+fraction of each client's limit) and, with "adaptive": true, per-client
+sizing:
+
+	"sendBuffer": {"size": 256, "adaptive": true, "min": 32, "max": 2048}
+
+A client that peaks above 3/4 of its limit (typically a spectator of a
+busy room) has the limit doubled up to max; one that stays under 1/8 for
+sendBufferIdleTicks samples (an idle chat) has it halved down to min.
+Channels are allocated at max, so the limit is enforced by trySend rather
+than by the channel capacity; max bounds the per-client memory.
+*/
+
+const (
+	sendBufferSampleInterval = time.Second
+	sendBufferIdleTicks      = 30
+)
+
+// SendBufferConfig is the "sendBuffer" block of the config file
+type SendBufferConfig struct {
+	Size     int  `json:"size,omitempty"` // initial limit, default 256
+	Adaptive bool `json:"adaptive,omitempty"`
+	Min      int  `json:"min,omitempty"` // default 32
+	Max      int  `json:"max,omitempty"` // default 2048
+}
+
+func (cfg SendBufferConfig) withDefaults() SendBufferConfig {
+	if cfg.Size <= 0 {
+		cfg.Size = 256
+	}
+	if !cfg.Adaptive {
+		cfg.Min, cfg.Max = cfg.Size, cfg.Size
+		return cfg
+	}
+	if cfg.Min <= 0 {
+		cfg.Min = 32
+	}
+	if cfg.Max <= 0 {
+		cfg.Max = 2048
+	}
+	if cfg.Min > cfg.Size {
+		cfg.Min = cfg.Size
+	}
+	if cfg.Max < cfg.Size {
+		cfg.Max = cfg.Size
+	}
+	return cfg
+}
+
+// trySend queues msg unless c is at its send limit or unregistered
+func (c *Client) trySend(msg []byte) bool {
+	if c.Closed() {
+		return false
+	}
+	if len(c.send) >= int(c.sendLimit.Load()) {
+		c.hub.sendBuffers.full.Inc()
+		return false
+	}
+	select {
+	case c.send <- msg:
+		n := int32(len(c.send))
+		for {
+			peak := c.sendPeak.Load()
+			if n <= peak || c.sendPeak.CompareAndSwap(peak, n) {
+				break
+			}
+		}
+		return true
+	default:
+		c.hub.sendBuffers.full.Inc()
+		return false
+	}
+}
+
+// SendBuffers samples client send channels and resizes their limits
+type SendBuffers struct {
+	cfg SendBufferConfig
+
+	full   Counter // sends refused because the client was at its limit
+	grown  Counter
+	shrunk Counter
+
+	mu        sync.Mutex
+	quantiles [3]float64 // p50, p90, p99 of the last sample
+}
+
+func NewSendBuffers(cfg SendBufferConfig) *SendBuffers {
+	return &SendBuffers{cfg: cfg.withDefaults()}
+}
+
+// newSendChan makes a channel for a new client and returns its initial limit
+func (s *SendBuffers) newSendChan() (chan []byte, int32) {
+	return make(chan []byte, s.cfg.Max), int32(s.cfg.Size)
+}
+
+// Register exposes the send-buffer metrics
+func (s *SendBuffers) Register(m *Metrics) {
+	m.Register("ws_send_buffer_occupancy", "peak send-buffer fill per client over the last second, as a fraction of its limit", "summary", func() []Sample {
+		s.mu.Lock()
+		q := s.quantiles
+		s.mu.Unlock()
+		return []Sample{
+			{Labels: `quantile="0.5"`, Value: q[0]},
+			{Labels: `quantile="0.9"`, Value: q[1]},
+			{Labels: `quantile="0.99"`, Value: q[2]},
+		}
+	})
+	m.Register("ws_send_buffer_full_total", "messages not queued because the client's send buffer was full", "counter", func() []Sample {
+		return []Sample{{Value: float64(s.full.Value())}}
+	})
+	m.Register("ws_send_buffer_resizes_total", "adaptive send-buffer limit changes", "counter", func() []Sample {
+		return []Sample{
+			{Labels: `direction="grow"`, Value: float64(s.grown.Value())},
+			{Labels: `direction="shrink"`, Value: float64(s.shrunk.Value())},
+		}
+	})
+}
+
+// Run samples the clients of hubs until the process exits
+func (s *SendBuffers) Run(hubs ...*Hub) {
+	ticker := time.NewTicker(sendBufferSampleInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		var fills []float64
+		for _, h := range hubs {
+			fills = s.sample(h, fills)
+		}
+		s.summarize(fills)
+	}
+}
+
+// sample resizes h's clients and appends their fill fractions to fills
+func (s *SendBuffers) sample(h *Hub, fills []float64) []float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		limit := c.sendLimit.Load()
+		peak := c.sendPeak.Swap(int32(len(c.send)))
+		fills = append(fills, float64(peak)/float64(limit))
+		if !s.cfg.Adaptive {
+			continue
+		}
+		switch {
+		case peak >= limit*3/4 && int(limit) < s.cfg.Max:
+			limit *= 2
+			if int(limit) > s.cfg.Max {
+				limit = int32(s.cfg.Max)
+			}
+			c.sendLimit.Store(limit)
+			c.sendIdle = 0
+			s.grown.Inc()
+		case peak < limit/8 && int(limit) > s.cfg.Min:
+			if c.sendIdle++; c.sendIdle >= sendBufferIdleTicks {
+				limit /= 2
+				if int(limit) < s.cfg.Min {
+					limit = int32(s.cfg.Min)
+				}
+				c.sendLimit.Store(limit)
+				c.sendIdle = 0
+				s.shrunk.Inc()
+			}
+		default:
+			c.sendIdle = 0
+		}
+	}
+	return fills
+}
+
+func (s *SendBuffers) summarize(fills []float64) {
+	var q [3]float64
+	if len(fills) > 0 {
+		sort.Float64s(fills)
+		for i, p := range []float64{0.5, 0.9, 0.99} {
+			q[i] = fills[int(p*float64(len(fills)-1))]
+		}
+	}
+	s.mu.Lock()
+	s.quantiles = q
+	s.mu.Unlock()
+}
+
+func (s *SendBuffers) String() string {
+	return fmt.Sprintf("size=%d adaptive=%v min=%d max=%d", s.cfg.Size, s.cfg.Adaptive, s.cfg.Min, s.cfg.Max)
+}
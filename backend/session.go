@@ -0,0 +1,239 @@
+// backend/session.go
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Session tokens are compact HS256 JWTs signed with the server's secret.
+They are issued by /auth/callback and presented on the WebSocket handshake
+either as ?token=<jwt>, as an "Authorization: Bearer <jwt>" header or,
+from browsers, in the encrypted session cookie (sessioncookie.go).
+Each token has its own session id (jti); revoking one session or every
+session of a user (usersessions.go) is recorded in -revoked-sessions and
+makes Verify reject the affected tokens until they would have expired.
+*/
+
+var (
+	errInvalidToken = errors.New("invalid session token")
+	errExpiredToken = errors.New("session token expired")
+	errRevokedToken = errors.New("session revoked")
+)
+
+// SessionClaims is the JWT payload
+type SessionClaims struct {
+	Sub    string            `json:"sub"`            // user id
+	Name   string            `json:"name,omitempty"` // display name
+	Iat    int64             `json:"iat"`
+	Exp    int64             `json:"exp"`
+	Jti    string            `json:"jti,omitempty"`    // session id
+	Tenant string            `json:"tenant,omitempty"` // from external issuers; labels load metrics
+	Tags   map[string]string `json:"tags,omitempty"`   // connection tags (see tags.go)
+}
+
+// Tenant is the tenant of c's session token, or ""
+func (c *Client) Tenant() string {
+	if c.claims == nil {
+		return ""
+	}
+	return c.claims.Tenant
+}
+
+// SessionManager issues and verifies session tokens
+type SessionManager struct {
+	secret []byte
+	ttl    time.Duration
+	cookie cipher.AEAD // seals tokens in session cookies
+
+	mu      sync.Mutex
+	path    string // "" keeps revocations in memory only
+	revoked sessionRevocations
+}
+
+// sessionRevocations is what the revocation file stores
+type sessionRevocations struct {
+	Sessions map[string]int64          `json:"sessions"` // jti -> token expiry, dropped after it
+	Users    map[string]userRevocation `json:"users"`
+}
+
+// userRevocation voids a user's tokens issued up to At, except Keep
+type userRevocation struct {
+	At   int64  `json:"at"`
+	Keep string `json:"keep,omitempty"` // jti of the session that asked
+}
+
+// NewSessionManager uses secret if set, otherwise a random per-process key
+// (tokens then stop validating after a restart).
+func NewSessionManager(secret string, ttl time.Duration) (*SessionManager, error) {
+	key := []byte(secret)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	aead, err := newCookieAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &SessionManager{secret: key, ttl: ttl, cookie: aead, revoked: sessionRevocations{Sessions: make(map[string]int64), Users: make(map[string]userRevocation)}}, nil
+}
+
+// LoadRevocations reads revoked sessions from path (a missing file is
+// none) and saves later revocations there
+func (s *SessionManager) LoadRevocations(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.path = path
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var rev sessionRevocations
+	if err := json.Unmarshal(b, &rev); err != nil {
+		return err
+	}
+	for jti, exp := range rev.Sessions {
+		s.revoked.Sessions[jti] = exp
+	}
+	for user, u := range rev.Users {
+		s.revoked.Users[user] = u
+	}
+	return nil
+}
+
+// RevokeSession voids the token with session id jti
+func (s *SessionManager) RevokeSession(jti string, exp int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revoked.Sessions[jti] = exp
+	return s.saveLocked()
+}
+
+// RevokeUser voids every token issued to userID so far except the
+// session keep ("" for none)
+func (s *SessionManager) RevokeUser(userID, keep string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revoked.Users[userID] = userRevocation{At: time.Now().Unix(), Keep: keep}
+	return s.saveLocked()
+}
+
+// saveLocked drops revocations of expired tokens and writes the file;
+// caller holds s.mu
+func (s *SessionManager) saveLocked() error {
+	now := time.Now().Unix()
+	for jti, exp := range s.revoked.Sessions {
+		if exp <= now {
+			delete(s.revoked.Sessions, jti)
+		}
+	}
+	for user, u := range s.revoked.Users {
+		if u.At+int64(s.ttl/time.Second) <= now {
+			delete(s.revoked.Users, user)
+		}
+	}
+	if s.path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(s.revoked, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, b)
+}
+
+// isRevoked reports whether claims belong to a revoked session
+func (s *SessionManager) isRevoked(claims *SessionClaims) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.revoked.Sessions[claims.Jti]; ok && claims.Jti != "" {
+		return true
+	}
+	u, ok := s.revoked.Users[claims.Sub]
+	return ok && claims.Iat <= u.At && (u.Keep == "" || claims.Jti != u.Keep)
+}
+
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// Issue returns a signed token for u
+func (s *SessionManager) Issue(u *User) (string, error) {
+	now := time.Now()
+	jti := make([]byte, 8)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	claims := SessionClaims{Sub: u.ID, Name: u.Name, Iat: now.Unix(), Exp: now.Add(s.ttl).Unix(), Jti: hex.EncodeToString(jti)}
+	body, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(body)
+	return unsigned + "." + s.sign(unsigned), nil
+}
+
+// Verify checks the signature and expiry and returns the claims
+func (s *SessionManager) Verify(token string) (*SessionClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return nil, errInvalidToken
+	}
+	want := s.sign(parts[0] + "." + parts[1])
+	if !hmac.Equal([]byte(want), []byte(parts[2])) {
+		return nil, errInvalidToken
+	}
+	body, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	var claims SessionClaims
+	if err := json.Unmarshal(body, &claims); err != nil || claims.Sub == "" {
+		return nil, errInvalidToken
+	}
+	if time.Now().Unix() >= claims.Exp {
+		return nil, errExpiredToken
+	}
+	if s.isRevoked(&claims) {
+		return nil, errRevokedToken
+	}
+	return &claims, nil
+}
+
+// FromRequest verifies the token carried by r, if any, falling back to
+// the session cookie. Returns (nil, nil) for anonymous requests.
+func (s *SessionManager) FromRequest(r *http.Request) (*SessionClaims, error) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		token = bearerToken(r)
+	}
+	if token != "" {
+		return s.Verify(token)
+	}
+	claims := s.fromCookie(r)
+	if claims != nil && !sameOrigin(r) {
+		return nil, errCookieOrigin
+	}
+	return claims, nil
+}
+
+func (s *SessionManager) sign(unsigned string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(unsigned))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,162 @@
+// backend/sessioncookie.go
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+/*
+Cookie sessions. A token in ?token= ends up in proxy logs, browser history
+and Referer headers; browsers can instead keep the session in a cookie
+that page scripts can't read. /auth/callback sets it, and so does
+
+	POST   /auth/session   Authorization: Bearer <jwt>    swap a token for the cookie
+	GET    /auth/session   {"user":"google:123","name":"Ann","expires":"..."} or 401
+	DELETE /auth/session   log out: the session is revoked and the cookie cleared
+
+The cookie holds the session token sealed with AES-GCM under a key derived
+from the signing secret, and is HttpOnly, SameSite=Lax and Secure when the
+request came over TLS (directly or per X-Forwarded-Proto). The WebSocket
+handshake falls back to it when there is no ?token= or Authorization
+header, but only from a page of the same origin: any site can open a
+websocket to this server, and the browser would send the cookie along.
+An unreadable, expired or revoked cookie leaves the client anonymous.
+*/
+
+const sessionCookie = "session"
+
+var errCookieOrigin = errors.New("cookie sessions are only accepted from the same origin")
+
+// newCookieAEAD derives the cookie cipher from the signing secret
+func newCookieAEAD(secret []byte) (cipher.AEAD, error) {
+	key := sha256.Sum256(append([]byte("session cookie\x00"), secret...))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// SetCookie stores token in the session cookie of w
+func (s *SessionManager) SetCookie(w http.ResponseWriter, r *http.Request, token string) error {
+	nonce := make([]byte, s.cookie.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := s.cookie.Seal(nonce, nonce, []byte(token), []byte(sessionCookie))
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    base64.RawURLEncoding.EncodeToString(sealed),
+		Path:     "/",
+		MaxAge:   int(s.ttl / time.Second),
+		HttpOnly: true,
+		Secure:   secureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// ClearCookie removes the session cookie
+func (s *SessionManager) ClearCookie(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1, HttpOnly: true, Secure: secureRequest(r), SameSite: http.SameSiteLaxMode})
+}
+
+// fromCookie returns the claims of r's session cookie, nil if there is
+// none or it isn't valid (anymore)
+func (s *SessionManager) fromCookie(r *http.Request) *SessionClaims {
+	ck, err := r.Cookie(sessionCookie)
+	if err != nil || ck.Value == "" {
+		return nil
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(ck.Value)
+	n := s.cookie.NonceSize()
+	if err != nil || len(sealed) < n {
+		return nil
+	}
+	token, err := s.cookie.Open(nil, sealed[:n], sealed[n:], []byte(sessionCookie))
+	if err != nil {
+		return nil
+	}
+	claims, err := s.Verify(string(token))
+	if err != nil {
+		return nil
+	}
+	return claims
+}
+
+// sameOrigin reports whether r comes from a page served by this host;
+// requests without an Origin header aren't from a browser page
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// secureRequest reports whether r reached us (or our proxy) over TLS
+func secureRequest(r *http.Request) bool {
+	return r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header
+func bearerToken(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimPrefix(h, "Bearer ")
+	}
+	return ""
+}
+
+// HandleSession serves /auth/session
+func (s *SessionManager) HandleSession(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		token := bearerToken(r)
+		claims, err := s.Verify(token)
+		if err != nil {
+			writeJSONError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if err := s.SetCookie(w, r, token); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "internal error")
+			return
+		}
+		writeJSON(w, http.StatusOK, sessionInfo(claims))
+	case http.MethodGet:
+		claims := s.fromCookie(r)
+		if claims == nil {
+			writeJSONError(w, http.StatusUnauthorized, "not logged in")
+			return
+		}
+		writeJSON(w, http.StatusOK, sessionInfo(claims))
+	case http.MethodDelete:
+		if !sameOrigin(r) {
+			writeJSONError(w, http.StatusForbidden, errCookieOrigin.Error())
+			return
+		}
+		if claims := s.fromCookie(r); claims != nil && claims.Jti != "" {
+			if err := s.RevokeSession(claims.Jti, claims.Exp); err != nil {
+				writeJSONError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+		s.ClearCookie(w, r)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "use GET, POST or DELETE")
+	}
+}
+
+func sessionInfo(c *SessionClaims) map[string]interface{} {
+	return map[string]interface{}{"user": c.Sub, "name": c.Name, "expires": time.Unix(c.Exp, 0).UTC()}
+}
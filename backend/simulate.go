@@ -0,0 +1,133 @@
+// backend/simulate.go
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+Deterministic simulation, for regression tests of multi-player game
+flows. A scenario is a capture (see capture.go) written by hand, with t
+as virtual time:
+
+	{"kind":"header","game":"trivia","seed":7}
+	{"t":0,"kind":"connect","client":"a","user":"alice"}
+	{"t":0,"kind":"connect","client":"b","user":"bob"}
+	{"t":10,"kind":"message","client":"a","msg":{"type":"room.join","payload":"r1"}}
+	{"t":10,"kind":"message","client":"b","msg":{"type":"room.join","payload":"r1"}}
+	{"t":20,"kind":"message","client":"a","msg":{"type":"trivia.start"}}
+	{"t":3020,"kind":"message","client":"b","msg":{"type":"answer","payload":"4"}}
+	{"t":60000,"kind":"wait"}
+
+	tictactoe-server -mode trivia -simulate scenario.jsonl [-simulate-expect golden.log]
+
+runs it like -replay, except that the game's clock is virtual. It starts
+at SimEpoch and only moves to the next event's t, firing the timers that
+come due on the way (hub.timers, Lua start_timer) one at a time, in
+deadline order, so countdowns expire, rounds end and time-based scores
+come out the same on every run. "wait" events only move the clock. The
+header's seed seeds math/rand, for games that shuffle. The log has one
+line per message a client received:
+
+	<step> <t> <client> <message>
+
+step is the event that caused it (for timer output, the last event
+before), t the virtual time in ms. Ids and timestamps are removed as with
+-replay; -simulate-expect compares the log with a golden one.
+*/
+
+// Clock is where Timers, and games through Hub.Now, get the time
+type Clock interface {
+	Now() time.Time
+	// AfterFunc runs f once d has passed; stop cancels it
+	AfterFunc(d time.Duration, f func()) (stop func() bool)
+}
+
+type wallClock struct{}
+
+func (wallClock) Now() time.Time { return time.Now() }
+
+func (wallClock) AfterFunc(d time.Duration, f func()) func() bool { return time.AfterFunc(d, f).Stop }
+
+// Now is the hub's time: the wall clock, or a simulation's
+func (h *Hub) Now() time.Time { return h.timers.clock.Now() }
+
+// SimEpoch is where simulated time starts
+var SimEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// SimClock is a Clock that only moves when told to
+type SimClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	seq     int // orders callbacks due at the same time
+	pending []*simTimer
+}
+
+type simTimer struct {
+	when time.Time
+	seq  int
+	f    func()
+	done bool // fired or stopped
+}
+
+func NewSimClock() *SimClock { return &SimClock{now: SimEpoch} }
+
+func (s *SimClock) Now() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.now
+}
+
+func (s *SimClock) AfterFunc(d time.Duration, f func()) func() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := &simTimer{when: s.now.Add(d), seq: s.seq, f: f}
+	s.seq++
+	s.pending = append(s.pending, t)
+	return func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		stopped := !t.done
+		t.done = true
+		return stopped
+	}
+}
+
+// AdvanceTo moves the clock to t. Callbacks that come due on the way run
+// on the caller's goroutine, one at a time with the clock at their
+// deadline, and each is followed by after.
+func (s *SimClock) AdvanceTo(t time.Time, after func()) {
+	for {
+		s.mu.Lock()
+		var next *simTimer
+		live := s.pending[:0]
+		for _, p := range s.pending {
+			if p.done {
+				continue
+			}
+			live = append(live, p)
+			if !p.when.After(t) && (next == nil || p.when.Before(next.when) || (p.when.Equal(next.when) && p.seq < next.seq)) {
+				next = p
+			}
+		}
+		s.pending = live
+		if next == nil {
+			if t.After(s.now) {
+				s.now = t
+			}
+			s.mu.Unlock()
+			return
+		}
+		next.done = true
+		if next.when.After(s.now) {
+			s.now = next.when
+		}
+		s.mu.Unlock()
+		next.f()
+		after()
+	}
+}
+
+// elapsed is the simulated time in ms
+func (s *SimClock) elapsed() int64 { return s.Now().Sub(SimEpoch).Milliseconds() }
@@ -0,0 +1,63 @@
+// backend/snapshot.go
+package main
+
+/*
+Snapshot coalescing. A full-state message supersedes every earlier one of
+its type, so queueing a backlog of them for a slow client only makes it
+render stale states one after another. Room broadcasts of the snapshot
+types
+
+	"snapshots": {"types": ["game.state", "state.snapshot"]}   (the default)
+
+skip the send channel: each client holds at most one pending snapshot per
+type, a newer one replaces it, and writePump sends it as soon as it gets
+to it. Snapshots are not sequenced (see envelope.go), so a client that
+can't keep up skips straight to the newest state without seeing a gap.
+*/
+
+// SnapshotConfig is the "snapshots" block of the config file
+type SnapshotConfig struct {
+	Types []string `json:"types,omitempty"`
+}
+
+// typeSet returns the snapshot types as a set
+func (cfg SnapshotConfig) typeSet() map[string]bool {
+	if len(cfg.Types) == 0 {
+		cfg.Types = []string{"game.state", "state.snapshot"}
+	}
+	types := make(map[string]bool, len(cfg.Types))
+	for _, t := range cfg.Types {
+		types[t] = true
+	}
+	return types
+}
+
+// queueSnapshot makes msg the pending snapshot of its type, replacing any
+// older one, and wakes writePump
+func (c *Client) queueSnapshot(typ string, msg []byte) {
+	c.snapMu.Lock()
+	if c.snapPending == nil {
+		c.snapPending = make(map[string][]byte)
+	}
+	c.snapPending[typ] = msg
+	c.snapMu.Unlock()
+	select {
+	case c.snapReady <- struct{}{}:
+	default: // already signalled
+	}
+}
+
+// takeSnapshots returns and clears the pending snapshots (writePump only)
+func (c *Client) takeSnapshots() [][]byte {
+	c.snapMu.Lock()
+	defer c.snapMu.Unlock()
+	if len(c.snapPending) == 0 {
+		return nil
+	}
+	out := make([][]byte, 0, len(c.snapPending))
+	for _, b := range c.snapPending {
+		out = append(out, b)
+	}
+	c.snapPending = nil
+	return out
+}
@@ -0,0 +1,633 @@
+// backend/sqlite.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite" // pure Go driver, keeps the binary cgo-free
+)
+
+/*
+Embedded SQLite storage, the default for single-node deployments.
+One database file (-db, default server.db) holds
+
+	messages      room history of /ws            (HistoryStore)
+	users         profiles and friend lists      (UserStore)
+	mutes         anti-cheat shadow mutes        (MuteStore)
+	matches       finished match results         (MatchStore)
+	inbox         user notifications             (InboxStore)
+	dead_letters  rejected and dropped messages  (DeadLetters)
+	bans          banned users                   (Bans)
+	reports       abuse reports                  (Reports)
+	fed_outbox    queued messages for peers      (Federation)
+
+so a restart keeps all of them without any other service. The explicit
+file flags (-history, -users, -matches) still select the JSON/JSONL stores
+instead, and -db "" turns the database off altogether. Games mounted from
+the config file keep their own "history" files.
+*/
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS messages (
+	id      INTEGER PRIMARY KEY AUTOINCREMENT,
+	room    TEXT NOT NULL,
+	sender  TEXT NOT NULL,
+	user_id TEXT NOT NULL DEFAULT '',
+	type    TEXT NOT NULL,
+	payload TEXT NOT NULL DEFAULT '',
+	data    BLOB,
+	size    INTEGER NOT NULL,
+	time    INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS messages_room ON messages (room, id);
+CREATE INDEX IF NOT EXISTS messages_user ON messages (user_id, id);
+CREATE TABLE IF NOT EXISTS users (
+	id   TEXT PRIMARY KEY,
+	data TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS mutes (
+	identity TEXT PRIMARY KEY,
+	reason   TEXT NOT NULL,
+	since    INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS matches (
+	id   INTEGER PRIMARY KEY,
+	data TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS inbox (
+	id      INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id TEXT NOT NULL,
+	kind    TEXT NOT NULL,
+	sender  TEXT NOT NULL DEFAULT '',
+	title   TEXT NOT NULL,
+	body    TEXT NOT NULL DEFAULT '',
+	data    BLOB,
+	time    INTEGER NOT NULL,
+	read    INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS inbox_user ON inbox (user_id, id);
+CREATE TABLE IF NOT EXISTS dead_letters (
+	id   INTEGER PRIMARY KEY,
+	data TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS bans (
+	user TEXT PRIMARY KEY,
+	data TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS reports (
+	id   INTEGER PRIMARY KEY,
+	data TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS fed_outbox (
+	seq  INTEGER PRIMARY KEY AUTOINCREMENT,
+	id   TEXT NOT NULL UNIQUE,
+	data TEXT NOT NULL
+);
+`
+
+// SQLiteDB is the server's embedded database
+type SQLiteDB struct {
+	db *sql.DB
+}
+
+// OpenSQLite opens (creating if needed) the database at path and brings
+// its schema up to date
+func OpenSQLite(path string) (*SQLiteDB, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=secure_delete(on)")
+	if err != nil {
+		return nil, err
+	}
+	// one writer at a time is all SQLite does anyway; a single connection
+	// avoids SQLITE_BUSY between our own goroutines
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &SQLiteDB{db: db}, nil
+}
+
+func (d *SQLiteDB) Close() error { return d.db.Close() }
+
+// SQLiteHistoryStore keeps history in the messages table
+type SQLiteHistoryStore struct {
+	db *sql.DB
+}
+
+// History returns the database's HistoryStore
+func (d *SQLiteDB) History() *SQLiteHistoryStore { return &SQLiteHistoryStore{db: d.db} }
+
+// where renders f as a WHERE clause
+func (f HistoryFilter) where() (string, []any) {
+	var conds []string
+	var args []any
+	if f.Room != "" {
+		conds, args = append(conds, "room = ?"), append(args, f.Room)
+	}
+	if f.UserID != "" {
+		conds, args = append(conds, "user_id = ?"), append(args, f.UserID)
+	}
+	if !f.Since.IsZero() {
+		conds, args = append(conds, "time >= ?"), append(args, f.Since.UnixNano())
+	}
+	if !f.Until.IsZero() {
+		conds, args = append(conds, "time < ?"), append(args, f.Until.UnixNano())
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+func (s *SQLiteHistoryStore) Append(m *StoredMessage) error {
+	res, err := s.db.Exec(`INSERT INTO messages (room, sender, user_id, type, payload, data, size, time) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		m.Room, m.Sender, m.UserID, m.Type, m.Payload, []byte(m.Data), m.Size(), m.Time.UnixNano())
+	if err != nil {
+		return err
+	}
+	m.ID, err = res.LastInsertId()
+	return err
+}
+
+func (s *SQLiteHistoryStore) Query(f HistoryFilter) ([]StoredMessage, error) {
+	where, args := f.where()
+	limit := f.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := s.db.Query(`SELECT id, room, sender, user_id, type, payload, data, time FROM
+		(SELECT * FROM messages`+where+` ORDER BY id DESC LIMIT ?) ORDER BY id`, append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []StoredMessage
+	for rows.Next() {
+		var m StoredMessage
+		var data []byte
+		var ts int64
+		if err := rows.Scan(&m.ID, &m.Room, &m.Sender, &m.UserID, &m.Type, &m.Payload, &data, &ts); err != nil {
+			return nil, err
+		}
+		if len(data) > 0 {
+			m.Data = json.RawMessage(data)
+		}
+		m.Time = time.Unix(0, ts)
+		out = append(out, m)
+	}
+	return out, rows.Err()
+}
+
+func (s *SQLiteHistoryStore) DeleteOldest(f HistoryFilter, n int) (int, error) {
+	where, args := f.where()
+	if n <= 0 {
+		n = -1
+	}
+	res, err := s.db.Exec(`DELETE FROM messages WHERE id IN (SELECT id FROM messages`+where+` ORDER BY id LIMIT ?)`, append(args, n)...)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := res.RowsAffected()
+	return int(deleted), err
+}
+
+func (s *SQLiteHistoryStore) Usage(f HistoryFilter) (int, int64, error) {
+	where, args := f.where()
+	var count int
+	var bytes int64
+	err := s.db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(size), 0) FROM messages`+where, args...).Scan(&count, &bytes)
+	return count, bytes, err
+}
+
+func (s *SQLiteHistoryStore) Anonymize(userID, alias string) (int, error) {
+	res, err := s.db.Exec(`UPDATE messages SET user_id = '', sender = ? WHERE user_id = ?`, alias, userID)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (s *SQLiteHistoryStore) Rooms() ([]string, error) {
+	rows, err := s.db.Query(`SELECT DISTINCT room FROM messages ORDER BY room`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var room string
+		if err := rows.Scan(&room); err != nil {
+			return nil, err
+		}
+		out = append(out, room)
+	}
+	return out, rows.Err()
+}
+
+// Compact rebuilds the file so freed pages don't linger on disk
+func (s *SQLiteHistoryStore) Compact() error {
+	_, err := s.db.Exec(`VACUUM`)
+	return err
+}
+
+// SQLiteUserStore keeps users in the users table
+type SQLiteUserStore struct {
+	db *sql.DB
+}
+
+// Users returns the database's UserStore
+func (d *SQLiteDB) Users() *SQLiteUserStore { return &SQLiteUserStore{db: d.db} }
+
+func (s *SQLiteUserStore) Get(id string) (*User, bool) {
+	var data string
+	if err := s.db.QueryRow(`SELECT data FROM users WHERE id = ?`, id).Scan(&data); err != nil {
+		return nil, false
+	}
+	var u User
+	if err := json.Unmarshal([]byte(data), &u); err != nil {
+		return nil, false
+	}
+	return &u, true
+}
+
+func (s *SQLiteUserStore) Put(u *User) error {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO users (id, data) VALUES (?, ?) ON CONFLICT (id) DO UPDATE SET data = excluded.data`, u.ID, string(b))
+	return err
+}
+
+func (s *SQLiteUserStore) Delete(id string) (bool, error) {
+	res, err := s.db.Exec(`DELETE FROM users WHERE id = ?`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *SQLiteUserStore) BlockLists() (map[string][]string, error) {
+	rows, err := s.db.Query(`SELECT data FROM users WHERE data LIKE '%"blocked":%'`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[string][]string)
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var u User
+		if err := json.Unmarshal([]byte(data), &u); err != nil {
+			return nil, fmt.Errorf("users: %v", err)
+		}
+		if len(u.Blocked) > 0 {
+			out[u.ID] = u.Blocked
+		}
+	}
+	return out, rows.Err()
+}
+
+// Mutes loads every persisted mute
+func (d *SQLiteDB) Mutes() (map[string]string, error) {
+	rows, err := d.db.Query(`SELECT identity, reason FROM mutes`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	muted := make(map[string]string)
+	for rows.Next() {
+		var id, reason string
+		if err := rows.Scan(&id, &reason); err != nil {
+			return nil, err
+		}
+		muted[id] = reason
+	}
+	return muted, rows.Err()
+}
+
+func (d *SQLiteDB) SaveMute(identity, reason string) error {
+	_, err := d.db.Exec(`INSERT INTO mutes (identity, reason, since) VALUES (?, ?, ?) ON CONFLICT (identity) DO UPDATE SET reason = excluded.reason`,
+		identity, reason, time.Now().Unix())
+	return err
+}
+
+func (d *SQLiteDB) DeleteMute(identity string) error {
+	_, err := d.db.Exec(`DELETE FROM mutes WHERE identity = ?`, identity)
+	return err
+}
+
+// OpenSQLiteMatchStore loads the matches table into a MatchStore that
+// writes new and anonymized results back to it
+func OpenSQLiteMatchStore(d *SQLiteDB) (*MatchStore, error) {
+	s := &MatchStore{byPlayer: make(map[string][]int), byRoom: make(map[string][]int), db: d}
+	rows, err := d.db.Query(`SELECT data FROM matches ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var r GameResult
+		if err := json.Unmarshal([]byte(data), &r); err != nil {
+			return nil, fmt.Errorf("matches: %v", err)
+		}
+		s.indexLocked(r)
+	}
+	return s, rows.Err()
+}
+
+// saveMatches inserts or replaces rs in one transaction
+func (d *SQLiteDB) saveMatches(rs ...GameResult) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, r := range rs {
+		b, err := json.Marshal(r)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO matches (id, data) VALUES (?, ?) ON CONFLICT (id) DO UPDATE SET data = excluded.data`, r.ID, string(b)); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// SQLiteInboxStore keeps inbox items in the inbox table
+type SQLiteInboxStore struct {
+	db *sql.DB
+}
+
+// Inbox returns the database's InboxStore
+func (d *SQLiteDB) Inbox() *SQLiteInboxStore { return &SQLiteInboxStore{db: d.db} }
+
+func (s *SQLiteInboxStore) Add(it *InboxItem) ([]InboxItem, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	res, err := tx.Exec(`INSERT INTO inbox (user_id, kind, sender, title, body, data, time) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		it.User, it.Kind, it.From, it.Title, it.Body, []byte(it.Data), it.Time.UnixNano())
+	if err == nil {
+		it.ID, err = res.LastInsertId()
+	}
+	const over = `user_id = ? AND id <= (SELECT id FROM inbox WHERE user_id = ? ORDER BY id DESC LIMIT 1 OFFSET ?)`
+	var dropped []InboxItem
+	if err == nil {
+		var rows *sql.Rows
+		if rows, err = tx.Query(`SELECT id, kind, sender, title, body, data, time, read FROM inbox WHERE read = 0 AND `+over, it.User, it.User, inboxMaxItems); err == nil {
+			dropped, err = scanInboxItems(rows, it.User)
+		}
+	}
+	if err == nil {
+		_, err = tx.Exec(`DELETE FROM inbox WHERE `+over, it.User, it.User, inboxMaxItems)
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return dropped, tx.Commit()
+}
+
+func (s *SQLiteInboxStore) List(user string, f InboxFilter) ([]InboxItem, int, error) {
+	var unread int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM inbox WHERE user_id = ? AND read = 0`, user).Scan(&unread); err != nil {
+		return nil, 0, err
+	}
+	q, args := `SELECT id, kind, sender, title, body, data, time, read FROM inbox WHERE user_id = ?`, []any{user}
+	if f.Before > 0 {
+		q, args = q+` AND id < ?`, append(args, f.Before)
+	}
+	if f.UnreadOnly {
+		q += ` AND read = 0`
+	}
+	rows, err := s.db.Query(q+` ORDER BY id DESC LIMIT ?`, append(args, f.Limit)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	out, err := scanInboxItems(rows, user)
+	return out, unread, err
+}
+
+// scanInboxItems reads rows of (id, kind, sender, title, body, data,
+// time, read) and closes them
+func scanInboxItems(rows *sql.Rows, user string) ([]InboxItem, error) {
+	defer rows.Close()
+	out := []InboxItem{}
+	for rows.Next() {
+		it := InboxItem{User: user}
+		var data []byte
+		var ts int64
+		if err := rows.Scan(&it.ID, &it.Kind, &it.From, &it.Title, &it.Body, &data, &ts, &it.Read); err != nil {
+			return nil, err
+		}
+		if len(data) > 0 {
+			it.Data = data
+		}
+		it.Time = time.Unix(0, ts)
+		out = append(out, it)
+	}
+	return out, rows.Err()
+}
+
+// deadLetters loads the stored dead letters, oldest first
+func (d *SQLiteDB) deadLetters() ([]DeadLetter, error) {
+	rows, err := d.db.Query(`SELECT data FROM dead_letters ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []DeadLetter
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var dl DeadLetter
+		if err := json.Unmarshal([]byte(data), &dl); err != nil {
+			return nil, fmt.Errorf("dead_letters: %v", err)
+		}
+		out = append(out, dl)
+	}
+	return out, rows.Err()
+}
+
+func (d *SQLiteDB) saveDeadLetter(dl DeadLetter) error {
+	b, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	_, err = d.db.Exec(`INSERT INTO dead_letters (id, data) VALUES (?, ?)`, dl.ID, string(b))
+	return err
+}
+
+func (d *SQLiteDB) deleteDeadLetters(ids []int64) error {
+	clause, args := idsClause(ids)
+	_, err := d.db.Exec(`DELETE FROM dead_letters WHERE 1 = 1`+clause, args...)
+	return err
+}
+
+func (d *SQLiteDB) bans() ([]Ban, error) {
+	rows, err := d.db.Query(`SELECT data FROM bans`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Ban
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var ban Ban
+		if err := json.Unmarshal([]byte(data), &ban); err != nil {
+			return nil, fmt.Errorf("bans: %v", err)
+		}
+		out = append(out, ban)
+	}
+	return out, rows.Err()
+}
+
+func (d *SQLiteDB) saveBan(ban Ban) error {
+	b, _ := json.Marshal(ban)
+	_, err := d.db.Exec(`INSERT INTO bans (user, data) VALUES (?, ?) ON CONFLICT (user) DO UPDATE SET data = excluded.data`, ban.User, string(b))
+	return err
+}
+
+func (d *SQLiteDB) deleteBan(user string) error {
+	_, err := d.db.Exec(`DELETE FROM bans WHERE user = ?`, user)
+	return err
+}
+
+// reports loads the stored reports, oldest first
+func (d *SQLiteDB) reports() ([]Report, error) {
+	rows, err := d.db.Query(`SELECT data FROM reports ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Report
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var rep Report
+		if err := json.Unmarshal([]byte(data), &rep); err != nil {
+			return nil, fmt.Errorf("reports: %v", err)
+		}
+		out = append(out, rep)
+	}
+	return out, rows.Err()
+}
+
+func (d *SQLiteDB) saveReport(rep Report) error {
+	b, err := json.Marshal(rep)
+	if err != nil {
+		return err
+	}
+	_, err = d.db.Exec(`INSERT INTO reports (id, data) VALUES (?, ?) ON CONFLICT (id) DO UPDATE SET data = excluded.data`, rep.ID, string(b))
+	return err
+}
+
+func (d *SQLiteDB) deleteReports(ids []int64) error {
+	clause, args := idsClause(ids)
+	_, err := d.db.Exec(`DELETE FROM reports WHERE 1 = 1`+clause, args...)
+	return err
+}
+
+// idsClause restricts a statement to ids; nil ids restrict nothing
+func idsClause(ids []int64) (string, []any) {
+	if ids == nil {
+		return "", nil
+	}
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return ` AND id IN (?` + strings.Repeat(`, ?`, len(ids)-1) + `)`, args
+}
+
+func (s *SQLiteInboxStore) MarkRead(user string, ids []int64) (int, error) {
+	if ids != nil && len(ids) == 0 {
+		return 0, nil
+	}
+	clause, args := idsClause(ids)
+	res, err := s.db.Exec(`UPDATE inbox SET read = 1 WHERE user_id = ? AND read = 0`+clause, append([]any{user}, args...)...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (s *SQLiteInboxStore) Delete(user string, ids []int64) (int, error) {
+	if ids != nil && len(ids) == 0 {
+		return 0, nil
+	}
+	clause, args := idsClause(ids)
+	res, err := s.db.Exec(`DELETE FROM inbox WHERE user_id = ?`+clause, append([]any{user}, args...)...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// warnLegacyFile points out a store file from before the database became
+// the default, which is no longer read unless its flag names it
+func warnLegacyFile(path, flagName string) {
+	if _, err := os.Stat(path); err == nil {
+		log.Printf("%s is ignored now that the database is the default; pass -%s %s to keep using it", path, flagName, path)
+	}
+}
+
+// fedOutbox loads the envelopes queued for peers, oldest first
+func (d *SQLiteDB) fedOutbox() ([]FedEnvelope, error) {
+	rows, err := d.db.Query(`SELECT data FROM fed_outbox ORDER BY seq`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []FedEnvelope
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var e FedEnvelope
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			return nil, fmt.Errorf("fed_outbox: %v", err)
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+func (d *SQLiteDB) saveFedEnvelope(e FedEnvelope) error {
+	b, _ := json.Marshal(e)
+	_, err := d.db.Exec(`INSERT INTO fed_outbox (id, data) VALUES (?, ?)`, e.ID, string(b))
+	return err
+}
+
+func (d *SQLiteDB) deleteFedEnvelope(id string) error {
+	_, err := d.db.Exec(`DELETE FROM fed_outbox WHERE id = ?`, id)
+	return err
+}
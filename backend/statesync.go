@@ -0,0 +1,138 @@
+// backend/statesync.go
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sync"
+)
+
+/*
+StateSync sends only what changed in a game's state between ticks.
+Each tick the game passes its state struct; StateSync compares it (as JSON)
+with what was last sent and returns a "state.patch" message holding an
+RFC 7386 JSON merge patch, or a full "state.snapshot" every snapshotEvery
+ticks so clients that missed a patch resync.
+
+	{"type":"state.patch","data":{"tick":42,"base":41,"patch":{"score":{"bob":3}}}}
+	{"type":"state.snapshot","data":{"tick":50,"state":{...}}}
+
+A client applies a patch only if base equals the tick it last applied, and
+otherwise waits for the next snapshot. New joiners get Snapshot() from OnConnect.
+Merge patches can't express "set to null", so state fields should be
+omitted rather than null. Built WithSchema, snapshots also carry the
+state's schema version ("schema":3, see schema.go).
+*/
+type StateSync struct {
+	snapshotEvery uint64
+	schema        int // version stamped on snapshots, 0 = none
+
+	mu   sync.Mutex
+	tick uint64
+	sent uint64      // tick of the last message returned by Tick
+	prev interface{} // last sent state, decoded as generic JSON
+}
+
+type stateSnapshot struct {
+	Tick   uint64      `json:"tick"`
+	Schema int         `json:"schema,omitempty"`
+	State  interface{} `json:"state"`
+}
+
+type statePatch struct {
+	Tick  uint64      `json:"tick"`
+	Base  uint64      `json:"base"`
+	Patch interface{} `json:"patch"`
+}
+
+// NewStateSync sends a full snapshot every snapshotEvery ticks (0 = only the first)
+func NewStateSync(snapshotEvery int) *StateSync {
+	return &StateSync{snapshotEvery: uint64(snapshotEvery)}
+}
+
+// WithSchema stamps snapshots with schema's version
+func (s *StateSync) WithSchema(schema *Schema) *StateSync {
+	s.schema = schema.Version
+	return s
+}
+
+// Tick advances one tick and returns the message to broadcast, or ok=false
+// if the state did not change
+func (s *StateSync) Tick(state interface{}) (msg Message, ok bool, err error) {
+	cur, err := toJSONValue(state)
+	if err != nil {
+		return Message{}, false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tick++
+
+	if s.prev == nil || (s.snapshotEvery > 0 && s.tick%s.snapshotEvery == 0) {
+		s.prev, s.sent = cur, s.tick
+		return stateMessage("state.snapshot", stateSnapshot{Tick: s.tick, Schema: s.schema, State: cur})
+	}
+	patch, changed := mergePatch(s.prev, cur)
+	if !changed {
+		return Message{}, false, nil
+	}
+	base := s.sent
+	s.prev, s.sent = cur, s.tick
+	return stateMessage("state.patch", statePatch{Tick: s.tick, Base: base, Patch: patch})
+}
+
+// Snapshot returns the last sent state as a full snapshot (for new joiners)
+func (s *StateSync) Snapshot() (Message, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.prev == nil {
+		return Message{}, false
+	}
+	msg, ok, _ := stateMessage("state.snapshot", stateSnapshot{Tick: s.sent, Schema: s.schema, State: s.prev})
+	return msg, ok
+}
+
+func stateMessage(typ string, data interface{}) (Message, bool, error) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return Message{}, false, err
+	}
+	return Message{Type: typ, Sender: "server", Data: b}, true, nil
+}
+
+// toJSONValue round-trips v through JSON to get maps/slices/float64s
+func toJSONValue(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var out interface{}
+	err = json.Unmarshal(b, &out)
+	return out, err
+}
+
+// mergePatch returns the RFC 7386 patch turning prev into cur
+func mergePatch(prev, cur interface{}) (interface{}, bool) {
+	po, pok := prev.(map[string]interface{})
+	co, cok := cur.(map[string]interface{})
+	if !pok || !cok {
+		// non-objects (and arrays) are replaced wholesale
+		return cur, !reflect.DeepEqual(prev, cur)
+	}
+	patch := make(map[string]interface{})
+	for k, cv := range co {
+		pv, existed := po[k]
+		if !existed {
+			patch[k] = cv
+			continue
+		}
+		if sub, changed := mergePatch(pv, cv); changed {
+			patch[k] = sub
+		}
+	}
+	for k := range po {
+		if _, ok := co[k]; !ok {
+			patch[k] = nil
+		}
+	}
+	return patch, len(patch) > 0
+}
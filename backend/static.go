@@ -0,0 +1,319 @@
+// backend/static.go
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+The frontend build (-static, Vite's dist) is served on every path no other
+handler takes. The "static" config block tunes it:
+
+	"static": {"routes": ["/", "/rooms/*", "/profile"], "maxAge": "1h", "immutable": ["/assets/"]}
+
+  - Files get an ETag (a hash of their content) and are revalidated with
+    If-None-Match. Files under the "immutable" prefixes (default /assets/,
+    where Vite puts content-hashed names) are cached for a year;
+    index.html is always revalidated; other files are cached for maxAge
+    (default 1h).
+  - With Accept-Encoding, file.br and file.gz next to a file are served
+    instead of it (precompress at build time for brotli). Text files
+    without a .gz are gzipped by the server, once per version of the file.
+  - Paths are resolved inside the directory only: "..", dot files and
+    symlinks that lead out of it are 404. A .br or .gz that leads out of
+    it is ignored.
+  - A path that is no file is the SPA's own route and gets index.html
+    when it matches "routes" (exact, or a prefix ending in /*). Without
+    routes every path without a file extension does. Anything else,
+    including unknown asset paths, is a plain 404, so a missing script
+    doesn't come back as HTML.
+*/
+
+// StaticConfig is the "static" config block
+type StaticConfig struct {
+	Routes    []string `json:"routes,omitempty"`    // SPA routes served index.html; empty = any path without an extension
+	MaxAge    Duration `json:"maxAge,omitempty"`    // Cache-Control max-age of files outside immutable, default 1h
+	Immutable []string `json:"immutable,omitempty"` // path prefixes of content-hashed files, default /assets/
+}
+
+const (
+	staticImmutableAge = 365 * 24 * time.Hour
+	staticGzipMin      = 1024    // smaller files aren't worth compressing
+	staticGzipMax      = 4 << 20 // larger ones are served as they are unless precompressed
+)
+
+// Static serves a frontend build directory
+type Static struct {
+	dir string // absolute, symlinks resolved
+	cfg StaticConfig
+
+	mu    sync.Mutex
+	files map[string]*staticFile // by absolute path
+}
+
+// staticFile is what Static remembers of one version of a file
+type staticFile struct {
+	size    int64
+	modTime time.Time
+	etag    string
+	gzipped []byte // nil until first asked for, or when not compressible
+}
+
+func NewStatic(dir string, cfg StaticConfig) *Static {
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	if real, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = real
+	}
+	if cfg.MaxAge <= 0 {
+		cfg.MaxAge = Duration(time.Hour)
+	}
+	if cfg.Immutable == nil {
+		cfg.Immutable = []string{"/assets/"}
+	}
+	return &Static{dir: dir, cfg: cfg, files: make(map[string]*staticFile)}
+}
+
+// resolve maps a URL path to a regular file inside the directory, or ""
+func (s *Static) resolve(urlPath string) string {
+	clean := path.Clean("/" + urlPath)
+	for _, seg := range strings.Split(clean, "/") {
+		if strings.HasPrefix(seg, ".") {
+			return ""
+		}
+	}
+	real := s.inside(filepath.Join(s.dir, filepath.FromSlash(clean)))
+	if real == "" {
+		return ""
+	}
+	info, err := os.Stat(real)
+	if err != nil {
+		return ""
+	}
+	if info.IsDir() {
+		return s.resolve(path.Join(clean, "index.html"))
+	}
+	if !info.Mode().IsRegular() {
+		return ""
+	}
+	return real
+}
+
+// inside returns p with symlinks resolved when that is inside the
+// directory, or ""
+func (s *Static) inside(p string) string {
+	real, err := filepath.EvalSymlinks(p)
+	if err != nil || (real != s.dir && !strings.HasPrefix(real, s.dir+string(filepath.Separator))) {
+		return ""
+	}
+	return real
+}
+
+// sibling opens the precompressed file next to file, when it is a regular
+// file inside the directory
+func (s *Static) sibling(file, ext string) *os.File {
+	real := s.inside(file + ext)
+	if real == "" {
+		return nil
+	}
+	f, err := os.Open(real)
+	if err != nil {
+		return nil
+	}
+	if info, err := f.Stat(); err != nil || !info.Mode().IsRegular() {
+		f.Close()
+		return nil
+	}
+	return f
+}
+
+// spaRoute reports whether urlPath is one of the SPA's own routes
+func (s *Static) spaRoute(urlPath string) bool {
+	if len(s.cfg.Routes) == 0 {
+		return path.Ext(urlPath) == "" && !s.immutable(urlPath)
+	}
+	for _, r := range s.cfg.Routes {
+		if r == urlPath || (strings.HasSuffix(r, "/*") && strings.HasPrefix(urlPath, r[:len(r)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Static) immutable(urlPath string) bool {
+	for _, p := range s.cfg.Immutable {
+		if strings.HasPrefix(urlPath, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Static) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	urlPath := path.Clean("/" + r.URL.Path)
+	file := s.resolve(urlPath)
+	cache := "public, max-age=" + strconv.Itoa(int(time.Duration(s.cfg.MaxAge).Seconds()))
+	switch {
+	case file == "" && s.spaRoute(urlPath):
+		file = s.resolve("/index.html")
+		cache = "no-cache"
+	case file == "":
+	case filepath.Base(file) == "index.html":
+		cache = "no-cache"
+	case s.immutable(urlPath):
+		cache = "public, max-age=" + strconv.Itoa(int(staticImmutableAge.Seconds())) + ", immutable"
+	}
+	if file == "" {
+		http.NotFound(w, r)
+		return
+	}
+	s.serveFile(w, r, file, cache)
+}
+
+// serveFile sends file, or a compressed version of it the client accepts
+func (s *Static) serveFile(w http.ResponseWriter, r *http.Request, file, cache string) {
+	f, err := os.Open(file)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	sf, err := s.info(file, f, info)
+	if err != nil {
+		http.Error(w, "read error", http.StatusInternalServerError)
+		return
+	}
+	h := w.Header()
+	ctype := mime.TypeByExtension(filepath.Ext(file))
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+	h.Set("Content-Type", ctype)
+	h.Set("Cache-Control", cache)
+	h.Set("Vary", "Accept-Encoding")
+	h.Set("X-Content-Type-Options", "nosniff")
+
+	var body io.ReadSeeker = f
+	etag := sf.etag
+	accept := r.Header.Get("Accept-Encoding")
+	for _, enc := range []struct{ name, ext string }{{"br", ".br"}, {"gzip", ".gz"}} {
+		if !acceptsEncoding(accept, enc.name) {
+			continue
+		}
+		if pf := s.sibling(file, enc.ext); pf != nil {
+			defer pf.Close()
+			h.Set("Content-Encoding", enc.name)
+			body, etag = pf, sf.etag[:len(sf.etag)-1]+"-"+enc.name+`"`
+			break
+		}
+		if enc.name == "gzip" {
+			if gz := s.gzipped(sf, f, ctype); gz != nil {
+				h.Set("Content-Encoding", "gzip")
+				body, etag = bytes.NewReader(gz), sf.etag[:len(sf.etag)-1]+`-gzip"`
+			}
+		}
+	}
+	h.Set("ETag", etag)
+	http.ServeContent(w, r, "", info.ModTime(), body)
+}
+
+// info returns what is known of the current version of file, hashing it
+// the first time
+func (s *Static) info(file string, f *os.File, info os.FileInfo) (*staticFile, error) {
+	s.mu.Lock()
+	sf := s.files[file]
+	s.mu.Unlock()
+	if sf != nil && sf.size == info.Size() && sf.modTime.Equal(info.ModTime()) {
+		return sf, nil
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	sf = &staticFile{size: info.Size(), modTime: info.ModTime(), etag: `"` + hex.EncodeToString(hash.Sum(nil)[:12]) + `"`}
+	s.mu.Lock()
+	s.files[file] = sf
+	s.mu.Unlock()
+	return sf, nil
+}
+
+// gzipped returns sf's content gzipped, or nil when it isn't worth it
+func (s *Static) gzipped(sf *staticFile, f *os.File, ctype string) []byte {
+	if sf.size < staticGzipMin || sf.size > staticGzipMax || !compressible(ctype) {
+		return nil
+	}
+	s.mu.Lock()
+	gz := sf.gzipped
+	s.mu.Unlock()
+	if gz != nil {
+		return gz
+	}
+	var buf bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	_, err := io.Copy(zw, f)
+	zw.Close()
+	if _, serr := f.Seek(0, io.SeekStart); err != nil || serr != nil {
+		return nil
+	}
+	s.mu.Lock()
+	sf.gzipped = buf.Bytes()
+	s.mu.Unlock()
+	return sf.gzipped
+}
+
+// compressible reports whether gzip is likely to shrink ctype
+func compressible(ctype string) bool {
+	ctype, _, _ = strings.Cut(ctype, ";")
+	switch {
+	case strings.HasPrefix(ctype, "text/"):
+		return true
+	case ctype == "application/javascript", ctype == "application/json", ctype == "application/wasm",
+		ctype == "image/svg+xml", ctype == "application/manifest+json", ctype == "application/xml":
+		return true
+	}
+	return false
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header allows enc
+func acceptsEncoding(header, enc string) bool {
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(name), enc) && strings.TrimSpace(name) != "*" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
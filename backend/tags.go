@@ -0,0 +1,309 @@
+// backend/tags.go
+package main
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+/*
+Connection tags: string attributes of a connection that announcements,
+experiments and games target subsets of clients by. A connection gets
+them from three places:
+
+  - its session token's "tags" claim, set by whoever issued the token
+    ({"sub":"u1","tags":{"beta":"true","plan":"pro"}})
+  - the client itself, for the keys the "tags" config block allows:
+
+	{"type":"tags.set","data":{"platform":"mobile","app_version":"2.3.1"}}
+
+    An empty value removes a tag. The reply, and the reply to
+    {"type":"tags.get"}, is {"type":"tags","data":{<all tags>}}.
+  - operators: PUT /api/admin/clients/{id}/tags with the same body, for
+    every connection of a client or user id. GET /api/admin/clients
+    shows them.
+
+	"tags": {"clientKeys": ["platform", "app_version"], "max": 16}
+
+clientKeys defaults to platform and app_version, so clients can't put
+themselves in the beta by sending beta=true. Keys and values are 1-64
+characters; a connection has at most max tags (default 16).
+
+Delivery:
+
+	hub.BroadcastTagged(Selector{"platform": "mobile", "locale": "de"}, m)
+	hub.BroadcastWhere(func(c *Client) bool { return c.Tag("beta") == "true" }, m)
+
+A selector matches connections that have every listed tag. "locale",
+"room", "tenant" and "user" are not tags but the connection's locale,
+room, session token tenant and user id, and can't be set as tags. BroadcastTagged looks the clients up
+in a per-hub index of tags, so targeting a few connections of many is
+cheap; BroadcastWhere asks pred about every client. Both stamp m and
+send it to each match once, without a seq (they are not a room's or the
+hub's stream, like SendToUser); outbound filters (outfilter.go) apply.
+pred runs under the hub's lock and must not call back into the hub.
+Announcements take a selector as "where" (announcements.go).
+*/
+
+// TagsConfig is the "tags" config block
+type TagsConfig struct {
+	ClientKeys []string `json:"clientKeys,omitempty"` // keys clients may set with tags.set; default platform, app_version
+	Max        int      `json:"max,omitempty"`        // tags per connection, default 16
+}
+
+const (
+	defaultMaxTags = 16
+	maxTagLen      = 64
+)
+
+// Selector picks connections by tag; see BroadcastTagged
+type Selector map[string]string
+
+// builtinTags are the selector keys that name connection state, not tags
+var builtinTags = map[string]bool{"locale": true, "room": true, "tenant": true, "user": true}
+
+func (tc TagsConfig) max() int {
+	if tc.Max <= 0 {
+		return defaultMaxTags
+	}
+	return tc.Max
+}
+
+// clientMay reports whether clients may set key themselves
+func (tc TagsConfig) clientMay(key string) bool {
+	keys := tc.ClientKeys
+	if keys == nil {
+		keys = []string{"platform", "app_version"}
+	}
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// validTag reports whether key=value may be stored; "" values remove
+func validTag(key, value string) bool {
+	return key != "" && len(key) <= maxTagLen && len(value) <= maxTagLen && !builtinTags[key]
+}
+
+// Tag returns c's value of key, or ""
+func (c *Client) Tag(key string) string {
+	c.hub.mu.RLock()
+	defer c.hub.mu.RUnlock()
+	return c.tags[key]
+}
+
+// Tags returns a copy of c's tags
+func (c *Client) Tags() map[string]string {
+	c.hub.mu.RLock()
+	defer c.hub.mu.RUnlock()
+	return c.tagsLocked()
+}
+
+func (c *Client) tagsLocked() map[string]string {
+	out := make(map[string]string, len(c.tags))
+	for k, v := range c.tags {
+		out[k] = v
+	}
+	return out
+}
+
+// SetTags merges tags into c's; empty values remove. It reports false,
+// changing nothing, when a tag is invalid or c would have too many.
+func (h *Hub) SetTags(c *Client, tags map[string]string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.clients[c]; !ok {
+		return false
+	}
+	return h.setTagsLocked(c, tags)
+}
+
+// setTagsLocked is SetTags. Requires h.mu.
+func (h *Hub) setTagsLocked(c *Client, tags map[string]string) bool {
+	n := len(c.tags)
+	for k, v := range tags {
+		if !validTag(k, v) {
+			return false
+		}
+		_, had := c.tags[k]
+		switch {
+		case v == "" && had:
+			n--
+		case v != "" && !had:
+			n++
+		}
+	}
+	if n > h.tags.max() {
+		return false
+	}
+	if c.tags == nil {
+		c.tags = make(map[string]string, len(tags))
+	}
+	for k, v := range tags {
+		if old, had := c.tags[k]; had {
+			h.unindexTagLocked(c, k, old)
+			delete(c.tags, k)
+		}
+		if v != "" {
+			c.tags[k] = v
+			set := h.tagged[k+"="+v]
+			if set == nil {
+				set = make(map[*Client]bool)
+				h.tagged[k+"="+v] = set
+			}
+			set[c] = true
+		}
+	}
+	return true
+}
+
+func (h *Hub) unindexTagLocked(c *Client, k, v string) {
+	if set := h.tagged[k+"="+v]; set != nil {
+		delete(set, c)
+		if len(set) == 0 {
+			delete(h.tagged, k+"="+v)
+		}
+	}
+}
+
+// untagLocked drops c from the tag index. Requires h.mu.
+func (h *Hub) untagLocked(c *Client) {
+	for k, v := range c.tags {
+		h.unindexTagLocked(c, k, v)
+	}
+}
+
+// matchesLocked reports whether c has everything sel asks for. Requires
+// h.mu (for c.room and c.tags).
+func (sel Selector) matchesLocked(c *Client) bool {
+	for k, v := range sel {
+		var have string
+		switch k {
+		case "locale":
+			have = c.Locale()
+		case "room":
+			have = c.room
+		case "tenant":
+			have = c.Tenant()
+		case "user":
+			have = c.userID
+		default:
+			have = c.tags[k]
+		}
+		if have != v {
+			return false
+		}
+	}
+	return true
+}
+
+// candidatesLocked returns the smallest indexed set of clients that
+// holds every match of sel, or all clients. Requires h.mu.
+func (h *Hub) candidatesLocked(sel Selector) map[*Client]bool {
+	best := h.clients
+	for k, v := range sel {
+		if builtinTags[k] {
+			if k == "user" {
+				if set := h.users[v]; len(set) < len(best) {
+					best = set
+				}
+			}
+			continue
+		}
+		set := h.tagged[k+"="+v]
+		if len(set) < len(best) {
+			best = set
+		}
+	}
+	return best
+}
+
+// ClientsTagged returns the connections sel matches
+func (h *Hub) ClientsTagged(sel Selector) []*Client {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var out []*Client
+	for c := range h.candidatesLocked(sel) {
+		if sel.matchesLocked(c) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// BroadcastTagged stamps m and sends it to every connection sel matches,
+// returning how many got it
+func (h *Hub) BroadcastTagged(sel Selector, m Message) int {
+	return h.broadcastWhere(sel, sel.matchesLocked, m)
+}
+
+// BroadcastWhere stamps m and sends it to every client pred accepts,
+// returning how many got it
+func (h *Hub) BroadcastWhere(pred func(c *Client) bool, m Message) int {
+	return h.broadcastWhere(nil, pred, m)
+}
+
+func (h *Hub) broadcastWhere(sel Selector, pred func(c *Client) bool, m Message) int {
+	m.stamp()
+	m.Seq = 0
+	b, _ := json.Marshal(m)
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	sent := 0
+	for c := range h.candidatesLocked(sel) {
+		if !pred(c) {
+			continue
+		}
+		frame := b
+		if h.filtering() {
+			if frame = h.filterFor(c, m, b); frame == nil {
+				continue
+			}
+		}
+		if c.trySend(frame) {
+			sent++
+		}
+	}
+	return sent
+}
+
+// TagsMiddleware handles tags.set and tags.get
+func TagsMiddleware(hub *Hub) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(c *Client, m Message) {
+			switch m.Type {
+			case "tags.set":
+				var tags map[string]string
+				if err := json.Unmarshal(m.Data, &tags); err != nil || len(tags) == 0 {
+					sendError(c, "bad_data", m.Type, `data must be {"key":"value",...}`)
+					return
+				}
+				keys := make([]string, 0, len(tags))
+				for k := range tags {
+					keys = append(keys, k)
+				}
+				sort.Strings(keys)
+				for _, k := range keys {
+					if !hub.tags.clientMay(k) {
+						sendError(c, "tags.not_allowed", m.Type, k)
+						return
+					}
+				}
+				if !hub.SetTags(c, tags) {
+					sendError(c, "tags.invalid", m.Type, maxTagLen, hub.tags.max())
+					return
+				}
+			case "tags.get":
+			default:
+				next(c, m)
+				return
+			}
+			data, _ := json.Marshal(c.Tags())
+			b, _ := json.Marshal(Message{Type: "tags", Sender: "server", Data: data})
+			c.Send(b)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+// backend/timers.go
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+Server-side countdowns. A game starts a named timer in a room:
+
+	hub.timers.Start("r1", "round", 30*time.Second, func() { endRound("r1") })
+
+and the room is sent
+
+	{"type":"timer","data":{"name":"round","state":"running","remainingMs":30000,"durationMs":30000}}
+
+on start and every timerUpdateInterval, then once more with state
+"expired" (after which the callback runs) or "cancelled". Clients set
+their deadline to now + remainingMs on every update, so their clocks never
+enter into it and each update corrects drift. {"type":"timer.list"}
+returns the caller's room's running timers, for late joiners.
+
+In Lua: start_timer(room, name, seconds) and cancel_timer(room, name);
+on expiry the global function on_timer(room, name) is called.
+*/
+
+const timerUpdateInterval = time.Second
+
+// TimerInfo is the "timer" message data
+type TimerInfo struct {
+	Name        string `json:"name"`
+	State       string `json:"state"` // running | expired | cancelled
+	RemainingMs int64  `json:"remainingMs"`
+	DurationMs  int64  `json:"durationMs"`
+}
+
+type countdown struct {
+	room, name string
+	duration   time.Duration
+	deadline   time.Time
+	stop       func() bool // disarms the pending update or expiry
+}
+
+func (cd *countdown) info(state string, now time.Time) TimerInfo {
+	remaining := cd.deadline.Sub(now)
+	if remaining < 0 || state != "running" {
+		remaining = 0
+	}
+	return TimerInfo{Name: cd.name, State: state, RemainingMs: remaining.Milliseconds(), DurationMs: cd.duration.Milliseconds()}
+}
+
+// Timers runs the countdowns of a hub's rooms
+type Timers struct {
+	hub   *Hub
+	clock Clock // the wall clock, or a simulation's (see simulate.go)
+
+	mu     sync.Mutex
+	timers map[string]map[string]*countdown // room -> name -> countdown
+}
+
+func NewTimers(h *Hub) *Timers {
+	return &Timers{hub: h, clock: wallClock{}, timers: make(map[string]map[string]*countdown)}
+}
+
+// Start begins (or restarts) the countdown name in room; onExpire, if not
+// nil, runs on its own goroutine when it reaches zero
+func (t *Timers) Start(room, name string, d time.Duration, onExpire func()) {
+	now := t.clock.Now()
+	cd := &countdown{room: room, name: name, duration: d, deadline: now.Add(d)}
+	t.mu.Lock()
+	if old := t.timers[room][name]; old != nil {
+		old.stop()
+	}
+	if t.timers[room] == nil {
+		t.timers[room] = make(map[string]*countdown)
+	}
+	t.timers[room][name] = cd
+	t.arm(cd, now, onExpire)
+	t.mu.Unlock()
+	t.send(room, cd.info("running", now))
+}
+
+// Cancel stops a countdown without running its callback
+func (t *Timers) Cancel(room, name string) bool {
+	t.mu.Lock()
+	cd := t.timers[room][name]
+	if cd != nil {
+		cd.stop()
+		t.removeLocked(cd)
+	}
+	t.mu.Unlock()
+	if cd == nil {
+		return false
+	}
+	t.send(room, cd.info("cancelled", t.clock.Now()))
+	return true
+}
+
+// Remaining returns how long the countdown has left
+func (t *Timers) Remaining(room, name string) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cd := t.timers[room][name]
+	if cd == nil {
+		return 0, false
+	}
+	return cd.deadline.Sub(t.clock.Now()), true
+}
+
+// List returns room's running countdowns by name
+func (t *Timers) List(room string) []TimerInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := []TimerInfo{}
+	now := t.clock.Now()
+	for _, cd := range t.timers[room] {
+		out = append(out, cd.info("running", now))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// arm schedules cd's next update, or its expiry when that comes first;
+// requires t.mu
+func (t *Timers) arm(cd *countdown, now time.Time, onExpire func()) {
+	wait, expiring := timerUpdateInterval, false
+	if left := cd.deadline.Sub(now); left <= wait {
+		wait, expiring = left, true
+	}
+	cd.stop = t.clock.AfterFunc(wait, func() {
+		t.mu.Lock()
+		if t.timers[cd.room][cd.name] != cd { // cancelled or restarted meanwhile
+			t.mu.Unlock()
+			return
+		}
+		now := t.clock.Now()
+		if !expiring {
+			t.arm(cd, now, onExpire)
+			t.mu.Unlock()
+			t.send(cd.room, cd.info("running", now))
+			return
+		}
+		t.removeLocked(cd)
+		t.mu.Unlock()
+		t.send(cd.room, cd.info("expired", now))
+		if onExpire != nil {
+			onExpire()
+		}
+	})
+}
+
+// removeLocked requires t.mu
+func (t *Timers) removeLocked(cd *countdown) {
+	delete(t.timers[cd.room], cd.name)
+	if len(t.timers[cd.room]) == 0 {
+		delete(t.timers, cd.room)
+	}
+}
+
+func (t *Timers) send(room string, info TimerInfo) {
+	data, _ := json.Marshal(info)
+	b, _ := json.Marshal(Message{Type: "timer", Sender: "server", Data: data})
+	t.hub.BroadcastRoomRaw(room, b)
+}
+
+// TimersMiddleware answers timer.list
+func TimersMiddleware(t *Timers) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(c *Client, m Message) {
+			if m.Type != "timer.list" {
+				next(c, m)
+				return
+			}
+			room := t.hub.RoomOf(c)
+			if room == "" {
+				sendError(c, "timer.no_room")
+				return
+			}
+			data, _ := json.Marshal(t.List(room))
+			b, _ := json.Marshal(Message{Type: "timer.list", Sender: "server", Data: data})
+			c.Send(b)
+		}
+	}
+}
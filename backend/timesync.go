@@ -0,0 +1,113 @@
+// backend/timesync.go
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+/*
+Clock sync. Clients that show countdowns or turn timers need the server's
+clock, not their own. They ask for it NTP-style:
+
+	{"type":"time.sync","data":{"t0":1714550400000}}                    t0 = client send time, unix ms
+	{"type":"time.sync","data":{"t0":1714550400000,"t1":1714550400731,"t2":1714550400732}}
+
+t1 is when the server received the request and t2 when it answered. With
+t3 the client's receive time,
+
+	rtt    = (t3 - t0) - (t2 - t1)
+	offset = ((t1 - t0) + (t2 - t3)) / 2      server clock minus client clock
+
+A few exchanges at connect and one every minute or so are plenty; clients
+should keep the sample with the smallest rtt. A client may report what it
+computed in its next request ("offset" and "rtt", in ms).
+
+The server keeps its own estimate per client for lag compensation: the
+round trip of websocket pings (or the client's reported rtt before the
+first pong) and t1 - t0 - rtt/2 from each request, smoothed. Games read it
+with c.ClockOffset() and turn client timestamps into server time with
+c.ServerTime(ms).
+*/
+
+// weight of a new sample in the smoothed estimates
+const clockSmoothing = 0.25
+
+// clockEstimate is the server's view of a client's clock
+type clockEstimate struct {
+	mu      sync.Mutex
+	offset  float64 // ms, server minus client
+	rtt     float64 // ms
+	samples int
+}
+
+// smooth folds sample into the running average v
+func smooth(v, sample float64, first bool) float64 {
+	if first {
+		return sample
+	}
+	return v + clockSmoothing*(sample-v)
+}
+
+// observeRTT records a measured round trip
+func (e *clockEstimate) observeRTT(d time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ms := float64(d) / float64(time.Millisecond)
+	e.rtt = smooth(e.rtt, ms, e.rtt == 0)
+}
+
+// observeSync records a time.sync request sent at client time t0 and
+// received at server time t1; reported is the client's rtt, if any
+func (e *clockEstimate) observeSync(t0, t1 int64, reported float64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.rtt == 0 && reported > 0 {
+		e.rtt = reported
+	}
+	sample := float64(t1-t0) - e.rtt/2
+	e.offset = smooth(e.offset, sample, e.samples == 0)
+	e.samples++
+}
+
+// ClockOffset returns how far the server's clock is ahead of c's and the
+// round trip to c; ok is false until c has sent a time.sync
+func (c *Client) ClockOffset() (offset, rtt time.Duration, ok bool) {
+	e := &c.clock
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return time.Duration(e.offset * float64(time.Millisecond)), time.Duration(e.rtt * float64(time.Millisecond)), e.samples > 0
+}
+
+// ServerTime converts a timestamp from c's clock (unix ms) to server time;
+// without an estimate it is taken as is
+func (c *Client) ServerTime(clientMs int64) time.Time {
+	offset, _, _ := c.ClockOffset()
+	return time.UnixMilli(clientMs).Add(offset)
+}
+
+// TimeSyncMiddleware answers time.sync
+func TimeSyncMiddleware() Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(c *Client, m Message) {
+			if m.Type != "time.sync" {
+				next(c, m)
+				return
+			}
+			var req struct {
+				T0  int64   `json:"t0"`
+				RTT float64 `json:"rtt"`
+			}
+			if err := json.Unmarshal(m.Data, &req); err != nil || req.T0 <= 0 {
+				sendError(c, "bad_data", m.Type, "t0 required")
+				return
+			}
+			t1 := m.Ts // stamped on receipt
+			c.clock.observeSync(req.T0, t1, req.RTT)
+			data, _ := json.Marshal(map[string]int64{"t0": req.T0, "t1": t1, "t2": time.Now().UnixMilli()})
+			b, _ := json.Marshal(Message{Type: "time.sync", Sender: "server", Data: data})
+			c.trySend(b)
+		}
+	}
+}
@@ -0,0 +1,652 @@
+// backend/tournament.go
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Single-elimination tournaments. An operator opens one on a game:
+
+	POST /api/admin/tournaments  {"name":"Friday cup","game":"/ws","maxPlayers":8}
+
+Logged-in players of that game sign up until it starts:
+
+	{"type":"tournament.list"}
+	{"type":"tournament.register","data":{"id":"t-3f9a1c02"}}
+	{"type":"tournament.unregister","data":{"id":"t-3f9a1c02"}}
+
+It starts when it is full or on POST /api/admin/tournaments/{id}/start.
+Players are seeded in sign-up order into a bracket of the next power of
+two; the top seeds get byes. Every round is a stage: each match gets a
+fresh room, both players' connections are moved into it and told
+
+	{"type":"tournament.match","data":{"tournament":"t-3f9a1c02","round":1,"match":0,"room":"t-3f9a1c02-r1m0","opponent":"bob"}}
+
+and the game in that room plays as usual. When it reports the result
+(Hub.ReportResult), the winner (outcome "win", else the sole best rank)
+advances; a draw is replayed in a new room. A player who isn't connected
+to the game when their match starts loses it by walkover; one who
+reconnects during their match is put back into its room. Players and
+anyone who sent
+
+	{"type":"tournament.watch","data":{"id":"t-3f9a1c02"}}     until tournament.unwatch
+
+get the whole bracket as {"type":"tournament.bracket","data":{...}} on
+every change. Operators can settle a stuck match or cancel:
+
+	GET    /api/admin/tournaments[/{id}]
+	POST   /api/admin/tournaments/{id}/result  {"round":1,"match":0,"winner":"alice"}
+	DELETE /api/admin/tournaments/{id}
+
+Tournaments are kept in memory only.
+*/
+
+// tournament states
+const (
+	tournamentOpen     = "registering"
+	tournamentRunning  = "running"
+	tournamentFinished = "finished"
+	tournamentCanceled = "canceled"
+)
+
+// match states
+const (
+	bracketWaiting = "waiting" // for its players
+	bracketPlaying = "playing"
+	bracketDone    = "done"
+)
+
+// bracketMatch is one pairing of a round
+type bracketMatch struct {
+	Players  [2]string `json:"players"` // "" = bye, or not known yet
+	Room     string    `json:"room,omitempty"`
+	Winner   string    `json:"winner,omitempty"`
+	Status   string    `json:"status"`
+	Replays  int       `json:"replays,omitempty"` // draws so far
+	Walkover bool      `json:"walkover,omitempty"`
+}
+
+// Tournament is one bracket on one game
+type Tournament struct {
+	ID         string            `json:"id"`
+	Name       string            `json:"name"`
+	Game       string            `json:"game"`
+	MaxPlayers int               `json:"maxPlayers"`
+	State      string            `json:"state"`
+	Players    []string          `json:"players"` // in seed order
+	Rounds     [][]*bracketMatch `json:"rounds,omitempty"`
+	Champion   string            `json:"champion,omitempty"`
+	Created    time.Time         `json:"created"`
+
+	hub      *Hub
+	watchers map[*Client]bool
+}
+
+// Tournaments runs the tournaments of every game
+type Tournaments struct {
+	mu     sync.Mutex
+	hubs   map[string]*Hub // game path -> hub
+	byID   map[string]*Tournament
+	byRoom map[string]*Tournament // rooms of running matches, "<game> <room>"
+}
+
+func NewTournaments() *Tournaments {
+	return &Tournaments{hubs: make(map[string]*Hub), byID: make(map[string]*Tournament), byRoom: make(map[string]*Tournament)}
+}
+
+// AddHub lets tournaments be held on hub's game
+func (ts *Tournaments) AddHub(hub *Hub) {
+	ts.mu.Lock()
+	ts.hubs[hub.path] = hub
+	ts.mu.Unlock()
+	hub.events.Subscribe(func(e Event) {
+		switch e.Kind {
+		case EventMatchFinished:
+			ts.finished(hub, e.Result)
+		case EventClientConnected:
+			ts.rejoin(hub, e.Client)
+		case EventClientDisconnected:
+			ts.unwatchAll(e.Client)
+		}
+	}, EventMatchFinished, EventClientConnected, EventClientDisconnected)
+}
+
+func roomKeyOf(hub *Hub, room string) string { return hub.path + " " + room }
+
+// Create opens a tournament for registration
+func (ts *Tournaments) Create(name, game string, maxPlayers int) (*Tournament, error) {
+	if maxPlayers < 2 {
+		return nil, fmt.Errorf("maxPlayers must be at least 2")
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	hub := ts.hubs[game]
+	if hub == nil {
+		return nil, fmt.Errorf("no game at %q", game)
+	}
+	b := make([]byte, 4)
+	rand.Read(b)
+	t := &Tournament{
+		ID:         "t-" + hex.EncodeToString(b),
+		Name:       name,
+		Game:       game,
+		MaxPlayers: maxPlayers,
+		State:      tournamentOpen,
+		Players:    []string{},
+		Created:    time.Now(),
+		hub:        hub,
+		watchers:   make(map[*Client]bool),
+	}
+	ts.byID[t.ID] = t
+	return t, nil
+}
+
+// view is a copy of t safe to marshal outside ts.mu
+func (t *Tournament) view() Tournament {
+	v := *t
+	v.Players = append([]string{}, t.Players...)
+	v.Rounds = make([][]*bracketMatch, len(t.Rounds))
+	for i, round := range t.Rounds {
+		v.Rounds[i] = make([]*bracketMatch, len(round))
+		for j, m := range round {
+			cp := *m
+			v.Rounds[i][j] = &cp
+		}
+	}
+	v.watchers = nil
+	return v
+}
+
+// publishLocked sends the bracket to t's players and watchers
+func (ts *Tournaments) publishLocked(t *Tournament) {
+	data, _ := json.Marshal(t.view())
+	b, _ := json.Marshal(Message{Type: "tournament.bracket", Sender: "server", Data: data})
+	sent := make(map[*Client]bool)
+	for _, p := range t.Players {
+		for _, c := range t.hub.FindClients(p) {
+			sent[c] = true
+		}
+	}
+	for c := range t.watchers {
+		sent[c] = true
+	}
+	for c := range sent {
+		c.trySend(b)
+	}
+}
+
+// register signs userID up; it returns the reply code
+func (ts *Tournaments) register(id, userID string, on bool) (code string, ok bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	t := ts.byID[id]
+	switch {
+	case t == nil:
+		return "tournament.unknown", false
+	case t.State != tournamentOpen:
+		return "tournament.closed", false
+	case on && containsString(t.Players, userID):
+		return "tournament.registered", true
+	case on && len(t.Players) >= t.MaxPlayers:
+		return "tournament.full", false
+	case !on && !containsString(t.Players, userID):
+		return "tournament.not_registered", false
+	}
+	if on {
+		t.Players = append(t.Players, userID)
+	} else {
+		t.Players = without(t.Players, userID)
+	}
+	if len(t.Players) == t.MaxPlayers {
+		ts.startLocked(t)
+	} else {
+		ts.publishLocked(t)
+	}
+	if on {
+		return "tournament.registered", true
+	}
+	return "tournament.unregistered", true
+}
+
+// Start closes registration and plays the first round
+func (ts *Tournaments) Start(id string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	t := ts.byID[id]
+	switch {
+	case t == nil:
+		return fmt.Errorf("no tournament %s", id)
+	case t.State != tournamentOpen:
+		return fmt.Errorf("tournament %s is %s", id, t.State)
+	case len(t.Players) < 2:
+		return fmt.Errorf("tournament %s needs at least 2 players", id)
+	}
+	ts.startLocked(t)
+	return nil
+}
+
+// startLocked builds the bracket: round 1 pairs seed i with seed
+// size+1-i, so byes go to the top seeds
+func (ts *Tournaments) startLocked(t *Tournament) {
+	size := 2
+	for size < len(t.Players) {
+		size *= 2
+	}
+	order := bracketOrder(size)
+	for n := size / 2; n >= 1; n /= 2 {
+		round := make([]*bracketMatch, n)
+		for i := range round {
+			round[i] = &bracketMatch{Status: bracketWaiting}
+		}
+		t.Rounds = append(t.Rounds, round)
+	}
+	for i, m := range t.Rounds[0] {
+		for side := 0; side < 2; side++ {
+			if seed := order[2*i+side]; seed < len(t.Players) {
+				m.Players[side] = t.Players[seed]
+			}
+		}
+	}
+	t.State = tournamentRunning
+	for i := range t.Rounds[0] {
+		ts.playLocked(t, 0, i)
+	}
+	ts.publishLocked(t)
+}
+
+// bracketOrder returns the seeds (0-based) in bracket order for size
+// players, so that 0 and 1 can only meet in the final
+func bracketOrder(size int) []int {
+	order := []int{0}
+	for n := 2; n <= size; n *= 2 {
+		next := make([]int, 0, n)
+		for _, s := range order {
+			next = append(next, s, n-1-s)
+		}
+		order = next
+	}
+	return order
+}
+
+// playLocked starts match i of round r, or settles it by bye or walkover
+func (ts *Tournaments) playLocked(t *Tournament, r, i int) {
+	m := t.Rounds[r][i]
+	a, b := m.Players[0], m.Players[1]
+	if r == 0 && (a == "" || b == "") {
+		ts.decideLocked(t, r, i, a+b, false) // bye
+		return
+	}
+	online := [2]bool{len(t.hub.FindClients(a)) > 0, len(t.hub.FindClients(b)) > 0}
+	switch {
+	case !online[0] && !online[1]:
+		ts.decideLocked(t, r, i, a, true) // the better seed goes through
+		return
+	case !online[0]:
+		ts.decideLocked(t, r, i, b, true)
+		return
+	case !online[1]:
+		ts.decideLocked(t, r, i, a, true)
+		return
+	}
+	if m.Room != "" {
+		delete(ts.byRoom, roomKeyOf(t.hub, m.Room))
+	}
+	m.Room = fmt.Sprintf("%s-r%dm%d", t.ID, r+1, i)
+	if m.Replays > 0 {
+		m.Room += "-" + strconv.Itoa(m.Replays+1)
+	}
+	m.Status = bracketPlaying
+	ts.byRoom[roomKeyOf(t.hub, m.Room)] = t
+	for side, p := range m.Players {
+		data, _ := json.Marshal(map[string]interface{}{"tournament": t.ID, "round": r + 1, "match": i, "room": m.Room, "opponent": m.Players[1-side]})
+		msg, _ := json.Marshal(Message{Type: "tournament.match", Sender: "server", Data: data})
+		for _, c := range t.hub.FindClients(p) {
+			t.hub.JoinRoom(c, m.Room)
+			c.trySend(msg)
+		}
+	}
+}
+
+// decideLocked records winner for match i of round r and moves them on
+func (ts *Tournaments) decideLocked(t *Tournament, r, i int, winner string, walkover bool) {
+	m := t.Rounds[r][i]
+	if m.Room != "" {
+		delete(ts.byRoom, roomKeyOf(t.hub, m.Room))
+	}
+	m.Winner, m.Status, m.Walkover = winner, bracketDone, walkover
+	if r == len(t.Rounds)-1 {
+		t.Champion = winner
+		t.State = tournamentFinished
+		return
+	}
+	next := t.Rounds[r+1][i/2]
+	next.Players[i%2] = winner
+	other := t.Rounds[r][i^1]
+	if other.Status == bracketDone {
+		ts.playLocked(t, r+1, i/2)
+	}
+}
+
+// finished applies a match result reported on hub
+func (ts *Tournaments) finished(hub *Hub, res *GameResult) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	t := ts.byRoom[roomKeyOf(hub, res.Room)]
+	if t == nil || t.State != tournamentRunning {
+		return
+	}
+	r, i := t.find(res.Room)
+	if r < 0 {
+		return
+	}
+	m := t.Rounds[r][i]
+	if winner := resultWinner(res, m.Players); winner != "" {
+		ts.decideLocked(t, r, i, winner, false)
+	} else {
+		m.Replays++
+		ts.playLocked(t, r, i)
+	}
+	ts.publishLocked(t)
+}
+
+// find returns the round and index of the match playing in room
+func (t *Tournament) find(room string) (int, int) {
+	for r, round := range t.Rounds {
+		for i, m := range round {
+			if m.Room == room && m.Status == bracketPlaying {
+				return r, i
+			}
+		}
+	}
+	return -1, -1
+}
+
+// resultWinner picks the winner among players from res: the one with
+// outcome "win", else the only one ranked first; "" for a draw
+func resultWinner(res *GameResult, players [2]string) string {
+	best, bestRank, tied := "", 0, false
+	for _, p := range res.Players {
+		if p.ID != players[0] && p.ID != players[1] {
+			continue
+		}
+		if p.Outcome == "win" {
+			return p.ID
+		}
+		switch {
+		case p.Rank > 0 && (bestRank == 0 || p.Rank < bestRank):
+			best, bestRank, tied = p.ID, p.Rank, false
+		case p.Rank > 0 && p.Rank == bestRank:
+			tied = true
+		}
+	}
+	if tied {
+		return ""
+	}
+	return best
+}
+
+// SetResult settles a match by hand
+func (ts *Tournaments) SetResult(id string, round, match int, winner string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	t := ts.byID[id]
+	if t == nil {
+		return fmt.Errorf("no tournament %s", id)
+	}
+	if t.State != tournamentRunning || round < 1 || round > len(t.Rounds) || match < 0 || match >= len(t.Rounds[round-1]) {
+		return fmt.Errorf("no running match %d of round %d", match, round)
+	}
+	m := t.Rounds[round-1][match]
+	if m.Status != bracketPlaying || (winner != m.Players[0] && winner != m.Players[1]) {
+		return fmt.Errorf("match %d of round %d isn't being played by %q", match, round, winner)
+	}
+	ts.decideLocked(t, round-1, match, winner, false)
+	ts.publishLocked(t)
+	return nil
+}
+
+// Cancel ends a tournament without a champion, or forgets a finished one
+func (ts *Tournaments) Cancel(id string) bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	t := ts.byID[id]
+	if t == nil {
+		return false
+	}
+	for _, round := range t.Rounds {
+		for _, m := range round {
+			if m.Room != "" {
+				delete(ts.byRoom, roomKeyOf(t.hub, m.Room))
+			}
+		}
+	}
+	if t.State != tournamentFinished {
+		t.State = tournamentCanceled
+		ts.publishLocked(t)
+	}
+	delete(ts.byID, id)
+	return true
+}
+
+// rejoin puts a reconnecting player back into their match room
+func (ts *Tournaments) rejoin(hub *Hub, c *Client) {
+	id := presenceIdentity(c)
+	ts.mu.Lock()
+	room := ""
+	for _, t := range ts.byID {
+		if t.hub != hub || t.State != tournamentRunning {
+			continue
+		}
+		for _, round := range t.Rounds {
+			for _, m := range round {
+				if m.Status == bracketPlaying && (m.Players[0] == id || m.Players[1] == id) {
+					room = m.Room
+				}
+			}
+		}
+	}
+	ts.mu.Unlock()
+	if room != "" {
+		hub.JoinRoom(c, room)
+	}
+}
+
+func (ts *Tournaments) watch(id string, c *Client, on bool) (Tournament, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	t := ts.byID[id]
+	if t == nil {
+		return Tournament{}, false
+	}
+	if on {
+		t.watchers[c] = true
+	} else {
+		delete(t.watchers, c)
+	}
+	return t.view(), true
+}
+
+func (ts *Tournaments) unwatchAll(c *Client) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for _, t := range ts.byID {
+		delete(t.watchers, c)
+	}
+}
+
+// tournamentSummary is one entry of tournament.list
+type tournamentSummary struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	State      string `json:"state"`
+	Players    int    `json:"players"`
+	MaxPlayers int    `json:"maxPlayers"`
+	Champion   string `json:"champion,omitempty"`
+}
+
+// list returns the tournaments on game ("" = all), newest first
+func (ts *Tournaments) list(game string) []tournamentSummary {
+	ts.mu.Lock()
+	var all []*Tournament
+	for _, t := range ts.byID {
+		if game == "" || t.Game == game {
+			all = append(all, t)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Created.After(all[j].Created) })
+	out := make([]tournamentSummary, 0, len(all))
+	for _, t := range all {
+		out = append(out, tournamentSummary{ID: t.ID, Name: t.Name, State: t.State, Players: len(t.Players), MaxPlayers: t.MaxPlayers, Champion: t.Champion})
+	}
+	ts.mu.Unlock()
+	return out
+}
+
+// get returns a copy of tournament id
+func (ts *Tournaments) get(id string) (Tournament, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	t := ts.byID[id]
+	if t == nil {
+		return Tournament{}, false
+	}
+	return t.view(), true
+}
+
+// TournamentMiddleware handles tournament.* for hub's game
+func TournamentMiddleware(ts *Tournaments, hub *Hub) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(c *Client, m Message) {
+			switch m.Type {
+			case "tournament.list", "tournament.register", "tournament.unregister", "tournament.watch", "tournament.unwatch":
+			default:
+				next(c, m)
+				return
+			}
+			reply := func(typ string, v interface{}) {
+				data, _ := json.Marshal(v)
+				b, _ := json.Marshal(Message{Type: typ, Sender: "server", Data: data})
+				c.Send(b)
+			}
+			if m.Type == "tournament.list" {
+				reply("tournament.list", map[string]interface{}{"tournaments": ts.list(hub.path)})
+				return
+			}
+			var req struct {
+				ID string `json:"id"`
+			}
+			if err := json.Unmarshal(m.Data, &req); err != nil || req.ID == "" {
+				sendError(c, "bad_data", m.Type, `want {"id":...}`)
+				return
+			}
+			switch m.Type {
+			case "tournament.register", "tournament.unregister":
+				if c.userID == "" {
+					sendError(c, "auth.required", m.Type)
+					return
+				}
+				if code, ok := ts.register(req.ID, c.userID, m.Type == "tournament.register"); ok {
+					sendSystem(c, code, req.ID)
+				} else {
+					sendError(c, code, req.ID)
+				}
+			case "tournament.watch", "tournament.unwatch":
+				t, ok := ts.watch(req.ID, c, m.Type == "tournament.watch")
+				switch {
+				case !ok:
+					sendError(c, "tournament.unknown", req.ID)
+				case m.Type == "tournament.watch":
+					reply("tournament.bracket", t)
+				default:
+					sendSystem(c, "ok", m.Type)
+				}
+			}
+		}
+	}
+}
+
+// RegisterAdmin mounts /api/admin/tournaments
+func (ts *Tournaments) RegisterAdmin(a *AdminAPI) {
+	a.Handle("/api/admin/tournaments", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, ts.list(r.URL.Query().Get("game")))
+		case http.MethodPost:
+			var req struct {
+				Name       string `json:"name"`
+				Game       string `json:"game"`
+				MaxPlayers int    `json:"maxPlayers"`
+			}
+			if err := readJSON(w, r, &req); err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if req.Game == "" {
+				req.Game = "/ws"
+			}
+			t, err := ts.Create(req.Name, req.Game, req.MaxPlayers)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			a.audit.Record(adminActor(r), "tournament.create", t.ID, req.Name)
+			v, _ := ts.get(t.ID)
+			writeJSON(w, http.StatusCreated, v)
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, "use GET or POST")
+		}
+	})
+	a.Handle("/api/admin/tournaments/", func(w http.ResponseWriter, r *http.Request) {
+		id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/admin/tournaments/"), "/")
+		var err error
+		switch {
+		case action == "" && r.Method == http.MethodGet:
+		case action == "" && r.Method == http.MethodDelete:
+			if !ts.Cancel(id) {
+				writeJSONError(w, http.StatusNotFound, "no tournament "+id)
+				return
+			}
+			a.audit.Record(adminActor(r), "tournament.cancel", id, "")
+			writeJSON(w, http.StatusOK, map[string]string{"canceled": id})
+			return
+		case action == "start" && r.Method == http.MethodPost:
+			if err = ts.Start(id); err == nil {
+				a.audit.Record(adminActor(r), "tournament.start", id, "")
+			}
+		case action == "result" && r.Method == http.MethodPost:
+			var req struct {
+				Round  int    `json:"round"`
+				Match  int    `json:"match"`
+				Winner string `json:"winner"`
+			}
+			if err = readJSON(w, r, &req); err == nil {
+				if err = ts.SetResult(id, req.Round, req.Match, req.Winner); err == nil {
+					a.audit.Record(adminActor(r), "tournament.result", id, fmt.Sprintf("round %d match %d: %s", req.Round, req.Match, req.Winner))
+				}
+			}
+		default:
+			writeJSONError(w, http.StatusNotFound, "want GET|DELETE /api/admin/tournaments/{id} or POST .../start|result")
+			return
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		t, ok := ts.get(id)
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "no tournament "+id)
+			return
+		}
+		writeJSON(w, http.StatusOK, t)
+	})
+}
@@ -0,0 +1,332 @@
+// backend/trivia.go
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+TriviaGame (-mode=trivia) runs timed quiz rounds per room from a question
+bank, configured by the "trivia" config block:
+
+	"trivia": {"questions": "questions.json", "rounds": 10, "roundTime": "15s", "pause": "4s", "maxPoints": 1000}
+
+The bank is a JSON array or a CSV file (question,answer,choice,choice,...):
+
+	[{"question": "2+2?", "answer": "4", "choices": ["3", "4", "5"], "category": "math"}]
+
+In a room, {"type":"trivia.start"} begins a match. Each round the room gets
+
+	{"type":"trivia.question","data":{"round":1,"rounds":10,"question":"2+2?","choices":[...],"timeMs":15000}}
+
+and a "trivia.round" countdown (see timers.go). Players reply with
+{"type":"answer","payload":"4"}; the first answer counts. The round ends
+when the time is up or everyone in the room has answered, with
+
+	{"type":"trivia.result","data":{"round":1,"answer":"4","points":{"alice":870},"scores":[...]}}
+
+A correct answer is worth maxPoints scaled from 100% (instant) down to 50%
+(at the buzzer). After the last round the room gets "trivia.leaderboard"
+and the match is reported to match history.
+*/
+
+// TriviaConfig is the "trivia" config block
+type TriviaConfig struct {
+	Questions string   `json:"questions,omitempty"` // JSON or CSV file, default questions.json
+	Rounds    int      `json:"rounds,omitempty"`    // default 10
+	RoundTime Duration `json:"roundTime,omitempty"` // default 15s
+	Pause     Duration `json:"pause,omitempty"`     // between rounds, default 4s
+	MaxPoints int      `json:"maxPoints,omitempty"` // default 1000
+}
+
+func (cfg TriviaConfig) withDefaults() TriviaConfig {
+	if cfg.Questions == "" {
+		cfg.Questions = "questions.json"
+	}
+	if cfg.Rounds <= 0 {
+		cfg.Rounds = 10
+	}
+	if cfg.RoundTime <= 0 {
+		cfg.RoundTime = Duration(15 * time.Second)
+	}
+	if cfg.Pause <= 0 {
+		cfg.Pause = Duration(4 * time.Second)
+	}
+	if cfg.MaxPoints <= 0 {
+		cfg.MaxPoints = 1000
+	}
+	return cfg
+}
+
+// TriviaQuestion is one entry of the question bank
+type TriviaQuestion struct {
+	Question string   `json:"question"`
+	Answer   string   `json:"answer"`
+	Choices  []string `json:"choices,omitempty"`
+	Category string   `json:"category,omitempty"`
+}
+
+// LoadTriviaQuestions reads a .json or .csv question bank
+func LoadTriviaQuestions(path string) ([]TriviaQuestion, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var qs []TriviaQuestion
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		r := csv.NewReader(f)
+		r.FieldsPerRecord = -1
+		rows, err := r.ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			if len(row) < 2 || strings.EqualFold(row[0], "question") {
+				continue // short row or header
+			}
+			qs = append(qs, TriviaQuestion{Question: row[0], Answer: row[1], Choices: row[2:]})
+		}
+	} else if err := json.NewDecoder(f).Decode(&qs); err != nil {
+		return nil, err
+	}
+	for i, q := range qs {
+		if q.Question == "" || q.Answer == "" {
+			return nil, fmt.Errorf("question %d: question and answer are required", i+1)
+		}
+	}
+	if len(qs) == 0 {
+		return nil, errors.New("no questions")
+	}
+	return qs, nil
+}
+
+// TriviaScore is one line of the scoreboard
+type TriviaScore struct {
+	Player string `json:"player"`
+	Name   string `json:"name,omitempty"`
+	Score  int    `json:"score"`
+	Rank   int    `json:"rank"`
+}
+
+type triviaMatch struct {
+	questions []TriviaQuestion
+	round     int // index into questions
+	asked     time.Time
+	answers   map[string]int // player -> points this round
+	scores    map[string]int
+	names     map[string]string
+	started   time.Time
+	open      bool // accepting answers
+}
+
+// TriviaGame runs one quiz per room
+type TriviaGame struct {
+	hub       *Hub
+	cfg       TriviaConfig
+	questions []TriviaQuestion
+
+	mu      sync.Mutex
+	matches map[string]*triviaMatch // room -> match
+}
+
+func NewTriviaGame(h *Hub, cfg TriviaConfig) (*TriviaGame, error) {
+	cfg = cfg.withDefaults()
+	qs, err := LoadTriviaQuestions(cfg.Questions)
+	if err != nil {
+		return nil, fmt.Errorf("trivia questions: %v", err)
+	}
+	return &TriviaGame{hub: h, cfg: cfg, questions: qs, matches: make(map[string]*triviaMatch)}, nil
+}
+
+func (g *TriviaGame) OnConnect(c *Client) {
+	sendSystem(c, "welcome.trivia", len(g.questions))
+}
+
+func (g *TriviaGame) OnMessage(c *Client, m Message) {
+	room := g.hub.RoomOf(c)
+	if room == "" {
+		sendError(c, "trivia.no_room", m.Type)
+		return
+	}
+	switch m.Type {
+	case "trivia.start":
+		g.start(c, room)
+	case "answer":
+		g.answer(c, room, m.Payload)
+	default:
+		sendError(c, "message.unknown_type", m.Type)
+	}
+}
+
+func (g *TriviaGame) OnBinaryMessage(c *Client, data []byte) {
+	sendError(c, "binary.unhandled")
+}
+
+func (g *TriviaGame) OnDisconnect(c *Client) {
+	// scores stay; the round simply doesn't wait for them
+}
+
+func (g *TriviaGame) start(c *Client, room string) {
+	g.mu.Lock()
+	if g.matches[room] != nil {
+		g.mu.Unlock()
+		sendError(c, "trivia.running")
+		return
+	}
+	n := g.cfg.Rounds
+	if n > len(g.questions) {
+		n = len(g.questions)
+	}
+	qs := make([]TriviaQuestion, 0, n)
+	for _, i := range rand.Perm(len(g.questions))[:n] {
+		qs = append(qs, g.questions[i])
+	}
+	g.matches[room] = &triviaMatch{
+		questions: qs,
+		scores:    make(map[string]int),
+		names:     make(map[string]string),
+		started:   g.hub.Now(),
+	}
+	g.mu.Unlock()
+	g.ask(room)
+}
+
+// ask sends the current question of room's match and starts the round timer
+func (g *TriviaGame) ask(room string) {
+	g.mu.Lock()
+	match := g.matches[room]
+	if match == nil {
+		g.mu.Unlock()
+		return
+	}
+	q := match.questions[match.round]
+	match.answers = make(map[string]int)
+	match.asked = g.hub.Now()
+	match.open = true
+	round := match.round + 1
+	g.mu.Unlock()
+
+	g.send(room, "trivia.question", map[string]interface{}{
+		"round":    round,
+		"rounds":   len(match.questions),
+		"question": q.Question,
+		"choices":  q.Choices,
+		"category": q.Category,
+		"timeMs":   time.Duration(g.cfg.RoundTime).Milliseconds(),
+	})
+	g.hub.timers.Start(room, "trivia.round", time.Duration(g.cfg.RoundTime), func() { g.endRound(room, round) })
+}
+
+func (g *TriviaGame) answer(c *Client, room, text string) {
+	player := presenceIdentity(c)
+	g.mu.Lock()
+	match := g.matches[room]
+	if match == nil || !match.open {
+		g.mu.Unlock()
+		sendError(c, "trivia.not_running")
+		return
+	}
+	if _, done := match.answers[player]; done {
+		g.mu.Unlock()
+		sendError(c, "trivia.already_answered")
+		return
+	}
+	points := 0
+	if strings.EqualFold(strings.TrimSpace(text), match.questions[match.round].Answer) {
+		left := 1 - float64(g.hub.Now().Sub(match.asked))/float64(g.cfg.RoundTime)
+		points = int(math.Round(float64(g.cfg.MaxPoints) * (0.5 + 0.5*math.Max(0, left))))
+	}
+	match.answers[player] = points
+	match.scores[player] += points
+	if c.name != "" {
+		match.names[player] = c.name
+	}
+	everyone := len(match.answers) >= g.hub.Rooms()[room]
+	round := match.round + 1
+	g.mu.Unlock()
+
+	b, _ := json.Marshal(Message{Type: "trivia.answered", Sender: "server"})
+	c.Send(b)
+	if everyone && g.hub.timers.Cancel(room, "trivia.round") {
+		g.endRound(room, round)
+	}
+}
+
+// endRound closes round (1-based) of room's match, once
+func (g *TriviaGame) endRound(room string, round int) {
+	g.mu.Lock()
+	match := g.matches[room]
+	if match == nil || !match.open || match.round+1 != round {
+		g.mu.Unlock()
+		return
+	}
+	match.open = false
+	answer := match.questions[match.round].Answer
+	points := make(map[string]int, len(match.answers))
+	for p, n := range match.answers {
+		if n > 0 {
+			points[p] = n
+		}
+	}
+	scores := match.scoreboard()
+	match.round++
+	last := match.round == len(match.questions)
+	if last {
+		delete(g.matches, room)
+	}
+	g.mu.Unlock()
+
+	g.send(room, "trivia.result", map[string]interface{}{"round": round, "answer": answer, "points": points, "scores": scores})
+	if last {
+		g.finish(room, match, scores)
+		return
+	}
+	g.hub.timers.Start(room, "trivia.next", time.Duration(g.cfg.Pause), func() { g.ask(room) })
+}
+
+func (g *TriviaGame) finish(room string, match *triviaMatch, scores []TriviaScore) {
+	g.send(room, "trivia.leaderboard", map[string]interface{}{"scores": scores})
+	res := GameResult{Game: "trivia", Room: room, Started: match.started}
+	for _, s := range scores {
+		res.Players = append(res.Players, PlayerResult{ID: s.Player, Name: s.Name, Score: float64(s.Score), Rank: s.Rank})
+	}
+	g.hub.ReportResult(res)
+}
+
+// scoreboard ranks players by score; requires the game's lock
+func (m *triviaMatch) scoreboard() []TriviaScore {
+	out := make([]TriviaScore, 0, len(m.scores))
+	for p, s := range m.scores {
+		out = append(out, TriviaScore{Player: p, Name: m.names[p], Score: s})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Score != out[j].Score {
+			return out[i].Score > out[j].Score
+		}
+		return out[i].Player < out[j].Player
+	})
+	for i := range out {
+		out[i].Rank = i + 1
+		if i > 0 && out[i].Score == out[i-1].Score {
+			out[i].Rank = out[i-1].Rank
+		}
+	}
+	return out
+}
+
+func (g *TriviaGame) send(room, typ string, data interface{}) {
+	d, _ := json.Marshal(data)
+	g.hub.BroadcastRoom(room, Message{Type: typ, Sender: "server", Data: d})
+}
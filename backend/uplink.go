@@ -0,0 +1,483 @@
+// backend/uplink.go
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+Uplinks let a server behind NAT (a game node at home, a LAN party box)
+take players without port forwarding: it dials out to a central server and
+players reach it through that server.
+
+On the central server, the "uplinks" config block names the nodes that may
+register and their tokens:
+
+	"uplinks": {"home-1": "s3cret", "lan-party": "0th3r"}
+
+An edge node lists the central server as a listener, next to or instead of
+its own ports:
+
+	"listeners": [
+	  {"network": "uplink", "addr": "wss://relay.example.com", "node": "home-1", "token": "s3cret"}
+	]
+
+The edge keeps a control websocket open to /uplink/connect (reconnecting
+with backoff when it drops). Players use the node's URLs under
+/edge/{node}/ on the central server, e.g. wss://relay.example.com/edge/home-1/ws.
+For each player connection the central server asks the edge over the
+control socket to open a tunnel, a second websocket to /uplink/data that
+carries the player's bytes both ways, and proxies the request through it
+with the /edge/{node} prefix removed. The edge serves tunnels like any
+other listener; its handlers see the player's address as RemoteAddr, so
+per-IP limits and bans work as if the player had connected directly.
+
+	GET /api/admin/uplinks    nodes registered on this server
+*/
+
+// uplinkOpenTimeout bounds how long a player waits for the edge's tunnel
+const uplinkOpenTimeout = 10 * time.Second
+
+// uplinkPing is how often the central server pings a node's control
+// socket; the edge reconnects after missing three
+const uplinkPing = 30 * time.Second
+
+// uplinkMsg is sent from the central server to an edge on the control socket
+type uplinkMsg struct {
+	Type   string `json:"type"`             // "open"
+	ID     string `json:"id,omitempty"`     // tunnel to open
+	Remote string `json:"remote,omitempty"` // the player's address
+}
+
+// Uplinks is the central side: registered edge nodes and the tunnels to them
+type Uplinks struct {
+	tokens map[string]string // node -> token
+
+	mu      sync.Mutex
+	nodes   map[string]*uplinkNode
+	pending map[string]*uplinkOpen
+}
+
+type uplinkNode struct {
+	name, remote string
+	since        time.Time
+	tunnels      int64 // atomic
+
+	wmu sync.Mutex // serializes writes to ws
+	ws  *websocket.Conn
+}
+
+func (n *uplinkNode) send(m uplinkMsg) error {
+	n.wmu.Lock()
+	defer n.wmu.Unlock()
+	n.ws.SetWriteDeadline(time.Now().Add(writeWait))
+	return n.ws.WriteJSON(m)
+}
+
+// uplinkOpen is a tunnel asked for but not opened yet
+type uplinkOpen struct {
+	node string
+	data chan *websocket.Conn
+	gone bool // the player gave up waiting; guarded by Uplinks.mu
+}
+
+func NewUplinks(tokens map[string]string) *Uplinks {
+	return &Uplinks{tokens: tokens, nodes: make(map[string]*uplinkNode), pending: make(map[string]*uplinkOpen)}
+}
+
+// authorized reports whether r carries the token of the node it names
+func (u *Uplinks) authorized(r *http.Request) (string, bool) {
+	node := r.URL.Query().Get("node")
+	token, ok := u.tokens[node]
+	bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return node, ok && token != "" && subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) == 1
+}
+
+// Register mounts /uplink/connect, /uplink/data and /edge/ on mux
+func (u *Uplinks) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/uplink/connect", u.handleConnect)
+	mux.HandleFunc("/uplink/data", u.handleData)
+	mux.HandleFunc("/edge/", u.handleEdge)
+}
+
+// handleConnect keeps a node's control socket until it drops
+func (u *Uplinks) handleConnect(w http.ResponseWriter, r *http.Request) {
+	name, ok := u.authorized(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	n := &uplinkNode{name: name, remote: r.RemoteAddr, since: time.Now(), ws: ws}
+	u.mu.Lock()
+	old := u.nodes[name]
+	u.nodes[name] = n
+	u.mu.Unlock()
+	if old != nil {
+		// the node reconnected before we noticed the old socket was gone
+		old.ws.Close()
+	}
+	log.Printf("uplink: node %s connected from %s", name, r.RemoteAddr)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		t := time.NewTicker(uplinkPing)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				if ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)) != nil {
+					ws.Close()
+					return
+				}
+			}
+		}
+	}()
+	ws.SetReadDeadline(time.Now().Add(3 * uplinkPing))
+	ws.SetPongHandler(func(string) error { return ws.SetReadDeadline(time.Now().Add(3 * uplinkPing)) })
+	for {
+		if _, _, err := ws.NextReader(); err != nil {
+			break
+		}
+	}
+	ws.Close()
+	u.mu.Lock()
+	if u.nodes[name] == n {
+		delete(u.nodes, name)
+	}
+	u.mu.Unlock()
+	log.Printf("uplink: node %s disconnected", name)
+}
+
+// handleData hands a tunnel the edge opened to the player waiting for it
+func (u *Uplinks) handleData(w http.ResponseWriter, r *http.Request) {
+	name, ok := u.authorized(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	u.mu.Lock()
+	open := u.pending[id]
+	if open != nil && open.node == name {
+		delete(u.pending, id)
+	} else {
+		open = nil
+	}
+	u.mu.Unlock()
+	if open == nil {
+		http.Error(w, "no such tunnel", http.StatusNotFound)
+		return
+	}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if open.gone {
+		ws.Close()
+		return
+	}
+	open.data <- ws
+}
+
+// tunnel asks node for a tunnel for a player at remote and waits for it
+func (u *Uplinks) tunnel(ctx context.Context, node, remote string) (net.Conn, error) {
+	u.mu.Lock()
+	n := u.nodes[node]
+	u.mu.Unlock()
+	if n == nil {
+		return nil, fmt.Errorf("node %s is not connected", node)
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	open := &uplinkOpen{node: node, data: make(chan *websocket.Conn, 1)}
+	u.mu.Lock()
+	u.pending[id] = open
+	u.mu.Unlock()
+	defer func() {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		delete(u.pending, id)
+		open.gone = true
+	}()
+	if err := n.send(uplinkMsg{Type: "open", ID: id, Remote: remote}); err != nil {
+		return nil, fmt.Errorf("node %s: %v", node, err)
+	}
+	timer := time.NewTimer(uplinkOpenTimeout)
+	defer timer.Stop()
+	select {
+	case ws := <-open.data:
+		atomic.AddInt64(&n.tunnels, 1)
+		return wsNetConn(ws, uplinkAddr(node)), nil
+	case <-timer.C:
+		return nil, fmt.Errorf("node %s did not open a tunnel", node)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type uplinkRemoteKey struct{}
+
+// handleEdge proxies /edge/{node}/... to the node, through a new tunnel
+// per connection
+func (u *Uplinks) handleEdge(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/edge/")
+	node, path := rest, "/"
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		node, path = rest[:i], rest[i:]
+	}
+	if _, ok := u.tokens[node]; !ok {
+		http.NotFound(w, r)
+		return
+	}
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = "http"
+			req.URL.Host = node
+			req.URL.Path = path
+			req.URL.RawPath = ""
+		},
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				remote, _ := ctx.Value(uplinkRemoteKey{}).(string)
+				return u.tunnel(ctx, node, remote)
+			},
+			DisableKeepAlives: true,
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("uplink: %v", err)
+			http.Error(w, "node unavailable", http.StatusBadGateway)
+		},
+	}
+	proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), uplinkRemoteKey{}, r.RemoteAddr)))
+}
+
+// RegisterAdmin mounts GET /api/admin/uplinks
+func (u *Uplinks) RegisterAdmin(a *AdminAPI) {
+	a.Handle("/api/admin/uplinks", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "use GET")
+			return
+		}
+		type node struct {
+			Node    string    `json:"node"`
+			Remote  string    `json:"remote"`
+			Since   time.Time `json:"since"`
+			Tunnels int64     `json:"tunnels"`
+		}
+		u.mu.Lock()
+		out := make([]node, 0, len(u.nodes))
+		for _, n := range u.nodes {
+			out = append(out, node{n.name, n.remote, n.since, atomic.LoadInt64(&n.tunnels)})
+		}
+		u.mu.Unlock()
+		sort.Slice(out, func(i, j int) bool { return out[i].Node < out[j].Node })
+		writeJSON(w, http.StatusOK, out)
+	})
+}
+
+// uplinkAddr is the address of a tunnel end
+type uplinkAddr string
+
+func (a uplinkAddr) Network() string { return "uplink" }
+func (a uplinkAddr) String() string  { return string(a) }
+
+// tunnelConn is one end of a tunnel; RemoteAddr is the player's address
+type tunnelConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c tunnelConn) LocalAddr() net.Addr  { return c.local }
+func (c tunnelConn) RemoteAddr() net.Addr { return c.remote }
+
+// wsNetConn turns a websocket into a byte stream. The stream goes through
+// a pipe rather than straight to ws, because net/http aborts reads with
+// past deadlines and a websocket doesn't survive a failed read.
+func wsNetConn(ws *websocket.Conn, remote net.Addr) net.Conn {
+	mine, theirs := net.Pipe()
+	go pipeWS(ws, theirs)
+	return tunnelConn{Conn: mine, local: ws.LocalAddr(), remote: remote}
+}
+
+// pipeWS copies between conn and binary messages of ws until either ends,
+// then closes both
+func pipeWS(ws *websocket.Conn, conn net.Conn) {
+	go func() {
+		defer conn.Close()
+		for {
+			_, r, err := ws.NextReader()
+			if err != nil {
+				return
+			}
+			if _, err := io.Copy(conn, r); err != nil {
+				return
+			}
+		}
+	}()
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 && ws.WriteMessage(websocket.BinaryMessage, buf[:n]) != nil {
+			break
+		}
+		if err != nil {
+			break
+		}
+	}
+	ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	ws.Close()
+	conn.Close()
+}
+
+// uplinkListener is the edge side: a net.Listener whose connections are
+// tunnels opened through the central server at base
+type uplinkListener struct {
+	base        *url.URL
+	node, token string
+
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func listenUplink(lc ListenerConfig) (net.Listener, error) {
+	base, err := url.Parse(strings.TrimRight(lc.Addr, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme != "ws" && base.Scheme != "wss" {
+		return nil, fmt.Errorf("uplink addr must be a ws:// or wss:// URL")
+	}
+	if lc.Node == "" || lc.Token == "" {
+		return nil, errors.New("uplink needs node and token")
+	}
+	l := &uplinkListener{base: base, node: lc.Node, token: lc.Token, conns: make(chan net.Conn), done: make(chan struct{})}
+	go l.run()
+	return l, nil
+}
+
+func (l *uplinkListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *uplinkListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *uplinkListener) Addr() net.Addr { return uplinkAddr(l.base.String() + "/edge/" + l.node) }
+
+// dial opens a websocket to path on the central server
+func (l *uplinkListener) dial(path string, q url.Values) (*websocket.Conn, error) {
+	q.Set("node", l.node)
+	u := *l.base
+	u.Path += path
+	u.RawQuery = q.Encode()
+	ws, resp, err := websocket.DefaultDialer.Dial(u.String(), http.Header{"Authorization": {"Bearer " + l.token}})
+	if err != nil && resp != nil {
+		err = fmt.Errorf("%v (%s)", err, resp.Status)
+	}
+	return ws, err
+}
+
+// run keeps the control socket open and opens the tunnels it asks for
+func (l *uplinkListener) run() {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := l.control()
+		select {
+		case <-l.done:
+			return
+		default:
+		}
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		log.Printf("uplink %s: %v; reconnecting in %s", l.node, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-l.done:
+			return
+		}
+		if backoff *= 2; backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+}
+
+// control serves one control socket until it fails
+func (l *uplinkListener) control() error {
+	ws, err := l.dial("/uplink/connect", url.Values{})
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+	go func() {
+		<-l.done
+		ws.Close()
+	}()
+	log.Printf("uplink %s: registered with %s", l.node, l.base)
+	ws.SetReadDeadline(time.Now().Add(3 * uplinkPing))
+	ws.SetPingHandler(func(data string) error {
+		ws.SetReadDeadline(time.Now().Add(3 * uplinkPing))
+		return ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(writeWait))
+	})
+	for {
+		var m uplinkMsg
+		if err := ws.ReadJSON(&m); err != nil {
+			return err
+		}
+		if m.Type == "open" {
+			go l.open(m.ID, m.Remote)
+		}
+	}
+}
+
+// open dials tunnel id and hands it to Accept
+func (l *uplinkListener) open(id, remote string) {
+	ws, err := l.dial("/uplink/data", url.Values{"id": {id}})
+	if err != nil {
+		log.Printf("uplink %s: tunnel: %v", l.node, err)
+		return
+	}
+	c := wsNetConn(ws, uplinkAddr(remote))
+	select {
+	case l.conns <- c:
+	case <-l.done:
+		c.Close()
+	}
+}
@@ -0,0 +1,116 @@
+// backend/users.go
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// User is a persisted account record, created on first OAuth login or
+// when a user first touches their friend list
+type User struct {
+	ID        string    `json:"id"`       // "<provider>:<subject>"
+	Provider  string    `json:"provider"` // e.g., "google", "github"
+	Subject   string    `json:"subject"`  // provider's stable user id
+	Name      string    `json:"name,omitempty"`
+	Email     string    `json:"email,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	LastLogin time.Time `json:"lastLogin"`
+
+	// social graph (friends.go); sorted user ids
+	Friends        []string `json:"friends,omitempty"`
+	FriendRequests []string `json:"friendRequests,omitempty"` // incoming, pending
+	SentRequests   []string `json:"sentRequests,omitempty"`
+	Blocked        []string `json:"blocked,omitempty"`
+}
+
+// UserStore persists user records
+type UserStore interface {
+	Get(id string) (*User, bool)
+	Put(u *User) error
+	// Delete removes a user and reports whether it existed
+	Delete(id string) (bool, error)
+}
+
+// blockLister is a UserStore that reads every block list at once, for the
+// index Friends keeps in memory
+type blockLister interface {
+	BlockLists() (map[string][]string, error) // user id -> Blocked
+}
+
+// FileUserStore keeps users in memory and rewrites a JSON file on every change.
+// Good enough for small deployments; swap for a database-backed store later.
+type FileUserStore struct {
+	path  string
+	mu    sync.Mutex
+	users map[string]*User
+}
+
+// NewFileUserStore loads users from path (a missing file is an empty store)
+func NewFileUserStore(path string) (*FileUserStore, error) {
+	s := &FileUserStore{path: path, users: make(map[string]*User)}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &s.users); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileUserStore) Get(id string) (*User, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[id]
+	if !ok {
+		return nil, false
+	}
+	cp := *u
+	return &cp, true
+}
+
+func (s *FileUserStore) Put(u *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cp := *u
+	s.users[u.ID] = &cp
+	return s.flush()
+}
+
+func (s *FileUserStore) Delete(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[id]; !ok {
+		return false, nil
+	}
+	delete(s.users, id)
+	return true, s.flush()
+}
+
+func (s *FileUserStore) BlockLists() (map[string][]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string][]string)
+	for id, u := range s.users {
+		if len(u.Blocked) > 0 {
+			out[id] = append([]string(nil), u.Blocked...)
+		}
+	}
+	return out, nil
+}
+
+// flush rewrites the file. Caller holds mu.
+func (s *FileUserStore) flush() error {
+	b, err := json.MarshalIndent(s.users, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, b)
+}
@@ -0,0 +1,250 @@
+// backend/usersessions.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Session listing for logged-in users, so they can spot a login they don't
+recognise and end it:
+
+	{"type":"sessions.list"}
+	{"type":"sessions","data":[{"id":"10.0.0.7:51234","session":"9c1f0e...","game":"/ws",
+	  "device":"Mozilla/5.0 ...","ip":"10.0.0.7","connectedAt":"...","current":true}, ...]}
+
+	{"type":"sessions.revoke","data":{"id":"<connection id or session>"}}
+	{"type":"sessions.revoke","data":{"all":true}}     every session but this one
+
+Revoking closes the connections (close code 4002) and voids the session
+token, so the device can't simply reconnect; "all" also voids tokens of
+devices that aren't connected right now. Operators get the same through
+
+	GET    /api/admin/sessions?user=<id>
+	DELETE /api/admin/sessions?user=<id>               every session
+	DELETE /api/admin/sessions/{id}?user=<id>          one connection or session
+*/
+
+// application close code sent to connections of a revoked session
+const closeSessionRevoked = 4002
+
+// SessionInfo is one live connection of a user
+type SessionInfo struct {
+	ID          string    `json:"id"`                // connection (client) id
+	Session     string    `json:"session,omitempty"` // token's session id; shared by tabs using the same login
+	Game        string    `json:"game"`
+	Device      string    `json:"device,omitempty"`
+	IP          string    `json:"ip,omitempty"`
+	Room        string    `json:"room,omitempty"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	Current     bool      `json:"current,omitempty"` // the connection that asked
+}
+
+// UserSessions lists and revokes users' sessions on every game
+type UserSessions struct {
+	sessions *SessionManager
+	audit    *AuditLog
+
+	mu   sync.Mutex
+	hubs []*Hub
+}
+
+func NewUserSessions(sessions *SessionManager, audit *AuditLog) *UserSessions {
+	return &UserSessions{sessions: sessions, audit: audit}
+}
+
+// AddHub makes the connections of hub's game visible
+func (u *UserSessions) AddHub(hub *Hub) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.hubs = append(u.hubs, hub)
+}
+
+// connections returns userID's clients on every game
+func (u *UserSessions) connections(userID string) []*Client {
+	u.mu.Lock()
+	hubs := u.hubs
+	u.mu.Unlock()
+	var out []*Client
+	for _, h := range hubs {
+		out = append(out, h.UserClients(userID)...)
+	}
+	return out
+}
+
+// List returns userID's live sessions, oldest first; current (may be
+// nil) is marked
+func (u *UserSessions) List(userID string, current *Client) []SessionInfo {
+	out := []SessionInfo{}
+	for _, c := range u.connections(userID) {
+		s := SessionInfo{ID: c.id, Game: c.hub.path, Device: c.device, IP: c.ip, Room: c.hub.RoomOf(c), ConnectedAt: c.connected, Current: c == current}
+		if c.claims != nil {
+			s.Session = c.claims.Jti
+		}
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ConnectedAt.Before(out[j].ConnectedAt) })
+	return out
+}
+
+// Revoke ends the session id of userID: a connection id or a session id.
+// It returns how many connections were closed; 0 means no such session.
+func (u *UserSessions) Revoke(userID, id string) (int, error) {
+	var doomed []*Client
+	var err error
+	revoked := map[string]bool{}
+	for _, c := range u.connections(userID) {
+		jti := ""
+		if c.claims != nil {
+			jti = c.claims.Jti
+		}
+		if c.id != id && (jti == "" || jti != id) {
+			continue
+		}
+		if jti != "" && !revoked[jti] {
+			revoked[jti] = true
+			if e := u.sessions.RevokeSession(jti, c.claims.Exp); e != nil {
+				err = e
+			}
+		}
+		doomed = append(doomed, c)
+	}
+	// other tabs of a revoked token go too
+	for _, c := range u.connections(userID) {
+		if c.claims != nil && revoked[c.claims.Jti] {
+			doomed = appendUnique(doomed, c)
+		}
+	}
+	for _, c := range doomed {
+		c.kick(closeSessionRevoked, "session revoked")
+	}
+	return len(doomed), err
+}
+
+// RevokeAll ends every session of userID except keep's (nil for none),
+// including tokens not connected right now
+func (u *UserSessions) RevokeAll(userID string, keep *Client) (int, error) {
+	keepJti := ""
+	if keep != nil && keep.claims != nil {
+		keepJti = keep.claims.Jti
+	}
+	err := u.sessions.RevokeUser(userID, keepJti)
+	n := 0
+	for _, c := range u.connections(userID) {
+		if c == keep || (keepJti != "" && c.claims != nil && c.claims.Jti == keepJti) {
+			continue
+		}
+		c.kick(closeSessionRevoked, "session revoked")
+		n++
+	}
+	return n, err
+}
+
+func appendUnique(cs []*Client, c *Client) []*Client {
+	for _, x := range cs {
+		if x == c {
+			return cs
+		}
+	}
+	return append(cs, c)
+}
+
+// UserSessionsMiddleware handles sessions.list and sessions.revoke
+func UserSessionsMiddleware(u *UserSessions) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(c *Client, m Message) {
+			if m.Type != "sessions.list" && m.Type != "sessions.revoke" {
+				next(c, m)
+				return
+			}
+			if c.userID == "" {
+				sendError(c, "sessions.login_required")
+				return
+			}
+			if m.Type == "sessions.list" {
+				data, _ := json.Marshal(u.List(c.userID, c))
+				b, _ := json.Marshal(Message{Type: "sessions", Sender: "server", Data: data})
+				c.Send(b)
+				return
+			}
+			var req struct {
+				ID  string `json:"id"`
+				All bool   `json:"all"`
+			}
+			if err := json.Unmarshal(m.Data, &req); err != nil {
+				sendError(c, "bad_data", m.Type, err.Error())
+				return
+			}
+			var n int
+			var err error
+			switch {
+			case req.All:
+				n, err = u.RevokeAll(c.userID, c)
+			case req.ID == "":
+				sendError(c, "bad_data", m.Type, "id or all required")
+				return
+			default:
+				if n, err = u.Revoke(c.userID, req.ID); n == 0 && err == nil {
+					sendError(c, "sessions.not_found", req.ID)
+					return
+				}
+			}
+			if err != nil {
+				log.Printf("sessions: revoke for %s: %v", c.userID, err)
+			}
+			u.audit.Record(c.userID, "session.revoke", c.userID, fmt.Sprintf("%d connection(s)", n))
+			if n > 0 && c.claims != nil && !req.All && (req.ID == c.id || req.ID == c.claims.Jti) {
+				return // revoked itself; the connection is gone
+			}
+			sendSystem(c, "sessions.revoked", n)
+		}
+	}
+}
+
+// RegisterAdmin mounts the session endpoints
+func (u *UserSessions) RegisterAdmin(a *AdminAPI) {
+	handle := func(w http.ResponseWriter, r *http.Request) {
+		user := r.URL.Query().Get("user")
+		if user == "" {
+			writeJSONError(w, http.StatusBadRequest, "user required")
+			return
+		}
+		id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/admin/sessions"), "/")
+		switch {
+		case r.Method == http.MethodGet && id == "":
+			writeJSON(w, http.StatusOK, u.List(user, nil))
+			return
+		case r.Method != http.MethodDelete:
+			writeJSONError(w, http.StatusMethodNotAllowed, "use GET or DELETE")
+			return
+		}
+		var n int
+		var err error
+		if id == "" {
+			n, err = u.RevokeAll(user, nil)
+		} else if n, err = u.Revoke(user, id); n == 0 && err == nil {
+			writeJSONError(w, http.StatusNotFound, "no such session")
+			return
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		target := user
+		if id != "" {
+			target += "/" + id
+		}
+		log.Printf("admin: revoke sessions %s (%d connections)", target, n)
+		u.audit.Record(adminActor(r), "session.revoke", target, fmt.Sprintf("%d connection(s)", n))
+		writeJSON(w, http.StatusOK, map[string]int{"closed": n})
+	}
+	a.Handle("/api/admin/sessions", handle)
+	a.Handle("/api/admin/sessions/", handle)
+}
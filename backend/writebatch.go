@@ -0,0 +1,112 @@
+// backend/writebatch.go
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+Write coalescing. With "writeBatch": {"maxMessages": 64, "flushInterval": "5ms"}
+in the config file, writePump drains up to maxMessages queued messages
+(waiting at most flushInterval for more to arrive) and writes them as one
+TextMessage, newline-delimited, instead of one frame and one syscall per
+message. Clients must then split frames on "\n"; every message is a single
+line of JSON. The default (maxMessages <= 1) keeps one message per frame.
+*/
+
+var errChaosSevered = errors.New("chaos: connection severed")
+
+// WriteBatchConfig is the "writeBatch" block of the config file
+type WriteBatchConfig struct {
+	MaxMessages   int      `json:"maxMessages,omitempty"`
+	FlushInterval Duration `json:"flushInterval,omitempty"` // 0 = only what is already queued
+}
+
+// collectBatch gathers more queued messages after first
+func (c *Client) collectBatch(first []byte) [][]byte {
+	cfg := c.hub.writeBatch
+	batch := [][]byte{first}
+	if cfg.MaxMessages <= 1 {
+		return batch
+	}
+	var timeout <-chan time.Time
+	if cfg.FlushInterval > 0 {
+		t := time.NewTimer(time.Duration(cfg.FlushInterval))
+		defer t.Stop()
+		timeout = t.C
+	}
+	for len(batch) < cfg.MaxMessages {
+		if timeout == nil {
+			select {
+			case m := <-c.send:
+				batch = append(batch, m)
+			default:
+				return batch
+			}
+			continue
+		}
+		select {
+		case m := <-c.send:
+			batch = append(batch, m)
+		case <-timeout:
+			return batch
+		case <-c.done:
+			return batch
+		}
+	}
+	return batch
+}
+
+// writeBatch writes msgs as one newline-delimited frame, or one frame each
+// when batching is off
+func (c *Client) writeBatch(msgs [][]byte) error {
+	if chaos := c.hub.chaos; chaos != nil {
+		kept := msgs[:0]
+		for _, m := range msgs {
+			switch chaos.outbound() {
+			case chaosDrop:
+				continue
+			case chaosSever:
+				log.Printf("chaos: severing %s", c.id)
+				return errChaosSevered
+			}
+			kept = append(kept, m)
+		}
+		msgs = kept
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	n := len(msgs) - 1 // separators
+	for _, m := range msgs {
+		n += len(m)
+	}
+	if !c.sent(n) {
+		return errBandwidthExceeded
+	}
+	c.hub.load.count(c, false, len(msgs), n)
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if c.hub.writeBatch.MaxMessages <= 1 {
+		for _, m := range msgs {
+			if err := c.conn.WriteMessage(websocket.TextMessage, m); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	w, err := c.conn.NextWriter(websocket.TextMessage)
+	if err != nil {
+		return err
+	}
+	for i, m := range msgs {
+		if i > 0 {
+			w.Write([]byte{'\n'})
+		}
+		w.Write(m)
+	}
+	return w.Close()
+}
@@ -14,6 +14,16 @@ export default function App() {
   const [logs, setLogs] = useState([]);
   const wsRef = useRef(null);
   const clientId = useRef("user-" + Math.floor(Math.random() * 10000));
+  const tokenRef = useRef(null);
+
+  // pick up the session token handed back by /auth/callback (#token=...)
+  useEffect(() => {
+    const m = window.location.hash.match(/token=([^&]+)/);
+    if (m) {
+      tokenRef.current = decodeURIComponent(m[1]);
+      window.history.replaceState(null, "", window.location.pathname);
+    }
+  }, []);
 
   // default server if none provided
   useEffect(() => {
@@ -30,18 +40,26 @@ export default function App() {
   function connect() {
     if (wsRef.current) return;
     try {
-      const ws = new WebSocket(serverAddr);
+      let url = serverAddr;
+      if (tokenRef.current) {
+        url += (url.includes("?") ? "&" : "?") + "token=" + encodeURIComponent(tokenRef.current);
+      }
+      const ws = new WebSocket(url);
       ws.onopen = () => {
         wsRef.current = ws;
         setConnected(true);
         addLog({ sender: "system", payload: "connected" });
       };
       ws.onmessage = (ev) => {
-        try {
-          const msg = JSON.parse(ev.data);
-          addLog({ sender: msg.sender || "server", payload: msg.payload, type: msg.type });
-        } catch (e) {
-          addLog({ sender: "server", payload: ev.data });
+        // the server may batch several messages into one frame, one JSON per line
+        for (const line of String(ev.data).split("\n")) {
+          if (!line) continue;
+          try {
+            const msg = JSON.parse(line);
+            addLog({ sender: msg.sender || "server", payload: msg.payload, type: msg.type });
+          } catch (e) {
+            addLog({ sender: "server", payload: line });
+          }
         }
       };
       ws.onclose = () => {